@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"expvar"
 	"fmt"
@@ -21,10 +22,32 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/signalfx/pops/collectdnet"
 	"github.com/signalfx/pops/debugserver"
+	"github.com/signalfx/pops/debugspans"
+	"github.com/signalfx/pops/decompress"
+	"github.com/signalfx/pops/egress"
+	"github.com/signalfx/pops/filter"
+	"github.com/signalfx/pops/graphite"
+	"github.com/signalfx/pops/limits"
+	"github.com/signalfx/pops/listener"
+	"github.com/signalfx/pops/metrictype"
+	"github.com/signalfx/pops/obfuscate"
+	"github.com/signalfx/pops/otlp"
+	"github.com/signalfx/pops/ratelimit"
+	"github.com/signalfx/pops/remotewrite"
+	"github.com/signalfx/pops/retry"
+	"github.com/signalfx/pops/rewrite"
+	"github.com/signalfx/pops/sapm"
+	"github.com/signalfx/pops/sinkerr"
+	"github.com/signalfx/pops/spantags"
+	"github.com/signalfx/pops/spillqueue"
+	"github.com/signalfx/pops/statsd"
+	"github.com/signalfx/pops/tlsconfig"
+	"github.com/signalfx/pops/tokenmap"
+	"github.com/signalfx/pops/tokenpolicy"
 
 	"github.com/gorilla/mux"
-	"github.com/signalfx/com_signalfx_metrics_protobuf"
 	"github.com/signalfx/golib/v3/clientcfg"
 	"github.com/signalfx/golib/v3/datapoint"
 	"github.com/signalfx/golib/v3/datapoint/dpsink"
@@ -34,11 +57,9 @@ import (
 	"github.com/signalfx/golib/v3/reportsha"
 	"github.com/signalfx/golib/v3/sfxclient"
 	"github.com/signalfx/golib/v3/timekeeper"
-	"github.com/signalfx/golib/v3/trace"
 	"github.com/signalfx/golib/v3/web"
 	"github.com/signalfx/ingest-protocols/protocol/collectd"
 	"github.com/signalfx/ingest-protocols/protocol/signalfx"
-	"github.com/signalfx/ingest-protocols/protocol/zipper"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -48,6 +69,7 @@ type stats struct {
 	BucketRequestCounter   web.BucketRequestCounter
 	NotFoundRequestCounter web.RequestCounter
 	TotalDecodeErrors      int64
+	TotalRefused           [sinkerr.NumKinds]int64
 	TotalHealthChecks      int64
 }
 
@@ -90,6 +112,7 @@ type dataSinkConfig struct {
 	EventEndpoint       *distconf.Str
 	TraceEndpoint       *distconf.Str
 	ShutdownTimeout     *distconf.Duration
+	RetryAfter          *distconf.Duration
 	NumDrainingThreads  *distconf.Int
 	NumChannels         *distconf.Int
 	BufferSize          *distconf.Int
@@ -105,6 +128,7 @@ func (c *dataSinkConfig) Load(conf *distconf.Distconf) {
 	c.EventEndpoint = conf.Str("DATA_SINK_EVENT_ENDPOINT", sfxclient.EventIngestEndpointV2)
 	c.TraceEndpoint = conf.Str("DATA_SINK_TRACE_ENDPOINT", sfxclient.TraceIngestEndpointV1)
 	c.ShutdownTimeout = conf.Duration("DATA_SINK_SHUTDOWN_TIMEOUT", 3*time.Second)
+	c.RetryAfter = conf.Duration("DATA_SINK_RETRY_AFTER", time.Second)
 	c.NumChannels = conf.Int("NUM_CHANNELS", 50)
 	c.NumDrainingThreads = conf.Int("NUM_DRAINING_THREADS", 2)
 	c.BufferSize = conf.Int("CHANNEL_SIZE", 1000000)
@@ -136,28 +160,57 @@ func (c *clientConfig) Load(conf *distconf.Distconf) {
 	c.clientConfig.OsHostname = os.Hostname
 }
 
+// okWriter is implemented by readers whose protocol defines its own success response
+type okWriter interface {
+	WriteOK(rw http.ResponseWriter, req *http.Request)
+}
+
 type decodeErrorTracker struct {
-	reader      signalfx.ErrorReader
-	TotalErrors *int64
+	reader   signalfx.ErrorReader
+	protocol *endpoint
 }
 
 func (e *decodeErrorTracker) ServeHTTPC(ctx context.Context, rw http.ResponseWriter, req *http.Request) {
-	if err := e.reader.Read(ctx, req); err != nil {
-		atomic.AddInt64(e.TotalErrors, 1)
-		rw.WriteHeader(http.StatusBadRequest)
-		_, _ = rw.Write([]byte(err.Error()))
+	ctx, state := withRequestState(ctx, req)
+	req.Body = e.protocol.limits.DecompressedBody(req.Body, state.reject)
+	err := e.reader.Read(limits.WithRequest(ctx), req)
+	// decoders that only log what the sink rejected still fail the request
+	if rejected := state.rejection(); err != nil || rejected != nil {
+		e.protocol.writeError(rw, err, rejected)
 		return
 	}
 
+	if w, ok := e.reader.(okWriter); ok {
+		w.WriteOK(rw, req)
+		return
+	}
 	rw.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	_, _ = rw.Write([]byte(`"OK"`))
 }
 
 type libraryConfigs struct {
-	clientConfig   clientConfig
-	debugConfig    debugserver.Config
-	mainConfig     popsConfig
-	dataSinkConfig dataSinkConfig
+	clientConfig      clientConfig
+	debugConfig       debugserver.Config
+	mainConfig        popsConfig
+	dataSinkConfig    dataSinkConfig
+	egressConfig      egress.Config
+	retryConfig       retry.Config
+	spillConfig       spillqueue.Config
+	rateLimitConfig   ratelimit.Config
+	limitsConfig      limits.Config
+	filterConfig      filter.Config
+	debugSpansConfig  debugspans.Config
+	spanTagsConfig    spantags.Config
+	obfuscateConfig   obfuscate.Config
+	rewriteConfig     rewrite.Config
+	tokenPolicyConfig tokenpolicy.Config
+	tokenMapConfig    tokenmap.Config
+	metricTypeConfig  metrictype.Config
+	tlsConfig         tlsconfig.Config
+	listenerConfig    listener.Config
+	statsdConfig      statsd.Config
+	graphiteConfig    graphite.Config
+	collectdNetConfig collectdnet.Config
 }
 
 type configLoader interface {
@@ -170,6 +223,24 @@ func (l *libraryConfigs) Load(conf *distconf.Distconf) {
 		&l.debugConfig,
 		&l.mainConfig,
 		&l.dataSinkConfig,
+		&l.egressConfig,
+		&l.retryConfig,
+		&l.spillConfig,
+		&l.rateLimitConfig,
+		&l.limitsConfig,
+		&l.filterConfig,
+		&l.debugSpansConfig,
+		&l.spanTagsConfig,
+		&l.obfuscateConfig,
+		&l.rewriteConfig,
+		&l.tokenPolicyConfig,
+		&l.tokenMapConfig,
+		&l.metricTypeConfig,
+		&l.tlsConfig,
+		&l.listenerConfig,
+		&l.statsdConfig,
+		&l.graphiteConfig,
+		&l.collectdNetConfig,
 	}
 	for _, l := range loaders {
 		l.Load(conf)
@@ -245,6 +316,7 @@ type Server struct {
 	standardHeaders    web.HeadersInRequest
 	debugServer        *debugserver.DebugServer
 	httpListener       net.Listener
+	extraListeners     []net.Listener
 	timeKeeper         timekeeper.TimeKeeper
 	sfxclient          *sfxclient.Scheduler
 	scheduler          *scheduledServices
@@ -254,6 +326,25 @@ type Server struct {
 	sfxClientLogger    log.Logger
 	configs            libraryConfigs
 	dataSink           *sfxclient.AsyncMultiTokenSink
+	sink               signalfx.Sink
+	unlimitedSink      signalfx.Sink
+	egress             *egress.Encoder
+	retryTransport     *retry.Transport
+	spillQueue         *spillqueue.Queue
+	rateLimiter        *ratelimit.Limiter
+	limiter            *limits.Limiter
+	filter             *filter.Filter
+	debugSpans         *debugspans.Processor
+	spanTagger         *spantags.Tagger
+	obfuscator         *obfuscate.Obfuscator
+	rewriter           *rewrite.Rewriter
+	tokenPolicy        *tokenpolicy.Policy
+	tokenMapper        *tokenmap.Mapper
+	typeGetter         *metrictype.Getter
+	tlsLoader          *tlsconfig.Loader
+	statsdListeners    []*statsd.Listener
+	graphiteListeners  []*graphite.Listener
+	collectdListeners  []*collectdnet.Listener
 	osStat             func(string) (os.FileInfo, error)
 	closeHeader        web.CloseHeader
 	SetupRetryAttempts int32
@@ -274,82 +365,112 @@ func (m *Server) defaultSchedulerErrorHandler(err error) {
 }
 
 func (m *Server) newIncomingCounter(sink signalfx.Sink, name string) signalfx.Sink {
+	endingSink, count := m.countIncoming(sink)
+	m.registerIncomingCounter(name, count)
+	return endingSink
+}
+
+// countIncoming returns a sink that counts what is sent through it to sink, and the counter to register
+func (m *Server) countIncoming(sink signalfx.Sink) (signalfx.Sink, sfxclient.Collector) {
 	count := dpsink.NewHistoCounter(&dpsink.Counter{
 		Logger: m.sfxClientLogger,
 	})
-	endingSink := signalfx.FromChain(sink, signalfx.NextWrap(signalfx.UnifyNextSinkWrap(count)))
+	return signalfx.FromChain(sink, signalfx.NextWrap(signalfx.UnifyNextSinkWrap(count))), count
+}
+
+// registerIncomingCounter reports count as the incoming counter of the protocol name
+func (m *Server) registerIncomingCounter(name string, count sfxclient.Collector) {
 	m.sfxclient.AddGroupedCallback(name, count)
 	dims := m.getDefaultDims(&m.configs.clientConfig.clientConfig)
 	dims["protocol"] = name
 	dims["reason"] = "incoming_counter"
 	m.sfxclient.GroupedDefaultDimensions(name, dims)
-	return endingSink
 }
 
-func (m *Server) setupJSONDatapointV2(r *mux.Router, sink dpsink.Sink) []sfxclient.Collector {
-	j2 := &signalfx.JSONDecoderV2{Sink: sink, Logger: m.sfxClientLogger}
-	zd := m.setupDatapointEndpoint(r, j2, signalfx.SetupJSONV2DatapointPaths)
-	return []sfxclient.Collector{j2, zd}
+func (m *Server) setupJSONDatapointV2(e *endpoint) sfxclient.Collector {
+	j2 := &signalfx.JSONDecoderV2{Sink: m.learnTypes(e.sink), Logger: m.sfxClientLogger}
+	zd := m.setupDatapointEndpoint(e, j2, signalfx.SetupJSONV2DatapointPaths)
+	// a MultiCollector isn't hashable, so it can't be a grouped callback on its own
+	return sfxclient.CollectorFunc(sfxclient.NewMultiCollector(j2, zd).Datapoints)
 }
 
-func (m *Server) setupJSONEventV2(r *mux.Router, sink dpsink.ESink) sfxclient.Collector {
-	j2e := &signalfx.JSONEventDecoderV2{Sink: sink, Logger: m.sfxClientLogger}
-	ze := m.setupDatapointEndpoint(r, j2e, signalfx.SetupJSONV2EventPaths)
+func (m *Server) setupJSONEventV2(e *endpoint) sfxclient.Collector {
+	j2e := &signalfx.JSONEventDecoderV2{Sink: e.sink, Logger: m.sfxClientLogger}
+	ze := m.setupDatapointEndpoint(e, j2e, signalfx.SetupJSONV2EventPaths)
 	return ze
 }
 
-func (m *Server) setupDatapointProtobufV2(r *mux.Router, sink dpsink.Sink) sfxclient.Collector {
-	return m.setupDatapointEndpoint(r, &signalfx.ProtobufDecoderV2{Sink: sink, Logger: m.sfxClientLogger}, signalfx.SetupProtobufV2DatapointPaths)
+func (m *Server) setupDatapointProtobufV2(e *endpoint) sfxclient.Collector {
+	return m.setupDatapointEndpoint(e, &signalfx.ProtobufDecoderV2{Sink: m.learnTypes(e.sink), Logger: m.sfxClientLogger}, signalfx.SetupProtobufV2DatapointPaths)
 }
 
-func (m *Server) setupEventProtobufV2(r *mux.Router, sink dpsink.ESink) sfxclient.Collector {
-	return m.setupDatapointEndpoint(r, &signalfx.ProtobufEventDecoderV2{Sink: sink, Logger: m.sfxClientLogger}, signalfx.SetupProtobufV2EventPaths)
+func (m *Server) setupEventProtobufV2(e *endpoint) sfxclient.Collector {
+	return m.setupDatapointEndpoint(e, &signalfx.ProtobufEventDecoderV2{Sink: e.sink, Logger: m.sfxClientLogger}, signalfx.SetupProtobufV2EventPaths)
 }
 
-func (m *Server) setupCollectd(r *mux.Router, sink dpsink.Sink) sfxclient.Collector {
-	return m.setupDatapointEndpoint(r, &collectd.JSONDecoder{SendTo: sink, Logger: m.sfxClientLogger}, func(r *mux.Router, handler http.Handler) {
+func (m *Server) setupCollectd(e *endpoint) sfxclient.Collector {
+	return m.setupDatapointEndpoint(e, &collectd.JSONDecoder{SendTo: e.sink, Logger: m.sfxClientLogger}, func(r *mux.Router, handler http.Handler) {
 		collectd.SetupCollectdPaths(r, handler, "/v1/collectd")
 	})
 }
 
-type constTypeGetter com_signalfx_metrics_protobuf.MetricType
-
-func (c constTypeGetter) GetMetricTypeFromMap(metricName string) com_signalfx_metrics_protobuf.MetricType {
-	return com_signalfx_metrics_protobuf.MetricType(c)
-}
-
-func (m *Server) setupDatapointJSONV1(r *mux.Router, sink dpsink.DSink) sfxclient.Collector {
-	return m.setupDatapointEndpoint(r, &signalfx.JSONDecoderV1{Sink: sink, TypeGetter: constTypeGetter(com_signalfx_metrics_protobuf.MetricType_GAUGE), Logger: m.sfxClientLogger}, signalfx.SetupJSONV1Paths)
+func (m *Server) setupDatapointJSONV1(e *endpoint) sfxclient.Collector {
+	return m.setupDatapointEndpoint(e, &signalfx.JSONDecoderV1{Sink: e.sink, TypeGetter: m.typeGetter, Logger: m.sfxClientLogger}, signalfx.SetupJSONV1Paths)
 }
 
-func (m *Server) setupDatapointProtobufV1(r *mux.Router, sink dpsink.DSink) sfxclient.Collector {
-	return m.setupDatapointEndpoint(r, &signalfx.ProtobufDecoderV1{Sink: sink, TypeGetter: constTypeGetter(com_signalfx_metrics_protobuf.MetricType_GAUGE), Logger: m.sfxClientLogger}, signalfx.SetupProtobufV1Paths)
+func (m *Server) setupDatapointProtobufV1(e *endpoint) sfxclient.Collector {
+	return m.setupDatapointEndpoint(e, &signalfx.ProtobufDecoderV1{Sink: e.sink, TypeGetter: m.typeGetter, Logger: m.sfxClientLogger}, signalfx.SetupProtobufV1Paths)
 }
 
 // setupSpanJSONV1 this is our v1, not zipkin's v1 format
-func (m *Server) setupSpanJSONV1(r *mux.Router, sink trace.Sink) sfxclient.Collector {
+func (m *Server) setupSpanJSONV1(e *endpoint) sfxclient.Collector {
 	handlerSetup := func(r *mux.Router, handler http.Handler) {
 		signalfx.SetupJSONByPaths(r, handler, signalfx.DefaultTracePathV1)
 	}
-	return m.setupDatapointEndpoint(r, &signalfx.JSONTraceDecoderV1{Sink: sink, Logger: m.sfxClientLogger}, handlerSetup)
+	return m.setupDatapointEndpoint(e, &signalfx.JSONTraceDecoderV1{Sink: e.sink, Logger: m.sfxClientLogger}, handlerSetup)
+}
+
+// setupZipkinJSON sets up a Zipkin json endpoint.  The span decoder works out whether each span is Zipkin v1 or v2 on
+// its own, so both versions share it.
+func (m *Server) setupZipkinJSON(e *endpoint, path string) sfxclient.Collector {
+	handlerSetup := func(r *mux.Router, handler http.Handler) {
+		signalfx.SetupJSONByPaths(r, handler, path)
+	}
+	return m.setupDatapointEndpoint(e, &signalfx.JSONTraceDecoderV1{Sink: e.sink, Logger: m.sfxClientLogger}, handlerSetup)
+}
+
+func (m *Server) setupRemoteWrite(e *endpoint) sfxclient.Collector {
+	return m.setupDatapointEndpoint(e, &remotewrite.Decoder{Sink: e.sink, Logger: m.sfxClientLogger}, remotewrite.SetupPaths)
+}
+
+func (m *Server) setupOTLPMetrics(e *endpoint) sfxclient.Collector {
+	return m.setupDatapointEndpoint(e, &otlp.MetricsDecoder{Sink: e.sink, Logger: m.sfxClientLogger}, otlp.SetupMetricsPaths)
+}
+
+func (m *Server) setupOTLPTraces(e *endpoint) sfxclient.Collector {
+	return m.setupDatapointEndpoint(e, &otlp.TracesDecoder{Sink: e.sink, Logger: m.sfxClientLogger}, otlp.SetupTracesPaths)
+}
+
+func (m *Server) setupSAPM(e *endpoint) sfxclient.Collector {
+	return m.setupDatapointEndpoint(e, &sapm.Decoder{Sink: e.sink, Logger: m.sfxClientLogger}, sapm.SetupPaths)
 }
 
 // setupSpanThriftV1 this is our v1, not zipkin's v1 format
-func (m *Server) setupSpanThriftV1(r *mux.Router, sink trace.Sink) sfxclient.Collector {
+func (m *Server) setupSpanThriftV1(e *endpoint) sfxclient.Collector {
 	handlerSetup := func(r *mux.Router, handler http.Handler) {
 		signalfx.SetupThriftByPaths(r, handler, signalfx.DefaultTracePathV1)
 	}
-	return m.setupDatapointEndpoint(r, signalfx.NewJaegerThriftTraceDecoderV1(m.sfxClientLogger, sink), handlerSetup)
+	return m.setupDatapointEndpoint(e, signalfx.NewJaegerThriftTraceDecoderV1(m.sfxClientLogger, e.sink), handlerSetup)
 }
 
-func (m *Server) setupDatapointEndpoint(r *mux.Router, reader signalfx.ErrorReader, handlerSetup func(r *mux.Router, handler http.Handler)) sfxclient.Collector {
-	zippers := zipper.NewZipper()
-	tracker := &decodeErrorTracker{
-		reader:      reader,
-		TotalErrors: &m.stats.TotalDecodeErrors,
-	}
+func (m *Server) setupDatapointEndpoint(e *endpoint, reader signalfx.ErrorReader, handlerSetup func(r *mux.Router, handler http.Handler)) sfxclient.Collector {
+	negotiator := decompress.New()
+	tracker := &decodeErrorTracker{reader: reader, protocol: e}
 	middleLayers := []web.Constructor{
+		web.NextConstructor(m.tokenMapper.MapTokens),
 		web.NextConstructor(m.PutTokenOnContext),
+		web.NextConstructor(m.tokenPolicy.RejectTokens),
+		web.NextConstructor(m.rateLimiter.LimitRequests),
 		&m.standardHeaders,
 		web.NextConstructor(m.closeHeader.OptionallyAddCloseHeader),
 		web.NextConstructor(web.AddRequestTime),
@@ -357,25 +478,21 @@ func (m *Server) setupDatapointEndpoint(r *mux.Router, reader signalfx.ErrorRead
 		web.NextHTTP(m.stats.BucketRequestCounter.ServeHTTP),
 	}
 	handler := web.NewHandler(m.ctx, tracker).Add(middleLayers...)
-	handlerSetup(r, zippers.GzipHandler(handler))
-	return zippers
+	handlerSetup(e.router, e.countRequests(negotiator.Handler(handler, e.limits.MaxDecompressedBodyBytes)))
+	return negotiator
 }
 
 // PutTokenOnContext extracts an access token from the request headers and assigns it to the context
 func (m *Server) PutTokenOnContext(ctx context.Context, rw http.ResponseWriter, r *http.Request, next web.ContextHandler) {
-	var token string
-	if token = r.Header.Get(sfxclient.TokenHeaderName); token != "" {
-		next.ServeHTTPC(context.WithValue(ctx, sfxclient.TokenCtxKey, token), rw, r)
-	} else if username, password, ok := r.BasicAuth(); ok && (username == "auth" || username == "") {
-		token = password
-		next.ServeHTTPC(context.WithValue(ctx, sfxclient.TokenCtxKey, token), rw, r)
-	} else {
+	token, ok := tokenmap.RequestToken(r)
+	if !ok {
 		// request basic authentication if no forms of auth found
 		rw.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=\"%s\"", m.configs.mainConfig.basicAuthRealm.Get()))
 		rw.WriteHeader(http.StatusUnauthorized)
 		_, _ = rw.Write([]byte("Unauthorized"))
 		return
 	}
+	next.ServeHTTPC(context.WithValue(ctx, sfxclient.TokenCtxKey, token), rw, r)
 }
 
 func (m *Server) getECSMetadata() *ecsMetadata {
@@ -449,11 +566,15 @@ func (m *Server) setupHealthCheck(r *mux.Router) {
 	r.Path("/healthz").Handler(handler)
 }
 
-func (m *Server) makeHTTPClientFunc() func() *http.Client {
+func (m *Server) makeTransport() *http.Transport {
 	// Create a new transport with the defaults and update idle connection settings
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.MaxIdleConns = int(m.configs.dataSinkConfig.MaxIdleConns.Get())
 	transport.MaxIdleConnsPerHost = int(m.configs.dataSinkConfig.MaxIdleConnsPerHost.Get())
+	return transport
+}
+
+func (m *Server) makeHTTPClientFunc(transport http.RoundTripper) func() *http.Client {
 	return func() *http.Client {
 		return &http.Client{
 			Timeout:   sfxclient.DefaultTimeout,
@@ -462,6 +583,29 @@ func (m *Server) makeHTTPClientFunc() func() *http.Client {
 	}
 }
 
+// setupTokenPolicy sets up the allow and deny lists and the cache of tokens upstream has rejected
+func (m *Server) setupTokenPolicy() (err error) {
+	m.tokenPolicy, err = tokenpolicy.New(&m.configs.tokenPolicyConfig, m.timeKeeper, m.logger)
+	return err
+}
+
+// setupTokenMapper sets up the rules that map incoming requests to the tokens they are sent upstream with
+func (m *Server) setupTokenMapper() (err error) {
+	m.tokenMapper, err = tokenmap.New(&m.configs.tokenMapConfig, m.timeKeeper, m.logger)
+	return err
+}
+
+// setupTypeGetter sets up the rules, and what is learned from v2 traffic, that give v1 datapoints their types
+func (m *Server) setupTypeGetter() (err error) {
+	m.typeGetter, err = metrictype.New(&m.configs.metricTypeConfig, m.timeKeeper, m.logger)
+	return err
+}
+
+// learnTypes passes datapoints sent to sink through the type getter so it can learn their types
+func (m *Server) learnTypes(sink signalfx.Sink) signalfx.Sink {
+	return signalfx.FromChain(sink, signalfx.NextWrap(m.typeGetter))
+}
+
 // setupDataSink sets up the sink for Pops with a DatapointEndpoint and EventEndpoint
 func (m *Server) setupDataSink() (err error) {
 	numChannels := m.configs.dataSinkConfig.NumChannels.Get()
@@ -480,6 +624,23 @@ func (m *Server) setupDataSink() (err error) {
 	m.logger.Log(fmt.Sprintf("dataSink trace endpoint configured with: %s", traceEndpoint))
 	maxRetry := int(m.configs.dataSinkConfig.MaxRetry.Get())
 	m.logger.Log(fmt.Sprintf("datasink max retry configured with: %d", maxRetry))
+	// everything sent upstream, including retries and replays, is re-encoded as it goes out
+	if m.egress, err = egress.New(&m.configs.egressConfig, datapointEndpoint, eventEndpoint, traceEndpoint, m.makeTransport(), m.timeKeeper, m.logger); err != nil {
+		return err
+	}
+	// the token policy learns which tokens upstream rejects from every response, including retries and replays
+	base := m.tokenPolicy.Observe(m.egress)
+	m.retryTransport = retry.New(&m.configs.retryConfig, base, m.timeKeeper, m.logger)
+	var transport http.RoundTripper = m.retryTransport
+	if m.configs.spillConfig.Enabled() {
+		m.logger.Log(fmt.Sprintf("dataSink spilling to: %s", m.configs.spillConfig.Directory.Get()))
+		// the spill queue does its own replaying, so it bypasses the retry transport
+		if m.spillQueue, err = spillqueue.New(&m.configs.spillConfig, transport, base, m.timeKeeper, m.logger); err != nil {
+			return err
+		}
+		m.retryTransport.GiveUp = m.spillQueue.Append
+		transport = m.spillQueue
+	}
 	// Setup the sink
 	m.dataSink = sfxclient.NewAsyncMultiTokenSink(
 		numChannels,
@@ -490,15 +651,178 @@ func (m *Server) setupDataSink() (err error) {
 		eventEndpoint,
 		traceEndpoint,
 		"",
-		m.makeHTTPClientFunc(),
+		m.makeHTTPClientFunc(transport),
 		m.defaultDataSinkErrorHandler,
 		maxRetry,
 	)
 	m.dataSink.ShutdownTimeout = m.configs.dataSinkConfig.ShutdownTimeout.Get()
+	m.sink = m.dataSink
+	if m.spillQueue != nil {
+		// anything the sink has no room for goes straight to disk
+		m.sink = signalfx.FromChain(m.dataSink, signalfx.NextWrap(spillqueue.NewOverflow(m.spillQueue, datapointEndpoint, eventEndpoint, traceEndpoint)))
+	}
+	// what couldn't be spilled is refused with an error saying whether to retry it
+	m.sink = signalfx.FromChain(m.sink, signalfx.NextWrap(sinkerr.Classifier{}))
 	m.sfxclient.AddCallback(m.dataSink)
 	return err
 }
 
+// setupRateLimiter puts the per token and global rate limits in front of the sink
+func (m *Server) setupRateLimiter() (err error) {
+	if m.rateLimiter, err = ratelimit.New(&m.configs.rateLimitConfig, m.timeKeeper, m.logger); err != nil {
+		return err
+	}
+	// debug spans skip the rate limits, and the filter, by going straight to the sink they are in front of.  The bytes
+	// per second limit still applies to them since it is checked before the request's spans are decoded.
+	m.unlimitedSink = m.sink
+	m.sink = signalfx.FromChain(m.sink, signalfx.NextWrap(m.rateLimiter))
+	return nil
+}
+
+// setupFilter drops the datapoints the filter rules exclude before they count against the rate limits
+func (m *Server) setupFilter() (err error) {
+	if m.filter, err = filter.New(&m.configs.filterConfig, m.timeKeeper, m.logger); err != nil {
+		return err
+	}
+	m.sink = signalfx.FromChain(m.sink, signalfx.NextWrap(m.filter))
+	return nil
+}
+
+// setupDebugSpans sends the spans of debug traces around the filter and rate limits, once they have been rewritten,
+// obfuscated and tagged, and mirrors them for troubleshooting.  Each protocol's limits on a request's size and how many
+// spans it has are checked before the spans get here, so still apply.
+func (m *Server) setupDebugSpans() error {
+	m.debugSpans = debugspans.New(&m.configs.debugSpansConfig, m.unlimitedSink, m.logger)
+	m.sink = signalfx.FromChain(m.sink, signalfx.NextWrap(m.debugSpans))
+	return nil
+}
+
+// setupSpanTagger adds the configured tags to spans once they have been rewritten and obfuscated, so the tags go
+// upstream as configured.  The ECS metadata is there for it to add too.
+func (m *Server) setupSpanTagger() (err error) {
+	deployment := make(map[string]string)
+	m.addECSDims(m.getECSMetadata(), deployment)
+	if m.spanTagger, err = spantags.New(&m.configs.spanTagsConfig, deployment, m.timeKeeper, m.logger); err != nil {
+		return err
+	}
+	m.sink = signalfx.FromChain(m.sink, signalfx.NextWrap(m.spanTagger))
+	return nil
+}
+
+// setupObfuscator obfuscates, removes and redacts span tags once the rewriter has made them, whichever endpoint the
+// spans came in on
+func (m *Server) setupObfuscator() (err error) {
+	if m.obfuscator, err = obfuscate.New(&m.configs.obfuscateConfig, m.timeKeeper, m.logger); err != nil {
+		return err
+	}
+	m.sink = signalfx.FromChain(m.sink, signalfx.NextWrap(m.obfuscator))
+	return nil
+}
+
+// setupRewriter rewrites dimensions and span tags before the filter sees them, so its rules match what is sent upstream
+func (m *Server) setupRewriter() (err error) {
+	if m.rewriter, err = rewrite.New(&m.configs.rewriteConfig, m.timeKeeper, m.logger); err != nil {
+		return err
+	}
+	m.sink = signalfx.FromChain(m.sink, signalfx.NextWrap(m.rewriter))
+	return nil
+}
+
+// setupLimits sets up the request size limits each protocol's endpoint enforces
+func (m *Server) setupLimits() (err error) {
+	m.limiter, err = limits.New(&m.configs.limitsConfig, m.logger)
+	return err
+}
+
+// openProtocolListeners opens n listeners for the protocol name with open, which is given the sink to send to.  If one
+// of them fails the ones already open are closed.  The protocol's incoming counter is only registered once they are all
+// open, so a setup that is retried doesn't register it again.
+func (m *Server) openProtocolListeners(name string, n int, open func(i int, sink signalfx.Sink) (io.Closer, error)) error {
+	sink, count := m.countIncoming(m.sink)
+	opened := make([]io.Closer, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := open(i, sink)
+		if err != nil {
+			for _, l := range opened {
+				_ = l.Close()
+			}
+			return err
+		}
+		opened = append(opened, l)
+	}
+	m.registerIncomingCounter(name, count)
+	return nil
+}
+
+// setupStatsD opens the statsd listeners, which aggregate into the sink with their own tokens
+func (m *Server) setupStatsD() error {
+	specs, err := m.configs.statsdConfig.Specs()
+	if err != nil || len(specs) == 0 {
+		return err
+	}
+	listeners := make([]*statsd.Listener, len(specs))
+	err = m.openProtocolListeners("statsd", len(specs), func(i int, sink signalfx.Sink) (l io.Closer, err error) {
+		m.logger.Log(logkey.PublishAddr, specs[i].Address, logkey.Name, specs[i].Name, "Setting up statsd listener")
+		listeners[i], err = statsd.New(specs[i], sink, m.timeKeeper, m.sfxClientLogger)
+		return listeners[i], err
+	})
+	if err == nil {
+		m.statsdListeners = listeners
+	}
+	return err
+}
+
+// setupGraphite opens the carbon compatible listeners, which send to the sink with their own tokens
+func (m *Server) setupGraphite() error {
+	specs, err := m.configs.graphiteConfig.Specs()
+	if err != nil || len(specs) == 0 {
+		return err
+	}
+	listeners := make([]*graphite.Listener, len(specs))
+	err = m.openProtocolListeners("graphite", len(specs), func(i int, sink signalfx.Sink) (l io.Closer, err error) {
+		m.logger.Log(logkey.PublishAddr, specs[i].Address, logkey.Name, specs[i].Name, "Setting up graphite listener")
+		listeners[i], err = graphite.New(specs[i], sink, m.timeKeeper, m.sfxClientLogger)
+		return listeners[i], err
+	})
+	if err == nil {
+		m.graphiteListeners = listeners
+	}
+	return err
+}
+
+// setupCollectdNetwork opens the listeners for collectd's network plugin, which send to the sink with their own tokens
+func (m *Server) setupCollectdNetwork() error {
+	specs, err := m.configs.collectdNetConfig.Specs()
+	if err != nil || len(specs) == 0 {
+		return err
+	}
+	listeners := make([]*collectdnet.Listener, len(specs))
+	err = m.openProtocolListeners("collectd_network", len(specs), func(i int, sink signalfx.Sink) (l io.Closer, err error) {
+		m.logger.Log(logkey.PublishAddr, specs[i].Address, logkey.Name, specs[i].Name, "Setting up collectd network listener")
+		listeners[i], err = collectdnet.New(specs[i], &m.configs.collectdNetConfig, sink, m.timeKeeper, m.sfxClientLogger)
+		return listeners[i], err
+	})
+	if err == nil {
+		m.collectdListeners = listeners
+	}
+	return err
+}
+
+// setupTLS loads the certificate for the ingest listener if one is configured
+func (m *Server) setupTLS() (err error) {
+	if !m.configs.tlsConfig.Enabled() {
+		return nil
+	}
+	m.logger.Log(fmt.Sprintf("serving TLS with certificate: %s", m.configs.tlsConfig.CertFile.Get()))
+	m.tlsLoader, err = tlsconfig.New(&m.configs.tlsConfig, m.timeKeeper, m.logger)
+	return err
+}
+
+const (
+	zipkinJSONV1 = signalfx.ZipkinV1
+	zipkinJSONV2 = "zipkin_json_v2"
+)
+
 // TODO refactor this with sbingest's setupHTTPServer maybe?
 func (m *Server) setupHTTPServer() error {
 	m.logger.Log("Setting up http server")
@@ -511,6 +835,17 @@ func (m *Server) setupHTTPServer() error {
 
 	handler.NotFoundHandler = web.NewHandler(m.ctx, web.FromHTTP(http.NotFoundHandler())).Add(web.NextHTTP(m.stats.NotFoundRequestCounter.ServeHTTP))
 
+	// every listener shares the one router, with each endpoint only matching requests from listeners that serve it
+	specs, err := m.configs.listenerConfig.Specs()
+	if err != nil {
+		return err
+	}
+	endpoints := listener.NewEndpoints(handler)
+	endpoints.Serve(listener.Main, m.configs.listenerConfig.Main())
+	for _, spec := range specs {
+		endpoints.Serve(spec.Name, spec.Endpoints)
+	}
+
 	dims := m.getDefaultDims(&m.configs.clientConfig.clientConfig)
 
 	cf := func(g string, cs ...sfxclient.Collector) {
@@ -521,16 +856,16 @@ func (m *Server) setupHTTPServer() error {
 	}
 
 	// setup the endpoints for differetnt data types
-	cf("sfx_protobuf_v2", m.setupDatapointProtobufV2(handler, m.newIncomingCounter(m.dataSink, "sfx_protobuf_v2")))
-	cf("event_protobuf_v2", m.setupEventProtobufV2(handler, m.newIncomingCounter(m.dataSink, "event_protobuf_v2")))
-	cf("sfx_json_v2", m.setupJSONDatapointV2(handler, m.newIncomingCounter(m.dataSink, "sfx_json_v2"))...)
-	cf("event_json_v2", m.setupJSONEventV2(handler, m.newIncomingCounter(m.dataSink, "event_json_v2")))
-	cf("sfx_collectd_v1", m.setupCollectd(handler, m.newIncomingCounter(m.dataSink, "sfx_collectd_v1")))
-	cf("sfx_protobuf_v1", m.setupDatapointProtobufV1(handler, m.dataSink))
-	cf("sfx_json_v1", m.setupDatapointJSONV1(handler, m.dataSink))
-	cf("span_thrift_v1", m.setupSpanThriftV1(handler, m.newIncomingCounter(m.dataSink, "span_thrift_v1")))
-	cf("span_json_v1", m.setupSpanJSONV1(handler, m.newIncomingCounter(m.dataSink, "span_json_v1")))
+	for _, p := range m.protocols() {
+		e := m.newEndpoint(p.name, endpoints.Route(p.name))
+		cf(p.name, p.setup(e), e)
+	}
 
+	if err = endpoints.Validate(); err != nil {
+		return err
+	}
+
+	// the health check is served on every listener
 	m.setupHealthCheck(handler)
 	m.server = &http.Server{
 		Handler:      handler,
@@ -538,22 +873,69 @@ func (m *Server) setupHTTPServer() error {
 		WriteTimeout: clientTimeout,
 	}
 
-	setupListener := func(addr string, storeInto *net.Listener) error {
-		m.logger.Log(logkey.PublishAddr, addr, "Setting up listener")
-		listener, err := net.Listen("tcp", addr)
-		if err != nil {
-			return err
+	listeners, err := m.openListeners(listenAddr, specs)
+	if err != nil {
+		return err
+	}
+	m.serveListeners(handler, clientTimeout, listeners, specs)
+	return nil
+}
+
+// openListeners opens the main listener and then every additional one, before serving on any so a failure doesn't
+// leave some of them open
+func (m *Server) openListeners(listenAddr string, specs []*listener.Spec) ([]net.Listener, error) {
+	m.logger.Log(logkey.PublishAddr, listenAddr, "Setting up listener")
+	listeners := make([]net.Listener, 0, len(specs)+1)
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	listeners = append(listeners, l)
+	for _, spec := range specs {
+		m.logger.Log(logkey.PublishAddr, spec.Address, logkey.Name, spec.Name, "Setting up listener")
+		if l, err = spec.Listen(); err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, err
 		}
-		*storeInto = listener
+		listeners = append(listeners, l)
+	}
+	if m.tlsLoader != nil {
+		for i, l := range listeners {
+			// unix sockets are local so they are never TLS
+			if i == 0 || specs[i-1].Network == "tcp" {
+				listeners[i] = tls.NewListener(l, m.tlsLoader.Config())
+			}
+		}
+	}
+	return listeners, nil
+}
+
+// serveListeners serves handler on the main listener and then on each additional listener with its own timeouts
+func (m *Server) serveListeners(handler http.Handler, clientTimeout time.Duration, listeners []net.Listener, specs []*listener.Spec) {
+	serve := func(server *http.Server, l net.Listener) {
 		go func() {
-			if err := m.server.Serve(listener); err != nil {
+			if err := server.Serve(l); err != nil {
 				m.logger.Log(err)
 			}
 		}()
-		return nil
 	}
-
-	return setupListener(listenAddr, &m.httpListener)
+	m.httpListener = listeners[0]
+	serve(m.server, m.httpListener)
+	for i, spec := range specs {
+		name := spec.Name
+		readTimeout, writeTimeout := spec.Timeouts(clientTimeout)
+		m.extraListeners = append(m.extraListeners, listeners[i+1])
+		serve(&http.Server{
+			Handler:      handler,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			BaseContext: func(net.Listener) context.Context {
+				return listener.WithName(context.Background(), name)
+			},
+		}, listeners[i+1])
+	}
 }
 
 type setupFunction func() error
@@ -576,6 +958,54 @@ outerLoop:
 	return nil
 }
 
+// protocolListenerDatapoints returns the stats of the listeners for the non HTTP protocols
+func (m *Server) protocolListenerDatapoints() []*datapoint.Datapoint {
+	var dps []*datapoint.Datapoint
+	for _, l := range m.statsdListeners {
+		dps = append(dps, l.Datapoints()...)
+	}
+	for _, l := range m.graphiteListeners {
+		dps = append(dps, l.Datapoints()...)
+	}
+	for _, l := range m.collectdListeners {
+		dps = append(dps, l.Datapoints()...)
+	}
+	return dps
+}
+
+// sinkDatapoints are the datapoints of what sits between the listeners and upstream
+func (m *Server) sinkDatapoints() []*datapoint.Datapoint {
+	var dps []*datapoint.Datapoint
+	if m.egress != nil {
+		dps = append(dps, m.egress.Datapoints()...)
+	}
+	if m.retryTransport != nil {
+		dps = append(dps, m.retryTransport.Datapoints()...)
+	}
+	if m.spillQueue != nil {
+		dps = append(dps, m.spillQueue.Datapoints()...)
+	}
+	if m.rateLimiter != nil {
+		dps = append(dps, m.rateLimiter.Datapoints()...)
+	}
+	if m.filter != nil {
+		dps = append(dps, m.filter.Datapoints()...)
+	}
+	if m.debugSpans != nil {
+		dps = append(dps, m.debugSpans.Datapoints()...)
+	}
+	if m.spanTagger != nil {
+		dps = append(dps, m.spanTagger.Datapoints()...)
+	}
+	if m.obfuscator != nil {
+		dps = append(dps, m.obfuscator.Datapoints()...)
+	}
+	if m.rewriter != nil {
+		dps = append(dps, m.rewriter.Datapoints()...)
+	}
+	return dps
+}
+
 // Datapoints about basic server stats.  Note many of the datapoints are registered when they are created.
 func (m *Server) Datapoints() []*datapoint.Datapoint {
 	dps := m.stats.BucketRequestCounter.Datapoints()
@@ -583,6 +1013,22 @@ func (m *Server) Datapoints() []*datapoint.Datapoint {
 		"instance": "pops",
 	}
 
+	dps = append(dps, m.sinkDatapoints()...)
+	if m.tokenPolicy != nil {
+		dps = append(dps, m.tokenPolicy.Datapoints()...)
+	}
+	if m.tokenMapper != nil {
+		dps = append(dps, m.tokenMapper.Datapoints()...)
+	}
+	if m.typeGetter != nil {
+		dps = append(dps, m.typeGetter.Datapoints()...)
+	}
+	if m.tlsLoader != nil {
+		dps = append(dps, m.tlsLoader.Datapoints()...)
+	}
+	dps = append(dps, m.protocolListenerDatapoints()...)
+	dps = append(dps, refusedDatapoints(dims, &m.stats.TotalRefused)...)
+
 	return append(dps,
 		sfxclient.CumulativeP("pointforwarder.addDataPoints.count", dims, &m.stats.RequestCounter.TotalConnections),
 		sfxclient.CumulativeP("TotalProcessingTimeNs", dims, &m.stats.RequestCounter.TotalProcessingTimeNs),
@@ -645,6 +1091,11 @@ func (m *Server) setupSfxClient() error {
 	m.configs.clientConfig.clientConfig.ReportingInterval.Watch(f)
 	m.sfxclient.Timer = m.timeKeeper
 	m.sfxclient.Sink = clientcfg.WatchSinkChanges(m.sfxclient.Sink, &m.configs.clientConfig.clientConfig, m.logger)
+	// some decoders log what they couldn't send rather than returning it, and can't do that without a logger.  main
+	// sets a rate limited one, which is kept.
+	if m.sfxClientLogger == nil {
+		m.sfxClientLogger = m.logger
+	}
 	m.sfxclient.DefaultDimensions(m.getDefaultDims(&m.configs.clientConfig.clientConfig))
 	m.versionMetric.RepoURL = "https://github.com/signalfx/pops"
 	m.versionMetric.FileName = "/buildInfo.json"
@@ -672,8 +1123,22 @@ func (m *Server) setupServer() error {
 		m.setupConfig,
 		//Note: The above two need to always be first, in that order
 		m.setupSfxClient,
-		m.setupDataSink, // Note: must come before setupHTTPServer
+		m.setupTokenPolicy, // Note: must come before setupDataSink
+		m.setupTokenMapper,
+		m.setupTypeGetter, // Note: must come before setupHTTPServer
+		m.setupDataSink,   // Note: must come before setupHTTPServer
+		m.setupRateLimiter,
+		m.setupFilter,     // Note: must come before setupHTTPServer
+		m.setupDebugSpans, // Note: must come after setupFilter and before setupHTTPServer
+		m.setupSpanTagger, // Note: must come after setupDebugSpans and before setupHTTPServer
+		m.setupObfuscator, // Note: must come after setupSpanTagger and before setupHTTPServer
+		m.setupRewriter,   // Note: must come after setupObfuscator and before setupHTTPServer
+		m.setupLimits,     // Note: must come before setupHTTPServer
+		m.setupTLS,        // Note: must come before setupHTTPServer
 		m.setupHTTPServer,
+		m.setupStatsD,
+		m.setupGraphite,
+		m.setupCollectdNetwork,
 		m.setupDebugServer,
 		m.setupSelfReportingStats,
 	}
@@ -718,6 +1183,21 @@ func (m *Server) gracefulShutdown() {
 	}
 }
 
+// protocolListeners returns the listeners for the non HTTP protocols
+func (m *Server) protocolListeners() []io.Closer {
+	listeners := make([]io.Closer, 0, len(m.statsdListeners)+len(m.graphiteListeners)+len(m.collectdListeners))
+	for _, l := range m.statsdListeners {
+		listeners = append(listeners, l)
+	}
+	for _, l := range m.graphiteListeners {
+		listeners = append(listeners, l)
+	}
+	for _, l := range m.collectdListeners {
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
 // Close close this server, closing any non nil injected parameters
 func (m *Server) Close() error {
 	m.logger.Log("Close called")
@@ -746,10 +1226,31 @@ func (m *Server) Close() error {
 	close(m.closeChan)
 	checkedCloseErr(m.debugServer)
 	checkedCloseErr(m.httpListener)
+	for _, l := range m.extraListeners {
+		checkedCloseErr(l)
+	}
+	// statsd listeners send what they have left on close, so the protocol listeners go before the data sink
+	for _, l := range m.protocolListeners() {
+		checkedCloseErr(l)
+	}
 	checkedClose(m.conf)
 	// must unregister the data sink as a datapoint collector from sfxclient
 	m.sfxclient.RemoveCallback(m.dataSink)
 	checkedCloseErr(m.dataSink)
+	// close the retries and spill queue after the data sink so anything it fails to send on the way out is kept
+	checkedCloseErr(m.retryTransport)
+	checkedCloseErr(m.spillQueue)
+	checkedCloseErr(m.egress)
+	checkedCloseErr(m.rateLimiter)
+	checkedCloseErr(m.filter)
+	checkedCloseErr(m.debugSpans)
+	checkedCloseErr(m.spanTagger)
+	checkedCloseErr(m.obfuscator)
+	checkedCloseErr(m.rewriter)
+	checkedCloseErr(m.tokenPolicy)
+	checkedCloseErr(m.tokenMapper)
+	checkedCloseErr(m.typeGetter)
+	checkedCloseErr(m.tlsLoader)
 	checkedCloseErr(m.scheduler)
 
 	return err
@@ -2,25 +2,48 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/signalfx/com_signalfx_metrics_protobuf"
 	"github.com/signalfx/golib/v3/clientcfg"
+	"github.com/signalfx/golib/v3/datapoint"
 	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
 	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
 	"github.com/signalfx/golib/v3/sfxclient"
 	"github.com/signalfx/golib/v3/timekeeper/timekeepertest"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/golib/v3/trace/translator"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/pops/internal/tokenhash"
+	"github.com/signalfx/pops/limits"
+	"github.com/signalfx/pops/ratelimit"
+	"github.com/signalfx/pops/remotewrite"
+	"github.com/signalfx/pops/sinkerr"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -387,6 +410,22 @@ func TestSetupHttpServerFailure(t *testing.T) {
 	assert.Error(t, m.setupHTTPServer())
 }
 
+func TestSetupTLS(t *testing.T) {
+	m := NewServer()
+	defer m.Close()
+	_ = setupServer(m, map[string]string{})
+	assert.NoError(t, m.setupConfig())
+	assert.NoError(t, m.setupTLS())
+	assert.Nil(t, m.tlsLoader)
+
+	_ = setupServer(m, map[string]string{
+		"TLS_CERT_FILE": "/does/not/exist.pem",
+		"TLS_KEY_FILE":  "/does/not/exist.key",
+	})
+	assert.NoError(t, m.setupConfig())
+	assert.Error(t, m.setupTLS())
+}
+
 func TestHealthCheck(t *testing.T) {
 	m := NewServer()
 	_ = setupServer(m, map[string]string{
@@ -589,6 +628,320 @@ func TestSendSpanV1(t *testing.T) {
 	assert.Equal(t, `"OK"`, rw.Body.String())
 }
 
+func TestSendZipkin(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	for _, tc := range []struct {
+		path string
+		body string
+		code int
+	}{
+		{"/api/v1/spans", `[{"traceId":"05d68b91f746bc97","id":"05d68b91f746bc97","name":"get","timestamp":1530215261156007,"duration":19242,"annotations":[{"timestamp":1530215261156007,"value":"sr","endpoint":{"serviceName":"signalboost","ipv4":"10.2.6.231"}}],"binaryAnnotations":[{"key":"component","value":"jetty","endpoint":{"serviceName":"signalboost","ipv4":"10.2.6.231"}}]}]`, http.StatusOK},
+		{"/api/v2/spans", `[{"traceId":"05d68b91f746bc97","id":"05d68b91f746bc97","name":"get","kind":"SERVER","timestamp":1530215261156007,"duration":19242,"localEndpoint":{"serviceName":"signalboost","ipv4":"10.2.6.231"},"tags":{"component":"jetty"}}]`, http.StatusOK},
+		{"/api/v2/spans", `not json`, http.StatusBadRequest},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8080"+tc.path, bytes.NewBufferString(tc.body))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, tc.code, rw.Code, tc.path)
+	}
+
+	incoming := map[string]bool{}
+	for _, dp := range m.sfxclient.CollectDatapoints() {
+		if protocol, ok := dp.Dimensions["protocol"]; ok {
+			incoming[protocol] = true
+		}
+	}
+	assert.True(t, incoming[zipkinJSONV1])
+	assert.True(t, incoming[zipkinJSONV2])
+}
+
+func TestSendSAPM(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	batch, err := translator.SFXToSAPMPostRequest([]*trace.Span{{
+		TraceID: "05d68b91f746bc97",
+		ID:      "05d68b91f746bc97",
+		Name:    pointer.String("get"),
+	}}).Marshal()
+	require.NoError(t, err)
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write(batch)
+	require.NoError(t, gw.Close())
+	zw, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		body     []byte
+		encoding string
+		code     int
+	}{
+		{batch, "", http.StatusOK},
+		{gzipped.Bytes(), "gzip", http.StatusOK},
+		{zw.EncodeAll(batch, nil), "zstd", http.StatusOK},
+		{[]byte("not zstd"), "zstd", http.StatusBadRequest},
+		{batch, "br", http.StatusUnsupportedMediaType},
+		{[]byte("not protobuf"), "", http.StatusBadRequest},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8080/v2/trace", bytes.NewReader(tc.body))
+		req.Header.Add("Content-Type", "application/x-protobuf")
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		if tc.encoding != "" {
+			req.Header.Add("Content-Encoding", tc.encoding)
+		}
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, tc.code, rw.Code, tc.encoding)
+	}
+}
+
+func TestSendRemoteWrite(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	b, err := proto.Marshal(&remotewrite.WriteRequest{Timeseries: []*remotewrite.TimeSeries{{
+		Labels:  []*remotewrite.Label{{Name: "__name__", Value: "up"}},
+		Samples: []*remotewrite.Sample{{Value: 1, Timestamp: 1500000000000}},
+	}}})
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		auth string
+		code int
+	}{
+		{"Bearer ABCD", http.StatusOK},
+		{"", http.StatusUnauthorized},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8080/api/v1/write", bytes.NewReader(snappy.Encode(nil, b)))
+		req.Header.Add("Content-Type", "application/x-protobuf")
+		req.Header.Add("Content-Encoding", "snappy")
+		if tc.auth != "" {
+			req.Header.Add("Authorization", tc.auth)
+		}
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, tc.code, rw.Code, tc.auth)
+	}
+}
+
+func TestSendOTLP(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	for path, body := range map[string]string{
+		"/v1/metrics": `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"up","gauge":{"dataPoints":[{"asInt":"1"}]}}]}]}]}`,
+		"/v1/traces":  `{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"0102030405060708090a0b0c0d0e0f10","spanId":"00000000000000aa","name":"op"}]}]}]}`,
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8080"+path, bytes.NewBufferString(body))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code, path)
+		assert.Equal(t, "{}", rw.Body.String(), path)
+
+		rw = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "http://localhost:8080"+path, bytes.NewBufferString("{"))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusBadRequest, rw.Code, path)
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+		"STATSD_LISTENERS":     `[{"name":"apps","address":"127.0.0.1:0","token":"ABCD","flush_interval":"10ms"}]`,
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	require.Len(t, m.statsdListeners, 1)
+	conn, err := net.Dial("udp", m.statsdListeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hits:1|c|#env:prod"))
+	require.NoError(t, err)
+
+	sent := func() bool {
+		for _, dp := range m.Datapoints() {
+			if dp.Metric == "statsd.datapoints" && dp.Value.String() != "0" {
+				return true
+			}
+		}
+		return false
+	}
+	for start := time.Now(); !sent(); time.Sleep(time.Millisecond) {
+		require.True(t, time.Since(start) < 5*time.Second, "statsd never flushed")
+	}
+}
+
+func TestStatsDBadConfig(t *testing.T) {
+	m := NewServer()
+	defer m.Close()
+	m.SetupRetryAttempts = 0
+	m.SetupRetryDelay = 0
+	_ = setupServer(m, map[string]string{
+		"STATSD_LISTENERS": `[{"name":"apps","address":"127.0.0.1:0"}]`,
+	})
+	assert.EqualError(t, m.setupServer(), "statsd listeners need a name, an address and a token")
+}
+
+func TestProtocolListenerSetupRetry(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	m := NewServer()
+	defer m.Close()
+	m.SetupRetryAttempts = 2
+	m.SetupRetryDelay = 0
+	_ = setupServer(m, map[string]string{
+		"GRAPHITE_LISTENERS": fmt.Sprintf(`[{"name":"a","address":"127.0.0.1:0","token":"ABCD"},{"name":"b","address":"%s","token":"ABCD"}]`, busy.Addr()),
+	})
+	incoming := func() int {
+		n := 0
+		for _, dp := range m.sfxclient.CollectDatapoints() {
+			if dp.Dimensions["protocol"] == "graphite" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// every attempt fails on the second listener, closes the first and registers nothing
+	assert.Error(t, m.setupServer())
+	assert.Empty(t, m.graphiteListeners)
+	assert.Equal(t, 0, incoming())
+
+	require.NoError(t, busy.Close())
+	require.NoError(t, m.setupGraphite())
+	require.Len(t, m.graphiteListeners, 2)
+	assert.True(t, incoming() > 0)
+}
+
+func TestGraphite(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+		"GRAPHITE_LISTENERS":   `[{"name":"carbon","address":"127.0.0.1:0","token":"ABCD","templates":["host.metric*"]}]`,
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	require.Len(t, m.graphiteListeners, 1)
+	conn, err := net.Dial("tcp", m.graphiteListeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("web01.cpu.user 1.5 1500000000\n"))
+	require.NoError(t, err)
+
+	sent := func() bool {
+		for _, dp := range m.Datapoints() {
+			if dp.Metric == "graphite.datapoints" && dp.Value.String() != "0" {
+				return true
+			}
+		}
+		return false
+	}
+	for start := time.Now(); !sent(); time.Sleep(time.Millisecond) {
+		require.True(t, time.Since(start) < 5*time.Second, "graphite never sent")
+	}
+}
+
+func TestGraphiteBadConfig(t *testing.T) {
+	m := NewServer()
+	defer m.Close()
+	m.SetupRetryAttempts = 0
+	m.SetupRetryDelay = 0
+	_ = setupServer(m, map[string]string{
+		"GRAPHITE_LISTENERS": `[{"name":"carbon","address":"127.0.0.1:0","token":"ABCD","protocol":"udp"}]`,
+	})
+	assert.EqualError(t, m.setupServer(), "graphite listener carbon has unknown protocol udp")
+}
+
+func TestCollectdNetwork(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS":       "2",
+		"CHANNEL_SIZE":               "10",
+		"MAX_DRAIN_SIZE":             "50",
+		"COLLECTD_NETWORK_LISTENERS": `[{"name":"collectd","address":"127.0.0.1:0","token":"ABCD"}]`,
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	require.Len(t, m.collectdListeners, 1)
+	conn, err := net.Dial("udp", m.collectdListeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	// a type part of "cpu" and a values part with the gauge 1.0
+	_, err = conn.Write([]byte{0, 4, 0, 8, 'c', 'p', 'u', 0, 0, 6, 0, 15, 0, 1, 1, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f})
+	require.NoError(t, err)
+
+	sent := func() bool {
+		for _, dp := range m.Datapoints() {
+			if dp.Metric == "collectd_network.datapoints" && dp.Value.String() != "0" {
+				return true
+			}
+		}
+		return false
+	}
+	for start := time.Now(); !sent(); time.Sleep(time.Millisecond) {
+		require.True(t, time.Since(start) < 5*time.Second, "collectd packet never sent")
+	}
+}
+
+func TestCollectdNetworkBadConfig(t *testing.T) {
+	m := NewServer()
+	defer m.Close()
+	m.SetupRetryAttempts = 0
+	m.SetupRetryDelay = 0
+	_ = setupServer(m, map[string]string{
+		"COLLECTD_NETWORK_LISTENERS": `[{"name":"collectd","address":"127.0.0.1:0","token":"ABCD","security_level":"sign"}]`,
+	})
+	assert.EqualError(t, m.setupServer(), "collectd network listener collectd needs an auth file for security level sign")
+}
+
 func TestSendDatapointV1(t *testing.T) {
 	m := NewServer()
 	_ = setupServer(m, map[string]string{
@@ -611,6 +964,332 @@ func TestSendDatapointV1(t *testing.T) {
 	assert.Equal(t, `"OK"`, rw.Body.String())
 }
 
+func TestProtocolInstrumentation(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	jsonBytes := 0
+	for _, tc := range []struct {
+		path        string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"/v1/datapoint", "application/json", `{"metric":"m1", "source":"hi2", "value":1}{"metric":"m2", "source":"hi2", "value":2}`, http.StatusOK},
+		{"/v1/datapoint", "application/json", `{"metric":`, http.StatusBadRequest},
+		{"/v1/datapoint", "application/x-protobuf", "\xff\xff\xff\xff", http.StatusBadRequest},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8080"+tc.path, bytes.NewBufferString(tc.body))
+		req.Header.Add("Content-Type", tc.contentType)
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, tc.code, rw.Code, tc.body)
+		if tc.contentType == "application/json" {
+			jsonBytes += len(tc.body)
+		}
+	}
+
+	values := map[string]map[string]string{}
+	for _, dp := range m.sfxclient.CollectDatapoints() {
+		protocol := dp.Dimensions["protocol"]
+		if values[protocol] == nil {
+			values[protocol] = map[string]string{}
+		}
+		values[protocol][dp.Metric] = dp.Value.String()
+	}
+	for _, p := range m.protocols() {
+		assert.Contains(t, values[p.name], "total_requests", p.name)
+		assert.Contains(t, values[p.name], "total_datapoints", p.name)
+	}
+	assert.Equal(t, "2", values["sfx_json_v1"]["total_requests"])
+	assert.Equal(t, "2", values["sfx_json_v1"]["total_datapoints"])
+	assert.Equal(t, "1", values["sfx_json_v1"]["total_decode_errors"])
+	assert.Equal(t, fmt.Sprint(jsonBytes), values["sfx_json_v1"]["total_bytes"])
+	assert.Equal(t, "1", values["sfx_protobuf_v1"]["total_requests"])
+	assert.Equal(t, "1", values["sfx_protobuf_v1"]["total_decode_errors"])
+	assert.Equal(t, "0", values["sfx_protobuf_v1"]["total_sink_rejections"])
+}
+
+type rejectingSink struct{}
+
+func (rejectingSink) AddDatapoints(context.Context, []*datapoint.Datapoint) error {
+	return errors.New("rejected")
+}
+func (rejectingSink) AddEvents(context.Context, []*event.Event) error { return errors.New("rejected") }
+func (rejectingSink) AddSpans(context.Context, []*trace.Span) error   { return errors.New("rejected") }
+
+func TestEndpointSinkRejections(t *testing.T) {
+	e := &endpoint{name: "test"}
+	sink := signalfx.FromChain(rejectingSink{}, signalfx.NextWrap(e))
+	req, _ := http.NewRequest("POST", "http://localhost:8080/v2/datapoint", nil)
+	ctx, state := withRequestState(context.Background(), req)
+	assert.NoError(t, state.rejection())
+	assert.Error(t, sink.AddDatapoints(ctx, nil))
+	assert.EqualError(t, state.rejection(), "rejected")
+	assert.Error(t, sink.AddEvents(context.Background(), nil))
+	assert.Error(t, sink.AddSpans(context.Background(), nil))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&e.stats.TotalSinkRejections))
+}
+
+type errSink struct {
+	err error
+}
+
+func (s errSink) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return s.err }
+func (s errSink) AddEvents(context.Context, []*event.Event) error             { return s.err }
+func (s errSink) AddSpans(context.Context, []*trace.Span) error               { return s.err }
+
+// sendingReader sends to its sink and then fails the way a decoder that hides the sink's error would
+type sendingReader struct {
+	sink signalfx.Sink
+}
+
+func (r sendingReader) Read(ctx context.Context, _ *http.Request) error {
+	if err := r.sink.AddDatapoints(ctx, nil); err != nil {
+		return fmt.Errorf("unable to send: %s", err)
+	}
+	return errors.New("invalid body")
+}
+
+// testEndpoint returns an endpoint with the limits in conf that sends to sink through the sinkerr.Classifier
+func testEndpoint(t *testing.T, sink signalfx.Sink, conf map[string]string) *endpoint {
+	mem := distconf.Mem()
+	for k, v := range conf {
+		mem.Write(k, []byte(v))
+	}
+	d := distconf.New([]distconf.Reader{mem})
+	limitsConfig := &limits.Config{}
+	limitsConfig.Load(d)
+	limiter, err := limits.New(limitsConfig, log.Discard)
+	require.NoError(t, err)
+	e := &endpoint{
+		name:       "test",
+		limits:     limiter.Protocol("test"),
+		server:     &stats{},
+		retryAfter: d.Duration("DATA_SINK_RETRY_AFTER", 1500*time.Millisecond),
+	}
+	e.sink = signalfx.FromChain(sink, signalfx.NextWrap(e), signalfx.NextWrap(e.limits), signalfx.NextWrap(sinkerr.Classifier{}))
+	return e
+}
+
+func TestDecodeErrorTrackerStatus(t *testing.T) {
+	for _, tc := range []struct {
+		sinkErr    error
+		code       int
+		retryAfter string
+	}{
+		{nil, http.StatusBadRequest, ""},
+		{errors.New("unable to add datapoints: the input buffer is full"), http.StatusServiceUnavailable, "2"},
+		{errors.New("unable to add datapoints: the worker has been stopped"), http.StatusServiceUnavailable, "2"},
+		{&sinkerr.Error{Kind: sinkerr.TooLarge, Err: errors.New("too many datapoints")}, http.StatusRequestEntityTooLarge, ""},
+		{errors.New("upstream said no"), http.StatusBadRequest, ""},
+	} {
+		e := testEndpoint(t, errSink{tc.sinkErr}, nil)
+		s := e.server
+		tracker := &decodeErrorTracker{reader: sendingReader{e.sink}, protocol: e}
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8080/v2/datapoint", nil)
+		tracker.ServeHTTPC(context.Background(), rw, req)
+		assert.Equal(t, tc.code, rw.Code, "%v", tc.sinkErr)
+		assert.Equal(t, tc.retryAfter, rw.Header().Get("Retry-After"), "%v", tc.sinkErr)
+
+		refused, ok := sinkerr.As(sinkerr.Classify(tc.sinkErr))
+		for k := range s.TotalRefused {
+			want := int64(0)
+			if ok && refused.Kind == sinkerr.Kind(k) {
+				want = 1
+			}
+			assert.Equal(t, want, s.TotalRefused[k], "%v %s", tc.sinkErr, sinkerr.Kind(k))
+			assert.Equal(t, want, e.stats.TotalRefused[k], "%v %s", tc.sinkErr, sinkerr.Kind(k))
+		}
+		decodeErrors := int64(0)
+		if tc.sinkErr == nil {
+			decodeErrors = 1
+		}
+		assert.Equal(t, decodeErrors, s.TotalDecodeErrors, "%v", tc.sinkErr)
+		assert.Equal(t, decodeErrors, e.stats.TotalDecodeErrors, "%v", tc.sinkErr)
+	}
+}
+
+func TestWrappedRateLimitError(t *testing.T) {
+	limited := fmt.Errorf("unable to add datapoints: %w", &ratelimit.ErrLimited{Kind: "datapoints", RetryAfter: 1500 * time.Millisecond})
+	e := testEndpoint(t, errSink{limited}, nil)
+	tracker := &decodeErrorTracker{reader: sendingReader{e.sink}, protocol: e}
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://localhost:8080/v2/datapoint", nil)
+	tracker.ServeHTTPC(context.Background(), rw, req)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("Retry-After"))
+	assert.Equal(t, int64(0), e.stats.TotalDecodeErrors)
+
+	// a decoder that wraps the limit error itself is answered the same way
+	rw = httptest.NewRecorder()
+	e.writeError(rw, limited, nil)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, int64(0), e.stats.TotalDecodeErrors)
+}
+
+func TestRequestLimits(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS":        "2",
+		"CHANNEL_SIZE":                "10",
+		"MAX_DRAIN_SIZE":              "50",
+		"MAX_BODY_BYTES":              "200",
+		"MAX_DECOMPRESSED_BODY_BYTES": "1000",
+		"MAX_DATAPOINTS_PER_REQUEST":  "2",
+		"MAX_DIMENSIONS":              "1",
+		"LIMITS_OVERRIDES":            `{"sfx_json_v1": {"max_datapoints_per_request": 1}}`,
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	var bomb bytes.Buffer
+	gw := gzip.NewWriter(&bomb)
+	_, _ = gw.Write([]byte(`{"gauge":[` + strings.Repeat(" ", 2000) + `]}`))
+	require.NoError(t, gw.Close())
+
+	for _, tc := range []struct {
+		path     string
+		body     string
+		encoding string
+		code     int
+	}{
+		{"/v2/datapoint", `{"gauge":[{"metric":"a","value":1},{"metric":"b","value":1,"dimensions":{"host":"a"}}]}`, "", http.StatusOK},
+		{"/v2/datapoint", `{"gauge":[` + strings.Repeat(" ", 200) + `]}`, "", http.StatusRequestEntityTooLarge},
+		{"/v2/datapoint", bomb.String(), "gzip", http.StatusRequestEntityTooLarge},
+		{"/v2/datapoint", `{"gauge":[{"metric":"a","value":1},{"metric":"b","value":1},{"metric":"c","value":1}]}`, "", http.StatusRequestEntityTooLarge},
+		{"/v2/datapoint", `{"gauge":[{"metric":"a","value":1,"dimensions":{"host":"a","az":"b"}}]}`, "", http.StatusBadRequest},
+		{"/v1/datapoint", `{"metric":"m1", "source":"a", "value":1}{"metric":"m2", "source":"a", "value":2}`, "", http.StatusRequestEntityTooLarge},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8080"+tc.path, bytes.NewBufferString(tc.body))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		if tc.encoding != "" {
+			req.Header.Add("Content-Encoding", tc.encoding)
+		}
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, tc.code, rw.Code, tc.body)
+	}
+
+	rejected := map[string]string{}
+	refused := map[string]string{}
+	for _, dp := range m.sfxclient.CollectDatapoints() {
+		switch {
+		case dp.Metric == "limits.rejected" && dp.Dimensions["protocol"] == "sfx_json_v2":
+			rejected[dp.Dimensions["reason"]] = dp.Value.String()
+		case dp.Metric == "total_refused_requests" && dp.Dimensions["protocol"] == "sfx_json_v2":
+			refused[dp.Dimensions["reason"]] = dp.Value.String()
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"body_bytes":              "1",
+		"decompressed_body_bytes": "1",
+		"datapoints":              "1",
+		"spans":                   "0",
+		"dimensions":              "1",
+		"dimension_key_length":    "0",
+		"dimension_value_length":  "0",
+	}, rejected)
+	assert.Equal(t, map[string]string{"full": "0", "stopped": "0", "too_large": "3", "invalid": "1"}, refused)
+}
+
+func TestCompressedRequests(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	body := []byte(`{"gauge":[{"metric":"a","value":1}]}`)
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	_, _ = zw.Write(body)
+	require.NoError(t, zw.Close())
+	zstdEncoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	for encoding, compressed := range map[string][]byte{
+		"deflate": deflated.Bytes(),
+		"zstd":    zstdEncoder.EncodeAll(body, nil),
+		"snappy":  snappy.Encode(nil, body),
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8080/v2/datapoint", bytes.NewReader(compressed))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Content-Encoding", encoding)
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code, encoding)
+	}
+
+	decompressed := map[string]string{}
+	for _, dp := range m.sfxclient.CollectDatapoints() {
+		if dp.Metric == "decompress.decompressed_bytes" && dp.Dimensions["protocol"] == "sfx_json_v2" {
+			decompressed[dp.Dimensions["encoding"]] = dp.Value.String()
+		}
+	}
+	size := fmt.Sprint(len(body))
+	assert.Equal(t, map[string]string{"gzip": "0", "deflate": size, "zstd": size, "snappy": size}, decompressed)
+}
+
+func TestSendDatapointV1LearnedType(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+		"METRIC_TYPE_LEARN":    "true",
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	send := func(url string, body string) {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code)
+	}
+	send("http://localhost:8080/v2/datapoint", `{"cumulative_counter":[{"metric":"requests", "value":1}]}`)
+	send("http://localhost:8080/v1/datapoint", `{"metric":"requests", "source":"hi2", "value":2}`)
+	assert.Equal(t, com_signalfx_metrics_protobuf.MetricType_CUMULATIVE_COUNTER, m.typeGetter.GetMetricTypeFromMap("requests"))
+	learned := ""
+	for _, dp := range m.Datapoints() {
+		if dp.Metric == "metrictype.resolved" && dp.Dimensions["source"] == "learned" {
+			learned = dp.Value.String()
+		}
+	}
+	assert.Equal(t, "2", learned)
+}
+
+func TestMetricTypeBadConfig(t *testing.T) {
+	m := NewServer()
+	defer m.Close()
+	m.SetupRetryAttempts = 0
+	m.SetupRetryDelay = 0
+	_ = setupServer(m, map[string]string{
+		"METRIC_TYPE_RULES_FILE": "/does/not/exist",
+	})
+	assert.EqualError(t, m.setupServer(), "stat /does/not/exist: no such file or directory")
+}
+
 func TestDecodeDatapointsBadDecoder(t *testing.T) {
 	m := NewServer()
 	_ = setupServer(m, map[string]string{
@@ -652,6 +1331,629 @@ func TestSendCollectdDatapoint(t *testing.T) {
 	assert.Equal(t, `"OK"`, rw.Body.String())
 }
 
+func TestSpillQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pops-spill")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+		"SPILL_DIR":            dir,
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+	require.NotNil(t, m.spillQueue)
+
+	found := false
+	for _, dp := range m.Datapoints() {
+		if dp.Metric == "spill_queue.spilled" {
+			found = true
+		}
+	}
+	assert.True(t, found, "spill queue stats should be reported by the server")
+}
+
+func TestSfxClientLoggerKept(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+	})
+	limited := log.NewOnePerSecond(m.logger)
+	m.sfxClientLogger = limited
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+	assert.Equal(t, limited, m.sfxClientLogger, "the logger main sets isn't replaced")
+}
+
+func TestRateLimit(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS":             "2",
+		"CHANNEL_SIZE":                     "10",
+		"MAX_DRAIN_SIZE":                   "50",
+		"RATE_LIMIT_DATAPOINTS_PER_SECOND": "3",
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	send := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		body := bytes.NewBufferString(`{"gauge":[{"metric":"a", "value":1}, {"metric":"b", "value":2}]}`)
+		req, _ := http.NewRequest("POST", "http://localhost:8080/v2/datapoint", body)
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		m.server.Handler.ServeHTTP(rw, req)
+		return rw
+	}
+	assert.Equal(t, http.StatusOK, send().Code)
+	rw := send()
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+
+	found := false
+	for _, dp := range m.Datapoints() {
+		if dp.Metric == "ratelimit.throttled" && dp.Dimensions["token_hash"] == tokenhash.Dimension("ABCD") {
+			found = true
+		}
+	}
+	assert.True(t, found, "throttled tokens should be reported by the server")
+}
+
+// upstream records the datapoints and spans the data sink sends it as json, and how each path's bodies were compressed.
+// It signals changed after every request.
+type upstream struct {
+	mu         sync.Mutex
+	datapoints map[string]map[string]string
+	spans      map[string]*trace.Span
+	encodings  map[string]string
+	changed    chan struct{}
+}
+
+func newUpstream() *upstream {
+	return &upstream{
+		datapoints: make(map[string]map[string]string),
+		spans:      make(map[string]*trace.Span),
+		encodings:  make(map[string]string),
+		changed:    make(chan struct{}, 1),
+	}
+}
+
+func (u *upstream) body(req *http.Request) (io.Reader, error) {
+	switch req.Header.Get("Content-Encoding") {
+	case "gzip":
+		return gzip.NewReader(req.Body)
+	case "zstd":
+		d, err := zstd.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(d)
+		d.Close()
+		return bytes.NewReader(b), err
+	}
+	return req.Body, nil
+}
+
+func (u *upstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer func() {
+		select {
+		case u.changed <- struct{}{}:
+		default:
+		}
+	}()
+	u.encodings[req.URL.Path] = req.Header.Get("Content-Encoding")
+	body, err := u.body(req)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.URL.Path == "/v1/trace" {
+		var spans []*trace.Span
+		if err := json.NewDecoder(body).Decode(&spans); err == nil {
+			for _, s := range spans {
+				u.spans[s.ID] = s
+			}
+		}
+	} else {
+		var points map[string][]struct {
+			Metric     string            `json:"metric"`
+			Dimensions map[string]string `json:"dimensions"`
+		}
+		if err := json.NewDecoder(body).Decode(&points); err == nil {
+			for _, dps := range points {
+				for _, dp := range dps {
+					u.datapoints[dp.Metric] = dp.Dimensions
+				}
+			}
+		}
+	}
+	_, _ = rw.Write([]byte(`"OK"`))
+}
+
+// wait fails the test unless up is sent exactly the given number of datapoints and spans within a few seconds
+func (u *upstream) wait(t *testing.T, datapoints int, spans int) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		u.mu.Lock()
+		gotDatapoints, gotSpans := len(u.datapoints), len(u.spans)
+		u.mu.Unlock()
+		if gotDatapoints == datapoints && gotSpans == spans {
+			return
+		}
+		select {
+		case <-u.changed:
+		case <-timeout:
+			t.Fatalf("upstream got %d datapoints and %d spans, expected %d and %d", gotDatapoints, gotSpans, datapoints, spans)
+		}
+	}
+}
+
+// upstreamServer starts a server that sends upstream to up as json, uncompressed unless conf says otherwise
+func upstreamServer(up *upstream, conf map[string]string) (*Server, func()) {
+	server := httptest.NewServer(up)
+	overrides := map[string]string{
+		"NUM_DRAINING_THREADS":        "2",
+		"CHANNEL_SIZE":                "10",
+		"MAX_DRAIN_SIZE":              "50",
+		"DATA_SINK_DP_ENDPOINT":       server.URL + "/v2/datapoint",
+		"DATA_SINK_TRACE_ENDPOINT":    server.URL + "/v1/trace",
+		"DATA_SINK_DP_FORMAT":         "json",
+		"DATA_SINK_DP_COMPRESSION":    "none",
+		"DATA_SINK_TRACE_COMPRESSION": "none",
+	}
+	for k, v := range conf {
+		overrides[k] = v
+	}
+	m := NewServer()
+	_ = setupServer(m, overrides)
+	go m.main()
+	<-m.setupDone
+	return m, func() {
+		_ = m.Close()
+		server.Close()
+	}
+}
+
+// sendJSON posts body to the server's path with token, returning the status code
+func sendJSON(m *Server, token string, path string, body string) int {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "http://localhost:8080"+path, bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add(sfxclient.TokenHeaderName, token)
+	m.server.Handler.ServeHTTP(rw, req)
+	return rw.Code
+}
+
+// reported returns the value of the server's cumulative counter called metric with dims, or -1 if it doesn't report one
+func reported(m *Server, metric string, dims map[string]string) int64 {
+	for _, dp := range m.Datapoints() {
+		if dp.Metric != metric {
+			continue
+		}
+		matches := true
+		for k, v := range dims {
+			matches = matches && dp.Dimensions[k] == v
+		}
+		if matches {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return -1
+}
+
+// writeFiles writes each of files to a temporary directory, returning the directory and a func to remove it
+func writeFiles(t *testing.T, files map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "pops")
+	require.NoError(t, err)
+	for name, contents := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600))
+	}
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+// stageSend is a request a stageTest sends
+type stageSend struct {
+	token string
+	path  string
+	body  string
+}
+
+// stageTest sends data through a server with one of its sink stages configured and checks what reaches upstream.  The
+// files are written to a temporary directory whose path replaces {dir} in conf.
+type stageTest struct {
+	name       string
+	files      map[string]string
+	conf       map[string]string
+	sends      []stageSend
+	datapoints int
+	spans      int
+	// check is called, with up locked, once up has been sent the datapoints and spans
+	check func(t *testing.T, m *Server, up *upstream)
+}
+
+var stageTests = []stageTest{
+	{
+		name: "egress",
+		conf: map[string]string{
+			"DATA_SINK_DP_COMPRESSION":    "zstd",
+			"DATA_SINK_TRACE_COMPRESSION": "gzip",
+		},
+		sends: []stageSend{
+			{"ABCD", "/v2/datapoint", `{"gauge":[{"metric":"a", "dimensions":{"env":"prod"}, "value":1}]}`},
+			{"ABCD", "/v1/trace", `[{"traceId":"0000000000000001", "id":"0000000000000001", "name":"get"}]`},
+		},
+		datapoints: 1,
+		spans:      1,
+		check: func(t *testing.T, m *Server, up *upstream) {
+			// what the data sink sends is re-encoded on its way upstream
+			assert.Equal(t, map[string]string{"env": "prod"}, up.datapoints["a"])
+			assert.Equal(t, "zstd", up.encodings["/v2/datapoint"])
+			assert.Equal(t, "gzip", up.encodings["/v1/trace"])
+			for _, signal := range []string{"datapoint", "span"} {
+				dims := map[string]string{"type": signal}
+				assert.Equal(t, int64(1), reported(m, "egress.requests", dims), signal)
+				assert.True(t, reported(m, "egress.uncompressed_bytes", dims) > 0, signal)
+				assert.True(t, reported(m, "egress.compressed_bytes", dims) > 0, signal)
+				assert.Equal(t, int64(0), reported(m, "egress.errors", dims), signal)
+			}
+		},
+	},
+	{
+		name: "filter",
+		files: map[string]string{
+			"filter.json": `{"rules": [
+				{"name": "debug", "action": "exclude", "glob": "debug.*"},
+				{"name": "partner", "action": "exclude", "tokens": ["EFGH"], "types": ["counter"]}
+			]}`,
+		},
+		conf: map[string]string{"FILTER_RULES_FILE": "{dir}/filter.json"},
+		sends: []stageSend{
+			{"ABCD", "/v2/datapoint", `{"gauge":[{"metric":"debug.a", "value":1}, {"metric":"a", "value":1}], "counter":[{"metric":"b", "value":1}]}`},
+			{"EFGH", "/v2/datapoint", `{"gauge":[{"metric":"c", "value":1}], "counter":[{"metric":"d", "value":1}]}`},
+		},
+		datapoints: 3,
+		check: func(t *testing.T, m *Server, up *upstream) {
+			for _, metric := range []string{"a", "b", "c"} {
+				assert.Contains(t, up.datapoints, metric)
+			}
+			assert.Equal(t, int64(3), reported(m, "filter.kept", nil))
+			assert.Equal(t, int64(2), reported(m, "filter.dropped", nil))
+			assert.Equal(t, int64(1), reported(m, "filter.matched", map[string]string{"rule": "debug"}))
+			assert.Equal(t, int64(1), reported(m, "filter.matched", map[string]string{"rule": "partner"}))
+		},
+	},
+	{
+		name: "rewrite",
+		files: map[string]string{
+			"rewrite.json": `{"rules": [
+				{"name": "service", "signals": ["datapoints"], "extract": [{"regex": "^(?P<service>[a-z]+)\\.requests$"}], "drop": ["host"]},
+				{"name": "partner", "tokens": ["EFGH"], "add": {"partner": "true"}},
+				{"name": "users", "signals": ["spans"], "span_names": ["^GET /users/(?P<userId>[0-9]+)$"]}
+			]}`,
+		},
+		conf: map[string]string{"REWRITE_RULES_FILE": "{dir}/rewrite.json"},
+		sends: []stageSend{
+			{"ABCD", "/v2/datapoint", `{"gauge":[{"metric":"checkout.requests", "dimensions":{"host":"a"}, "value":1}]}`},
+			{"EFGH", "/v2/datapoint", `{"gauge":[{"metric":"latency", "dimensions":{"host":"b"}, "value":1}]}`},
+			{"EFGH", "/v1/trace", `[{"traceId":"0000000000000001", "id":"0000000000000001", "name":"GET /users/42"}]`},
+		},
+		datapoints: 2,
+		spans:      1,
+		check: func(t *testing.T, m *Server, up *upstream) {
+			assert.Equal(t, map[string]string{"service": "checkout"}, up.datapoints["checkout.requests"])
+			assert.Equal(t, map[string]string{"partner": "true"}, up.datapoints["latency"])
+			span := up.spans["0000000000000001"]
+			require.NotNil(t, span)
+			assert.Equal(t, "GET /users/{userId}", *span.Name)
+			assert.Equal(t, map[string]string{"userId": "42", "partner": "true"}, span.Tags)
+			assert.Equal(t, int64(2), reported(m, "rewrite.applied", map[string]string{"rule": "service"}))
+			assert.Equal(t, int64(2), reported(m, "rewrite.applied", map[string]string{"rule": "partner"}))
+			assert.Equal(t, int64(1), reported(m, "rewrite.applied", map[string]string{"rule": "users"}))
+		},
+	},
+	{
+		name: "obfuscate",
+		files: map[string]string{
+			"obfuscate.json": `{"rules": [
+				{"name": "sql", "action": "obfuscate", "service": "db*", "tags": ["db.statement"]},
+				{"name": "auth", "action": "remove", "tags": ["authorization"]},
+				{"name": "emails", "action": "redact", "regex": "[a-z]+@[a-z.]+"}
+			]}`,
+		},
+		conf: map[string]string{"OBFUSCATE_RULES_FILE": "{dir}/obfuscate.json"},
+		// every trace endpoint's spans are obfuscated
+		sends: []stageSend{
+			{"ABCD", "/v1/trace", `[{"traceId":"0000000000000001", "id":"0000000000000001", "name":"get", "localEndpoint":{"serviceName":"dbproxy"}, "tags":{"db.statement":"select 1", "authorization":"Bearer x", "user":"me@example.com"}}]`},
+			{"ABCD", "/api/v2/spans", `[{"traceId":"0000000000000002", "id":"0000000000000002", "name":"get", "localEndpoint":{"serviceName":"dbproxy"}, "tags":{"db.statement":"select 1", "authorization":"Bearer x", "user":"me@example.com"}}]`},
+			{"ABCD", "/v1/trace", `[{"traceId":"0000000000000003", "id":"0000000000000003", "name":"get", "localEndpoint":{"serviceName":"web"}, "tags":{"db.statement":"select 1", "authorization":"Bearer x", "user":"me@example.com"}}]`},
+		},
+		spans: 3,
+		check: func(t *testing.T, m *Server, up *upstream) {
+			for _, id := range []string{"0000000000000001", "0000000000000002"} {
+				require.NotNil(t, up.spans[id], id)
+				assert.Equal(t, map[string]string{"db.statement": "<obfuscated>", "user": "<obfuscated>"}, up.spans[id].Tags, id)
+			}
+			require.NotNil(t, up.spans["0000000000000003"])
+			assert.Equal(t, map[string]string{"db.statement": "select 1", "user": "<obfuscated>"}, up.spans["0000000000000003"].Tags, "sql is only obfuscated for db services")
+			assert.Equal(t, int64(2), reported(m, "obfuscate.tags", map[string]string{"rule": "sql", "action": "obfuscate"}))
+			assert.Equal(t, int64(3), reported(m, "obfuscate.tags", map[string]string{"rule": "auth", "action": "remove"}))
+			assert.Equal(t, int64(3), reported(m, "obfuscate.tags", map[string]string{"rule": "emails", "action": "redact"}))
+		},
+	},
+	{
+		name:  "spantags",
+		files: map[string]string{"spantags.json": `{"tokens": {"EFGH": {"region": "west"}}}`},
+		conf: map[string]string{
+			"SPAN_TAGS":           `{"tags": {"environment": "prod", "region": "east"}}`,
+			"SPAN_TAGS_FILE":      "{dir}/spantags.json",
+			"SPAN_TAGS_OVERWRITE": "false",
+		},
+		sends: []stageSend{
+			{"ABCD", "/v1/trace", `[
+				{"traceId":"0000000000000001", "id":"0000000000000001", "name":"get", "tags":{"region":"north"}},
+				{"traceId":"0000000000000001", "id":"0000000000000002", "name":"get"}
+			]`},
+			{"EFGH", "/v1/trace", `[{"traceId":"0000000000000002", "id":"0000000000000003", "name":"get"}]`},
+		},
+		spans: 3,
+		check: func(t *testing.T, m *Server, up *upstream) {
+			assert.Equal(t, map[string]string{"environment": "prod", "region": "north"}, up.spans["0000000000000001"].Tags, "tags already on a span are kept")
+			assert.Equal(t, map[string]string{"environment": "prod", "region": "east"}, up.spans["0000000000000002"].Tags)
+			assert.Equal(t, map[string]string{"environment": "prod", "region": "west"}, up.spans["0000000000000003"].Tags)
+			assert.Equal(t, int64(3), reported(m, "spantags.spans", nil))
+			assert.Equal(t, int64(1), reported(m, "spantags.token_spans", nil))
+		},
+	},
+}
+
+func TestStages(t *testing.T) {
+	for _, tc := range stageTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			dir, cleanupFiles := writeFiles(t, tc.files)
+			defer cleanupFiles()
+			conf := make(map[string]string, len(tc.conf))
+			for k, v := range tc.conf {
+				conf[k] = strings.Replace(v, "{dir}", dir, -1)
+			}
+			up := newUpstream()
+			m, cleanup := upstreamServer(up, conf)
+			defer cleanup()
+
+			for _, send := range tc.sends {
+				assert.Equal(t, http.StatusOK, sendJSON(m, send.token, send.path, send.body), send.path)
+			}
+			up.wait(t, tc.datapoints, tc.spans)
+			up.mu.Lock()
+			defer up.mu.Unlock()
+			tc.check(t, m, up)
+		})
+	}
+}
+
+func TestDebugSpans(t *testing.T) {
+	dir, cleanupFiles := writeFiles(t, nil)
+	defer cleanupFiles()
+	mirror := newUpstream()
+	mirrorServer := httptest.NewServer(mirror)
+	defer mirrorServer.Close()
+	up := newUpstream()
+	m, cleanup := upstreamServer(up, map[string]string{
+		"DEBUG_SPANS_FILE":            filepath.Join(dir, "debug.json"),
+		"DEBUG_SPANS_ENDPOINT":        mirrorServer.URL + "/v1/trace",
+		"RATE_LIMIT_SPANS_PER_SECOND": "1",
+	})
+	defer cleanup()
+
+	assert.Equal(t, http.StatusOK, sendJSON(m, "ABCD", "/v1/trace", `[{"traceId":"0000000000000003", "id":"0000000000000004", "name":"get"}]`))
+	// debug spans aren't sent anywhere when the rest of their request is refused, since the client sends them again
+	assert.Equal(t, http.StatusTooManyRequests, sendJSON(m, "ABCD", "/v1/trace", `[
+		{"traceId":"0000000000000004", "id":"0000000000000005", "name":"get", "debug":true},
+		{"traceId":"0000000000000005", "id":"0000000000000006", "name":"get"}
+	]`))
+	// the spans of debug traces, and of traces with a sampling.priority of 1, go around the limit of one a second
+	assert.Equal(t, http.StatusOK, sendJSON(m, "ABCD", "/v1/trace", `[
+		{"traceId":"0000000000000001", "id":"0000000000000001", "name":"get", "debug":true},
+		{"traceId":"0000000000000001", "id":"0000000000000002", "name":"get"},
+		{"traceId":"0000000000000002", "id":"0000000000000003", "name":"get", "tags":{"sampling.priority":"1"}}
+	]`))
+	up.wait(t, 0, 4)
+	// spans are mirrored in order, so the refused debug span would have been mirrored first
+	mirror.wait(t, 0, 3)
+
+	up.mu.Lock()
+	assert.Equal(t, "1", up.spans["0000000000000001"].Tags["sampling.priority"])
+	assert.True(t, *up.spans["0000000000000003"].Debug)
+	assert.Nil(t, up.spans["0000000000000004"].Debug)
+	assert.NotContains(t, up.spans, "0000000000000005")
+	up.mu.Unlock()
+	assert.Equal(t, int64(4), reported(m, "debugspans.spans", nil))
+	assert.Equal(t, int64(3), reported(m, "debugspans.bypassed", nil))
+
+	// the file is written before the endpoint is sent to
+	b, err := ioutil.ReadFile(filepath.Join(dir, "debug.json"))
+	require.NoError(t, err)
+	var mirrored []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var s trace.Span
+		require.NoError(t, json.Unmarshal([]byte(line), &s))
+		mirrored = append(mirrored, s.ID)
+	}
+	assert.Equal(t, []string{"0000000000000001", "0000000000000002", "0000000000000003"}, mirrored)
+}
+
+func TestSinkChain(t *testing.T) {
+	dir, cleanupFiles := writeFiles(t, map[string]string{
+		"rewrite.json": `{"rules": [
+			{"name": "env", "signals": ["datapoints"], "rename": {"env_name": "env"}},
+			{"name": "agent", "signals": ["spans"], "drop": ["http.user_agent"]}
+		]}`,
+		"obfuscate.json": `{"rules": [{"name": "emails", "action": "redact", "regex": "[a-z]+@[a-z.]+"}]}`,
+		"filter.json":    `{"rules": [{"name": "no-dev", "action": "exclude", "dimensions": {"env": "dev"}}]}`,
+	})
+	defer cleanupFiles()
+	up := newUpstream()
+	m, cleanup := upstreamServer(up, map[string]string{
+		"REWRITE_RULES_FILE":               filepath.Join(dir, "rewrite.json"),
+		"OBFUSCATE_RULES_FILE":             filepath.Join(dir, "obfuscate.json"),
+		"FILTER_RULES_FILE":                filepath.Join(dir, "filter.json"),
+		"SPAN_TAGS":                        `{"tags": {"environment": "prod"}}`,
+		"RATE_LIMIT_DATAPOINTS_PER_SECOND": "1",
+		"RATE_LIMIT_SPANS_PER_SECOND":      "1",
+	})
+	defer cleanup()
+
+	send := func(path string, body string) int {
+		return sendJSON(m, "ABCD", path, body)
+	}
+	// the rewritten dev datapoints are filtered out before they count against the limit of one a second
+	assert.Equal(t, http.StatusOK, send("/v2/datapoint", `{"gauge":[
+		{"metric":"a", "dimensions":{"env_name":"dev"}, "value":1},
+		{"metric":"b", "dimensions":{"env_name":"dev"}, "value":1},
+		{"metric":"c", "dimensions":{"env_name":"prod"}, "value":1}
+	]}`))
+	assert.Equal(t, http.StatusTooManyRequests, send("/v2/datapoint", `{"gauge":[{"metric":"d", "dimensions":{"env_name":"prod"}, "value":1}]}`))
+
+	spans := `[
+		{"traceId":"0000000000000001", "id":"0000000000000001", "name":"get", "debug":true, "tags":{"user":"me@example.com", "http.user_agent":"curl"}},
+		{"traceId":"0000000000000001", "id":"0000000000000002", "name":"get"},
+		{"traceId":"0000000000000002", "id":"0000000000000003", "name":"get"}
+	]`
+	assert.Equal(t, http.StatusOK, send("/v1/trace", spans))
+	// debug spans go around the rate limits, the rest don't
+	assert.Equal(t, http.StatusOK, send("/v1/trace", `[{"traceId":"0000000000000003", "id":"0000000000000004", "name":"get", "debug":true}]`))
+	assert.Equal(t, http.StatusTooManyRequests, send("/v1/trace", `[{"traceId":"0000000000000004", "id":"0000000000000005", "name":"get"}]`))
+
+	up.wait(t, 1, 4)
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	assert.Equal(t, map[string]string{"env": "prod"}, up.datapoints["c"])
+	debugSpan := up.spans["0000000000000001"]
+	require.NotNil(t, debugSpan)
+	assert.Equal(t, map[string]string{"user": "<obfuscated>", "environment": "prod", "sampling.priority": "1"}, debugSpan.Tags, "debug spans are rewritten, obfuscated and tagged before they go around the limits")
+	assert.Equal(t, "prod", up.spans["0000000000000003"].Tags["environment"])
+}
+
+func TestTokenPolicy(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+		"TOKEN_DENY_LIST":      "REVOKED",
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	for token, code := range map[string]int{"REVOKED": http.StatusUnauthorized, "ABCD": http.StatusOK} {
+		rw := httptest.NewRecorder()
+		body := bytes.NewBufferString(`{"gauge":[{"metric":"a", "value":1}]}`)
+		req, _ := http.NewRequest("POST", "http://localhost:8080/v2/datapoint", body)
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add(sfxclient.TokenHeaderName, token)
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, code, rw.Code, token)
+	}
+}
+
+func TestDefaultToken(t *testing.T) {
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS":    "2",
+		"CHANNEL_SIZE":            "10",
+		"MAX_DRAIN_SIZE":          "50",
+		"TOKEN_MAP_DEFAULT_TOKEN": "ABCD",
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+
+	rw := httptest.NewRecorder()
+	body := bytes.NewBufferString(`{"gauge":[{"metric":"a", "value":1}]}`)
+	req, _ := http.NewRequest("POST", "http://localhost:8080/v2/datapoint", body)
+	req.Header.Add("Content-Type", "application/json")
+	m.server.Handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+func TestMultipleListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pops-listeners")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "pops.sock")
+	m := NewServer()
+	_ = setupServer(m, map[string]string{
+		"NUM_DRAINING_THREADS": "2",
+		"CHANNEL_SIZE":         "10",
+		"MAX_DRAIN_SIZE":       "50",
+		"POPS_ENDPOINTS":       "sfx_json_v2",
+		"POPS_LISTENERS":       fmt.Sprintf(`[{"name": "traces", "network": "unix", "address": %q, "endpoints": ["span_json_v1"]}]`, socket),
+	})
+	defer m.Close()
+	go m.main()
+	<-m.setupDone
+	require.Len(t, m.extraListeners, 1)
+
+	overSocket := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}}}
+	for _, tc := range []struct {
+		path       string
+		body       string
+		mainCode   int
+		socketCode int
+	}{
+		{"/v2/datapoint", `{"gauge":[{"metric":"a", "value":1}]}`, http.StatusOK, http.StatusNotFound},
+		{"/v1/trace", `[]`, http.StatusNotFound, http.StatusOK},
+		{"/healthz", ``, http.StatusOK, http.StatusOK},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "http://localhost:8080"+tc.path, bytes.NewBufferString(tc.body))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		m.server.Handler.ServeHTTP(rw, req)
+		assert.Equal(t, tc.mainCode, rw.Code, tc.path)
+
+		req, _ = http.NewRequest("POST", "http://pops"+tc.path, bytes.NewBufferString(tc.body))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add(sfxclient.TokenHeaderName, "ABCD")
+		resp, err := overSocket.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, tc.socketCode, resp.StatusCode, tc.path)
+	}
+}
+
+func TestBadListeners(t *testing.T) {
+	for _, conf := range []map[string]string{
+		{"POPS_LISTENERS": `[{"name": "traces"}]`},
+		{"POPS_ENDPOINTS": "sfx_json_v3"},
+		{"POPS_LISTENERS": `[{"name": "traces", "network": "unix", "address": "/does/not/exist/pops.sock"}]`},
+	} {
+		m := NewServer()
+		_ = setupServer(m, conf)
+		assert.NoError(t, m.setupConfig())
+		assert.NoError(t, m.setupTokenPolicy())
+		assert.NoError(t, m.setupDataSink())
+		assert.NoError(t, m.setupTokenMapper())
+		assert.NoError(t, m.setupRateLimiter())
+		assert.Error(t, m.setupHTTPServer(), "%v", conf)
+		assert.Nil(t, m.httpListener, "the main listener is closed if the others fail")
+		assert.NoError(t, m.Close())
+	}
+}
+
 func BenchmarkBadAuthToken(b *testing.B) {
 	m := NewServer()
 	_ = setupServer(m, map[string]string{})
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/pops/limits"
+	"github.com/signalfx/pops/ratelimit"
+	"github.com/signalfx/pops/sinkerr"
+)
+
+// protocol is an entry in the registry of HTTP protocols.  Setup only ever sees the protocol's endpoint, whose sink
+// counts everything sent through it, so there is no way to register a protocol that isn't instrumented.
+type protocol struct {
+	name  string
+	setup func(e *endpoint) sfxclient.Collector
+}
+
+// protocols are every protocol served over HTTP, in the order they are set up
+func (m *Server) protocols() []protocol {
+	return []protocol{
+		{"sfx_protobuf_v2", m.setupDatapointProtobufV2},
+		{"event_protobuf_v2", m.setupEventProtobufV2},
+		{"sfx_json_v2", m.setupJSONDatapointV2},
+		{"event_json_v2", m.setupJSONEventV2},
+		{"sfx_collectd_v1", m.setupCollectd},
+		{"sfx_protobuf_v1", m.setupDatapointProtobufV1},
+		{"sfx_json_v1", m.setupDatapointJSONV1},
+		{"span_thrift_v1", m.setupSpanThriftV1},
+		{"span_json_v1", m.setupSpanJSONV1},
+		{"sapm", m.setupSAPM},
+		{zipkinJSONV1, func(e *endpoint) sfxclient.Collector { return m.setupZipkinJSON(e, signalfx.ZipkinTracePathV1) }},
+		{zipkinJSONV2, func(e *endpoint) sfxclient.Collector { return m.setupZipkinJSON(e, signalfx.ZipkinTracePathV2) }},
+		{"prometheus_remote_write", m.setupRemoteWrite},
+		{"otlp_metrics", m.setupOTLPMetrics},
+		{"otlp_traces", m.setupOTLPTraces},
+	}
+}
+
+// endpoint is where a protocol is served: its routes, a sink that counts what the protocol sends it, and the
+// protocol's request stats
+type endpoint struct {
+	name       string
+	router     *mux.Router
+	sink       signalfx.Sink
+	limits     *limits.Protocol
+	server     *stats
+	retryAfter *distconf.Duration
+
+	stats struct {
+		TotalRequests       int64
+		TotalBytes          int64
+		TotalDecodeErrors   int64
+		TotalSinkRejections int64
+		TotalRefused        [sinkerr.NumKinds]int64
+	}
+}
+
+var _ signalfx.NextSink = &endpoint{}
+
+func (m *Server) newEndpoint(name string, router *mux.Router) *endpoint {
+	e := &endpoint{
+		name:       name,
+		router:     router,
+		limits:     m.limiter.Protocol(name),
+		server:     &m.stats,
+		retryAfter: m.configs.dataSinkConfig.RetryAfter,
+	}
+	e.sink = signalfx.FromChain(m.newIncomingCounter(m.sink, name), signalfx.NextWrap(e), signalfx.NextWrap(e.limits))
+	return e
+}
+
+// writeError responds to a request that failed with err.  rejected is why the sink or a limit refused the request,
+// which is what counts even if the decoder didn't pass it on.  Only data the sink might take later is retryable, and
+// only bodies nothing refused are counted as decode errors.
+func (e *endpoint) writeError(rw http.ResponseWriter, err error, rejected error) {
+	if rejected != nil {
+		err = rejected
+	}
+	var limited *ratelimit.ErrLimited
+	if errors.As(err, &limited) {
+		ratelimit.WriteLimited(rw, limited)
+		return
+	}
+	if refused, ok := sinkerr.As(err); ok {
+		atomic.AddInt64(&e.server.TotalRefused[refused.Kind], 1)
+		atomic.AddInt64(&e.stats.TotalRefused[refused.Kind], 1)
+		sinkerr.Write(rw, refused, e.retryAfter.Get())
+		return
+	}
+	// the sink has already counted what it rejected
+	if rejected == nil {
+		atomic.AddInt64(&e.server.TotalDecodeErrors, 1)
+		atomic.AddInt64(&e.stats.TotalDecodeErrors, 1)
+	}
+	rw.WriteHeader(http.StatusBadRequest)
+	_, _ = rw.Write([]byte(err.Error()))
+}
+
+// Datapoints returns how many requests and bytes the protocol has received and how many of its requests failed
+func (e *endpoint) Datapoints() []*datapoint.Datapoint {
+	dps := []*datapoint.Datapoint{
+		sfxclient.CumulativeP("total_requests", nil, &e.stats.TotalRequests),
+		sfxclient.CumulativeP("total_bytes", nil, &e.stats.TotalBytes),
+		sfxclient.CumulativeP("total_decode_errors", nil, &e.stats.TotalDecodeErrors),
+		sfxclient.CumulativeP("total_sink_rejections", nil, &e.stats.TotalSinkRejections),
+	}
+	dps = append(dps, refusedDatapoints(nil, &e.stats.TotalRefused)...)
+	return append(dps, e.limits.Datapoints()...)
+}
+
+// refusedDatapoints returns how many requests were refused for each sinkerr.Kind
+func refusedDatapoints(dims map[string]string, refused *[sinkerr.NumKinds]int64) []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0, sinkerr.NumKinds)
+	for k := range refused {
+		dps = append(dps, sfxclient.CumulativeP("total_refused_requests", datapoint.AddMaps(dims, map[string]string{"reason": sinkerr.Kind(k).String()}), &refused[k]))
+	}
+	return dps
+}
+
+// requestState is put on the context of each request so the sink and the body limits can record why they rejected
+// the request, which keeps the decode errors to requests whose body was bad even when a decoder doesn't return the
+// error it was given
+type requestState struct {
+	mu       sync.Mutex
+	rejected error
+}
+
+type requestStateKey struct{}
+
+// withRequestState puts the state countRequests put on req's context on ctx, or a new one if there isn't one
+func withRequestState(ctx context.Context, req *http.Request) (context.Context, *requestState) {
+	state, ok := req.Context().Value(requestStateKey{}).(*requestState)
+	if !ok {
+		state = &requestState{}
+	}
+	return context.WithValue(ctx, requestStateKey{}, state), state
+}
+
+func (s *requestState) reject(err error) {
+	s.mu.Lock()
+	s.rejected = err
+	s.mu.Unlock()
+}
+
+// rejection returns the last error the sink returned for the request
+func (s *requestState) rejection() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rejected
+}
+
+func (e *endpoint) checkRejected(ctx context.Context, err error) error {
+	if err != nil {
+		atomic.AddInt64(&e.stats.TotalSinkRejections, 1)
+		if state, ok := ctx.Value(requestStateKey{}).(*requestState); ok {
+			state.reject(err)
+		}
+	}
+	return err
+}
+
+// AddDatapoints forwards the datapoints, noting if they are rejected
+func (e *endpoint) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	return e.checkRejected(ctx, next.AddDatapoints(ctx, points))
+}
+
+// AddEvents forwards the events, noting if they are rejected
+func (e *endpoint) AddEvents(ctx context.Context, events []*event.Event, next signalfx.Sink) error {
+	return e.checkRejected(ctx, next.AddEvents(ctx, events))
+}
+
+// AddSpans forwards the spans, noting if they are rejected
+func (e *endpoint) AddSpans(ctx context.Context, spans []*trace.Span, next signalfx.Sink) error {
+	return e.checkRejected(ctx, next.AddSpans(ctx, spans))
+}
+
+// byteCounter counts the bytes read from a request body
+type byteCounter struct {
+	io.ReadCloser
+	total *int64
+}
+
+func (b *byteCounter) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.total, int64(n))
+	return n, err
+}
+
+// countRequests counts requests and the bytes of their bodies as they arrive, before they are decompressed, and
+// limits the size of those bodies
+func (e *endpoint) countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&e.stats.TotalRequests, 1)
+		state := &requestState{}
+		req = req.WithContext(context.WithValue(req.Context(), requestStateKey{}, state))
+		if req.Body != nil {
+			body, err := e.limits.Body(&byteCounter{ReadCloser: req.Body, total: &e.stats.TotalBytes}, req.ContentLength, state.reject)
+			if err != nil {
+				e.writeError(rw, err, err)
+				return
+			}
+			req.Body = body
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
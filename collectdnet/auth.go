@@ -0,0 +1,109 @@
+package collectdnet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// securityLevel is how well a part of a packet has been authenticated, and how well values and notifications need to
+// be authenticated to be accepted
+type securityLevel int
+
+const (
+	levelNone securityLevel = iota
+	levelSign
+	levelEncrypt
+)
+
+var securityLevels = map[string]securityLevel{"none": levelNone, "sign": levelSign, "encrypt": levelEncrypt}
+
+const (
+	signatureSize = sha256.Size
+	checksumSize  = sha1.Size
+)
+
+var errUnknownUser = errors.New("collectd packet is from a user that isn't in the auth file")
+
+// signed checks the HMAC-SHA256 of the username and the rest of the packet, keyed with the user's password, before
+// decoding the rest of the packet as signed.  Without an auth file, a listener that doesn't require signing decodes
+// it without checking, as collectd does.
+func (d *decoder) signed(body []byte, rest []byte, level securityLevel, s *state, p *packet) error {
+	if len(body) < signatureSize {
+		return errShortPart
+	}
+	signature, user := body[:signatureSize], body[signatureSize:]
+	password, ok := d.users(string(user))
+	if !ok {
+		if d.security == levelNone {
+			return d.parts(rest, level, s, p)
+		}
+		return errUnknownUser
+	}
+	mac := hmac.New(sha256.New, []byte(password))
+	_, _ = mac.Write(user)
+	_, _ = mac.Write(rest)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("collectd packet has an invalid signature")
+	}
+	if level < levelSign {
+		level = levelSign
+	}
+	return d.parts(rest, level, s, p)
+}
+
+// encrypted decrypts a part encrypted with AES-256 in OFB mode, keyed with the SHA-256 of the user's password, and
+// decodes what's inside once its SHA-1 checksum matches
+func (d *decoder) encrypted(body []byte, s *state, p *packet) error {
+	if len(body) < 2 {
+		return errShortPart
+	}
+	userSize := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+userSize+aes.BlockSize+checksumSize {
+		return errShortPart
+	}
+	user := string(body[2 : 2+userSize])
+	iv := body[2+userSize : 2+userSize+aes.BlockSize]
+	password, ok := d.users(user)
+	if !ok {
+		return errUnknownUser
+	}
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	plain := make([]byte, len(body)-2-userSize-aes.BlockSize)
+	cipher.NewOFB(block, iv).XORKeyStream(plain, body[2+userSize+aes.BlockSize:])
+	checksum := sha1.Sum(plain[checksumSize:])
+	if !bytes.Equal(checksum[:], plain[:checksumSize]) {
+		return errors.New("collectd packet could not be decrypted")
+	}
+	return d.parts(plain[checksumSize:], levelEncrypt, s, p)
+}
+
+// parseAuthFile parses collectd's auth file of "user: password" lines
+func parseAuthFile(b []byte) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.IndexByte(text, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("collectd auth file line %d isn't \"user: password\"", line)
+		}
+		users[strings.TrimSpace(text[:i])] = strings.TrimSpace(text[i+1:])
+	}
+	return users, scanner.Err()
+}
@@ -0,0 +1,273 @@
+package collectdnet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/pops/filewatch"
+)
+
+// maxPacketSize is the largest UDP datagram
+const maxPacketSize = 65535
+
+// Config configures the collectd network protocol listeners and the files they share
+type Config struct {
+	Listeners      *distconf.Str
+	TypesDB        *distconf.Str
+	ReloadInterval *distconf.Duration
+}
+
+// Load the collectd network config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.Listeners = d.Str("COLLECTD_NETWORK_LISTENERS", "")
+	c.TypesDB = d.Str("COLLECTD_TYPES_DB", "")
+	c.ReloadInterval = d.Duration("COLLECTD_AUTH_FILE_RELOAD_INTERVAL", 10*time.Second)
+}
+
+// Spec describes a UDP listener for collectd's network plugin, and everything received on it is sent with Token.
+// SecurityLevel is "none", "sign" or "encrypt" like the plugin's own SecurityLevel, and anything but "none" needs the
+// AuthFile of "user: password" lines the clients sign or encrypt with.  Dimensions are added to every datapoint the
+// way sfxdim_ query parameters are on /v1/collectd.
+type Spec struct {
+	Name          string            `json:"name"`
+	Address       string            `json:"address"`
+	Token         string            `json:"token"`
+	SecurityLevel string            `json:"security_level,omitempty"`
+	AuthFile      string            `json:"auth_file,omitempty"`
+	Dimensions    map[string]string `json:"dimensions,omitempty"`
+
+	security securityLevel
+	types    typesDB
+}
+
+// Specs returns the collectd network listeners, checking they are valid and loading COLLECTD_TYPES_DB for them
+func (c *Config) Specs() ([]*Spec, error) {
+	raw := c.Listeners.Get()
+	if raw == "" {
+		return nil, nil
+	}
+	var specs []*Spec
+	if err := json.Unmarshal([]byte(raw), &specs); err != nil {
+		return nil, err
+	}
+	types, err := c.loadTypesDB()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(specs))
+	for _, s := range specs {
+		if s.Name == "" || s.Address == "" || s.Token == "" {
+			return nil, errors.New("collectd network listeners need a name, an address and a token")
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("collectd network listener name %s is used more than once", s.Name)
+		}
+		names[s.Name] = true
+		if err := s.setDefaults(types); err != nil {
+			return nil, err
+		}
+	}
+	return specs, nil
+}
+
+func (c *Config) loadTypesDB() (typesDB, error) {
+	path := c.TypesDB.Get()
+	if path == "" {
+		return typesDB{}, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTypesDB(b)
+}
+
+// setDefaults fills in the security level if it's unset and checks there is an auth file if one is needed
+func (s *Spec) setDefaults(types typesDB) error {
+	if s.SecurityLevel == "" {
+		s.SecurityLevel = "none"
+	}
+	var ok bool
+	if s.security, ok = securityLevels[s.SecurityLevel]; !ok {
+		return fmt.Errorf("collectd network listener %s has unknown security level %s", s.Name, s.SecurityLevel)
+	}
+	if s.security != levelNone && s.AuthFile == "" {
+		return fmt.Errorf("collectd network listener %s needs an auth file for security level %s", s.Name, s.SecurityLevel)
+	}
+	s.types = types
+	return nil
+}
+
+// Listener receives collectd's network protocol and sends the datapoints and notifications in it to the sink with
+// the listener's token, exactly as /v1/collectd would have for the same values sent by write_http
+type Listener struct {
+	spec    *Spec
+	sink    dpsink.Sink
+	ctx     context.Context
+	logger  log.Logger
+	decoder *decoder
+	watcher *filewatch.Watcher
+	conn    net.PacketConn
+	closing chan struct{}
+	done    chan struct{}
+
+	mu    sync.RWMutex
+	users map[string]string
+
+	stats struct {
+		TotalPackets        int64
+		TotalInvalidPackets int64
+		TotalDatapoints     int64
+		TotalEvents         int64
+		TotalUnauthorized   int64
+		TotalSendErrors     int64
+	}
+}
+
+// New opens the listener described by spec, loading and watching its auth file if it has one, and starts receiving
+func New(spec *Spec, conf *Config, sink dpsink.Sink, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Listener, error) {
+	if spec.types == nil {
+		if err := spec.setDefaults(typesDB{}); err != nil {
+			return nil, err
+		}
+	}
+	l := &Listener{
+		spec:    spec,
+		sink:    sink,
+		ctx:     context.WithValue(context.Background(), sfxclient.TokenCtxKey, spec.Token),
+		logger:  log.NewContext(logger).With("collectd_listener", spec.Name),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		users:   map[string]string{},
+	}
+	l.decoder = &decoder{security: spec.security, users: l.user, types: spec.types, defaultDims: spec.Dimensions}
+	var err error
+	if spec.AuthFile != "" {
+		if l.watcher, err = filewatch.New(spec.AuthFile, conf.ReloadInterval.Get(), l.loadAuthFile, timeKeeper, l.logger); err != nil {
+			return nil, err
+		}
+	}
+	if l.conn, err = net.ListenPacket("udp", spec.Address); err != nil {
+		if l.watcher != nil {
+			_ = l.watcher.Close()
+		}
+		return nil, err
+	}
+	go l.readPackets()
+	return l, nil
+}
+
+func (l *Listener) loadAuthFile(b []byte) error {
+	users, err := parseAuthFile(b)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.users = users
+	l.mu.Unlock()
+	return nil
+}
+
+// user returns the password of user from the auth file
+func (l *Listener) user(user string) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	password, ok := l.users[user]
+	return password, ok
+}
+
+// Addr returns the address the listener is bound to
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *Listener) readPackets() {
+	defer close(l.done)
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if !l.isClosing() {
+				l.logger.Log(log.Err, err, "unable to read collectd packet")
+			}
+			return
+		}
+		atomic.AddInt64(&l.stats.TotalPackets, 1)
+		l.handlePacket(buf[:n])
+	}
+}
+
+// handlePacket sends what was decoded before any error, since collectd packs many values into one packet
+func (l *Listener) handlePacket(b []byte) {
+	p, err := l.decoder.decode(b)
+	if err != nil {
+		atomic.AddInt64(&l.stats.TotalInvalidPackets, 1)
+		l.logger.Log(log.Err, err, "invalid collectd packet")
+	}
+	atomic.AddInt64(&l.stats.TotalUnauthorized, p.dropped)
+	if len(p.dps) > 0 {
+		atomic.AddInt64(&l.stats.TotalDatapoints, int64(len(p.dps)))
+		l.send(l.sink.AddDatapoints(l.ctx, p.dps))
+	}
+	if len(p.events) > 0 {
+		atomic.AddInt64(&l.stats.TotalEvents, int64(len(p.events)))
+		l.send(l.sink.AddEvents(l.ctx, p.events))
+	}
+}
+
+func (l *Listener) send(err error) {
+	if err != nil {
+		atomic.AddInt64(&l.stats.TotalSendErrors, 1)
+		l.logger.Log(log.Err, err, "unable to send collectd values")
+	}
+}
+
+func (l *Listener) isClosing() bool {
+	select {
+	case <-l.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Datapoints returns how much the listener has received and sent, and how its auth file is reloading
+func (l *Listener) Datapoints() []*datapoint.Datapoint {
+	dims := map[string]string{"listener": l.spec.Name}
+	dps := []*datapoint.Datapoint{
+		sfxclient.CumulativeP("collectd_network.packets", dims, &l.stats.TotalPackets),
+		sfxclient.CumulativeP("collectd_network.invalid_packets", dims, &l.stats.TotalInvalidPackets),
+		sfxclient.CumulativeP("collectd_network.datapoints", dims, &l.stats.TotalDatapoints),
+		sfxclient.CumulativeP("collectd_network.events", dims, &l.stats.TotalEvents),
+		sfxclient.CumulativeP("collectd_network.unauthorized", dims, &l.stats.TotalUnauthorized),
+		sfxclient.CumulativeP("collectd_network.send_errors", dims, &l.stats.TotalSendErrors),
+	}
+	if l.watcher != nil {
+		dps = append(dps, l.watcher.Datapoints()...)
+	}
+	return dps
+}
+
+// Close stops receiving and watching the auth file
+func (l *Listener) Close() error {
+	close(l.closing)
+	err := l.conn.Close()
+	<-l.done
+	if l.watcher != nil {
+		_ = l.watcher.Close()
+	}
+	return err
+}
@@ -0,0 +1,360 @@
+package collectdnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper/timekeepertest"
+	"github.com/signalfx/ingest-protocols/protocol/collectd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sink struct {
+	mu     sync.Mutex
+	tokens []string
+	dps    []*datapoint.Datapoint
+	events []*event.Event
+}
+
+func (s *sink) AddDatapoints(ctx context.Context, dps []*datapoint.Datapoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, _ := ctx.Value(sfxclient.TokenCtxKey).(string)
+	s.tokens = append(s.tokens, token)
+	s.dps = append(s.dps, dps...)
+	return nil
+}
+
+func (s *sink) AddEvents(ctx context.Context, events []*event.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *sink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.dps) + len(s.events)
+}
+
+func part(typ uint16, body []byte) []byte {
+	b := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint16(b, typ)
+	binary.BigEndian.PutUint16(b[2:], uint16(4+len(body)))
+	return append(b, body...)
+}
+
+func strPart(typ uint16, s string) []byte {
+	return part(typ, append([]byte(s), 0))
+}
+
+func numPart(typ uint16, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return part(typ, b)
+}
+
+// valuesPart encodes values of the given data source types
+func valuesPart(kinds []byte, values ...float64) []byte {
+	b := make([]byte, 2, 2+9*len(values))
+	binary.BigEndian.PutUint16(b, uint16(len(values)))
+	b = append(b, kinds...)
+	for i, v := range values {
+		raw := make([]byte, 8)
+		switch kinds[i] {
+		case dsGauge:
+			binary.LittleEndian.PutUint64(raw, math.Float64bits(v))
+		case dsDerive:
+			binary.BigEndian.PutUint64(raw, uint64(int64(v)))
+		default:
+			binary.BigEndian.PutUint64(raw, uint64(v))
+		}
+		b = append(b, raw...)
+	}
+	return part(partValues, b)
+}
+
+func sign(user, password string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	_, _ = mac.Write([]byte(user))
+	_, _ = mac.Write(payload)
+	return append(part(partSignature, append(mac.Sum(nil), user...)), payload...)
+}
+
+func encrypt(user, password string, payload []byte) []byte {
+	key := sha256.Sum256([]byte(password))
+	block, _ := aes.NewCipher(key[:])
+	iv := bytes.Repeat([]byte{7}, aes.BlockSize)
+	checksum := sha1.Sum(payload)
+	plain := append(checksum[:], payload...)
+	encrypted := make([]byte, len(plain))
+	cipher.NewOFB(block, iv).XORKeyStream(encrypted, plain)
+	body := make([]byte, 2, 2+len(user)+len(iv)+len(encrypted))
+	binary.BigEndian.PutUint16(body, uint16(len(user)))
+	body = append(append(append(body, user...), iv...), encrypted...)
+	return part(partEncryption, body)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+const testTime = 1500000000.5
+
+// testPacket is what collectd sends for the values in testJSON
+func testPacket() []byte {
+	return concat(
+		strPart(partHost, "web01[env=prod]"),
+		numPart(partTimeHR, uint64(testTime*hrScale)),
+		numPart(partIntervalHR, uint64(10*hrScale)),
+		strPart(partPlugin, "interface"),
+		strPart(partPluginInstance, "eth0"),
+		strPart(partType, "if_octets"),
+		strPart(partTypeInstance, ""),
+		valuesPart([]byte{dsDerive, dsDerive}, 1000, -5),
+		strPart(partPlugin, "cpu"),
+		strPart(partPluginInstance, "0"),
+		strPart(partType, "cpu"),
+		strPart(partTypeInstance, "idle[core=a]"),
+		valuesPart([]byte{dsGauge}, 97.5),
+		strPart(partTypeInstance, "nan"),
+		valuesPart([]byte{dsGauge}, math.NaN()),
+		strPart(partType, "unknown"),
+		strPart(partTypeInstance, ""),
+		valuesPart([]byte{dsCounter, dsAbsolute}, 3, 4),
+		numPart(partSeverity, 2),
+		strPart(partMessage, "disk is filling up"),
+	)
+}
+
+const testJSON = `[
+{"host":"web01[env=prod]","time":1500000000.5,"interval":10,"plugin":"interface","plugin_instance":"eth0","type":"if_octets","type_instance":"","dsnames":["rx","tx"],"dstypes":["derive","derive"],"values":[1000,-5]},
+{"host":"web01[env=prod]","time":1500000000.5,"interval":10,"plugin":"cpu","plugin_instance":"0","type":"cpu","type_instance":"idle[core=a]","dsnames":["value"],"dstypes":["gauge"],"values":[97.5]},
+{"host":"web01[env=prod]","time":1500000000.5,"interval":10,"plugin":"cpu","plugin_instance":"0","type":"cpu","type_instance":"nan","dsnames":["value"],"dstypes":["gauge"],"values":[null]},
+{"host":"web01[env=prod]","time":1500000000.5,"interval":10,"plugin":"cpu","plugin_instance":"0","type":"unknown","type_instance":"","dsnames":["0","1"],"dstypes":["counter","absolute"],"values":[3,4]},
+{"host":"web01[env=prod]","time":1500000000.5,"interval":10,"plugin":"cpu","plugin_instance":"0","type":"unknown","type_instance":"","severity":"WARNING","message":"disk is filling up"}
+]`
+
+const testTypesDB = `# comment
+cpu        value:DERIVE:0:U
+if_octets  rx:DERIVE:0:U, tx:DERIVE:0:U
+`
+
+func testDecoder(t *testing.T, security securityLevel) *decoder {
+	types, err := parseTypesDB([]byte(testTypesDB))
+	require.NoError(t, err)
+	users := map[string]string{"alice": "secret"}
+	return &decoder{
+		security:    security,
+		users:       func(u string) (string, bool) { p, ok := users[u]; return p, ok },
+		types:       types,
+		defaultDims: map[string]string{"cluster": "a"},
+	}
+}
+
+func TestDecodeMatchesJSON(t *testing.T) {
+	p, err := testDecoder(t, levelNone).decode(testPacket())
+	require.NoError(t, err)
+
+	expected := &sink{}
+	req := httptest.NewRequest("POST", "/v1/collectd?sfxdim_cluster=a", strings.NewReader(testJSON))
+	require.NoError(t, (&collectd.JSONDecoder{SendTo: expected, Logger: log.Discard}).Read(context.Background(), req))
+
+	require.Len(t, p.dps, 5)
+	assert.ElementsMatch(t, expected.dps, p.dps)
+	require.Len(t, p.events, 1)
+	assert.Equal(t, expected.events, p.events)
+	assert.Equal(t, "if_octets.rx", p.dps[0].Metric)
+	assert.Equal(t, datapoint.Counter, p.dps[0].MetricType)
+	assert.Equal(t, "prod", p.dps[0].Dimensions["env"])
+}
+
+func TestSecurityLevels(t *testing.T) {
+	values := concat(strPart(partType, "cpu"), valuesPart([]byte{dsGauge}, 1))
+	for _, tc := range []struct {
+		security securityLevel
+		packet   []byte
+		dps      int
+		dropped  int64
+	}{
+		{levelNone, values, 1, 0},
+		{levelNone, sign("mallory", "guess", values), 1, 0},
+		{levelSign, values, 0, 1},
+		{levelSign, sign("alice", "secret", values), 1, 0},
+		{levelSign, concat(values, sign("alice", "secret", values)), 1, 1},
+		{levelSign, encrypt("alice", "secret", values), 1, 0},
+		{levelEncrypt, sign("alice", "secret", values), 0, 1},
+		{levelEncrypt, encrypt("alice", "secret", sign("alice", "secret", values)), 1, 0},
+	} {
+		p, err := testDecoder(t, tc.security).decode(tc.packet)
+		require.NoError(t, err)
+		assert.Len(t, p.dps, tc.dps)
+		assert.Equal(t, tc.dropped, p.dropped)
+	}
+}
+
+func TestInvalidPackets(t *testing.T) {
+	values := concat(strPart(partType, "cpu"), valuesPart([]byte{dsGauge}, 1))
+	for _, bad := range [][]byte{
+		{0, 0, 0},
+		{0, 0, 0, 2},
+		{0, 0, 0, 9},
+		part(partHost, []byte("no null")),
+		part(partTime, []byte{1}),
+		part(partValues, []byte{0}),
+		part(partValues, []byte{0, 2, 1}),
+		valuesPart([]byte{9}, 1),
+		strPart(partMessage, "no severity"),
+		part(partMessage, nil),
+		part(partSignature, []byte("short")),
+		sign("alice", "wrong", values),
+		part(partEncryption, []byte{0}),
+		part(partEncryption, []byte{0, 5, 'a'}),
+		encrypt("mallory", "guess", values),
+		encrypt("alice", "wrong", values),
+	} {
+		_, err := testDecoder(t, levelNone).decode(bad)
+		assert.Error(t, err, "%v", bad)
+	}
+	_, err := testDecoder(t, levelSign).decode(sign("mallory", "guess", values))
+	assert.Equal(t, errUnknownUser, err)
+
+	// parts before the error are kept and unknown parts are skipped
+	p, err := testDecoder(t, levelNone).decode(concat(strPart(0x7777, "x"), values, []byte{1}))
+	assert.Error(t, err)
+	assert.Len(t, p.dps, 1)
+}
+
+func TestParseFiles(t *testing.T) {
+	users, err := parseAuthFile([]byte("# users\nalice: secret\n\n bob :pass:word \n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"alice": "secret", "bob": "pass:word"}, users)
+	_, err = parseAuthFile([]byte("alice secret"))
+	assert.Error(t, err)
+
+	for _, bad := range []string{"cpu\n", "cpu value:GAUGE\n", "cpu :GAUGE:0:U\n"} {
+		_, err = parseTypesDB([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func testConfig(values map[string]string) *Config {
+	mem := distconf.Mem()
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	return conf
+}
+
+func writeFile(t *testing.T, dir string, name string, contents string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestSpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collectdnet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	typesPath := writeFile(t, dir, "types.db", testTypesDB)
+
+	specs, err := testConfig(nil).Specs()
+	assert.NoError(t, err)
+	assert.Nil(t, specs)
+
+	specs, err = testConfig(map[string]string{
+		"COLLECTD_NETWORK_LISTENERS": `[{"name":"a","address":":25826","token":"T"},{"name":"b","address":":25827","token":"U","security_level":"encrypt","auth_file":"auth"}]`,
+		"COLLECTD_TYPES_DB":          typesPath,
+	}).Specs()
+	require.NoError(t, err)
+	require.Len(t, specs, 2)
+	assert.Equal(t, levelNone, specs[0].security)
+	assert.Equal(t, []string{"rx", "tx"}, specs[0].types["if_octets"])
+	assert.Equal(t, levelEncrypt, specs[1].security)
+
+	for _, bad := range []map[string]string{
+		{"COLLECTD_NETWORK_LISTENERS": `{`},
+		{"COLLECTD_NETWORK_LISTENERS": `[{"name":"a","address":":25826"}]`},
+		{"COLLECTD_NETWORK_LISTENERS": `[{"name":"a","address":":25826","token":"T"},{"name":"a","address":":25827","token":"T"}]`},
+		{"COLLECTD_NETWORK_LISTENERS": `[{"name":"a","address":":25826","token":"T","security_level":"paranoid"}]`},
+		{"COLLECTD_NETWORK_LISTENERS": `[{"name":"a","address":":25826","token":"T","security_level":"sign"}]`},
+		{"COLLECTD_NETWORK_LISTENERS": `[{"name":"a","address":":25826","token":"T"}]`, "COLLECTD_TYPES_DB": filepath.Join(dir, "missing")},
+		{"COLLECTD_NETWORK_LISTENERS": `[{"name":"a","address":":25826","token":"T"}]`, "COLLECTD_TYPES_DB": writeFile(t, dir, "bad.db", "cpu\n")},
+	} {
+		_, err = testConfig(bad).Specs()
+		assert.Error(t, err, bad["COLLECTD_NETWORK_LISTENERS"])
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		require.True(t, time.Now().Before(deadline), "timed out")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collectdnet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	authPath := writeFile(t, dir, "auth", "alice: secret\n")
+
+	s := &sink{}
+	conf := testConfig(nil)
+	clock := timekeepertest.NewStubClock(time.Now())
+	l, err := New(&Spec{Name: "signed", Address: "127.0.0.1:0", Token: "TOKEN", SecurityLevel: "sign", AuthFile: authPath}, conf, s, clock, log.Discard)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(testPacket())
+	require.NoError(t, err)
+	_, err = conn.Write(sign("alice", "secret", testPacket()))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{1})
+	require.NoError(t, err)
+	waitFor(t, func() bool { return atomic.LoadInt64(&l.stats.TotalPackets) == 3 && s.count() == 6 })
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&l.stats.TotalInvalidPackets))
+	assert.Equal(t, int64(5), atomic.LoadInt64(&l.stats.TotalUnauthorized))
+	s.mu.Lock()
+	assert.Equal(t, []string{"TOKEN"}, s.tokens)
+	s.mu.Unlock()
+	assert.Len(t, l.Datapoints(), 8)
+	require.NoError(t, l.Close())
+
+	_, err = New(&Spec{Name: "bad", Address: "127.0.0.1:0", Token: "TOKEN", SecurityLevel: "sign"}, conf, s, clock, log.Discard)
+	assert.Error(t, err)
+	_, err = New(&Spec{Name: "bad", Address: "127.0.0.1:0", Token: "TOKEN", AuthFile: filepath.Join(dir, "missing")}, conf, s, clock, log.Discard)
+	assert.Error(t, err)
+	_, err = New(&Spec{Name: "bad", Address: "127.0.0.1:-1", Token: "TOKEN", AuthFile: authPath}, conf, s, clock, log.Discard)
+	assert.Error(t, err)
+}
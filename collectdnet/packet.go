@@ -0,0 +1,260 @@
+package collectdnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/ingest-protocols/protocol/collectd"
+)
+
+// Part types of collectd's network protocol.  Every part is a two byte type and a two byte length, both big endian,
+// with the length including the four byte header.
+const (
+	partHost           = 0x0000
+	partTime           = 0x0001
+	partPlugin         = 0x0002
+	partPluginInstance = 0x0003
+	partType           = 0x0004
+	partTypeInstance   = 0x0005
+	partValues         = 0x0006
+	partInterval       = 0x0007
+	partTimeHR         = 0x0008
+	partIntervalHR     = 0x0009
+	partMessage        = 0x0100
+	partSeverity       = 0x0101
+	partSignature      = 0x0200
+	partEncryption     = 0x0210
+)
+
+// Data source types of the values in a values part
+const (
+	dsCounter = iota
+	dsGauge
+	dsDerive
+	dsAbsolute
+)
+
+// dsTypes are the names write_http gives the data source types
+var dsTypes = []string{dsCounter: "counter", dsGauge: "gauge", dsDerive: "derive", dsAbsolute: "absolute"}
+
+// severities are the names write_http gives notification severities
+var severities = map[uint64]string{1: "FAILURE", 2: "WARNING", 4: "OKAY"}
+
+// hrScale converts the high resolution times and intervals, which are in units of 2^-30 seconds
+const hrScale = 1 << 30
+
+// state is what the parts before a values or message part have set.  Parts only change the fields they carry, so
+// state is kept across the whole packet.
+type state struct {
+	host           string
+	plugin         string
+	pluginInstance string
+	typ            string
+	typeInstance   string
+	time           float64
+	interval       float64
+	severity       uint64
+}
+
+// format returns the JSON write_http would have sent for the current state, so the collectd package can turn it
+// into the same datapoints and events
+func (s *state) format() *collectd.JSONWriteFormat {
+	host, plugin, pluginInstance, typ, typeInstance := s.host, s.plugin, s.pluginInstance, s.typ, s.typeInstance
+	t, interval := s.time, s.interval
+	return &collectd.JSONWriteFormat{
+		Host:           &host,
+		Plugin:         &plugin,
+		PluginInstance: &pluginInstance,
+		TypeS:          &typ,
+		TypeInstance:   &typeInstance,
+		Time:           &t,
+		Interval:       &interval,
+	}
+}
+
+// packet is what was decoded from one datagram
+type packet struct {
+	dps     []*datapoint.Datapoint
+	events  []*event.Event
+	dropped int64
+}
+
+var errShortPart = errors.New("collectd part is truncated")
+
+// decoder turns datagrams into datapoints and events
+type decoder struct {
+	security    securityLevel
+	users       func(string) (string, bool)
+	types       typesDB
+	defaultDims map[string]string
+}
+
+func (d *decoder) decode(b []byte) (*packet, error) {
+	p := &packet{}
+	return p, d.parts(b, levelNone, &state{}, p)
+}
+
+// parts decodes b, which has been authenticated to level
+func (d *decoder) parts(b []byte, level securityLevel, s *state, p *packet) error {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return errShortPart
+		}
+		typ, size := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if size < 4 || size > len(b) {
+			return fmt.Errorf("collectd part 0x%04x has invalid length %d", typ, size)
+		}
+		body, rest := b[4:size], b[size:]
+		switch typ {
+		case partSignature:
+			// the signature covers the rest of the packet
+			return d.signed(body, rest, level, s, p)
+		case partEncryption:
+			if err := d.encrypted(body, s, p); err != nil {
+				return err
+			}
+		default:
+			if err := d.part(typ, body, level, s, p); err != nil {
+				return err
+			}
+		}
+		b = rest
+	}
+	return nil
+}
+
+func (d *decoder) part(typ uint16, body []byte, level securityLevel, s *state, p *packet) error {
+	switch typ {
+	case partValues, partMessage:
+		if level < d.security {
+			p.dropped++
+			return nil
+		}
+		if typ == partMessage {
+			return d.message(body, s, p)
+		}
+		return d.values(body, s, p)
+	case partTime, partTimeHR, partInterval, partIntervalHR, partSeverity:
+		return numberPart(typ, body, s)
+	default:
+		return stringPart(typ, body, s)
+	}
+}
+
+func numberPart(typ uint16, body []byte, s *state) error {
+	if len(body) != 8 {
+		return fmt.Errorf("collectd part 0x%04x has %d bytes instead of 8", typ, len(body))
+	}
+	v := binary.BigEndian.Uint64(body)
+	switch typ {
+	case partTime:
+		s.time = float64(v)
+	case partTimeHR:
+		s.time = float64(v) / hrScale
+	case partInterval:
+		s.interval = float64(v)
+	case partIntervalHR:
+		s.interval = float64(v) / hrScale
+	default:
+		s.severity = v
+	}
+	return nil
+}
+
+// stringPart sets the field of a null terminated string part.  Unknown parts are skipped, as collectd does.
+func stringPart(typ uint16, body []byte, s *state) error {
+	var field *string
+	switch typ {
+	case partHost:
+		field = &s.host
+	case partPlugin:
+		field = &s.plugin
+	case partPluginInstance:
+		field = &s.pluginInstance
+	case partType:
+		field = &s.typ
+	case partTypeInstance:
+		field = &s.typeInstance
+	default:
+		return nil
+	}
+	str, err := readString(typ, body)
+	*field = str
+	return err
+}
+
+func readString(typ uint16, body []byte) (string, error) {
+	if len(body) == 0 || body[len(body)-1] != 0 {
+		return "", fmt.Errorf("collectd part 0x%04x is not a null terminated string", typ)
+	}
+	return string(body[:len(body)-1]), nil
+}
+
+// values decodes a values part into datapoints, naming the values from types.db the way write_http does
+func (d *decoder) values(body []byte, s *state, p *packet) error {
+	if len(body) < 2 {
+		return errShortPart
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) != 2+9*n {
+		return fmt.Errorf("collectd values part has %d bytes for %d values", len(body), n)
+	}
+	f := s.format()
+	names := d.types.names(s.typ, n)
+	f.Dsnames = make([]*string, n)
+	f.Dstypes = make([]*string, n)
+	f.Values = make([]*float64, n)
+	for i := 0; i < n; i++ {
+		kind := body[2+i]
+		if int(kind) >= len(dsTypes) {
+			return fmt.Errorf("collectd value has unknown data source type %d", kind)
+		}
+		f.Dsnames[i] = &names[i]
+		f.Dstypes[i] = &dsTypes[kind]
+		f.Values[i] = value(kind, body[2+n+8*i:2+n+8*i+8])
+	}
+	for i := range f.Values {
+		// write_http sends null for gauges that are NaN, and the JSON path skips them
+		if f.Values[i] != nil {
+			p.dps = append(p.dps, collectd.NewDatapoint(f, uint(i), d.defaultDims))
+		}
+	}
+	return nil
+}
+
+// value decodes an eight byte value.  Gauges are little endian doubles and everything else is a big endian integer.
+func value(kind byte, b []byte) *float64 {
+	var v float64
+	switch kind {
+	case dsGauge:
+		if v = math.Float64frombits(binary.LittleEndian.Uint64(b)); math.IsNaN(v) {
+			return nil
+		}
+	case dsDerive:
+		v = float64(int64(binary.BigEndian.Uint64(b)))
+	default:
+		v = float64(binary.BigEndian.Uint64(b))
+	}
+	return &v
+}
+
+// message decodes a notification into an event
+func (d *decoder) message(body []byte, s *state, p *packet) error {
+	msg, err := readString(partMessage, body)
+	if err != nil {
+		return err
+	}
+	f := s.format()
+	f.Message = &msg
+	severity, ok := severities[s.severity]
+	if !ok {
+		return fmt.Errorf("collectd notification has unknown severity %d", s.severity)
+	}
+	f.Severity = &severity
+	p.events = append(p.events, collectd.NewEvent(f, d.defaultDims))
+	return nil
+}
@@ -0,0 +1,55 @@
+package collectdnet
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// typesDB maps collectd types to the names of their data sources, which the network protocol doesn't send but
+// write_http does
+type typesDB map[string][]string
+
+// parseTypesDB parses collectd's types.db, with lines like "if_octets  rx:DERIVE:0:U, tx:DERIVE:0:U"
+func parseTypesDB(b []byte) (typesDB, error) {
+	types := make(typesDB)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("collectd types.db line %d has no data sources", line)
+		}
+		names := make([]string, 0, len(fields)-1)
+		for _, ds := range strings.Split(strings.Join(fields[1:], ""), ",") {
+			parts := strings.Split(ds, ":")
+			if len(parts) != 4 || parts[0] == "" {
+				return nil, fmt.Errorf("collectd types.db line %d has invalid data source %q", line, ds)
+			}
+			names = append(names, parts[0])
+		}
+		types[fields[0]] = names
+	}
+	return types, scanner.Err()
+}
+
+// names returns the data source names of n values of typ.  Types that aren't in types.db, or that have a different
+// number of values, get "value" for a single value, which is what most of collectd's types use, and their index
+// otherwise.
+func (t typesDB) names(typ string, n int) []string {
+	if names, ok := t[typ]; ok && len(names) == n {
+		return names
+	}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = strconv.Itoa(i)
+	}
+	if n == 1 {
+		names[0] = "value"
+	}
+	return names
+}
@@ -0,0 +1,250 @@
+package debugspans
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx/processdebug"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Config configures what happens to the spans of debug traces
+type Config struct {
+	Bypass       *distconf.Bool
+	File         *distconf.Str
+	FileMaxMB    *distconf.Int
+	Endpoint     *distconf.Str
+	Token        *distconf.Str
+	MirrorBuffer *distconf.Int
+}
+
+// Load the debug spans config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.Bypass = d.Bool("DEBUG_SPANS_BYPASS", true)
+	c.File = d.Str("DEBUG_SPANS_FILE", "")
+	c.FileMaxMB = d.Int("DEBUG_SPANS_FILE_MAX_MB", 100)
+	c.Endpoint = d.Str("DEBUG_SPANS_ENDPOINT", "")
+	c.Token = d.Str("DEBUG_SPANS_TOKEN", "")
+	c.MirrorBuffer = d.Int("DEBUG_SPANS_MIRROR_BUFFER", 1000)
+}
+
+// Processor is a signalfx.NextSink that marks debug spans with processdebug, so a span with its Debug flag set has a
+// sampling.priority of 1 and the other way around, and treats every span of a trace that has a debug span in the
+// same batch as a debug span.  Debug spans are sent to the bypass sink, skipping the rest of the chain and whatever
+// filtering or rate limiting it does, and are mirrored to a file, a secondary endpoint, or both.  Limits checked before
+// then, such as on the size of the request they came in, still apply since whether it has debug spans isn't known yet.
+type Processor struct {
+	conf    *Config
+	bypass  signalfx.Sink
+	process *processdebug.ProcessDebug
+	logger  log.Logger
+
+	file     io.WriteCloser
+	endpoint *sfxclient.HTTPSink
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan []*trace.Span
+	done   chan struct{}
+
+	stats struct {
+		TotalDebugSpans     int64
+		TotalMirrored       int64
+		TotalMirrorDropped  int64
+		TotalMirrorErrors   int64
+		TotalBypassedSpans  int64
+		TotalBypassedErrors int64
+	}
+}
+
+var _ signalfx.NextSink = &Processor{}
+
+// New returns a Processor for conf that sends debug spans to bypass, mirroring them if conf has somewhere to
+func New(conf *Config, bypass signalfx.Sink, logger log.Logger) *Processor {
+	p := &Processor{
+		conf:    conf,
+		bypass:  bypass,
+		process: processdebug.New(discard{}),
+		logger:  logger,
+	}
+	if path := conf.File.Get(); path != "" {
+		p.file = &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    int(conf.FileMaxMB.Get()),
+			MaxBackups: 3,
+		}
+	}
+	if endpoint := conf.Endpoint.Get(); endpoint != "" {
+		p.endpoint = sfxclient.NewHTTPSink()
+		p.endpoint.TraceEndpoint = endpoint
+		p.endpoint.AuthToken = conf.Token.Get()
+	}
+	if p.file != nil || p.endpoint != nil {
+		p.queue = make(chan []*trace.Span, conf.MirrorBuffer.Get())
+		p.done = make(chan struct{})
+		go p.drain()
+	}
+	return p
+}
+
+// discard is the sink after the processdebug, which only marks the spans given to it
+type discard struct{}
+
+func (discard) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return nil }
+func (discard) AddEvents(context.Context, []*event.Event) error             { return nil }
+func (discard) AddSpans(context.Context, []*trace.Span) error               { return nil }
+
+func isDebug(s *trace.Span) bool {
+	return s.Debug != nil && *s.Debug
+}
+
+// split returns the spans of debug traces and the rest
+func split(spans []*trace.Span) ([]*trace.Span, []*trace.Span) {
+	traces := make(map[string]bool)
+	for _, s := range spans {
+		if isDebug(s) {
+			traces[s.TraceID] = true
+		}
+	}
+	if len(traces) == 0 {
+		return nil, spans
+	}
+	var debug, rest []*trace.Span
+	for _, s := range spans {
+		if traces[s.TraceID] {
+			debug = append(debug, s)
+		} else {
+			rest = append(rest, s)
+		}
+	}
+	return debug, rest
+}
+
+// AddDatapoints forwards the datapoints
+func (p *Processor) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	return next.AddDatapoints(ctx, points)
+}
+
+// AddEvents forwards the events
+func (p *Processor) AddEvents(ctx context.Context, events []*event.Event, next signalfx.Sink) error {
+	return next.AddEvents(ctx, events)
+}
+
+// AddSpans forwards the spans that aren't part of debug traces and then sends the rest to the bypass sink.  The debug
+// spans are only sent, and mirrored, once the others have been accepted, so they aren't sent twice when a request that
+// was refused is retried.
+func (p *Processor) AddSpans(ctx context.Context, spans []*trace.Span, next signalfx.Sink) error {
+	_ = p.process.AddSpans(ctx, spans)
+	debug, rest := split(spans)
+	if len(debug) == 0 {
+		return next.AddSpans(ctx, spans)
+	}
+	atomic.AddInt64(&p.stats.TotalDebugSpans, int64(len(debug)))
+	bypass := p.conf.Bypass.Get()
+	if !bypass {
+		rest = spans
+	}
+	if len(rest) > 0 {
+		if err := next.AddSpans(ctx, rest); err != nil {
+			return err
+		}
+	}
+	if bypass {
+		atomic.AddInt64(&p.stats.TotalBypassedSpans, int64(len(debug)))
+		if err := p.bypass.AddSpans(ctx, debug); err != nil {
+			atomic.AddInt64(&p.stats.TotalBypassedErrors, 1)
+			if len(rest) == 0 {
+				return err
+			}
+			// the rest were accepted and failing the request would have them sent again, so the debug spans are
+			// only mirrored
+			p.logger.Log(log.Err, err, "unable to send debug spans around the chain")
+		}
+	}
+	p.mirror(debug)
+	return nil
+}
+
+// mirror queues the spans to be mirrored, dropping them if the queue is full so the request isn't held up
+func (p *Processor) mirror(spans []*trace.Span) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.queue == nil || p.closed {
+		return
+	}
+	select {
+	case p.queue <- spans:
+	default:
+		atomic.AddInt64(&p.stats.TotalMirrorDropped, int64(len(spans)))
+	}
+}
+
+func (p *Processor) drain() {
+	defer close(p.done)
+	for spans := range p.queue {
+		if err := p.write(spans); err != nil {
+			atomic.AddInt64(&p.stats.TotalMirrorErrors, 1)
+			p.logger.Log(log.Err, err, "unable to mirror debug spans")
+			continue
+		}
+		atomic.AddInt64(&p.stats.TotalMirrored, int64(len(spans)))
+	}
+}
+
+// write writes the spans to the file, one json span per line, and sends them to the endpoint
+func (p *Processor) write(spans []*trace.Span) error {
+	if p.file != nil {
+		for _, s := range spans {
+			b, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			if _, err := p.file.Write(append(b, '\n')); err != nil {
+				return err
+			}
+		}
+	}
+	if p.endpoint != nil {
+		return p.endpoint.AddSpans(context.Background(), spans)
+	}
+	return nil
+}
+
+// Datapoints returns how many debug spans there were and how many were sent around the chain and mirrored
+func (p *Processor) Datapoints() []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{
+		sfxclient.CumulativeP("debugspans.spans", nil, &p.stats.TotalDebugSpans),
+		sfxclient.CumulativeP("debugspans.bypassed", nil, &p.stats.TotalBypassedSpans),
+		sfxclient.CumulativeP("debugspans.bypass_errors", nil, &p.stats.TotalBypassedErrors),
+		sfxclient.CumulativeP("debugspans.mirrored", nil, &p.stats.TotalMirrored),
+		sfxclient.CumulativeP("debugspans.mirror_dropped", nil, &p.stats.TotalMirrorDropped),
+		sfxclient.CumulativeP("debugspans.mirror_errors", nil, &p.stats.TotalMirrorErrors),
+	}
+}
+
+// Close mirrors whatever is queued and closes the file
+func (p *Processor) Close() error {
+	p.mu.Lock()
+	if p.queue == nil || p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+	<-p.done
+	if p.file != nil {
+		return p.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package debugspans
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder keeps the ids of the spans that reach it, and fails them if err is set
+type recorder struct {
+	ids []string
+	err error
+}
+
+func (r *recorder) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return nil }
+func (r *recorder) AddEvents(context.Context, []*event.Event) error             { return nil }
+
+func (r *recorder) AddSpans(ctx context.Context, spans []*trace.Span) error {
+	for _, s := range spans {
+		r.ids = append(r.ids, s.ID)
+	}
+	return r.err
+}
+
+func testProcessor(t *testing.T, values map[string]string) (*Processor, *recorder, *recorder) {
+	mem := distconf.Mem()
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	bypass := &recorder{}
+	return New(conf, bypass, log.Discard), bypass, &recorder{}
+}
+
+func span(traceID string, id string) *trace.Span {
+	return &trace.Span{TraceID: traceID, ID: id, Name: pointer.String("get")}
+}
+
+func debug(s *trace.Span) *trace.Span {
+	s.Debug = pointer.Bool(true)
+	return s
+}
+
+func sampled(s *trace.Span) *trace.Span {
+	s.Tags = map[string]string{"sampling.priority": "1"}
+	return s
+}
+
+func counter(p *Processor, metric string) int64 {
+	for _, dp := range p.Datapoints() {
+		if dp.Metric == metric {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return -1
+}
+
+func TestBypass(t *testing.T) {
+	p, bypass, next := testProcessor(t, nil)
+	defer func() { assert.NoError(t, p.Close()) }()
+	spans := []*trace.Span{debug(span("t1", "a")), span("t1", "b"), sampled(span("t2", "c")), span("t3", "d")}
+	require.NoError(t, signalfx.FromChain(next, signalfx.NextWrap(p)).AddSpans(context.Background(), spans))
+	assert.Equal(t, []string{"a", "b", "c"}, bypass.ids, "every span of a debug trace goes around the chain")
+	assert.Equal(t, []string{"d"}, next.ids)
+	assert.Equal(t, "1", spans[0].Tags["sampling.priority"])
+	assert.True(t, *spans[2].Debug)
+	assert.Nil(t, spans[1].Debug, "only the spans that were flagged are marked")
+	assert.Equal(t, int64(3), counter(p, "debugspans.spans"))
+	assert.Equal(t, int64(3), counter(p, "debugspans.bypassed"))
+
+	sink := signalfx.FromChain(next, signalfx.NextWrap(p))
+	next.err = errors.New("throttled")
+	assert.Equal(t, next.err, sink.AddSpans(context.Background(), []*trace.Span{debug(span("t4", "e")), span("t5", "f")}))
+	assert.Equal(t, []string{"a", "b", "c"}, bypass.ids, "debug spans aren't sent unless the rest are accepted, so a retried request doesn't send them twice")
+	next.err = nil
+	bypass.err = errors.New("full")
+	assert.Equal(t, bypass.err, sink.AddSpans(context.Background(), []*trace.Span{debug(span("t6", "g"))}))
+	assert.Equal(t, int64(1), counter(p, "debugspans.bypass_errors"))
+	assert.NoError(t, sink.AddSpans(context.Background(), []*trace.Span{debug(span("t7", "h")), span("t8", "i")}), "once the rest are accepted the request is")
+	assert.Equal(t, []string{"d", "f", "i"}, next.ids)
+	assert.Equal(t, int64(2), counter(p, "debugspans.bypass_errors"))
+}
+
+func TestNoBypass(t *testing.T) {
+	p, bypass, next := testProcessor(t, map[string]string{"DEBUG_SPANS_BYPASS": "false"})
+	sink := signalfx.FromChain(next, signalfx.NextWrap(p))
+	require.NoError(t, sink.AddSpans(context.Background(), []*trace.Span{debug(span("t1", "a")), span("t2", "b")}))
+	assert.Nil(t, bypass.ids)
+	assert.Equal(t, []string{"a", "b"}, next.ids)
+	assert.Equal(t, int64(1), counter(p, "debugspans.spans"))
+	assert.NoError(t, sink.AddDatapoints(context.Background(), nil))
+	assert.NoError(t, sink.AddEvents(context.Background(), nil))
+	assert.NoError(t, p.Close())
+}
+
+func TestMirror(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		tokens = append(tokens, req.Header.Get("X-Sf-Token"))
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		_, _ = rw.Write([]byte(`"OK"`))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "debugspans")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "debug.json")
+
+	p, _, next := testProcessor(t, map[string]string{
+		"DEBUG_SPANS_FILE":     path,
+		"DEBUG_SPANS_ENDPOINT": server.URL + "/v1/trace",
+		"DEBUG_SPANS_TOKEN":    "troubleshooting",
+	})
+	require.NoError(t, signalfx.FromChain(next, signalfx.NextWrap(p)).AddSpans(context.Background(), []*trace.Span{debug(span("t1", "a")), span("t1", "b"), span("t2", "c")}))
+	require.NoError(t, p.Close())
+	assert.NoError(t, p.Close())
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 2)
+	var mirrored trace.Span
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &mirrored))
+	assert.Equal(t, "b", mirrored.ID)
+
+	require.Len(t, bodies, 1)
+	assert.Equal(t, "troubleshooting", tokens[0])
+	assert.Contains(t, bodies[0], `"id":"a"`)
+	assert.NotContains(t, bodies[0], `"id":"c"`)
+	assert.Equal(t, int64(2), counter(p, "debugspans.mirrored"))
+	assert.Equal(t, int64(0), counter(p, "debugspans.mirror_errors"))
+
+	require.NoError(t, signalfx.FromChain(next, signalfx.NextWrap(p)).AddSpans(context.Background(), []*trace.Span{debug(span("t3", "d"))}))
+	assert.Equal(t, int64(2), counter(p, "debugspans.mirrored"), "nothing is mirrored once closed")
+}
+
+func TestMirrorErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	p, _, next := testProcessor(t, map[string]string{"DEBUG_SPANS_ENDPOINT": server.URL})
+	require.NoError(t, signalfx.FromChain(next, signalfx.NextWrap(p)).AddSpans(context.Background(), []*trace.Span{debug(span("t1", "a"))}))
+	require.NoError(t, p.Close())
+	assert.Equal(t, int64(1), counter(p, "debugspans.mirror_errors"))
+	assert.Equal(t, int64(0), counter(p, "debugspans.mirrored"))
+}
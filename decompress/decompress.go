@@ -0,0 +1,334 @@
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/pops/sinkerr"
+)
+
+type encoding int
+
+const (
+	gzipEncoding encoding = iota
+	deflateEncoding
+	zstdEncoding
+	snappyEncoding
+	numEncodings
+)
+
+var encodingNames = [numEncodings]string{"gzip", "deflate", "zstd", "snappy"}
+
+// encodings are the Content-Encoding values that are decompressed, including the aliases clients send
+var encodings = map[string]encoding{
+	"gzip":            gzipEncoding,
+	"x-gzip":          gzipEncoding,
+	"deflate":         deflateEncoding,
+	"zstd":            zstdEncoding,
+	"snappy":          snappyEncoding,
+	"x-snappy-framed": snappyEncoding,
+}
+
+// snappyMagic starts every snappy framed stream, and tells it from a single snappy block
+const snappyMagic = "\xff\x06\x00\x00sNaPpY"
+
+// defaultZstdWindow caps the zstd window when there is no decompressed body limit.  It is the window size the zstd
+// format asks every decoder to support.
+const defaultZstdWindow = 8 * 1024 * 1024
+
+// pooledZstdReaders is how many idle zstd decoders are kept.  Each one runs a goroutine until it is closed, so they
+// can't be left for the garbage collector the way the other decompressors are.
+const pooledZstdReaders = 16
+
+// Negotiator decompresses request bodies according to their Content-Encoding before they reach the decoders, reusing
+// decompressors between requests
+type Negotiator struct {
+	gzipReaders   sync.Pool
+	flateReaders  sync.Pool
+	zlibReaders   sync.Pool
+	zstdReaders   chan *zstdReader
+	snappyReaders sync.Pool
+
+	stats struct {
+		TotalRequests          [numEncodings]int64
+		TotalCompressedBytes   [numEncodings]int64
+		TotalDecompressedBytes [numEncodings]int64
+		TotalErrors            [numEncodings]int64
+		TotalUnsupported       int64
+	}
+}
+
+// New returns a Negotiator
+func New() *Negotiator {
+	return &Negotiator{
+		zstdReaders: make(chan *zstdReader, pooledZstdReaders),
+	}
+}
+
+// countingReader adds the bytes read through it to total
+type countingReader struct {
+	io.Reader
+	total *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	atomic.AddInt64(c.total, int64(n))
+	return n, err
+}
+
+// body is a decompressed request body that closes the compressed body it reads from
+type body struct {
+	io.Reader
+	compressed io.Closer
+}
+
+func (b *body) Close() error {
+	return b.compressed.Close()
+}
+
+// errReader returns err from every read
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// Handler decompresses the bodies of requests to next.  Snappy blocks have to be decoded whole, so ones that would
+// decode to more than maxDecompressed bytes are refused before they are, and zstd frames are refused before their
+// window is allocated if it is larger than that.  Requests with an encoding that isn't supported are refused with a 415.
+func (n *Negotiator) Handler(next http.Handler, maxDecompressed func() int64) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		name := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if name == "" || name == "identity" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		enc, ok := encodings[name]
+		if !ok {
+			atomic.AddInt64(&n.stats.TotalUnsupported, 1)
+			rw.WriteHeader(http.StatusUnsupportedMediaType)
+			_, _ = fmt.Fprintf(rw, "unsupported content encoding %q", name)
+			return
+		}
+		atomic.AddInt64(&n.stats.TotalRequests[enc], 1)
+		decompressed, release, err := n.open(enc, name, &countingReader{Reader: r.Body, total: &n.stats.TotalCompressedBytes[enc]}, maxDecompressed)
+		if err != nil {
+			atomic.AddInt64(&n.stats.TotalErrors[enc], 1)
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(rw, "unable to decompress %s request body: %s", name, err)
+			return
+		}
+		defer release()
+		r.Body = &body{Reader: &countingReader{Reader: decompressed, total: &n.stats.TotalDecompressedBytes[enc]}, compressed: r.Body}
+		// the body the decoders see isn't compressed any more
+		r.Header.Del("Content-Encoding")
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// open returns a reader of src decompressed as enc and a function to call once it has been read
+func (n *Negotiator) open(enc encoding, name string, src io.Reader, maxDecompressed func() int64) (io.Reader, func(), error) {
+	switch enc {
+	case gzipEncoding:
+		return n.openGzip(src)
+	case deflateEncoding:
+		return n.openDeflate(src)
+	case zstdEncoding:
+		return n.openZstd(src, maxDecompressed())
+	default:
+		return n.openSnappy(src, name == "x-snappy-framed", maxDecompressed)
+	}
+}
+
+func (n *Negotiator) openGzip(src io.Reader) (io.Reader, func(), error) {
+	var zr *gzip.Reader
+	if pooled := n.gzipReaders.Get(); pooled != nil {
+		zr = pooled.(*gzip.Reader)
+		if err := zr.Reset(src); err != nil {
+			n.gzipReaders.Put(zr)
+			return nil, nil, err
+		}
+	} else {
+		var err error
+		if zr, err = gzip.NewReader(src); err != nil {
+			return nil, nil, err
+		}
+	}
+	return zr, func() {
+		_ = zr.Close()
+		n.gzipReaders.Put(zr)
+	}, nil
+}
+
+// isZlib returns true if header is a zlib header: deflate with a valid checksum.  HTTP's deflate is zlib wrapped, but
+// enough clients send raw deflate that both are accepted.
+func isZlib(header []byte) bool {
+	return len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+func (n *Negotiator) openDeflate(src io.Reader) (io.Reader, func(), error) {
+	br := bufio.NewReader(src)
+	header, _ := br.Peek(2)
+	if !isZlib(header) {
+		fr, ok := n.flateReaders.Get().(io.ReadCloser)
+		if ok {
+			_ = fr.(flate.Resetter).Reset(br, nil)
+		} else {
+			fr = flate.NewReader(br)
+		}
+		return fr, func() { n.flateReaders.Put(fr) }, nil
+	}
+	zr, ok := n.zlibReaders.Get().(io.ReadCloser)
+	if ok {
+		if err := zr.(zlib.Resetter).Reset(br, nil); err != nil {
+			n.zlibReaders.Put(zr)
+			return nil, nil, err
+		}
+	} else {
+		var err error
+		if zr, err = zlib.NewReader(br); err != nil {
+			return nil, nil, err
+		}
+	}
+	return zr, func() { n.zlibReaders.Put(zr) }, nil
+}
+
+// zstdReader is a zstd decoder and the window it was created to allow, since that can't be changed afterwards
+type zstdReader struct {
+	*zstd.Decoder
+	maxWindow uint64
+}
+
+// Read reports a frame whose window is over the limit as too large rather than as a bad body
+func (z *zstdReader) Read(p []byte) (int, error) {
+	n, err := z.Decoder.Read(p)
+	if errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		err = &sinkerr.Error{Kind: sinkerr.TooLarge, Err: fmt.Errorf("zstd frame needs a window over the limit of %d bytes", z.maxWindow)}
+	}
+	return n, err
+}
+
+// zstdWindow returns the largest zstd window allowed for a decompressed body limit of max bytes
+func zstdWindow(max int64) uint64 {
+	switch {
+	case max <= 0:
+		return defaultZstdWindow
+	case max < zstd.MinWindowSize:
+		// every frame is allowed the smallest window, and its body is still held to the limit afterwards
+		return zstd.MinWindowSize
+	default:
+		return uint64(max)
+	}
+}
+
+func (n *Negotiator) openZstd(src io.Reader, maxDecompressed int64) (io.Reader, func(), error) {
+	maxWindow := zstdWindow(maxDecompressed)
+	var zr *zstdReader
+	select {
+	case zr = <-n.zstdReaders:
+		if zr.maxWindow != maxWindow {
+			// the limit changed since this decoder was made
+			zr.Close()
+			zr = nil
+		}
+	default:
+	}
+	if zr == nil {
+		// WithDecoderMaxMemory also caps the window the decoder will allocate for a frame
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxWindow))
+		if err != nil {
+			return nil, nil, err
+		}
+		zr = &zstdReader{Decoder: dec, maxWindow: maxWindow}
+	}
+	if err := zr.Reset(src); err != nil {
+		n.putZstd(zr)
+		return nil, nil, err
+	}
+	return zr, func() {
+		// drop the reference to the body before the decoder goes back in the pool
+		if err := zr.Reset(nil); err != nil {
+			zr.Close()
+			return
+		}
+		n.putZstd(zr)
+	}, nil
+}
+
+// putZstd returns zr to the pool, closing it if the pool is full
+func (n *Negotiator) putZstd(zr *zstdReader) {
+	select {
+	case n.zstdReaders <- zr:
+	default:
+		zr.Close()
+	}
+}
+
+// openSnappy reads src as a snappy framed stream if framed is set or it starts like one, and as a single snappy block
+// otherwise
+func (n *Negotiator) openSnappy(src io.Reader, framed bool, maxDecompressed func() int64) (io.Reader, func(), error) {
+	br := bufio.NewReader(src)
+	if magic, _ := br.Peek(len(snappyMagic)); framed || string(magic) == snappyMagic {
+		sr, ok := n.snappyReaders.Get().(*snappy.Reader)
+		if ok {
+			sr.Reset(br)
+		} else {
+			sr = snappy.NewReader(br)
+		}
+		return sr, func() {
+			sr.Reset(nil)
+			n.snappyReaders.Put(sr)
+		}, nil
+	}
+	block, err := ioutil.ReadAll(br)
+	if err != nil {
+		// the decoder gets the error, which may be the body being too large
+		return errReader{err}, func() {}, nil
+	}
+	size, err := snappy.DecodedLen(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	if max := maxDecompressed(); max > 0 && int64(size) > max {
+		return errReader{&sinkerr.Error{Kind: sinkerr.TooLarge, Err: fmt.Errorf("snappy block decodes to %d bytes, over the limit of %d", size, max)}}, func() {}, nil
+	}
+	decoded, err := snappy.Decode(nil, block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.NewReader(decoded), func() {}, nil
+}
+
+// Datapoints returns how many requests were received with each encoding, and how many bytes they were before and
+// after they were decompressed
+func (n *Negotiator) Datapoints() []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0, 4*numEncodings+1)
+	for enc, name := range encodingNames {
+		dims := map[string]string{"encoding": name}
+		dps = append(dps,
+			sfxclient.CumulativeP("decompress.requests", dims, &n.stats.TotalRequests[enc]),
+			sfxclient.CumulativeP("decompress.compressed_bytes", dims, &n.stats.TotalCompressedBytes[enc]),
+			sfxclient.CumulativeP("decompress.decompressed_bytes", dims, &n.stats.TotalDecompressedBytes[enc]),
+			sfxclient.CumulativeP("decompress.errors", dims, &n.stats.TotalErrors[enc]),
+		)
+	}
+	return append(dps, sfxclient.CumulativeP("decompress.unsupported", nil, &n.stats.TotalUnsupported))
+}
@@ -0,0 +1,192 @@
+package decompress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/pops/sinkerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var payload = []byte(strings.Repeat(`{"metric":"requests","value":1}`, 100))
+
+func compress(t *testing.T, newWriter func(io.Writer) io.WriteCloser) []byte {
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	_, err := w.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// echo responds with the body it read, or the error reading it, and the Content-Encoding it saw
+func echo() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		rw.Header().Set("X-Seen-Encoding", r.Header.Get("Content-Encoding"))
+		if err != nil {
+			if e, ok := sinkerr.As(err); ok {
+				sinkerr.Write(rw, e, 0)
+				return
+			}
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte(err.Error()))
+			return
+		}
+		_, _ = rw.Write(b)
+	})
+}
+
+func post(handler http.Handler, encoding string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v2/datapoint", bytes.NewReader(body))
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	return rw
+}
+
+func noLimit() int64 { return 0 }
+
+func counter(n *Negotiator, metric string, encoding string) int64 {
+	for _, dp := range n.Datapoints() {
+		if dp.Metric == metric && dp.Dimensions["encoding"] == encoding {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return -1
+}
+
+func TestEncodings(t *testing.T) {
+	zstdEncoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	bodies := map[string][]byte{
+		"gzip": compress(t, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }),
+		"zlib": compress(t, func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }),
+		"flate": compress(t, func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.BestSpeed)
+			return fw
+		}),
+		"zstd":   zstdEncoder.EncodeAll(payload, nil),
+		"framed": compress(t, func(w io.Writer) io.WriteCloser { return snappy.NewBufferedWriter(w) }),
+		"block":  snappy.Encode(nil, payload),
+	}
+
+	n := New()
+	handler := n.Handler(echo(), noLimit)
+	for _, tc := range []struct {
+		encoding string
+		body     string
+	}{
+		{"gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"deflate", "zlib"},
+		{"deflate", "flate"},
+		{"zstd", "zstd"},
+		{"snappy", "framed"},
+		{"x-snappy-framed", "framed"},
+		{"snappy", "block"},
+	} {
+		// twice, so the second request gets a pooled decompressor
+		for i := 0; i < 2; i++ {
+			rw := post(handler, tc.encoding, bodies[tc.body])
+			assert.Equal(t, http.StatusOK, rw.Code, "%s %s", tc.encoding, tc.body)
+			assert.Equal(t, string(payload), rw.Body.String(), "%s %s", tc.encoding, tc.body)
+			assert.Equal(t, "", rw.Header().Get("X-Seen-Encoding"), "%s %s", tc.encoding, tc.body)
+		}
+	}
+
+	assert.Equal(t, int64(6), counter(n, "decompress.requests", "gzip"))
+	assert.Equal(t, int64(4), counter(n, "decompress.requests", "deflate"))
+	assert.Equal(t, int64(2), counter(n, "decompress.requests", "zstd"))
+	assert.Equal(t, int64(6), counter(n, "decompress.requests", "snappy"))
+	assert.Equal(t, int64(2*len(bodies["zstd"])), counter(n, "decompress.compressed_bytes", "zstd"))
+	assert.Equal(t, int64(2*len(payload)), counter(n, "decompress.decompressed_bytes", "zstd"))
+	assert.Equal(t, int64(0), counter(n, "decompress.errors", "gzip"))
+}
+
+func TestIdentity(t *testing.T) {
+	n := New()
+	handler := n.Handler(echo(), noLimit)
+	for _, encoding := range []string{"", "identity"} {
+		rw := post(handler, encoding, payload)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, string(payload), rw.Body.String())
+		assert.Equal(t, encoding, rw.Header().Get("X-Seen-Encoding"))
+	}
+	assert.Equal(t, int64(0), counter(n, "decompress.requests", "snappy"))
+}
+
+func TestBadBodies(t *testing.T) {
+	n := New()
+	handler := n.Handler(echo(), func() int64 { return int64(len(payload)) - 1 })
+
+	rw := post(handler, "br", payload)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rw.Code)
+	assert.Equal(t, `unsupported content encoding "br"`, rw.Body.String())
+
+	for _, encoding := range []string{"gzip", "deflate", "zstd"} {
+		rw = post(handler, encoding, []byte("not compressed at all"))
+		assert.Equal(t, http.StatusBadRequest, rw.Code, encoding)
+	}
+	assert.Equal(t, int64(1), counter(n, "decompress.errors", "gzip"))
+
+	rw = post(handler, "snappy", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, int64(1), counter(n, "decompress.errors", "snappy"))
+
+	// a snappy block is refused before it is decoded if it would decode to more than the limit
+	rw = post(handler, "snappy", snappy.Encode(nil, payload))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+
+	assert.Equal(t, int64(1), n.stats.TotalUnsupported)
+}
+
+func TestZstdWindow(t *testing.T) {
+	// a frame of a few bytes that declares a 512MB window, followed by a single raw block
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 19 << 3, 0x09, 0x00, 0x00, 'x'}
+	zstdEncoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name  string
+		limit func() int64
+	}{
+		{"no limit", noLimit},
+		{"limit", func() int64 { return int64(len(payload)) }},
+	} {
+		n := New()
+		handler := n.Handler(echo(), tc.limit)
+		rw := post(handler, "zstd", frame)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code, tc.name)
+
+		// a frame within the limit still decodes, with a decoder from the pool
+		rw = post(handler, "zstd", zstdEncoder.EncodeAll(payload, nil))
+		assert.Equal(t, http.StatusOK, rw.Code, tc.name)
+		assert.Equal(t, string(payload), rw.Body.String(), tc.name)
+	}
+
+	// a decoder made for another limit isn't reused
+	n := New()
+	limit := int64(len(payload))
+	handler := n.Handler(echo(), func() int64 { return limit })
+	assert.Equal(t, http.StatusOK, post(handler, "zstd", zstdEncoder.EncodeAll(payload, nil)).Code)
+	limit = 0
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(handler, "zstd", frame).Code)
+	zr := <-n.zstdReaders
+	assert.Equal(t, uint64(defaultZstdWindow), zr.maxWindow)
+}
@@ -0,0 +1,441 @@
+package egress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/signalfx/com_signalfx_metrics_protobuf"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	traceformat "github.com/signalfx/golib/v3/trace/format"
+	"github.com/signalfx/golib/v3/trace/translator"
+	signalfxformat "github.com/signalfx/ingest-protocols/protocol/signalfx/format"
+	"github.com/signalfx/pops/internal/httpbody"
+)
+
+type signal int
+
+const (
+	datapoints signal = iota
+	events
+	spans
+	numSignals
+)
+
+var signalNames = [numSignals]string{"datapoint", "event", "span"}
+
+const (
+	// FormatProtobuf is the signalfx protobuf format for datapoints and events
+	FormatProtobuf = "protobuf"
+	// FormatJSON is the signalfx JSON format for datapoints and events, and the zipkin JSON format for spans
+	FormatJSON = "json"
+	// FormatSAPM is the SAPM protobuf format for spans
+	FormatSAPM = "sapm"
+
+	// CompressionGzip compresses with gzip at the configured level
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses with zstd
+	CompressionZstd = "zstd"
+	// CompressionNone sends bodies uncompressed
+	CompressionNone = "none"
+)
+
+// formats are the formats each signal can be sent in, the first being the one the data sink encodes it in
+var formats = [numSignals][]string{
+	{FormatProtobuf, FormatJSON},
+	{FormatProtobuf, FormatJSON},
+	{FormatJSON, FormatSAPM},
+}
+
+var contentTypes = map[string]string{
+	FormatProtobuf: "application/x-protobuf",
+	FormatJSON:     "application/json",
+	FormatSAPM:     "application/x-protobuf",
+}
+
+// Config configures the format and compression each signal type is sent upstream in
+type Config struct {
+	Formats      [numSignals]*distconf.Str
+	Compressions [numSignals]*distconf.Str
+	GzipLevels   [numSignals]*distconf.Int
+	// MinCompressBytes is the smallest body that is compressed, for when compressing what fits in a single ethernet
+	// frame isn't worth it
+	MinCompressBytes *distconf.Int
+}
+
+// Load the egress config values from distconf.  Spans sent as SAPM need DATA_SINK_TRACE_ENDPOINT pointing at a SAPM
+// endpoint.
+func (c *Config) Load(d *distconf.Distconf) {
+	c.Formats[datapoints] = d.Str("DATA_SINK_DP_FORMAT", FormatProtobuf)
+	c.Formats[events] = d.Str("DATA_SINK_EVENT_FORMAT", FormatProtobuf)
+	c.Formats[spans] = d.Str("DATA_SINK_TRACE_FORMAT", FormatJSON)
+	c.Compressions[datapoints] = d.Str("DATA_SINK_DP_COMPRESSION", CompressionGzip)
+	c.Compressions[events] = d.Str("DATA_SINK_EVENT_COMPRESSION", CompressionGzip)
+	c.Compressions[spans] = d.Str("DATA_SINK_TRACE_COMPRESSION", CompressionGzip)
+	c.GzipLevels[datapoints] = d.Int("DATA_SINK_DP_GZIP_LEVEL", gzip.DefaultCompression)
+	c.GzipLevels[events] = d.Int("DATA_SINK_EVENT_GZIP_LEVEL", gzip.DefaultCompression)
+	c.GzipLevels[spans] = d.Int("DATA_SINK_TRACE_GZIP_LEVEL", gzip.DefaultCompression)
+	c.MinCompressBytes = d.Int("DATA_SINK_MIN_COMPRESS_BYTES", 0)
+}
+
+// encoding is how a signal is to be sent, as currently configured
+type encoding struct {
+	format      string
+	compression string
+	gzipLevel   int
+}
+
+func (c *Config) encoding(s signal) (encoding, error) {
+	e := encoding{
+		format:      strings.ToLower(c.Formats[s].Get()),
+		compression: strings.ToLower(c.Compressions[s].Get()),
+		gzipLevel:   int(c.GzipLevels[s].Get()),
+	}
+	if !contains(formats[s], e.format) {
+		return e, fmt.Errorf("unsupported %s format %q", signalNames[s], e.format)
+	}
+	switch e.compression {
+	case CompressionGzip:
+		if e.gzipLevel < gzip.HuffmanOnly || e.gzipLevel > gzip.BestCompression {
+			return e, fmt.Errorf("invalid %s gzip level %d", signalNames[s], e.gzipLevel)
+		}
+	case CompressionZstd, CompressionNone:
+	default:
+		return e, fmt.Errorf("unsupported %s compression %q", signalNames[s], e.compression)
+	}
+	return e, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Encoder is an http.RoundTripper that re-encodes the requests the data sink sends upstream in the configured format
+// and compression for their signal type.  Requests it can't re-encode are sent as they are.
+type Encoder struct {
+	conf       *Config
+	next       http.RoundTripper
+	timeKeeper timekeeper.TimeKeeper
+	logger     log.Logger
+	endpoints  map[string]signal
+
+	gzipWriters [numSignals]sync.Pool
+	zstd        *zstd.Encoder
+
+	stats struct {
+		TotalRequests          [numSignals]int64
+		TotalUncompressedBytes [numSignals]int64
+		TotalCompressedBytes   [numSignals]int64
+		TotalEncodeNanos       [numSignals]int64
+		TotalErrors            [numSignals]int64
+	}
+}
+
+// New returns an Encoder for the requests to the data sink's endpoints that sends them on through next
+func New(conf *Config, datapointEndpoint string, eventEndpoint string, traceEndpoint string, next http.RoundTripper, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Encoder, error) {
+	for s := datapoints; s < numSignals; s++ {
+		if _, err := conf.encoding(s); err != nil {
+			return nil, err
+		}
+	}
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	e := &Encoder{conf: conf, next: next, timeKeeper: timeKeeper, logger: logger, endpoints: make(map[string]signal), zstd: zw}
+	for s, endpoint := range [numSignals]string{datapointEndpoint, eventEndpoint, traceEndpoint} {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s endpoint: %s", signalNames[s], err)
+		}
+		e.endpoints[u.String()] = signal(s)
+	}
+	return e, nil
+}
+
+// RoundTrip re-encodes requests to one of the data sink's endpoints and sends them on
+func (e *Encoder) RoundTrip(req *http.Request) (*http.Response, error) {
+	s, ok := e.endpoints[req.URL.String()]
+	if !ok || req.Body == nil {
+		return e.next.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// a RoundTripper mustn't change the request it was given
+	out := req.Clone(req.Context())
+	atomic.AddInt64(&e.stats.TotalRequests[s], 1)
+	start := e.timeKeeper.Now()
+	if err := e.encode(s, body, out); err != nil {
+		atomic.AddInt64(&e.stats.TotalErrors[s], 1)
+		e.logger.Log(log.Err, err, "unable to re-encode upstream request, sending it as it is")
+		out = req.Clone(req.Context())
+		httpbody.Set(out, body)
+	}
+	atomic.AddInt64(&e.stats.TotalEncodeNanos[s], int64(e.timeKeeper.Now().Sub(start)))
+	return e.next.RoundTrip(out)
+}
+
+// encode sets the body of out to body re-encoded for s, along with its Content-Type and Content-Encoding
+func (e *Encoder) encode(s signal, body []byte, out *http.Request) error {
+	header := out.Header
+	enc, err := e.conf.encoding(s)
+	if err != nil {
+		return err
+	}
+	if size, ok := unchanged(s, enc, header, body); ok {
+		atomic.AddInt64(&e.stats.TotalUncompressedBytes[s], size)
+		atomic.AddInt64(&e.stats.TotalCompressedBytes[s], int64(len(body)))
+		httpbody.Set(out, body)
+		return nil
+	}
+	if header.Get("Content-Encoding") == CompressionGzip {
+		if body, err = gunzip(body); err != nil {
+			return err
+		}
+	}
+	if body, err = reformat(s, formatOf(s, header.Get("Content-Type")), enc.format, body); err != nil {
+		return err
+	}
+	atomic.AddInt64(&e.stats.TotalUncompressedBytes[s], int64(len(body)))
+	header.Set("Content-Type", contentTypes[enc.format])
+	header.Del("Content-Encoding")
+	if int64(len(body)) >= e.conf.MinCompressBytes.Get() {
+		if body, err = e.compress(s, enc, body, header); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&e.stats.TotalCompressedBytes[s], int64(len(body)))
+	httpbody.Set(out, body)
+	return nil
+}
+
+// unchanged returns true, along with its uncompressed size, if the data sink already sent body in the format and
+// compression it is to be sent upstream in, so it can be sent as it is
+func unchanged(s signal, enc encoding, header http.Header, body []byte) (int64, bool) {
+	if formatOf(s, header.Get("Content-Type")) != enc.format {
+		return 0, false
+	}
+	switch header.Get("Content-Encoding") {
+	case "":
+		return int64(len(body)), enc.compression == CompressionNone
+	case CompressionGzip:
+		return gzipSize(body), enc.compression == CompressionGzip
+	}
+	return 0, false
+}
+
+// gzipSize returns the uncompressed size a gzip stream records at its end, which is modulo 2^32
+func gzipSize(body []byte) int64 {
+	if len(body) < 4 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint32(body[len(body)-4:]))
+}
+
+// formatOf returns the format a body the data sink sent for s is in
+func formatOf(s signal, contentType string) string {
+	switch {
+	case s == spans && contentType == contentTypes[FormatSAPM]:
+		return FormatSAPM
+	case strings.HasPrefix(contentType, contentTypes[FormatJSON]):
+		return FormatJSON
+	}
+	return formats[s][0]
+}
+
+func gunzip(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(zr)
+}
+
+func (e *Encoder) compress(s signal, enc encoding, body []byte, header http.Header) ([]byte, error) {
+	switch enc.compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw, ok := e.gzipWriters[s].Get().(*gzipWriter)
+		if !ok || zw.level != enc.gzipLevel {
+			w, err := gzip.NewWriterLevel(nil, enc.gzipLevel)
+			if err != nil {
+				return nil, err
+			}
+			zw = &gzipWriter{Writer: w, level: enc.gzipLevel}
+		}
+		zw.Reset(&buf)
+		defer e.gzipWriters[s].Put(zw)
+		if err := write(zw, body); err != nil {
+			return nil, err
+		}
+		header.Set("Content-Encoding", CompressionGzip)
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		header.Set("Content-Encoding", CompressionZstd)
+		return e.zstd.EncodeAll(body, nil), nil
+	}
+	return body, nil
+}
+
+// gzipWriter is a pooled gzip.Writer and the level it compresses at, which can't be changed by resetting it
+type gzipWriter struct {
+	*gzip.Writer
+	level int
+}
+
+func write(w io.WriteCloser, body []byte) error {
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+type conversion struct {
+	signal   signal
+	from, to string
+}
+
+// conversions are the format conversions there are.  The data sink only sends datapoints and events as protobuf and
+// spans as JSON, so only conversions from those are needed.
+var conversions = map[conversion]func([]byte) ([]byte, error){
+	{datapoints, FormatProtobuf, FormatJSON}: datapointsToJSON,
+	{events, FormatProtobuf, FormatJSON}:     eventsToJSON,
+	{spans, FormatJSON, FormatSAPM}:          spansToSAPM,
+}
+
+// reformat converts a body for s from one format to another
+func reformat(s signal, from string, to string, body []byte) ([]byte, error) {
+	if from == to {
+		return body, nil
+	}
+	convert, ok := conversions[conversion{s, from, to}]
+	if !ok {
+		return nil, fmt.Errorf("unable to convert %ss from %s to %s", signalNames[s], from, to)
+	}
+	return convert(body)
+}
+
+func datapointsToJSON(body []byte) ([]byte, error) {
+	var msg com_signalfx_metrics_protobuf.DataPointUploadMessage
+	if err := proto.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	out := make(signalfxformat.JSONDatapointV2)
+	for _, dp := range msg.GetDatapoints() {
+		metricType := strings.ToLower(dp.GetMetricType().String())
+		out[metricType] = append(out[metricType], &signalfxformat.BodySendFormatV2{
+			Metric:     dp.GetMetric(),
+			Timestamp:  dp.GetTimestamp(),
+			Value:      datumValue(dp.GetValue()),
+			Dimensions: dimensions(dp.GetDimensions()),
+		})
+	}
+	return json.Marshal(out)
+}
+
+func datumValue(d *com_signalfx_metrics_protobuf.Datum) interface{} {
+	switch {
+	case d.StrValue != nil:
+		return d.GetStrValue()
+	case d.DoubleValue != nil:
+		return d.GetDoubleValue()
+	}
+	return d.GetIntValue()
+}
+
+func dimensions(dims []*com_signalfx_metrics_protobuf.Dimension) map[string]string {
+	m := make(map[string]string, len(dims))
+	for _, d := range dims {
+		m[d.GetKey()] = d.GetValue()
+	}
+	return m
+}
+
+func eventsToJSON(body []byte) ([]byte, error) {
+	var msg com_signalfx_metrics_protobuf.EventUploadMessage
+	if err := proto.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	out := make(signalfxformat.JSONEventV2, 0, len(msg.GetEvents()))
+	for _, ev := range msg.GetEvents() {
+		properties := make(map[string]interface{}, len(ev.GetProperties()))
+		for _, p := range ev.GetProperties() {
+			properties[p.GetKey()] = propertyValue(p.GetValue())
+		}
+		out = append(out, &signalfxformat.EventSendFormatV2{
+			EventType:  ev.GetEventType(),
+			Category:   pointer.String(ev.GetCategory().String()),
+			Dimensions: dimensions(ev.GetDimensions()),
+			Properties: properties,
+			Timestamp:  pointer.Int64(ev.GetTimestamp()),
+		})
+	}
+	return json.Marshal(out)
+}
+
+func propertyValue(v *com_signalfx_metrics_protobuf.PropertyValue) interface{} {
+	switch {
+	case v.StrValue != nil:
+		return v.GetStrValue()
+	case v.DoubleValue != nil:
+		return v.GetDoubleValue()
+	case v.BoolValue != nil:
+		return v.GetBoolValue()
+	}
+	return v.GetIntValue()
+}
+
+func spansToSAPM(body []byte) ([]byte, error) {
+	var t traceformat.Trace
+	if err := json.Unmarshal(body, &t); err != nil {
+		return nil, err
+	}
+	return translator.SFXToSAPMPostRequest([]*trace.Span(t)).Marshal()
+}
+
+// Datapoints returns how many requests of each signal type were sent, how many bytes they were before and after they
+// were compressed and how long they took to encode
+func (e *Encoder) Datapoints() []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0, 5*numSignals)
+	for s, name := range signalNames {
+		dims := map[string]string{"type": name}
+		dps = append(dps,
+			sfxclient.CumulativeP("egress.requests", dims, &e.stats.TotalRequests[s]),
+			sfxclient.CumulativeP("egress.uncompressed_bytes", dims, &e.stats.TotalUncompressedBytes[s]),
+			sfxclient.CumulativeP("egress.compressed_bytes", dims, &e.stats.TotalCompressedBytes[s]),
+			sfxclient.CumulativeP("egress.encode_time_ns", dims, &e.stats.TotalEncodeNanos[s]),
+			sfxclient.CumulativeP("egress.errors", dims, &e.stats.TotalErrors[s]),
+		)
+	}
+	return dps
+}
+
+// Close releases the zstd encoder
+func (e *Encoder) Close() error {
+	return e.zstd.Close()
+}
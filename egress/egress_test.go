@@ -0,0 +1,261 @@
+package egress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/signalfx/com_signalfx_metrics_protobuf"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper/timekeepertest"
+	"github.com/signalfx/golib/v3/trace"
+	signalfxformat "github.com/signalfx/ingest-protocols/protocol/signalfx/format"
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	datapointEndpoint = "http://upstream/v2/datapoint"
+	eventEndpoint     = "http://upstream/v2/event"
+	traceEndpoint     = "http://upstream/v2/trace"
+)
+
+// upstream records the requests that reach it and accepts all of them
+type upstream struct {
+	headers []http.Header
+	bodies  [][]byte
+}
+
+func (u *upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	u.headers = append(u.headers, req.Header)
+	u.bodies = append(u.bodies, body)
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`"OK"`)), Request: req}, nil
+}
+
+// last returns the last body received, decompressed
+func (u *upstream) last(t *testing.T) (http.Header, []byte) {
+	require.NotEmpty(t, u.bodies)
+	header, body := u.headers[len(u.headers)-1], u.bodies[len(u.bodies)-1]
+	switch header.Get("Content-Encoding") {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		body, err = ioutil.ReadAll(zr)
+		require.NoError(t, err)
+	case "zstd":
+		zr, err := zstd.NewReader(nil)
+		require.NoError(t, err)
+		body, err = zr.DecodeAll(body, nil)
+		require.NoError(t, err)
+	}
+	return header, body
+}
+
+// steppingClock moves forward a millisecond every time it is read
+type steppingClock struct {
+	*timekeepertest.StubClock
+}
+
+func (c *steppingClock) Now() time.Time {
+	c.Incr(time.Millisecond)
+	return c.StubClock.Now()
+}
+
+func testEncoder(t *testing.T, values map[string]string) (*sfxclient.HTTPSink, *Encoder, *upstream, distconf.ReaderWriter) {
+	mem := distconf.Mem()
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	u := &upstream{}
+	e, err := New(conf, datapointEndpoint, eventEndpoint, traceEndpoint, u, &steppingClock{timekeepertest.NewStubClock(time.Unix(1600000000, 0))}, log.Discard)
+	require.NoError(t, err)
+	sink := sfxclient.NewHTTPSink()
+	sink.DatapointEndpoint = datapointEndpoint
+	sink.EventEndpoint = eventEndpoint
+	sink.TraceEndpoint = traceEndpoint
+	sink.Client = &http.Client{Transport: e}
+	return sink, e, u, mem
+}
+
+func counter(e *Encoder, metric string, signal string) int64 {
+	for _, dp := range e.Datapoints() {
+		if dp.Metric == metric && dp.Dimensions["type"] == signal {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return -1
+}
+
+func testDatapoints(n int) []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0, n)
+	for i := 0; i < n; i++ {
+		dps = append(dps, datapoint.New("requests", map[string]string{"host": fmt.Sprintf("host-%d", i)}, datapoint.NewIntValue(int64(i)), datapoint.Counter, time.Unix(1600000000, 0)))
+	}
+	return dps
+}
+
+func TestDefaults(t *testing.T) {
+	sink, e, u, mem := testEncoder(t, nil)
+	ctx := context.Background()
+
+	require.NoError(t, sink.AddDatapoints(ctx, testDatapoints(100)))
+	header, body := u.last(t)
+	assert.Equal(t, "gzip", header.Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", header.Get("Content-Type"))
+	var msg com_signalfx_metrics_protobuf.DataPointUploadMessage
+	require.NoError(t, proto.Unmarshal(body, &msg))
+	assert.Len(t, msg.Datapoints, 100)
+	assert.Equal(t, int64(1), counter(e, "egress.requests", "datapoint"))
+	assert.Equal(t, int64(len(body)), counter(e, "egress.uncompressed_bytes", "datapoint"))
+	assert.Equal(t, int64(len(u.bodies[0])), counter(e, "egress.compressed_bytes", "datapoint"))
+	assert.True(t, counter(e, "egress.compressed_bytes", "datapoint") < counter(e, "egress.uncompressed_bytes", "datapoint"))
+	// the clock moves a millisecond between the encoder reading it before and after encoding
+	assert.Equal(t, int64(time.Millisecond), counter(e, "egress.encode_time_ns", "datapoint"))
+
+	// small bodies the sink didn't compress are compressed too, unless they are under the minimum
+	require.NoError(t, sink.AddDatapoints(ctx, testDatapoints(1)))
+	header, _ = u.last(t)
+	assert.Equal(t, "gzip", header.Get("Content-Encoding"))
+	mem.Write("DATA_SINK_MIN_COMPRESS_BYTES", []byte("1500"))
+	require.NoError(t, sink.AddDatapoints(ctx, testDatapoints(1)))
+	header, _ = u.last(t)
+	assert.Equal(t, "", header.Get("Content-Encoding"))
+	assert.Equal(t, int64(0), counter(e, "egress.errors", "datapoint"))
+}
+
+func TestPassThrough(t *testing.T) {
+	_, e, u, _ := testEncoder(t, nil)
+	raw, err := proto.Marshal(&com_signalfx_metrics_protobuf.DataPointUploadMessage{})
+	require.NoError(t, err)
+	raw = append(raw, make([]byte, 2000)...)
+	var gzipped bytes.Buffer
+	// compressed differently to how the encoder would, to tell a body sent as it is from one that was re-encoded
+	zw, err := gzip.NewWriterLevel(&gzipped, gzip.BestSpeed)
+	require.NoError(t, err)
+	require.NoError(t, write(zw, raw))
+
+	req, err := http.NewRequest(http.MethodPost, datapointEndpoint, bytes.NewReader(gzipped.Bytes()))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "gzip")
+	_, err = e.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, gzipped.Bytes(), u.bodies[0], "already in the format and compression it is sent in")
+	assert.Equal(t, int64(len(raw)), counter(e, "egress.uncompressed_bytes", "datapoint"))
+	assert.Equal(t, int64(gzipped.Len()), counter(e, "egress.compressed_bytes", "datapoint"))
+}
+
+func TestFormats(t *testing.T) {
+	sink, e, u, _ := testEncoder(t, map[string]string{
+		"DATA_SINK_DP_FORMAT":         "json",
+		"DATA_SINK_DP_COMPRESSION":    "zstd",
+		"DATA_SINK_EVENT_FORMAT":      "JSON",
+		"DATA_SINK_EVENT_COMPRESSION": "none",
+		"DATA_SINK_TRACE_FORMAT":      "sapm",
+		"DATA_SINK_TRACE_GZIP_LEVEL":  "9",
+	})
+	ctx := context.Background()
+
+	require.NoError(t, sink.AddDatapoints(ctx, testDatapoints(100)))
+	header, body := u.last(t)
+	assert.Equal(t, "zstd", header.Get("Content-Encoding"))
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+	var dps signalfxformat.JSONDatapointV2
+	require.NoError(t, json.Unmarshal(body, &dps))
+	if assert.Len(t, dps["cumulative_counter"], 100) {
+		dp := dps["cumulative_counter"][7]
+		assert.Equal(t, "requests", dp.Metric)
+		assert.Equal(t, int64(1600000000000), dp.Timestamp)
+		assert.Equal(t, "host-7", dp.Dimensions["host"])
+		assert.Equal(t, float64(7), dp.Value)
+	}
+
+	ev := event.NewWithProperties("deploy", event.USERDEFINED, map[string]string{"service": "api"}, map[string]interface{}{"version": "1.2", "canary": true}, time.Unix(1600000000, 0))
+	require.NoError(t, sink.AddEvents(ctx, []*event.Event{ev}))
+	header, body = u.last(t)
+	assert.Equal(t, "", header.Get("Content-Encoding"))
+	var evs signalfxformat.JSONEventV2
+	require.NoError(t, json.Unmarshal(body, &evs))
+	if assert.Len(t, evs, 1) {
+		assert.Equal(t, "deploy", evs[0].EventType)
+		assert.Equal(t, "USER_DEFINED", *evs[0].Category)
+		assert.Equal(t, map[string]interface{}{"version": "1.2", "canary": true}, evs[0].Properties)
+	}
+
+	spans := make([]*trace.Span, 0, 50)
+	for i := 0; i < 50; i++ {
+		spans = append(spans, &trace.Span{TraceID: "0123456789abcdef", ID: fmt.Sprintf("%016x", i+1), Name: pointer.String("get"), Timestamp: pointer.Int64(1600000000000000), Duration: pointer.Int64(10)})
+	}
+	require.NoError(t, sink.AddSpans(ctx, spans))
+	header, body = u.last(t)
+	assert.Equal(t, "gzip", header.Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", header.Get("Content-Type"))
+	var sapm splunksapm.PostSpansRequest
+	require.NoError(t, sapm.Unmarshal(body))
+	count := 0
+	for _, batch := range sapm.Batches {
+		count += len(batch.Spans)
+	}
+	assert.Equal(t, 50, count)
+	assert.Equal(t, int64(1), counter(e, "egress.requests", "span"))
+	assert.Equal(t, int64(0), counter(e, "egress.errors", "span"))
+}
+
+func TestBadConfig(t *testing.T) {
+	for k, v := range map[string]string{
+		"DATA_SINK_DP_FORMAT":        "sapm",
+		"DATA_SINK_TRACE_FORMAT":     "protobuf",
+		"DATA_SINK_EVENT_GZIP_LEVEL": "10",
+		"DATA_SINK_DP_COMPRESSION":   "br",
+	} {
+		mem := distconf.Mem()
+		mem.Write(k, []byte(v))
+		conf := &Config{}
+		conf.Load(distconf.New([]distconf.Reader{mem}))
+		_, err := New(conf, datapointEndpoint, eventEndpoint, traceEndpoint, &upstream{}, timekeepertest.NewStubClock(time.Now()), log.Discard)
+		assert.Error(t, err, k)
+	}
+
+	sink, e, u, mem := testEncoder(t, nil)
+	mem.Write("DATA_SINK_DP_COMPRESSION", []byte("br"))
+	require.NoError(t, sink.AddDatapoints(context.Background(), testDatapoints(100)))
+	header, body := u.last(t)
+	assert.Equal(t, "gzip", header.Get("Content-Encoding"), "sent as the sink encoded it")
+	var msg com_signalfx_metrics_protobuf.DataPointUploadMessage
+	require.NoError(t, proto.Unmarshal(body, &msg))
+	assert.Equal(t, int64(1), counter(e, "egress.errors", "datapoint"))
+	assert.NoError(t, e.Close())
+}
+
+func TestOtherRequests(t *testing.T) {
+	_, e, u, _ := testEncoder(t, map[string]string{"DATA_SINK_DP_COMPRESSION": "none"})
+	req, err := http.NewRequest(http.MethodPost, "http://upstream/v1/other", bytes.NewReader([]byte("anything")))
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	_, err = e.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "anything", string(u.bodies[0]))
+	assert.Equal(t, "gzip", u.headers[0].Get("Content-Encoding"))
+	assert.Equal(t, int64(0), counter(e, "egress.requests", "datapoint"))
+}
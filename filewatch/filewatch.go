@@ -0,0 +1,121 @@
+package filewatch
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+)
+
+// Watcher polls a file and hands its contents to OnChange every time it changes
+type Watcher struct {
+	path       string
+	interval   time.Duration
+	onChange   func([]byte) error
+	timeKeeper timekeeper.TimeKeeper
+	logger     log.Logger
+	modTime    time.Time
+	size       int64
+	lastErr    string // the last error reported, so one that keeps happening isn't reported on every check
+	closing    chan struct{}
+	done       chan struct{}
+
+	stats struct {
+		TotalReloads      int64
+		TotalReloadErrors int64
+	}
+}
+
+// New loads path, passes it to onChange and then keeps checking it for changes every interval.  An error is
+// returned if the file can't be read or onChange rejects it the first time.
+func New(path string, interval time.Duration, onChange func([]byte) error, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Watcher, error) {
+	w := &Watcher{
+		path:       path,
+		interval:   interval,
+		onChange:   onChange,
+		timeKeeper: timeKeeper,
+		logger:     logger,
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if _, err := w.check(); err != nil {
+		return nil, err
+	}
+	go w.poll()
+	return w, nil
+}
+
+// check reloads the file if it has changed since the last time it was read.  A file onChange rejects is remembered too,
+// so it is only reported once rather than on every check until it is fixed.
+func (w *Watcher) check() (bool, error) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false, nil
+	}
+	contents, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return false, err
+	}
+	w.modTime = info.ModTime()
+	w.size = info.Size()
+	if err := w.onChange(contents); err != nil {
+		return false, err
+	}
+	atomic.AddInt64(&w.stats.TotalReloads, 1)
+	return true, nil
+}
+
+func (w *Watcher) poll() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.closing:
+			return
+		case <-w.timeKeeper.After(w.interval):
+			changed, err := w.check()
+			if err != nil {
+				w.reportErr(err)
+				continue
+			}
+			w.lastErr = ""
+			if changed {
+				w.logger.Log("file", w.path, "reloaded file")
+			}
+		}
+	}
+}
+
+// reportErr logs and counts err unless it is the error that was reported last, so a file that goes missing or can't be
+// read is reported once until the error changes or the file can be read again
+func (w *Watcher) reportErr(err error) {
+	if err.Error() == w.lastErr {
+		return
+	}
+	w.lastErr = err.Error()
+	atomic.AddInt64(&w.stats.TotalReloadErrors, 1)
+	w.logger.Log(log.Err, err, "file", w.path, "unable to reload file")
+}
+
+// Datapoints returns how many times the file has been reloaded
+func (w *Watcher) Datapoints() []*datapoint.Datapoint {
+	dims := map[string]string{"file": w.path}
+	return []*datapoint.Datapoint{
+		sfxclient.CumulativeP("filewatch.reloads", dims, &w.stats.TotalReloads),
+		sfxclient.CumulativeP("filewatch.reload_errors", dims, &w.stats.TotalReloadErrors),
+	}
+}
+
+// Close stops watching the file
+func (w *Watcher) Close() error {
+	close(w.closing)
+	<-w.done
+	return nil
+}
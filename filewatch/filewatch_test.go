@@ -0,0 +1,80 @@
+package filewatch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("one"), 0600))
+
+	var current atomic.Value
+	onChange := func(b []byte) error {
+		if string(b) == "bad" {
+			return errors.New("bad contents")
+		}
+		current.Store(string(b))
+		return nil
+	}
+	_, err = New(filepath.Join(dir, "missing"), time.Millisecond, onChange, timekeeper.RealTime{}, log.Discard)
+	assert.Error(t, err)
+
+	w, err := New(path, time.Millisecond, onChange, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, "one", current.Load())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("two!"), 0600))
+	for current.Load() != "two!" {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a bad file leaves the last good contents in place
+	require.NoError(t, ioutil.WriteFile(path, []byte("bad"), 0600))
+	for atomic.LoadInt64(&w.stats.TotalReloadErrors) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, "two!", current.Load())
+	// and is only reported once, not on every check until it is fixed
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&w.stats.TotalReloadErrors))
+	assert.Len(t, w.Datapoints(), 2)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("three"), 0600))
+	for current.Load() != "three" {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&w.stats.TotalReloadErrors))
+
+	// a missing file is reported once too, and again if it goes missing after coming back
+	require.NoError(t, os.Remove(path))
+	for atomic.LoadInt64(&w.stats.TotalReloadErrors) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&w.stats.TotalReloadErrors))
+	require.NoError(t, ioutil.WriteFile(path, []byte("four"), 0600))
+	for current.Load() != "four" {
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, os.Remove(path))
+	for atomic.LoadInt64(&w.stats.TotalReloadErrors) == 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&w.stats.TotalReloadErrors))
+}
@@ -0,0 +1,313 @@
+package filter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/config/globbing"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/pops/filewatch"
+)
+
+// Config configures which datapoints are forwarded
+type Config struct {
+	RulesFile      *distconf.Str
+	ReloadInterval *distconf.Duration
+}
+
+// Load the filter config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.RulesFile = d.Str("FILTER_RULES_FILE", "")
+	c.ReloadInterval = d.Duration("FILTER_RELOAD_INTERVAL", 10*time.Second)
+}
+
+const (
+	// ActionInclude keeps the datapoints a rule matches
+	ActionInclude = "include"
+	// ActionExclude drops the datapoints a rule matches
+	ActionExclude = "exclude"
+)
+
+// typeNames are the names rules give metric types by
+var typeNames = map[datapoint.MetricType]string{
+	datapoint.Gauge:     "gauge",
+	datapoint.Count:     "counter",
+	datapoint.Counter:   "cumulative_counter",
+	datapoint.Enum:      "enum",
+	datapoint.Rate:      "rate",
+	datapoint.Timestamp: "timestamp",
+}
+
+// Rule includes or excludes the datapoints it matches.  Every condition that is set must match: the metric name
+// matching Glob, where only "*" is special, or Regex, every dimension in Dimensions being present with a value
+// matching its glob, and the metric type being one of Types.  A rule with Tokens only applies to datapoints sent with
+// one of them, and to every datapoint otherwise.
+type Rule struct {
+	Name       string            `json:"name,omitempty"`
+	Action     string            `json:"action"`
+	Glob       string            `json:"glob,omitempty"`
+	Regex      string            `json:"regex,omitempty"`
+	Dimensions map[string]string `json:"dimensions,omitempty"`
+	Types      []string          `json:"types,omitempty"`
+	Tokens     []string          `json:"tokens,omitempty"`
+
+	include    bool
+	metric     func(string) bool
+	dimensions map[string]func(string) bool
+	types      map[datapoint.MetricType]bool
+	tokens     map[string]bool
+	matched    *int64
+}
+
+func (r *Rule) compile(index int) error {
+	if r.Name == "" {
+		r.Name = strconv.Itoa(index)
+	}
+	switch r.Action {
+	case ActionInclude, ActionExclude:
+		r.include = r.Action == ActionInclude
+	default:
+		return fmt.Errorf("rule %s has unknown action %q", r.Name, r.Action)
+	}
+	if r.Glob == "" && r.Regex == "" && len(r.Dimensions) == 0 && len(r.Types) == 0 {
+		return fmt.Errorf("rule %s has nothing to match", r.Name)
+	}
+	if err := r.compileMetric(); err != nil {
+		return err
+	}
+	r.dimensions = make(map[string]func(string) bool, len(r.Dimensions))
+	for key, value := range r.Dimensions {
+		r.dimensions[key] = globbing.GetGlob(value).Match
+	}
+	if err := r.compileTypes(); err != nil {
+		return err
+	}
+	r.tokens = set(r.Tokens)
+	return nil
+}
+
+func set(values []string) map[string]bool {
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
+
+func (r *Rule) compileMetric() error {
+	if r.Glob != "" && r.Regex != "" {
+		return fmt.Errorf("rule %s can't have both a glob and a regex", r.Name)
+	}
+	switch {
+	case r.Glob != "":
+		r.metric = globbing.GetGlob(r.Glob).Match
+	case r.Regex != "":
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return fmt.Errorf("rule %s: %s", r.Name, err)
+		}
+		r.metric = re.MatchString
+	}
+	return nil
+}
+
+func (r *Rule) compileTypes() error {
+	r.types = make(map[datapoint.MetricType]bool, len(r.Types))
+	for _, name := range r.Types {
+		found := false
+		for t, typeName := range typeNames {
+			if strings.EqualFold(name, typeName) {
+				r.types[t] = true
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("rule %s has unknown metric type %q", r.Name, name)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) appliesTo(token string) bool {
+	return len(r.tokens) == 0 || r.tokens[token]
+}
+
+func (r *Rule) matches(dp *datapoint.Datapoint) bool {
+	if r.metric != nil && !r.metric(dp.Metric) {
+		return false
+	}
+	if len(r.types) > 0 && !r.types[dp.MetricType] {
+		return false
+	}
+	for key, matches := range r.dimensions {
+		value, ok := dp.Dimensions[key]
+		if !ok || !matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rules are loaded from the rules file.  They decide like the allow and deny lists of a filtering.FilteredForwarder,
+// with include rules as allows and exclude rules as denies: a datapoint is kept if an include rule matches it, and
+// otherwise only if no exclude rule matches it and no include rule applies to its token.  Rules with only a Regex
+// keep exactly what a FilteredForwarder would.  The FilteredForwarder isn't used itself because it only matches metric
+// names, and differs in that:
+//
+//   - rules can also match globs, dimensions and metric types
+//   - the include rules that make a token's datapoints allow listed are only those that apply to the token, rather
+//     than every allow
+//   - every rule that matches a datapoint counts it, rather than only the first allow or deny
+type Rules struct {
+	Rules []*Rule `json:"rules,omitempty"`
+}
+
+func parseRules(b []byte) (*Rules, error) {
+	rules := &Rules{}
+	if err := json.Unmarshal(b, rules); err != nil {
+		return nil, err
+	}
+	for i, r := range rules.Rules {
+		if err := r.compile(i); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func (r *Rules) keep(token string, dp *datapoint.Datapoint) bool {
+	included, excluded, includes := false, false, false
+	for _, rule := range r.Rules {
+		if !rule.appliesTo(token) {
+			continue
+		}
+		includes = includes || rule.include
+		if rule.matches(dp) {
+			atomic.AddInt64(rule.matched, 1)
+			included = included || rule.include
+			excluded = excluded || !rule.include
+		}
+	}
+	return included || (!includes && !excluded)
+}
+
+// Filter is a signalfx.NextSink that drops datapoints according to a set of rules
+type Filter struct {
+	watcher *filewatch.Watcher
+
+	mu      sync.RWMutex
+	rules   *Rules
+	matched map[string]*int64
+
+	stats struct {
+		TotalKept    int64
+		TotalDropped int64
+	}
+}
+
+var _ signalfx.NextSink = &Filter{}
+
+// New returns a Filter for conf, loading the rules file if there is one and watching it for changes
+func New(conf *Config, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Filter, error) {
+	f := &Filter{
+		rules:   &Rules{},
+		matched: make(map[string]*int64),
+	}
+	if path := conf.RulesFile.Get(); path != "" {
+		var err error
+		if f.watcher, err = filewatch.New(path, conf.ReloadInterval.Get(), f.load, timeKeeper, logger); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *Filter) load(b []byte) error {
+	rules, err := parseRules(b)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// rules keep counting where they left off across reloads
+	for _, rule := range rules.Rules {
+		if rule.matched = f.matched[rule.Name]; rule.matched == nil {
+			rule.matched = new(int64)
+			f.matched[rule.Name] = rule.matched
+		}
+	}
+	f.rules = rules
+	return nil
+}
+
+// AddDatapoints forwards the datapoints the rules keep
+func (f *Filter) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	f.mu.RLock()
+	rules := f.rules
+	f.mu.RUnlock()
+	if len(rules.Rules) == 0 {
+		return next.AddDatapoints(ctx, points)
+	}
+	token, _ := ctx.Value(sfxclient.TokenCtxKey).(string)
+	kept := make([]*datapoint.Datapoint, 0, len(points))
+	for _, dp := range points {
+		if rules.keep(token, dp) {
+			kept = append(kept, dp)
+		}
+	}
+	atomic.AddInt64(&f.stats.TotalKept, int64(len(kept)))
+	atomic.AddInt64(&f.stats.TotalDropped, int64(len(points)-len(kept)))
+	if len(kept) == 0 {
+		return nil
+	}
+	return next.AddDatapoints(ctx, kept)
+}
+
+// AddEvents forwards the events, which aren't filtered
+func (f *Filter) AddEvents(ctx context.Context, events []*event.Event, next signalfx.Sink) error {
+	return next.AddEvents(ctx, events)
+}
+
+// AddSpans forwards the spans, which aren't filtered
+func (f *Filter) AddSpans(ctx context.Context, spans []*trace.Span, next signalfx.Sink) error {
+	return next.AddSpans(ctx, spans)
+}
+
+// Datapoints returns how many datapoints were kept and dropped and how many each rule matched
+func (f *Filter) Datapoints() []*datapoint.Datapoint {
+	dps := []*datapoint.Datapoint{
+		sfxclient.CumulativeP("filter.kept", nil, &f.stats.TotalKept),
+		sfxclient.CumulativeP("filter.dropped", nil, &f.stats.TotalDropped),
+	}
+	f.mu.RLock()
+	for name, matched := range f.matched {
+		dps = append(dps, sfxclient.CumulativeP("filter.matched", map[string]string{"rule": name}, matched))
+	}
+	f.mu.RUnlock()
+	if f.watcher != nil {
+		dps = append(dps, f.watcher.Datapoints()...)
+	}
+	return dps
+}
+
+// Close stops watching the rules file
+func (f *Filter) Close() error {
+	if f.watcher != nil {
+		return f.watcher.Close()
+	}
+	return nil
+}
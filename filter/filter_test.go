@@ -0,0 +1,189 @@
+package filter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/filtering"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `{
+  "rules": [
+    {"name": "no-debug", "action": "exclude", "glob": "debug.*"},
+    {"name": "no-dev-gauges", "action": "exclude", "dimensions": {"env": "dev*"}, "types": ["gauge"]},
+    {"name": "partner-cpu", "action": "include", "glob": "cpu.*", "tokens": ["partner"]},
+    {"name": "partner-dev-errors", "action": "include", "regex": "^errors\\.", "dimensions": {"env": "dev*"}, "tokens": ["partner"]}
+  ]
+}`
+
+// recorder keeps the names of the metrics that reach it
+type recorder struct {
+	metrics []string
+}
+
+func (r *recorder) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	for _, dp := range points {
+		r.metrics = append(r.metrics, dp.Metric)
+	}
+	return nil
+}
+
+func (r *recorder) AddEvents(context.Context, []*event.Event) error { return nil }
+func (r *recorder) AddSpans(context.Context, []*trace.Span) error   { return nil }
+
+func testFilter(t *testing.T, rules string) (*Filter, string, func()) {
+	dir, err := ioutil.TempDir("", "filter")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(rules), 0600))
+	mem := distconf.Mem()
+	mem.Write("FILTER_RULES_FILE", []byte(path))
+	mem.Write("FILTER_RELOAD_INTERVAL", []byte("1ms"))
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	f, err := New(conf, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	return f, path, func() {
+		_ = f.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func dp(metric string, metricType datapoint.MetricType, dims map[string]string) *datapoint.Datapoint {
+	return datapoint.New(metric, dims, datapoint.NewIntValue(1), metricType, time.Now())
+}
+
+func send(f *Filter, token string, points ...*datapoint.Datapoint) []string {
+	r := &recorder{}
+	ctx := context.WithValue(context.Background(), sfxclient.TokenCtxKey, token)
+	_ = signalfx.FromChain(r, signalfx.NextWrap(f)).AddDatapoints(ctx, points)
+	return r.metrics
+}
+
+func counter(f *Filter, metric string, rule string) int64 {
+	for _, d := range f.Datapoints() {
+		if d.Metric == metric && d.Dimensions["rule"] == rule {
+			return d.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return -1
+}
+
+func TestFilter(t *testing.T) {
+	f, _, cleanup := testFilter(t, testRules)
+	defer cleanup()
+
+	dev := map[string]string{"env": "dev-1"}
+	prod := map[string]string{"env": "prod"}
+	assert.Equal(t, []string{"requests", "latency"}, send(f, "mine",
+		dp("requests", datapoint.Counter, nil),
+		dp("debug.heap", datapoint.Gauge, nil),
+		dp("latency", datapoint.Gauge, prod),
+		dp("queue", datapoint.Gauge, dev),
+		dp("errors.total", datapoint.Gauge, dev),
+	))
+	assert.Equal(t, []string{"requests"}, send(f, "mine", dp("requests", datapoint.Count, dev)), "only gauges are excluded in dev")
+	assert.Equal(t, []string{"cpu.idle", "errors.total"}, send(f, "partner",
+		dp("cpu.idle", datapoint.Gauge, nil),
+		dp("requests", datapoint.Counter, nil),
+		dp("errors.total", datapoint.Gauge, dev),
+	), "a token with include rules only gets what they include, even if it is excluded")
+	assert.Nil(t, send(f, "partner", dp("memory", datapoint.Gauge, nil)), "nothing is sent when everything is dropped")
+
+	assert.Equal(t, int64(1), counter(f, "filter.matched", "no-debug"))
+	assert.Equal(t, int64(3), counter(f, "filter.matched", "no-dev-gauges"))
+	assert.Equal(t, int64(1), counter(f, "filter.matched", "partner-cpu"))
+	assert.Equal(t, int64(1), counter(f, "filter.matched", "partner-dev-errors"))
+	assert.Equal(t, int64(5), counter(f, "filter.kept", ""))
+	assert.Equal(t, int64(5), counter(f, "filter.dropped", ""))
+}
+
+func TestNoRules(t *testing.T) {
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{distconf.Mem()}))
+	f, err := New(conf, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"debug.heap"}, send(f, "mine", dp("debug.heap", datapoint.Gauge, nil)))
+	sink := signalfx.FromChain(&recorder{}, signalfx.NextWrap(f))
+	assert.NoError(t, sink.AddEvents(context.Background(), nil))
+	assert.NoError(t, sink.AddSpans(context.Background(), nil))
+	assert.NoError(t, f.Close())
+}
+
+func TestReload(t *testing.T) {
+	f, path, cleanup := testFilter(t, testRules)
+	defer cleanup()
+	assert.Nil(t, send(f, "mine", dp("debug.heap", datapoint.Gauge, nil)))
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"rules": [{"name": "no-debug", "action": "exclude", "glob": "debug.stack*"}]}`), 0600))
+	for len(send(f, "mine", dp("debug.heap", datapoint.Gauge, nil))) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	matched := counter(f, "filter.matched", "no-debug")
+	assert.True(t, matched > 0, "counts carry over reloads")
+	assert.Nil(t, send(f, "mine", dp("debug.stack", datapoint.Gauge, nil)))
+	assert.Equal(t, matched+1, counter(f, "filter.matched", "no-debug"))
+}
+
+func TestBadRules(t *testing.T) {
+	for _, rules := range []string{
+		`{`,
+		`{"rules": [{"glob": "a"}]}`,
+		`{"rules": [{"action": "drop", "glob": "a"}]}`,
+		`{"rules": [{"action": "include"}]}`,
+		`{"rules": [{"action": "include", "glob": "a", "regex": "a"}]}`,
+		`{"rules": [{"action": "include", "regex": "("}]}`,
+		`{"rules": [{"action": "include", "types": ["histogram"]}]}`,
+	} {
+		_, err := parseRules([]byte(rules))
+		assert.Error(t, err, rules)
+	}
+}
+
+func TestMatchesFilteredForwarder(t *testing.T) {
+	metrics := []string{"cpu.idle", "cpu.user", "debug.gc", "debug.cpu", "memory.free", "errors"}
+	for _, lists := range []filtering.FilterObj{
+		{},
+		{Deny: []string{"^debug\\."}},
+		{Allow: []string{"^cpu\\."}},
+		{Allow: []string{"cpu"}, Deny: []string{"^debug\\."}},
+		{Allow: []string{"^memory", "^errors$"}, Deny: []string{"^debug\\.", "^cpu\\.idle$"}},
+	} {
+		forwarder := &filtering.FilteredForwarder{}
+		require.NoError(t, forwarder.Setup(&lists))
+		rules := &Rules{}
+		for _, allow := range lists.Allow {
+			rules.Rules = append(rules.Rules, &Rule{Action: ActionInclude, Regex: allow})
+		}
+		for _, deny := range lists.Deny {
+			rules.Rules = append(rules.Rules, &Rule{Action: ActionExclude, Regex: deny})
+		}
+		for i, r := range rules.Rules {
+			require.NoError(t, r.compile(i))
+			r.matched = new(int64)
+		}
+		for _, metric := range metrics {
+			assert.Equal(t, forwarder.FilterMetricName(metric), rules.keep("tok", dp(metric, datapoint.Gauge, nil)), "%v %s", lists, metric)
+		}
+	}
+
+	// where they differ: include rules only allow list the tokens they apply to
+	rules, err := parseRules([]byte(`{"rules": [{"action": "include", "regex": "^cpu", "tokens": ["partner"]}]}`))
+	require.NoError(t, err)
+	rules.Rules[0].matched = new(int64)
+	assert.False(t, rules.keep("partner", dp("memory.free", datapoint.Gauge, nil)))
+	assert.True(t, rules.keep("other", dp("memory.free", datapoint.Gauge, nil)), "a FilteredForwarder would drop this")
+}
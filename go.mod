@@ -5,14 +5,18 @@ go 1.14
 replace git.apache.org/thrift.git => github.com/signalfx/thrift v0.0.0-20181211001559-3838fa316492
 
 require (
-	github.com/golang/protobuf v1.3.4 // indirect
+	github.com/golang/protobuf v1.3.4
+	github.com/golang/snappy v0.0.4
 	github.com/gopherjs/gopherjs v0.0.0-20200217142428-fce0ec30dd00 // indirect
 	github.com/gorilla/mux v1.7.3
+	github.com/jaegertracing/jaeger v1.16.0
 	github.com/jstemmer/go-junit-report v0.9.1
+	github.com/klauspost/compress v1.12.3
 	github.com/signalfx/com_signalfx_metrics_protobuf v0.0.0-20190530013331-054be550cb49
 	github.com/signalfx/gobuild v0.0.0-20171013201037-4abf7c615b64
 	github.com/signalfx/golib/v3 v3.2.1
 	github.com/signalfx/ingest-protocols v0.0.3
+	github.com/signalfx/sapm-proto v0.4.0
 	github.com/smartystreets/goconvey v1.6.4
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/stretchr/testify v1.4.0
@@ -0,0 +1,409 @@
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+)
+
+const (
+	// Plaintext is carbon's line protocol of "path value timestamp"
+	Plaintext = "plaintext"
+	// Pickle is carbon's protocol of length prefixed pickled lists of (path, (timestamp, value)) tuples
+	Pickle = "pickle"
+
+	// maxPickleSize is the largest pickle frame carbon accepts
+	maxPickleSize = 1 << 20
+	// maxLineSize is the longest plaintext line accepted
+	maxLineSize = 64 * 1024
+	// maxBatchSize is the most plaintext datapoints sent to the sink at once
+	maxBatchSize = 1000
+)
+
+// Config configures the graphite listeners
+type Config struct {
+	Listeners *distconf.Str
+}
+
+// Load the graphite config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.Listeners = d.Str("GRAPHITE_LISTENERS", "")
+}
+
+// Spec describes a graphite listener.  Protocol is "plaintext" or "pickle", and everything received on it is sent
+// with Token.  Templates are tried in order to turn each path into a metric and dimensions.
+type Spec struct {
+	Name      string   `json:"name"`
+	Protocol  string   `json:"protocol,omitempty"`
+	Address   string   `json:"address"`
+	Token     string   `json:"token"`
+	Templates []string `json:"templates,omitempty"`
+
+	templates templates
+}
+
+// Specs returns the graphite listeners, checking they are valid
+func (c *Config) Specs() ([]*Spec, error) {
+	raw := c.Listeners.Get()
+	if raw == "" {
+		return nil, nil
+	}
+	var specs []*Spec
+	if err := json.Unmarshal([]byte(raw), &specs); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(specs))
+	for _, s := range specs {
+		if s.Name == "" || s.Address == "" || s.Token == "" {
+			return nil, errors.New("graphite listeners need a name, an address and a token")
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("graphite listener name %s is used more than once", s.Name)
+		}
+		names[s.Name] = true
+		if err := s.setDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	return specs, nil
+}
+
+// setDefaults fills in the protocol if it's unset and parses the templates
+func (s *Spec) setDefaults() error {
+	if s.Protocol == "" {
+		s.Protocol = Plaintext
+	}
+	if s.Protocol != Plaintext && s.Protocol != Pickle {
+		return fmt.Errorf("graphite listener %s has unknown protocol %s", s.Name, s.Protocol)
+	}
+	var err error
+	if s.templates, err = parseTemplates(s.Templates); err != nil {
+		return fmt.Errorf("graphite listener %s: %s", s.Name, err)
+	}
+	return nil
+}
+
+// Listener accepts carbon connections and sends what they send to the sink as gauges with the listener's token
+type Listener struct {
+	spec       *Spec
+	sink       dpsink.DSink
+	ctx        context.Context
+	timeKeeper timekeeper.TimeKeeper
+	logger     log.Logger
+	listener   net.Listener
+	closing    chan struct{}
+	wg         sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+
+	stats struct {
+		TotalConnections    int64
+		TotalMetrics        int64
+		TotalInvalidMetrics int64
+		TotalDatapoints     int64
+		TotalSendErrors     int64
+	}
+}
+
+// New opens the listener described by spec and starts accepting connections
+func New(spec *Spec, sink dpsink.DSink, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Listener, error) {
+	if spec.templates == nil {
+		var err error
+		if spec.templates, err = parseTemplates(spec.Templates); err != nil {
+			return nil, err
+		}
+	}
+	l := &Listener{
+		spec:       spec,
+		sink:       sink,
+		ctx:        context.WithValue(context.Background(), sfxclient.TokenCtxKey, spec.Token),
+		timeKeeper: timeKeeper,
+		logger:     log.NewContext(logger).With("graphite_listener", spec.Name),
+		closing:    make(chan struct{}),
+		conns:      make(map[net.Conn]struct{}),
+	}
+	var err error
+	if l.listener, err = net.Listen("tcp", spec.Address); err != nil {
+		return nil, err
+	}
+	l.wg.Add(1)
+	go l.accept()
+	return l, nil
+}
+
+// Addr returns the address the listener is bound to
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *Listener) accept() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if !l.isClosing() {
+				l.logger.Log(log.Err, err, "unable to accept graphite connection")
+			}
+			return
+		}
+		l.mu.Lock()
+		if l.isClosing() {
+			l.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
+		atomic.AddInt64(&l.stats.TotalConnections, 1)
+		l.wg.Add(1)
+		go l.serve(conn)
+	}
+}
+
+func (l *Listener) serve(conn net.Conn) {
+	defer l.wg.Done()
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		_ = conn.Close()
+	}()
+	var err error
+	if l.spec.Protocol == Pickle {
+		err = l.readPickles(bufio.NewReader(conn))
+	} else {
+		err = l.readLines(bufio.NewReaderSize(conn, maxLineSize))
+	}
+	if err != nil && err != io.EOF && !l.isClosing() {
+		l.logger.Log(log.Err, err, "dropping graphite connection")
+	}
+}
+
+// readLines reads plaintext lines, sending them in batches whenever reading the next line would have to wait
+func (l *Listener) readLines(r *bufio.Reader) error {
+	var batch []*datapoint.Datapoint
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return errors.New("graphite line too long")
+		}
+		if len(line) > 0 {
+			batch = l.appendLine(batch, string(line))
+		}
+		if err != nil {
+			l.send(batch)
+			return err
+		}
+		if len(batch) >= maxBatchSize || !lineBuffered(r) {
+			l.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// lineBuffered returns true if a whole line can be read from r without blocking
+func lineBuffered(r *bufio.Reader) bool {
+	buffered, _ := r.Peek(r.Buffered())
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
+
+func (l *Listener) appendLine(batch []*datapoint.Datapoint, line string) []*datapoint.Datapoint {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return batch
+	}
+	atomic.AddInt64(&l.stats.TotalMetrics, 1)
+	dp, err := l.parseLine(fields)
+	if err != nil {
+		atomic.AddInt64(&l.stats.TotalInvalidMetrics, 1)
+		l.logger.Log(log.Err, err, "dropping invalid graphite line")
+		return batch
+	}
+	if dp == nil {
+		return batch
+	}
+	return append(batch, dp)
+}
+
+// parseLine parses "path value [timestamp]".  A missing or negative timestamp means now, like carbon.
+func (l *Listener) parseLine(fields []string) (*datapoint.Datapoint, error) {
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid graphite line %q", strings.Join(fields, " "))
+	}
+	v, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid graphite value %q", fields[1])
+	}
+	ts := float64(-1)
+	if len(fields) == 3 {
+		if ts, err = strconv.ParseFloat(fields[2], 64); err != nil {
+			return nil, fmt.Errorf("invalid graphite timestamp %q", fields[2])
+		}
+	}
+	return l.datapoint(fields[0], v, ts), nil
+}
+
+// datapoint returns the gauge for path, or nil for values SignalFx can't take
+func (l *Listener) datapoint(path string, v float64, ts float64) *datapoint.Datapoint {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	metric, dims := l.spec.templates.apply(path)
+	timestamp := l.timeKeeper.Now()
+	if ts >= 0 {
+		sec, frac := math.Modf(ts)
+		timestamp = time.Unix(int64(sec), int64(frac*float64(time.Second)))
+	}
+	return datapoint.New(metric, dims, value(v), datapoint.Gauge, timestamp)
+}
+
+// readPickles reads frames of a four byte big endian length followed by a pickled list of tuples
+func (l *Listener) readPickles(r *bufio.Reader) error {
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n > maxPickleSize {
+			return fmt.Errorf("graphite pickle of %d bytes is too large", n)
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return err
+		}
+		dps, err := l.parsePickle(frame)
+		if err != nil {
+			atomic.AddInt64(&l.stats.TotalInvalidMetrics, 1)
+			return err
+		}
+		l.send(dps)
+	}
+}
+
+// parsePickle converts [(path, (timestamp, value)), ...].  Malformed entries are skipped.
+func (l *Listener) parsePickle(frame []byte) ([]*datapoint.Datapoint, error) {
+	obj, err := unpickle(frame)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.(*pyList)
+	if !ok {
+		return nil, errors.New("graphite pickle is not a list")
+	}
+	dps := make([]*datapoint.Datapoint, 0, len(list.items))
+	for _, item := range list.items {
+		atomic.AddInt64(&l.stats.TotalMetrics, 1)
+		path, ts, v, ok := pickledMetric(item)
+		if !ok {
+			atomic.AddInt64(&l.stats.TotalInvalidMetrics, 1)
+			continue
+		}
+		if dp := l.datapoint(path, v, ts); dp != nil {
+			dps = append(dps, dp)
+		}
+	}
+	return dps, nil
+}
+
+func pickledMetric(item interface{}) (string, float64, float64, bool) {
+	metric, ok := item.([]interface{})
+	if !ok || len(metric) != 2 {
+		return "", 0, 0, false
+	}
+	path, ok := metric[0].(string)
+	point, isTuple := metric[1].([]interface{})
+	if !ok || !isTuple || len(point) != 2 {
+		return "", 0, 0, false
+	}
+	ts, tsOK := number(point[0])
+	v, vOK := number(point[1])
+	return path, ts, v, tsOK && vOK
+}
+
+// number accepts the ints, floats and numeric strings senders put in pickles
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (l *Listener) send(dps []*datapoint.Datapoint) {
+	if len(dps) == 0 {
+		return
+	}
+	atomic.AddInt64(&l.stats.TotalDatapoints, int64(len(dps)))
+	if err := l.sink.AddDatapoints(l.ctx, dps); err != nil {
+		atomic.AddInt64(&l.stats.TotalSendErrors, 1)
+		l.logger.Log(log.Err, err, "unable to send graphite datapoints")
+	}
+}
+
+func (l *Listener) isClosing() bool {
+	select {
+	case <-l.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Datapoints returns how much the listener has received and sent
+func (l *Listener) Datapoints() []*datapoint.Datapoint {
+	dims := map[string]string{"listener": l.spec.Name, "protocol": l.spec.Protocol}
+	return []*datapoint.Datapoint{
+		sfxclient.CumulativeP("graphite.connections", dims, &l.stats.TotalConnections),
+		sfxclient.CumulativeP("graphite.metrics", dims, &l.stats.TotalMetrics),
+		sfxclient.CumulativeP("graphite.invalid_metrics", dims, &l.stats.TotalInvalidMetrics),
+		sfxclient.CumulativeP("graphite.datapoints", dims, &l.stats.TotalDatapoints),
+		sfxclient.CumulativeP("graphite.send_errors", dims, &l.stats.TotalSendErrors),
+	}
+}
+
+// Close stops accepting connections and closes the open ones
+func (l *Listener) Close() error {
+	close(l.closing)
+	err := l.listener.Close()
+	l.mu.Lock()
+	for conn := range l.conns {
+		_ = conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+// value keeps whole numbers as ints
+func value(v float64) datapoint.Value {
+	if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+		return datapoint.NewIntValue(int64(v))
+	}
+	return datapoint.NewFloatValue(v)
+}
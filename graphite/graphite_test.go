@@ -0,0 +1,218 @@
+package graphite
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper/timekeepertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// carbon style batches pickled by python with protocols 0, 2 and 4
+var pickles = map[string]string{
+	"protocol 0": "(lp0\n(Vweb01.prod.cpu.user\np1\n(I1500000000\nF1.5\ntp2\ntp3\na(Vweb01.prod.load\np4\n(F1500000000.5\nI2\ntp5\ntp6\na(Vbad\np7\n(I1\ntp8\ntp9\na(Vweb02.prod.cpu.user\np10\n(I1500000000\nVnan\np11\ntp12\ntp13\na(Vbig\np14\n(I1500000000\nL1099511627776L\ntp15\ntp16\na(Vneg\np17\n(I-1\nI-300\ntp18\ntp19\na.",
+	"protocol 2": "\x80\x02]q\x00(X\x13\x00\x00\x00web01.prod.cpu.userq\x01J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x0f\x00\x00\x00web01.prod.loadq\x04GA\xd6Z\x0b\xc0 \x00\x00K\x02\x86q\x05\x86q\x06X\x03\x00\x00\x00badq\x07K\x01\x85q\x08\x86q\x09X\x13\x00\x00\x00web02.prod.cpu.userq\nJ\x00/hYX\x03\x00\x00\x00nanq\x0b\x86q\x0c\x86q\x0dX\x03\x00\x00\x00bigq\x0eJ\x00/hY\x8a\x06\x00\x00\x00\x00\x00\x01\x86q\x0f\x86q\x10X\x03\x00\x00\x00negq\x11J\xff\xff\xff\xffJ\xd4\xfe\xff\xff\x86q\x12\x86q\x13e.",
+	"protocol 4": "\x80\x04\x95\xaa\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x13web01.prod.cpu.user\x94J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x0fweb01.prod.load\x94GA\xd6Z\x0b\xc0 \x00\x00K\x02\x86\x94\x86\x94\x8c\x03bad\x94K\x01\x85\x94\x86\x94\x8c\x13web02.prod.cpu.user\x94J\x00/hY\x8c\x03nan\x94\x86\x94\x86\x94\x8c\x03big\x94J\x00/hY\x8a\x06\x00\x00\x00\x00\x00\x01\x86\x94\x86\x94\x8c\x03neg\x94J\xff\xff\xff\xffJ\xd4\xfe\xff\xff\x86\x94\x86\x94e.",
+}
+
+type dpSink struct {
+	mu     sync.Mutex
+	tokens []string
+	dps    []*datapoint.Datapoint
+}
+
+func (s *dpSink) AddDatapoints(ctx context.Context, dps []*datapoint.Datapoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, _ := ctx.Value(sfxclient.TokenCtxKey).(string)
+	s.tokens = append(s.tokens, token)
+	s.dps = append(s.dps, dps...)
+	return nil
+}
+
+func (s *dpSink) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.dps)
+}
+
+func testConfig(listeners string) *Config {
+	mem := distconf.Mem()
+	mem.Write("GRAPHITE_LISTENERS", []byte(listeners))
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	return conf
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		require.True(t, time.Now().Before(deadline), "timed out")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	ts, err := parseTemplates([]string{
+		"*.prod.* host.env.metric*",
+		"stats.*.* .service.metric",
+		"host.host.metric",
+	})
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		path   string
+		metric string
+		dims   map[string]string
+	}{
+		{"web01.prod.cpu.user", "cpu.user", map[string]string{"host": "web01", "env": "prod"}},
+		{"stats.api.requests", "requests", map[string]string{"service": "api"}},
+		{"stats.api.requests.total", "requests.total", map[string]string{"service": "api"}},
+		{"us.web01.load", "load", map[string]string{"host": "us.web01"}},
+		{"us", "us", map[string]string{"host": "us"}},
+	} {
+		metric, dims := ts.apply(tc.path)
+		assert.Equal(t, tc.metric, metric, tc.path)
+		assert.Equal(t, tc.dims, dims, tc.path)
+	}
+	metric, dims := templates(nil).apply("a.b")
+	assert.Equal(t, "a.b", metric)
+	assert.Empty(t, dims)
+
+	for _, bad := range []string{"metric*.host", "a b c", "[ metric"} {
+		_, err = parseTemplate(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestUnpickle(t *testing.T) {
+	l := &Listener{spec: &Spec{}, timeKeeper: timekeepertest.NewStubClock(time.Unix(1600000000, 0))}
+	for name, p := range pickles {
+		dps, err := l.parsePickle([]byte(p))
+		require.NoError(t, err, name)
+		require.Len(t, dps, 4, name)
+		assert.Equal(t, "web01.prod.cpu.user", dps[0].Metric, name)
+		assert.Equal(t, datapoint.NewFloatValue(1.5), dps[0].Value, name)
+		assert.Equal(t, time.Unix(1500000000, 0), dps[0].Timestamp, name)
+		assert.Equal(t, datapoint.NewIntValue(2), dps[1].Value, name)
+		assert.Equal(t, time.Unix(1500000000, 5e8), dps[1].Timestamp, name)
+		assert.Equal(t, datapoint.NewIntValue(1<<40), dps[2].Value, name)
+		assert.Equal(t, datapoint.NewIntValue(-300), dps[3].Value, name)
+		assert.Equal(t, time.Unix(1600000000, 0), dps[3].Timestamp, name)
+	}
+	assert.Equal(t, int64(6*len(pickles)), l.stats.TotalMetrics)
+	assert.Equal(t, int64(len(pickles)), l.stats.TotalInvalidMetrics)
+
+	v, err := unpickle([]byte("(lp0\n(S'a.b'\np1\n(I1\nI01\ntp2\ntp3\nag1\n0."))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{[]interface{}{"a.b", []interface{}{int64(1), true}}}, v.(*pyList).items)
+
+	for _, bad := range []string{"", "]", "a.", "]K", "]\x8a\x09", "\x85.", "h\x05.", "c__builtin__\neval\n.", "]e.", "NN."} {
+		_, err = unpickle([]byte(bad))
+		assert.Error(t, err, "%q", bad)
+	}
+	_, err = l.parsePickle([]byte("N."))
+	assert.Error(t, err)
+}
+
+func TestSpecs(t *testing.T) {
+	specs, err := testConfig("").Specs()
+	assert.NoError(t, err)
+	assert.Nil(t, specs)
+
+	specs, err = testConfig(`[{"name":"carbon","address":":2003","token":"T","templates":["host.metric*"]},{"name":"pickle","protocol":"pickle","address":":2004","token":"T"}]`).Specs()
+	require.NoError(t, err)
+	require.Len(t, specs, 2)
+	assert.Equal(t, Plaintext, specs[0].Protocol)
+	assert.Len(t, specs[0].templates, 1)
+	assert.Equal(t, Pickle, specs[1].Protocol)
+
+	for _, bad := range []string{
+		`{`,
+		`[{"name":"a","address":":2003"}]`,
+		`[{"name":"a","address":":2003","token":"T"},{"name":"a","address":":2004","token":"T"}]`,
+		`[{"name":"a","protocol":"udp","address":":2003","token":"T"}]`,
+		`[{"name":"a","address":":2003","token":"T","templates":["metric*.host"]}]`,
+	} {
+		_, err = testConfig(bad).Specs()
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestPlaintextListener(t *testing.T) {
+	sink := &dpSink{}
+	clock := timekeepertest.NewStubClock(time.Unix(1600000000, 0))
+	l, err := New(&Spec{Name: "carbon", Protocol: Plaintext, Address: "127.0.0.1:0", Token: "TOKEN", Templates: []string{"host.metric*"}}, sink, clock, log.Discard)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("web01.cpu.user 1.5 1500000000\nweb01.load 2\n\nnot a valid line at all\nweb01.bad x 1\nweb01.nan NaN 1\nweb01.partial 3"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return sink.len() == 2 })
+	require.NoError(t, conn.Close())
+	waitFor(t, func() bool { return sink.len() == 3 })
+
+	sink.mu.Lock()
+	assert.Equal(t, "cpu.user", sink.dps[0].Metric)
+	assert.Equal(t, map[string]string{"host": "web01"}, sink.dps[0].Dimensions)
+	assert.Equal(t, time.Unix(1500000000, 0), sink.dps[0].Timestamp)
+	assert.Equal(t, datapoint.Gauge, sink.dps[0].MetricType)
+	assert.Equal(t, time.Unix(1600000000, 0), sink.dps[1].Timestamp)
+	assert.Equal(t, "partial", sink.dps[2].Metric)
+	for _, token := range sink.tokens {
+		assert.Equal(t, "TOKEN", token)
+	}
+	sink.mu.Unlock()
+	assert.Equal(t, int64(2), atomic.LoadInt64(&l.stats.TotalInvalidMetrics))
+	assert.Len(t, l.Datapoints(), 5)
+
+	// an open connection doesn't hold up close
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	waitFor(t, func() bool { return atomic.LoadInt64(&l.stats.TotalConnections) == 2 })
+	require.NoError(t, l.Close())
+}
+
+func TestPickleListener(t *testing.T) {
+	sink := &dpSink{}
+	l, err := New(&Spec{Name: "pickle", Protocol: Pickle, Address: "127.0.0.1:0", Token: "TOKEN"}, sink, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	require.NoError(t, err)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	frame := func(p string) []byte {
+		b := make([]byte, 4, 4+len(p))
+		binary.BigEndian.PutUint32(b, uint32(len(p)))
+		return append(b, p...)
+	}
+	_, err = conn.Write(append(frame(pickles["protocol 2"]), frame(pickles["protocol 4"])...))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return sink.len() == 8 })
+
+	// a bad frame drops the connection
+	_, err = conn.Write(frame("garbage"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return atomic.LoadInt64(&l.stats.TotalInvalidMetrics) == 3 })
+
+	conn2, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	_, err = conn2.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	require.NoError(t, err)
+
+	_, err = New(&Spec{Name: "bad", Address: "127.0.0.1:0", Templates: []string{"metric*.x"}}, sink, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	assert.Error(t, err)
+}
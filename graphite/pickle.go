@@ -0,0 +1,421 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The pickle protocol is a stack machine.  unpickle supports the opcodes python's pickle module uses for carbon's
+// list of (path, (timestamp, value)) tuples in protocols 0 through 4, and nothing that could construct objects.
+
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opInt            = 'I'
+	opBinInt         = 'J'
+	opBinInt1        = 'K'
+	opBinInt2        = 'M'
+	opLong           = 'L'
+	opNone           = 'N'
+	opFloat          = 'F'
+	opBinFloat       = 'G'
+	opString         = 'S'
+	opBinString      = 'T'
+	opShortBinString = 'U'
+	opUnicode        = 'V'
+	opBinUnicode     = 'X'
+	opBinBytes       = 'B'
+	opShortBinBytes  = 'C'
+	opAppend         = 'a'
+	opAppends        = 'e'
+	opList           = 'l'
+	opEmptyList      = ']'
+	opTuple          = 't'
+	opEmptyTuple     = ')'
+	opGet            = 'g'
+	opBinGet         = 'h'
+	opLongBinGet     = 'j'
+	opPut            = 'p'
+	opBinPut         = 'q'
+	opLongBinPut     = 'r'
+	opProto          = 0x80
+	opTuple1         = 0x85
+	opTuple2         = 0x86
+	opTuple3         = 0x87
+	opNewTrue        = 0x88
+	opNewFalse       = 0x89
+	opLong1          = 0x8a
+	opShortBinUni    = 0x8c
+	opMemoize        = 0x94
+	opFrame          = 0x95
+)
+
+var errPickleStack = errors.New("invalid pickle: stack underflow")
+
+// pyList is a python list.  Lists are mutable and may be memoized, so they are shared by pointer.
+type pyList struct {
+	items []interface{}
+}
+
+// mark is pushed by opMark and collected by the opcodes that take everything above it
+type mark struct{}
+
+type unpickler struct {
+	b     []byte
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+// unpickle returns the object in b.  Lists are *pyList and tuples []interface{}.
+func unpickle(b []byte) (interface{}, error) {
+	u := &unpickler{b: b, memo: make(map[int]interface{})}
+	for len(u.b) > 0 {
+		op := u.b[0]
+		u.b = u.b[1:]
+		if op == opStop {
+			if len(u.stack) != 1 {
+				return nil, errors.New("invalid pickle: stack not empty at stop")
+			}
+			return u.stack[0], nil
+		}
+		if err := u.step(op); err != nil {
+			return nil, err
+		}
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+func (u *unpickler) step(op byte) error {
+	switch op {
+	case opProto:
+		_, err := u.read(1)
+		return err
+	case opFrame:
+		_, err := u.read(8)
+		return err
+	case opMark:
+		u.push(mark{})
+	case opPop:
+		_, err := u.pop()
+		return err
+	case opNone:
+		u.push(nil)
+	case opNewTrue:
+		u.push(true)
+	case opNewFalse:
+		u.push(false)
+	case opEmptyList:
+		u.push(&pyList{})
+	case opEmptyTuple:
+		u.push([]interface{}{})
+	default:
+		return u.stepNumber(op)
+	}
+	return nil
+}
+
+func (u *unpickler) stepNumber(op byte) error {
+	switch op {
+	case opBinInt:
+		return u.binInt(4)
+	case opBinInt1:
+		return u.binInt(1)
+	case opBinInt2:
+		return u.binInt(2)
+	case opLong1:
+		return u.long1()
+	case opBinFloat:
+		b, err := u.read(8)
+		if err != nil {
+			return err
+		}
+		u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case opInt, opLong, opFloat:
+		return u.textNumber(op)
+	default:
+		return u.stepString(op)
+	}
+	return nil
+}
+
+// binInt reads a little endian integer of size bytes, which is signed only for four bytes
+func (u *unpickler) binInt(size int) error {
+	b, err := u.read(size)
+	if err != nil {
+		return err
+	}
+	switch size {
+	case 1:
+		u.push(int64(b[0]))
+	case 2:
+		u.push(int64(binary.LittleEndian.Uint16(b)))
+	default:
+		u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+	}
+	return nil
+}
+
+// long1 reads a little endian two's complement integer of up to 8 bytes
+func (u *unpickler) long1() error {
+	n, err := u.read(1)
+	if err != nil {
+		return err
+	}
+	b, err := u.read(int(n[0]))
+	if err != nil {
+		return err
+	}
+	if len(b) > 8 {
+		return errors.New("invalid pickle: integer too large")
+	}
+	var v int64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | int64(b[i])
+	}
+	if len(b) > 0 && len(b) < 8 && b[len(b)-1]&0x80 != 0 {
+		v -= 1 << (8 * uint(len(b)))
+	}
+	u.push(v)
+	return nil
+}
+
+// textNumber reads the newline terminated numbers of protocol 0
+func (u *unpickler) textNumber(op byte) error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	switch {
+	case op == opFloat:
+		v, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return err
+		}
+		u.push(v)
+	case op == opInt && (line == "00" || line == "01"):
+		u.push(line == "01")
+	default:
+		v, err := strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64)
+		if err != nil {
+			return err
+		}
+		u.push(v)
+	}
+	return nil
+}
+
+func (u *unpickler) stepString(op byte) error {
+	switch op {
+	case opString:
+		return u.quotedString()
+	case opUnicode:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		u.push(line)
+	case opShortBinString, opShortBinUni, opShortBinBytes:
+		return u.sizedString(1)
+	case opBinString, opBinUnicode, opBinBytes:
+		return u.sizedString(4)
+	default:
+		return u.stepCollection(op)
+	}
+	return nil
+}
+
+// quotedString reads the python repr of a string used by protocol 0
+func (u *unpickler) quotedString() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	s, err := strconv.Unquote(line)
+	if err != nil {
+		if len(line) < 2 || line[0] != '\'' || line[len(line)-1] != '\'' {
+			return fmt.Errorf("invalid pickle string %s", line)
+		}
+		s = line[1 : len(line)-1]
+	}
+	u.push(s)
+	return nil
+}
+
+// sizedString reads a string prefixed by its length in sizeBytes little endian bytes
+func (u *unpickler) sizedString(sizeBytes int) error {
+	b, err := u.read(sizeBytes)
+	if err != nil {
+		return err
+	}
+	size := int(b[0])
+	if sizeBytes == 4 {
+		size = int(binary.LittleEndian.Uint32(b))
+	}
+	if b, err = u.read(size); err != nil {
+		return err
+	}
+	u.push(string(b))
+	return nil
+}
+
+func (u *unpickler) stepCollection(op byte) error {
+	switch op {
+	case opAppend:
+		v, err := u.pop()
+		if err != nil {
+			return err
+		}
+		return u.appendTo(v)
+	case opAppends:
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		return u.appendTo(items...)
+	case opList:
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(&pyList{items: items})
+	case opTuple:
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(items)
+	case opTuple1, opTuple2, opTuple3:
+		return u.tupleN(int(op-opTuple1) + 1)
+	default:
+		return u.stepMemo(op)
+	}
+	return nil
+}
+
+func (u *unpickler) tupleN(n int) error {
+	if len(u.stack) < n {
+		return errPickleStack
+	}
+	items := append([]interface{}{}, u.stack[len(u.stack)-n:]...)
+	u.stack = u.stack[:len(u.stack)-n]
+	u.push(items)
+	return nil
+}
+
+func (u *unpickler) stepMemo(op byte) error {
+	switch op {
+	case opMemoize:
+		if len(u.stack) == 0 {
+			return errPickleStack
+		}
+		u.memo[len(u.memo)] = u.stack[len(u.stack)-1]
+	case opPut, opBinPut, opLongBinPut:
+		key, err := u.memoKey(op, opPut, opBinPut)
+		if err != nil {
+			return err
+		}
+		if len(u.stack) == 0 {
+			return errPickleStack
+		}
+		u.memo[key] = u.stack[len(u.stack)-1]
+	case opGet, opBinGet, opLongBinGet:
+		key, err := u.memoKey(op, opGet, opBinGet)
+		if err != nil {
+			return err
+		}
+		v, ok := u.memo[key]
+		if !ok {
+			return fmt.Errorf("invalid pickle: memo %d not found", key)
+		}
+		u.push(v)
+	default:
+		return fmt.Errorf("unsupported pickle opcode 0x%02x", op)
+	}
+	return nil
+}
+
+// memoKey reads the key of a get or put, which is text, one byte or four bytes depending on the opcode
+func (u *unpickler) memoKey(op byte, text byte, oneByte byte) (int, error) {
+	switch op {
+	case text:
+		line, err := u.readLine()
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(line)
+	case oneByte:
+		b, err := u.read(1)
+		if err != nil {
+			return 0, err
+		}
+		return int(b[0]), nil
+	}
+	b, err := u.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.LittleEndian.Uint32(b)), nil
+}
+
+func (u *unpickler) appendTo(items ...interface{}) error {
+	if len(u.stack) == 0 {
+		return errPickleStack
+	}
+	l, ok := u.stack[len(u.stack)-1].(*pyList)
+	if !ok {
+		return errors.New("invalid pickle: append to something that isn't a list")
+	}
+	l.items = append(l.items, items...)
+	return nil
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errPickleStack
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+// popMark pops everything above the topmost mark, and the mark
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(mark); ok {
+			items := append([]interface{}{}, u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errors.New("invalid pickle: mark not found")
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || len(u.b) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := u.b[:n]
+	u.b = u.b[n:]
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	i := bytes.IndexByte(u.b, '\n')
+	if i < 0 {
+		return "", io.ErrUnexpectedEOF
+	}
+	line := string(u.b[:i])
+	u.b = u.b[i+1:]
+	return line, nil
+}
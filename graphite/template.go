@@ -0,0 +1,119 @@
+package graphite
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	metricField     = "metric"
+	metricRestField = "metric*"
+)
+
+// template turns a dotted graphite path into a metric name and dimensions.  Each field of the template names what the
+// path field in the same position is: "metric" for part of the metric name, "metric*" for the rest of the path, an
+// empty field to drop it, or anything else for the dimension to put it in.  With a filter, like "*.prod.*", the
+// template only applies to paths whose leading fields match it.
+type template struct {
+	filter []string
+	fields []string
+}
+
+// parseTemplate parses "[filter ]template"
+func parseTemplate(s string) (*template, error) {
+	parts := strings.Fields(s)
+	t := &template{}
+	switch len(parts) {
+	case 1:
+		t.fields = strings.Split(parts[0], ".")
+	case 2:
+		t.filter = strings.Split(parts[0], ".")
+		for _, f := range t.filter {
+			if _, err := path.Match(f, ""); err != nil {
+				return nil, fmt.Errorf("invalid graphite template filter %q: %s", parts[0], err)
+			}
+		}
+		t.fields = strings.Split(parts[1], ".")
+	default:
+		return nil, fmt.Errorf("invalid graphite template %q", s)
+	}
+	for i, f := range t.fields {
+		if f == metricRestField && i != len(t.fields)-1 {
+			return nil, fmt.Errorf("invalid graphite template %q: %s must be the last field", s, metricRestField)
+		}
+	}
+	return t, nil
+}
+
+// matches checks each field of the filter against the path field in the same position
+func (t *template) matches(p string) bool {
+	if len(t.filter) == 0 {
+		return true
+	}
+	fields := strings.SplitN(p, ".", len(t.filter)+1)
+	if len(fields) < len(t.filter) {
+		return false
+	}
+	for i, f := range t.filter {
+		if matched, _ := path.Match(f, fields[i]); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// apply splits p into a metric and dimensions.  Path fields past the end of the template become part of the metric,
+// and a dimension named more than once joins its fields with dots.  If the template picks out no metric the whole
+// path is used.
+func (t *template) apply(p string) (string, map[string]string) {
+	fields := strings.Split(p, ".")
+	var metric []string
+	dims := make(map[string]string)
+	i := 0
+	for ; i < len(fields) && i < len(t.fields); i++ {
+		switch name := t.fields[i]; name {
+		case "":
+		case metricField:
+			metric = append(metric, fields[i])
+		case metricRestField:
+			return strings.Join(append(metric, fields[i:]...), "."), dims
+		default:
+			if existing, ok := dims[name]; ok {
+				dims[name] = existing + "." + fields[i]
+			} else {
+				dims[name] = fields[i]
+			}
+		}
+	}
+	metric = append(metric, fields[i:]...)
+	if len(metric) == 0 {
+		return p, dims
+	}
+	return strings.Join(metric, "."), dims
+}
+
+// templates are tried in order, and the first that matches a path is used
+type templates []*template
+
+func parseTemplates(raw []string) (templates, error) {
+	ts := make(templates, 0, len(raw))
+	for _, s := range raw {
+		t, err := parseTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// apply uses the first matching template, or the whole path as the metric if none match
+func (ts templates) apply(p string) (string, map[string]string) {
+	for _, t := range ts {
+		if t.matches(p) {
+			return t.apply(p)
+		}
+	}
+	return p, map[string]string{}
+}
@@ -0,0 +1,53 @@
+package httpbody
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Read reads the whole request body, replacing it with one that can be read again and resent
+func Read(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	Set(req, body)
+	return body, nil
+}
+
+// Set makes body the request's body, setting its length and GetBody so it can be resent
+func Set(req *http.Request, body []byte) {
+	req.ContentLength = int64(len(body))
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// Drain reads and closes the response body so the connection can be reused
+func Drain(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+// Accepted is the response handed back to a sink for a request that was taken to be sent later
+func Accepted(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(strings.NewReader(`"OK"`)),
+		ContentLength: 4,
+		Request:       req,
+	}
+}
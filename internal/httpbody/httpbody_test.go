@@ -0,0 +1,42 @@
+package httpbody
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRead(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/v2/datapoint", bytes.NewBufferString("body"))
+	require.NoError(t, err)
+	body, err := Read(req)
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+	assert.Equal(t, int64(4), req.ContentLength)
+	again, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(again))
+	rc, err := req.GetBody()
+	require.NoError(t, err)
+	again, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(again))
+
+	req.Body = nil
+	body, err = Read(req)
+	assert.NoError(t, err)
+	assert.Nil(t, body)
+}
+
+func TestAccepted(t *testing.T) {
+	resp := Accepted(nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, resp.ContentLength, int64(len(b)))
+	Drain(resp)
+}
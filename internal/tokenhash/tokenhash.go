@@ -0,0 +1,25 @@
+package tokenhash
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// dimensionLength is how much of the hash is kept in a dimension, enough to tell tokens apart without the dimension
+// being usable as the token
+const dimensionLength = 12
+
+// Other is the dimension that counts for tokens past the most a counter keeps track of are reported under.  It can't
+// be mistaken for a token's Dimension, which is hex.
+const Other = "other"
+
+// Sum returns the hex encoded sha1 of the token
+func Sum(token string) string {
+	sum := sha1.Sum([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Dimension returns the start of the token's Sum, to report a token as a dimension without leaking it
+func Dimension(token string) string {
+	return Sum(token)[:dimensionLength]
+}
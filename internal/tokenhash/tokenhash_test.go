@@ -0,0 +1,13 @@
+package tokenhash
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenHash(t *testing.T) {
+	assert.Equal(t, "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", Sum("test"))
+	assert.Equal(t, "a94a8fe5ccb1", Dimension("test"))
+	assert.NotEqual(t, Dimension("test"), Dimension("other"))
+}
@@ -0,0 +1,326 @@
+package limits
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/pops/sinkerr"
+)
+
+type kind int
+
+const (
+	bodyBytes kind = iota
+	decompressedBodyBytes
+	datapoints
+	spans
+	dimensions
+	dimensionKeyLength
+	dimensionValueLength
+	numKinds
+)
+
+var kindNames = [numKinds]string{"body_bytes", "decompressed_body_bytes", "datapoints", "spans", "dimensions", "dimension_key_length", "dimension_value_length"}
+
+// Config configures the default limits of every protocol.  Zero means unlimited.
+type Config struct {
+	Limits    [numKinds]*distconf.Int
+	Overrides *distconf.Str
+}
+
+// Load the limits config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.Limits[bodyBytes] = d.Int("MAX_BODY_BYTES", 32<<20)
+	c.Limits[decompressedBodyBytes] = d.Int("MAX_DECOMPRESSED_BODY_BYTES", 128<<20)
+	c.Limits[datapoints] = d.Int("MAX_DATAPOINTS_PER_REQUEST", 0)
+	c.Limits[spans] = d.Int("MAX_SPANS_PER_REQUEST", 0)
+	c.Limits[dimensions] = d.Int("MAX_DIMENSIONS", 0)
+	c.Limits[dimensionKeyLength] = d.Int("MAX_DIMENSION_KEY_LENGTH", 0)
+	c.Limits[dimensionValueLength] = d.Int("MAX_DIMENSION_VALUE_LENGTH", 0)
+	c.Overrides = d.Str("LIMITS_OVERRIDES", "")
+}
+
+// Limits override the configured defaults for a protocol.  Unset limits fall back to the default and zero means
+// unlimited.
+type Limits struct {
+	BodyBytes             *int64 `json:"max_body_bytes,omitempty"`
+	DecompressedBodyBytes *int64 `json:"max_decompressed_body_bytes,omitempty"`
+	Datapoints            *int64 `json:"max_datapoints_per_request,omitempty"`
+	Spans                 *int64 `json:"max_spans_per_request,omitempty"`
+	Dimensions            *int64 `json:"max_dimensions,omitempty"`
+	DimensionKeyLength    *int64 `json:"max_dimension_key_length,omitempty"`
+	DimensionValueLength  *int64 `json:"max_dimension_value_length,omitempty"`
+}
+
+func (l *Limits) get(k kind) *int64 {
+	if l == nil {
+		return nil
+	}
+	return [numKinds]*int64{l.BodyBytes, l.DecompressedBodyBytes, l.Datapoints, l.Spans, l.Dimensions, l.DimensionKeyLength, l.DimensionValueLength}[k]
+}
+
+// Overrides are the limits of individual protocols, by protocol name
+type Overrides map[string]*Limits
+
+func parseOverrides(s string) (Overrides, error) {
+	o := Overrides{}
+	if s == "" {
+		return o, nil
+	}
+	if err := json.Unmarshal([]byte(s), &o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// ErrExceeded is the reason a request was refused for going over one of its protocol's limits
+type ErrExceeded struct {
+	Protocol string
+	Limit    string
+	Max      int64
+}
+
+func (e *ErrExceeded) Error() string {
+	return fmt.Sprintf("%s request exceeds the limit of %d for %s", e.Protocol, e.Max, e.Limit)
+}
+
+// Limiter holds the limits of every protocol
+type Limiter struct {
+	conf   *Config
+	logger log.Logger
+
+	mu        sync.RWMutex
+	overrides Overrides
+}
+
+// New returns a Limiter for conf, parsing the overrides and watching them for changes
+func New(conf *Config, logger log.Logger) (*Limiter, error) {
+	l := &Limiter{conf: conf, logger: logger}
+	var err error
+	if l.overrides, err = parseOverrides(conf.Overrides.Get()); err != nil {
+		return nil, fmt.Errorf("unable to parse limits overrides: %s", err)
+	}
+	conf.Overrides.Watch(func(str *distconf.Str, oldValue string) {
+		o, err := parseOverrides(str.Get())
+		if err != nil {
+			l.logger.Log(log.Err, err, "unable to parse limits overrides")
+			return
+		}
+		l.mu.Lock()
+		l.overrides = o
+		l.mu.Unlock()
+	})
+	return l, nil
+}
+
+// Protocol returns the limits of the protocol called name
+func (l *Limiter) Protocol(name string) *Protocol {
+	return &Protocol{limiter: l, name: name}
+}
+
+func (l *Limiter) max(protocol string, k kind) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if m := l.overrides[protocol].get(k); m != nil {
+		return *m
+	}
+	return l.conf.Limits[k].Get()
+}
+
+// Protocol enforces the limits of one protocol.  Request bodies are limited as they are read and datapoints, events
+// and spans by the Protocol's signalfx.NextSink methods once they are decoded.
+type Protocol struct {
+	limiter *Limiter
+	name    string
+
+	stats struct {
+		TotalRejected [numKinds]int64
+	}
+}
+
+var _ signalfx.NextSink = &Protocol{}
+
+// exceeded counts a request going over the limit for k and returns the error to refuse it with.  Requests over the
+// dimension limits are invalid rather than too large, since splitting them up wouldn't help.
+func (p *Protocol) exceeded(k kind, max int64) error {
+	atomic.AddInt64(&p.stats.TotalRejected[k], 1)
+	refusal := sinkerr.TooLarge
+	switch k {
+	case dimensions, dimensionKeyLength, dimensionValueLength:
+		refusal = sinkerr.Invalid
+	}
+	return &sinkerr.Error{Kind: refusal, Err: &ErrExceeded{Protocol: p.name, Limit: kindNames[k], Max: max}}
+}
+
+// limitedReader returns an error once more than max bytes have been read
+type limitedReader struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  func() error
+	err       error
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	// read one byte past the limit to tell a body of exactly max bytes from a longer one
+	if int64(len(b)) > r.remaining+1 {
+		b = b[:r.remaining+1]
+	}
+	n, err := r.ReadCloser.Read(b)
+	if int64(n) > r.remaining {
+		r.err = r.exceeded()
+		return int(r.remaining), r.err
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func (p *Protocol) limitBody(body io.ReadCloser, k kind, exceeded func(error)) io.ReadCloser {
+	max := p.limiter.max(p.name, k)
+	if max <= 0 || body == nil {
+		return body
+	}
+	return &limitedReader{ReadCloser: body, remaining: max, exceeded: func() error {
+		err := p.exceeded(k, max)
+		exceeded(err)
+		return err
+	}}
+}
+
+// Body limits a request body as it is received.  A body that says it is too large is refused before any of it is
+// read.  Reading past the limit returns the error to refuse the request with, which is also passed to exceeded for
+// decoders that don't return it.
+func (p *Protocol) Body(body io.ReadCloser, contentLength int64, exceeded func(error)) (io.ReadCloser, error) {
+	if max := p.limiter.max(p.name, bodyBytes); max > 0 && contentLength > max {
+		return nil, p.exceeded(bodyBytes, max)
+	}
+	return p.limitBody(body, bodyBytes, exceeded), nil
+}
+
+// MaxDecompressedBodyBytes returns the most a request body may decompress to, or zero if there is no limit
+func (p *Protocol) MaxDecompressedBodyBytes() int64 {
+	return p.limiter.max(p.name, decompressedBodyBytes)
+}
+
+// DecompressedBody limits a request body once it has been decompressed, the same way as Body
+func (p *Protocol) DecompressedBody(body io.ReadCloser, exceeded func(error)) io.ReadCloser {
+	return p.limitBody(body, decompressedBodyBytes, exceeded)
+}
+
+// request counts what has been sent for a request so far, since decoders may send a request's data in parts
+type request struct {
+	counts [numKinds]int64
+}
+
+type requestKey struct{}
+
+// WithRequest returns a context for a request that the per request limits are counted on
+func WithRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestKey{}, &request{})
+}
+
+// add counts n more of k for the request on ctx, or just n if there isn't one, returning false if that is over max
+func add(ctx context.Context, k kind, n int, max int64) bool {
+	total := int64(n)
+	if r, ok := ctx.Value(requestKey{}).(*request); ok {
+		total = atomic.AddInt64(&r.counts[k], total)
+	}
+	return total <= max
+}
+
+func (p *Protocol) checkCount(ctx context.Context, k kind, n int) error {
+	if max := p.limiter.max(p.name, k); max > 0 && !add(ctx, k, n, max) {
+		return p.exceeded(k, max)
+	}
+	return nil
+}
+
+// dimensionLimits are the limits on the dimensions of each datapoint and event, looked up once for all of them
+type dimensionLimits struct {
+	p                 *Protocol
+	count, key, value int64
+}
+
+// dimensionLimits returns the protocol's dimension limits, and false if there aren't any
+func (p *Protocol) dimensionLimits() (*dimensionLimits, bool) {
+	d := &dimensionLimits{
+		p:     p,
+		count: p.limiter.max(p.name, dimensions),
+		key:   p.limiter.max(p.name, dimensionKeyLength),
+		value: p.limiter.max(p.name, dimensionValueLength),
+	}
+	return d, d.count > 0 || d.key > 0 || d.value > 0
+}
+
+func (d *dimensionLimits) check(dims map[string]string) error {
+	if d.count > 0 && int64(len(dims)) > d.count {
+		return d.p.exceeded(dimensions, d.count)
+	}
+	for key, value := range dims {
+		if d.key > 0 && int64(len(key)) > d.key {
+			return d.p.exceeded(dimensionKeyLength, d.key)
+		}
+		if d.value > 0 && int64(len(value)) > d.value {
+			return d.p.exceeded(dimensionValueLength, d.value)
+		}
+	}
+	return nil
+}
+
+// AddDatapoints forwards the datapoints if the request is within its datapoints limit and every datapoint is within
+// the dimension limits
+func (p *Protocol) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	if err := p.checkCount(ctx, datapoints, len(points)); err != nil {
+		return err
+	}
+	if limits, ok := p.dimensionLimits(); ok {
+		for _, dp := range points {
+			if err := limits.check(dp.Dimensions); err != nil {
+				return err
+			}
+		}
+	}
+	return next.AddDatapoints(ctx, points)
+}
+
+// AddEvents forwards the events if every event is within the dimension limits
+func (p *Protocol) AddEvents(ctx context.Context, evts []*event.Event, next signalfx.Sink) error {
+	if limits, ok := p.dimensionLimits(); ok {
+		for _, e := range evts {
+			if err := limits.check(e.Dimensions); err != nil {
+				return err
+			}
+		}
+	}
+	return next.AddEvents(ctx, evts)
+}
+
+// AddSpans forwards the spans if the request is within its spans limit
+func (p *Protocol) AddSpans(ctx context.Context, spns []*trace.Span, next signalfx.Sink) error {
+	if err := p.checkCount(ctx, spans, len(spns)); err != nil {
+		return err
+	}
+	return next.AddSpans(ctx, spns)
+}
+
+// Datapoints returns how many requests were rejected for going over each limit
+func (p *Protocol) Datapoints() []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0, numKinds)
+	for k, name := range kindNames {
+		dps = append(dps, sfxclient.CumulativeP("limits.rejected", map[string]string{"reason": name}, &p.stats.TotalRejected[k]))
+	}
+	return dps
+}
@@ -0,0 +1,186 @@
+package limits
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/pops/sinkerr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopSink struct{}
+
+func (nopSink) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return nil }
+func (nopSink) AddEvents(context.Context, []*event.Event) error             { return nil }
+func (nopSink) AddSpans(context.Context, []*trace.Span) error               { return nil }
+
+func testLimiter(t *testing.T, values map[string]string) (*Limiter, distconf.ReaderWriter) {
+	mem := distconf.Mem()
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	l, err := New(conf, log.Discard)
+	require.NoError(t, err)
+	return l, mem
+}
+
+func rejected(p *Protocol, reason string) int64 {
+	for _, dp := range p.Datapoints() {
+		if dp.Dimensions["reason"] == reason {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return -1
+}
+
+func assertRefused(t *testing.T, err error, kind sinkerr.Kind, msg string) {
+	e, ok := sinkerr.As(err)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, kind, e.Kind)
+		assert.EqualError(t, err, msg)
+	}
+}
+
+func TestBody(t *testing.T) {
+	l, _ := testLimiter(t, map[string]string{"MAX_BODY_BYTES": "10", "MAX_DECOMPRESSED_BODY_BYTES": "20"})
+	p := l.Protocol("sfx_json_v2")
+
+	_, err := p.Body(ioutil.NopCloser(strings.NewReader("")), 11, nil)
+	assertRefused(t, err, sinkerr.TooLarge, "sfx_json_v2 request exceeds the limit of 10 for body_bytes")
+
+	body, err := p.Body(ioutil.NopCloser(strings.NewReader("0123456789")), -1, nil)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(body)
+	assert.NoError(t, err, "a body of exactly the limit is fine")
+	assert.Equal(t, "0123456789", string(b))
+
+	var exceeded error
+	body, err = p.Body(ioutil.NopCloser(strings.NewReader("0123456789a")), -1, func(err error) { exceeded = err })
+	require.NoError(t, err)
+	b, err = ioutil.ReadAll(body)
+	assertRefused(t, err, sinkerr.TooLarge, "sfx_json_v2 request exceeds the limit of 10 for body_bytes")
+	assert.Equal(t, err, exceeded)
+	assert.Equal(t, "0123456789", string(b))
+	_, err = body.Read(make([]byte, 1))
+	assert.Equal(t, exceeded, err, "the error sticks")
+	assert.Equal(t, int64(2), rejected(p, "body_bytes"))
+
+	decompressed := p.DecompressedBody(ioutil.NopCloser(bytes.NewReader(make([]byte, 21))), func(err error) { exceeded = err })
+	_, err = ioutil.ReadAll(decompressed)
+	assertRefused(t, err, sinkerr.TooLarge, "sfx_json_v2 request exceeds the limit of 20 for decompressed_body_bytes")
+	assert.Equal(t, int64(1), rejected(p, "decompressed_body_bytes"))
+
+	assert.Nil(t, p.DecompressedBody(nil, nil))
+}
+
+func TestUnlimited(t *testing.T) {
+	l, _ := testLimiter(t, map[string]string{"MAX_BODY_BYTES": "0", "MAX_DECOMPRESSED_BODY_BYTES": "0"})
+	p := l.Protocol("sapm")
+	body := ioutil.NopCloser(strings.NewReader("anything"))
+	limited, err := p.Body(body, 1<<40, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, body, limited)
+	assert.Equal(t, body, p.DecompressedBody(body, nil))
+
+	sink := signalfx.FromChain(nopSink{}, signalfx.NextWrap(p))
+	ctx := context.Background()
+	assert.NoError(t, sink.AddDatapoints(ctx, make([]*datapoint.Datapoint, 1000)))
+	assert.NoError(t, sink.AddSpans(ctx, make([]*trace.Span, 1000)))
+}
+
+func TestPerRequestCounts(t *testing.T) {
+	l, _ := testLimiter(t, map[string]string{"MAX_DATAPOINTS_PER_REQUEST": "3", "MAX_SPANS_PER_REQUEST": "2"})
+	p := l.Protocol("sfx_json_v1")
+	sink := signalfx.FromChain(nopSink{}, signalfx.NextWrap(p))
+	dp := datapoint.New("m", nil, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())
+
+	// without a request each call is limited on its own
+	ctx := context.Background()
+	assert.NoError(t, sink.AddDatapoints(ctx, []*datapoint.Datapoint{dp, dp, dp}))
+	assert.NoError(t, sink.AddDatapoints(ctx, []*datapoint.Datapoint{dp, dp, dp}))
+
+	ctx = WithRequest(context.Background())
+	assert.NoError(t, sink.AddDatapoints(ctx, []*datapoint.Datapoint{dp, dp}))
+	assert.NoError(t, sink.AddDatapoints(ctx, []*datapoint.Datapoint{dp}))
+	assertRefused(t, sink.AddDatapoints(ctx, []*datapoint.Datapoint{dp}), sinkerr.TooLarge, "sfx_json_v1 request exceeds the limit of 3 for datapoints")
+	assert.NoError(t, sink.AddSpans(ctx, make([]*trace.Span, 2)))
+	assertRefused(t, sink.AddSpans(ctx, make([]*trace.Span, 1)), sinkerr.TooLarge, "sfx_json_v1 request exceeds the limit of 2 for spans")
+	assert.NoError(t, sink.AddEvents(ctx, make([]*event.Event, 10)), "events are not counted")
+	assert.Equal(t, int64(1), rejected(p, "datapoints"))
+	assert.Equal(t, int64(1), rejected(p, "spans"))
+}
+
+func TestDimensions(t *testing.T) {
+	l, _ := testLimiter(t, map[string]string{"MAX_DIMENSIONS": "2", "MAX_DIMENSION_KEY_LENGTH": "3", "MAX_DIMENSION_VALUE_LENGTH": "4"})
+	p := l.Protocol("event_json_v2")
+	sink := signalfx.FromChain(nopSink{}, signalfx.NextWrap(p))
+	ctx := context.Background()
+	for _, tc := range []struct {
+		dims   map[string]string
+		reason string
+	}{
+		{map[string]string{"abc": "abcd", "a": "b"}, ""},
+		{map[string]string{"a": "a", "b": "b", "c": "c"}, "dimensions"},
+		{map[string]string{"abcd": "a"}, "dimension_key_length"},
+		{map[string]string{"a": "abcde"}, "dimension_value_length"},
+	} {
+		dp := datapoint.New("m", tc.dims, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())
+		ev := event.New("e", event.USERDEFINED, tc.dims, time.Now())
+		for _, err := range []error{sink.AddDatapoints(ctx, []*datapoint.Datapoint{dp}), sink.AddEvents(ctx, []*event.Event{ev})} {
+			if tc.reason == "" {
+				assert.NoError(t, err)
+				continue
+			}
+			e, ok := sinkerr.As(err)
+			if assert.True(t, ok, tc.reason) {
+				assert.Equal(t, sinkerr.Invalid, e.Kind)
+				assert.Equal(t, tc.reason, e.Err.(*ErrExceeded).Limit)
+			}
+		}
+		if tc.reason != "" {
+			assert.Equal(t, int64(2), rejected(p, tc.reason))
+		}
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	l, mem := testLimiter(t, map[string]string{
+		"MAX_DATAPOINTS_PER_REQUEST": "1",
+		"LIMITS_OVERRIDES":           `{"sfx_protobuf_v2": {"max_datapoints_per_request": 2}, "otlp_metrics": {"max_datapoints_per_request": 0}}`,
+	})
+	dps := make([]*datapoint.Datapoint, 2)
+	ctx := context.Background()
+	add := func(protocol string) error {
+		return signalfx.FromChain(nopSink{}, signalfx.NextWrap(l.Protocol(protocol))).AddDatapoints(ctx, dps)
+	}
+	assert.Error(t, add("sfx_json_v2"))
+	assert.NoError(t, add("sfx_protobuf_v2"))
+	assert.NoError(t, add("otlp_metrics"), "zero overrides the default with unlimited")
+
+	mem.Write("LIMITS_OVERRIDES", []byte(`{"sfx_json_v2": {"max_datapoints_per_request": 5}}`))
+	assert.NoError(t, add("sfx_json_v2"))
+	assert.Error(t, add("sfx_protobuf_v2"))
+
+	mem.Write("LIMITS_OVERRIDES", []byte(`{`))
+	assert.NoError(t, add("sfx_json_v2"), "bad overrides are ignored")
+
+	mem = distconf.Mem()
+	mem.Write("LIMITS_OVERRIDES", []byte(`[]`))
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	_, err := New(conf, log.Discard)
+	assert.Error(t, err)
+}
@@ -0,0 +1,189 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/signalfx/golib/v3/distconf"
+)
+
+// Main is the name of the listener on POPS_PORT.  Requests that didn't come through a named listener are treated as
+// coming through it.
+const Main = "main"
+
+// Config configures which endpoints the main listener serves and any additional listeners
+type Config struct {
+	MainEndpoints *distconf.Str
+	Listeners     *distconf.Str
+}
+
+// Load the listener config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.MainEndpoints = d.Str("POPS_ENDPOINTS", "")
+	c.Listeners = d.Str("POPS_LISTENERS", "")
+}
+
+// Main returns the endpoints the main listener serves, or nil for all of them
+func (c *Config) Main() []string {
+	if endpoints := c.MainEndpoints.Get(); endpoints != "" {
+		return strings.Split(endpoints, ",")
+	}
+	return nil
+}
+
+// Duration is a time.Duration that is written as a string like "10s" in JSON
+type Duration time.Duration
+
+// UnmarshalJSON parses the duration from a string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+// Spec describes an additional listener.  Network is "tcp" or "unix", and an empty list of endpoints serves them all.
+type Spec struct {
+	Name         string   `json:"name"`
+	Network      string   `json:"network,omitempty"`
+	Address      string   `json:"address"`
+	Endpoints    []string `json:"endpoints,omitempty"`
+	ReadTimeout  Duration `json:"read_timeout,omitempty"`
+	WriteTimeout Duration `json:"write_timeout,omitempty"`
+}
+
+// Specs returns the additional listeners, checking they are valid
+func (c *Config) Specs() ([]*Spec, error) {
+	raw := c.Listeners.Get()
+	if raw == "" {
+		return nil, nil
+	}
+	var specs []*Spec
+	if err := json.Unmarshal([]byte(raw), &specs); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{Main: true}
+	for _, s := range specs {
+		if s.Name == "" || s.Address == "" {
+			return nil, errors.New("listeners need a name and an address")
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("listener name %s is used more than once", s.Name)
+		}
+		names[s.Name] = true
+		if s.Network == "" {
+			s.Network = "tcp"
+		}
+		if s.Network != "tcp" && s.Network != "unix" {
+			return nil, fmt.Errorf("listener %s has unknown network %s", s.Name, s.Network)
+		}
+	}
+	return specs, nil
+}
+
+// Listen opens the listener.  A socket file left behind by a previous process is removed first.
+func (s *Spec) Listen() (net.Listener, error) {
+	if s.Network == "unix" {
+		if info, err := os.Stat(s.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(s.Address); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return net.Listen(s.Network, s.Address)
+}
+
+// Timeouts returns the read and write timeouts, using def for any that aren't set
+func (s *Spec) Timeouts(def time.Duration) (time.Duration, time.Duration) {
+	read, write := time.Duration(s.ReadTimeout), time.Duration(s.WriteTimeout)
+	if read == 0 {
+		read = def
+	}
+	if write == 0 {
+		write = def
+	}
+	return read, write
+}
+
+type ctxKey int
+
+const nameKey ctxKey = iota
+
+// WithName returns a context for requests that arrive on the named listener.  It's meant for http.Server.BaseContext.
+func WithName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, nameKey, name)
+}
+
+func nameFromContext(ctx context.Context) string {
+	if name, ok := ctx.Value(nameKey).(string); ok {
+		return name
+	}
+	return Main
+}
+
+// Endpoints gates each endpoint's routes so they only match requests from listeners that serve that endpoint
+type Endpoints struct {
+	router   *mux.Router
+	serves   map[string]map[string]bool
+	declared map[string]bool
+}
+
+// NewEndpoints returns Endpoints that add their routes to router
+func NewEndpoints(router *mux.Router) *Endpoints {
+	return &Endpoints{
+		router:   router,
+		serves:   make(map[string]map[string]bool),
+		declared: make(map[string]bool),
+	}
+}
+
+// Serve declares which endpoints a listener serves.  An empty list serves every endpoint.
+func (e *Endpoints) Serve(listener string, endpoints []string) {
+	if len(endpoints) == 0 {
+		e.serves[listener] = nil
+		return
+	}
+	set := make(map[string]bool, len(endpoints))
+	for _, endpoint := range endpoints {
+		set[strings.TrimSpace(endpoint)] = true
+	}
+	e.serves[listener] = set
+}
+
+// Route returns the router to register the endpoint's routes on
+func (e *Endpoints) Route(endpoint string) *mux.Router {
+	e.declared[endpoint] = true
+	return e.router.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		set, ok := e.serves[nameFromContext(r.Context())]
+		return ok && (set == nil || set[endpoint])
+	}).Subrouter()
+}
+
+// Validate returns an error if a listener names an endpoint that was never routed
+func (e *Endpoints) Validate() error {
+	var unknown []string
+	for listener, set := range e.serves {
+		for endpoint := range set {
+			if !e.declared[endpoint] {
+				unknown = append(unknown, fmt.Sprintf("%s (on %s)", endpoint, listener))
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown endpoints: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
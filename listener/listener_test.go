@@ -0,0 +1,127 @@
+package listener
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig(values map[string]string) *Config {
+	mem := distconf.Mem()
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	c := &Config{}
+	c.Load(distconf.New([]distconf.Reader{mem}))
+	return c
+}
+
+func TestSpecs(t *testing.T) {
+	specs, err := testConfig(nil).Specs()
+	assert.NoError(t, err)
+	assert.Empty(t, specs)
+	assert.Nil(t, testConfig(nil).Main())
+	assert.Equal(t, []string{"a", "b"}, testConfig(map[string]string{"POPS_ENDPOINTS": "a,b"}).Main())
+
+	specs, err = testConfig(map[string]string{"POPS_LISTENERS": `[
+		{"name": "traces", "address": ":8101", "endpoints": ["span_json_v1"], "read_timeout": "5s"},
+		{"name": "sidecar", "network": "unix", "address": "/tmp/pops.sock"}
+	]`}).Specs()
+	require.NoError(t, err)
+	require.Len(t, specs, 2)
+	assert.Equal(t, "tcp", specs[0].Network)
+	read, write := specs[0].Timeouts(time.Minute)
+	assert.Equal(t, 5*time.Second, read)
+	assert.Equal(t, time.Minute, write)
+	assert.Equal(t, "unix", specs[1].Network)
+
+	for _, bad := range []string{
+		`[`,
+		`[{"name": "a"}]`,
+		`[{"address": ":1"}]`,
+		`[{"name": "main", "address": ":1"}]`,
+		`[{"name": "a", "address": ":1"}, {"name": "a", "address": ":2"}]`,
+		`[{"name": "a", "network": "udp", "address": ":1"}]`,
+		`[{"name": "a", "address": ":1", "read_timeout": "soon"}]`,
+		`[{"name": "a", "address": ":1", "read_timeout": 5}]`,
+	} {
+		_, err := testConfig(map[string]string{"POPS_LISTENERS": bad}).Specs()
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	router := mux.NewRouter()
+	e := NewEndpoints(router)
+	e.Serve(Main, []string{"metrics"})
+	e.Serve("traces", []string{"traces"})
+	e.Serve("all", nil)
+	ok := func(rw http.ResponseWriter, _ *http.Request) { _, _ = rw.Write([]byte("OK")) }
+	e.Route("metrics").Path("/v2/datapoint").Methods(http.MethodPost).HandlerFunc(ok)
+	e.Route("traces").Path("/v1/trace").Methods(http.MethodPost).HandlerFunc(ok)
+	assert.NoError(t, e.Validate())
+
+	status := func(listener string, path string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if listener != "" {
+			req = req.WithContext(WithName(req.Context(), listener))
+		}
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusOK, status("", "/v2/datapoint"))
+	assert.Equal(t, http.StatusNotFound, status("", "/v1/trace"))
+	assert.Equal(t, http.StatusNotFound, status("traces", "/v2/datapoint"))
+	assert.Equal(t, http.StatusOK, status("traces", "/v1/trace"))
+	assert.Equal(t, http.StatusOK, status("all", "/v1/trace"))
+	assert.Equal(t, http.StatusNotFound, status("unknown", "/v1/trace"))
+
+	e.Serve("typo", []string{"tarces"})
+	assert.Error(t, e.Validate())
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	spec := &Spec{Name: "sidecar", Network: "unix", Address: filepath.Join(dir, "pops.sock")}
+
+	// a socket left over from a previous run is replaced
+	stale, err := spec.Listen()
+	require.NoError(t, err)
+	if unix, ok := stale.(*net.UnixListener); ok {
+		unix.SetUnlinkOnClose(false)
+	}
+	require.NoError(t, stale.Close())
+	l, err := spec.Listen()
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(nameFromContext(req.Context())))
+		}),
+		BaseContext: func(net.Listener) context.Context { return WithName(context.Background(), spec.Name) },
+	}
+	go func() { _ = server.Serve(l) }()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", spec.Address)
+	}}}
+	resp, err := client.Get("http://pops/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "sidecar", string(body))
+}
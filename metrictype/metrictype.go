@@ -0,0 +1,300 @@
+package metrictype
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/com_signalfx_metrics_protobuf"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/config/globbing"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/pops/filewatch"
+)
+
+// Config configures how the type of v1 datapoints, which don't carry one, is worked out
+type Config struct {
+	RulesFile      *distconf.Str
+	ReloadInterval *distconf.Duration
+	Learn          *distconf.Bool
+	MaxLearned     *distconf.Int
+}
+
+// Load the metric type config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.RulesFile = d.Str("METRIC_TYPE_RULES_FILE", "")
+	c.ReloadInterval = d.Duration("METRIC_TYPE_RELOAD_INTERVAL", 10*time.Second)
+	c.Learn = d.Bool("METRIC_TYPE_LEARN", false)
+	c.MaxLearned = d.Int("METRIC_TYPE_MAX_LEARNED", 100000)
+}
+
+// Rule gives Type to metrics named Metric, matching Glob, where only "*" is special, or matching Regex.  Exactly one
+// of them must be set.  Type is gauge, counter, cumulative_counter or enum.
+type Rule struct {
+	Metric string `json:"metric,omitempty"`
+	Glob   string `json:"glob,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	Type   string `json:"type"`
+
+	metricType com_signalfx_metrics_protobuf.MetricType
+	matches    func(string) bool
+}
+
+func (r *Rule) compile(index int) error {
+	var err error
+	if r.metricType, err = parseType(r.Type); err != nil {
+		return fmt.Errorf("rule %d: %s", index, err)
+	}
+	set := 0
+	for _, s := range []string{r.Metric, r.Glob, r.Regex} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("rule %d must have exactly one of metric, glob and regex", index)
+	}
+	switch {
+	case r.Glob != "":
+		r.matches = globbing.GetGlob(r.Glob).Match
+	case r.Regex != "":
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return fmt.Errorf("rule %d: %s", index, err)
+		}
+		r.matches = re.MatchString
+	}
+	return nil
+}
+
+func parseType(s string) (com_signalfx_metrics_protobuf.MetricType, error) {
+	t, ok := com_signalfx_metrics_protobuf.MetricType_value[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown metric type %q", s)
+	}
+	return com_signalfx_metrics_protobuf.MetricType(t), nil
+}
+
+// Rules are loaded from the rules file.  Exact metric names win over globs and regexes, which are tried in order.
+// Metrics nothing matches get Default, or gauge if it isn't set.
+type Rules struct {
+	Default string  `json:"default,omitempty"`
+	Rules   []*Rule `json:"rules,omitempty"`
+
+	defaultType com_signalfx_metrics_protobuf.MetricType
+	exact       map[string]com_signalfx_metrics_protobuf.MetricType
+	patterns    []*Rule
+}
+
+func parseRules(b []byte) (*Rules, error) {
+	rules := &Rules{}
+	if err := json.Unmarshal(b, rules); err != nil {
+		return nil, err
+	}
+	return rules, rules.compile()
+}
+
+func (r *Rules) compile() error {
+	r.exact = make(map[string]com_signalfx_metrics_protobuf.MetricType)
+	if r.Default != "" {
+		var err error
+		if r.defaultType, err = parseType(r.Default); err != nil {
+			return err
+		}
+	}
+	for i, rule := range r.Rules {
+		if err := rule.compile(i); err != nil {
+			return err
+		}
+		if rule.Metric == "" {
+			r.patterns = append(r.patterns, rule)
+		} else if _, exists := r.exact[rule.Metric]; !exists {
+			r.exact[rule.Metric] = rule.metricType
+		}
+	}
+	return nil
+}
+
+// Sources of a metric's type, in the order they are tried
+const (
+	sourceExact = iota
+	sourcePattern
+	sourceLearned
+	sourceDefault
+	numSources
+)
+
+var sourceNames = [numSources]string{"exact", "pattern", "learned", "default"}
+
+// learnable are the v2 metric types that have a v1 equivalent
+var learnable = map[datapoint.MetricType]com_signalfx_metrics_protobuf.MetricType{
+	datapoint.Gauge:   com_signalfx_metrics_protobuf.MetricType_GAUGE,
+	datapoint.Count:   com_signalfx_metrics_protobuf.MetricType_COUNTER,
+	datapoint.Enum:    com_signalfx_metrics_protobuf.MetricType_ENUM,
+	datapoint.Counter: com_signalfx_metrics_protobuf.MetricType_CUMULATIVE_COUNTER,
+}
+
+// Getter is the signalfx.MericTypeGetter for the v1 endpoints.  It uses the rules file and, when METRIC_TYPE_LEARN is
+// set, the type last seen for the same metric name in v2 traffic passing through its signalfx.NextSink methods.
+type Getter struct {
+	conf    *Config
+	watcher *filewatch.Watcher
+
+	mu      sync.RWMutex
+	rules   *Rules
+	learned map[string]com_signalfx_metrics_protobuf.MetricType
+
+	stats struct {
+		TotalResolved   [numSources]int64
+		TotalNotLearned int64
+	}
+}
+
+var _ signalfx.MericTypeGetter = &Getter{}
+var _ signalfx.NextSink = &Getter{}
+
+// New returns a Getter for conf, loading the rules file if there is one and watching it for changes
+func New(conf *Config, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Getter, error) {
+	g := &Getter{
+		conf:    conf,
+		rules:   &Rules{},
+		learned: make(map[string]com_signalfx_metrics_protobuf.MetricType),
+	}
+	if err := g.rules.compile(); err != nil {
+		return nil, err
+	}
+	if path := conf.RulesFile.Get(); path != "" {
+		var err error
+		if g.watcher, err = filewatch.New(path, conf.ReloadInterval.Get(), g.load, timeKeeper, logger); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func (g *Getter) load(b []byte) error {
+	rules, err := parseRules(b)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.rules = rules
+	g.mu.Unlock()
+	return nil
+}
+
+// GetMetricTypeFromMap returns the type of metricName
+func (g *Getter) GetMetricTypeFromMap(metricName string) com_signalfx_metrics_protobuf.MetricType {
+	t, source := g.resolve(metricName)
+	atomic.AddInt64(&g.stats.TotalResolved[source], 1)
+	return t
+}
+
+func (g *Getter) resolve(metricName string) (com_signalfx_metrics_protobuf.MetricType, int) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if t, ok := g.rules.exact[metricName]; ok {
+		return t, sourceExact
+	}
+	for _, r := range g.rules.patterns {
+		if r.matches(metricName) {
+			return r.metricType, sourcePattern
+		}
+	}
+	if t, ok := g.learned[metricName]; ok {
+		return t, sourceLearned
+	}
+	return g.rules.defaultType, sourceDefault
+}
+
+// AddDatapoints learns the types of the datapoints before forwarding them
+func (g *Getter) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	if g.conf.Learn.Get() {
+		g.learn(points)
+	}
+	return next.AddDatapoints(ctx, points)
+}
+
+// learn remembers the type of each datapoint, but only as many metric names as METRIC_TYPE_MAX_LEARNED.  The write
+// lock is only taken when a batch has something new to learn, which once the names are known is almost never.
+func (g *Getter) learn(points []*datapoint.Datapoint) {
+	unknown := g.unknown(points)
+	if len(unknown) == 0 {
+		return
+	}
+	limit := int(g.conf.MaxLearned.Get())
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, dp := range unknown {
+		t := learnable[dp.MetricType]
+		if _, exists := g.learned[dp.Metric]; !exists && len(g.learned) >= limit {
+			g.stats.TotalNotLearned++
+			continue
+		}
+		g.learned[dp.Metric] = t
+	}
+}
+
+// unknown returns the learnable datapoints whose metric names haven't been learned yet or were learned with another type
+func (g *Getter) unknown(points []*datapoint.Datapoint) []*datapoint.Datapoint {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var unknown []*datapoint.Datapoint
+	for _, dp := range points {
+		t, ok := learnable[dp.MetricType]
+		if !ok {
+			continue
+		}
+		if known, exists := g.learned[dp.Metric]; !exists || known != t {
+			unknown = append(unknown, dp)
+		}
+	}
+	return unknown
+}
+
+// AddEvents forwards the events
+func (g *Getter) AddEvents(ctx context.Context, evts []*event.Event, next signalfx.Sink) error {
+	return next.AddEvents(ctx, evts)
+}
+
+// AddSpans forwards the spans
+func (g *Getter) AddSpans(ctx context.Context, spns []*trace.Span, next signalfx.Sink) error {
+	return next.AddSpans(ctx, spns)
+}
+
+// Datapoints returns how each metric's type was worked out and how many names have been learned
+func (g *Getter) Datapoints() []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0, numSources+2)
+	for source, name := range sourceNames {
+		dps = append(dps, sfxclient.CumulativeP("metrictype.resolved", map[string]string{"source": name}, &g.stats.TotalResolved[source]))
+	}
+	g.mu.RLock()
+	dps = append(dps,
+		sfxclient.Gauge("metrictype.learned", nil, int64(len(g.learned))),
+		sfxclient.Cumulative("metrictype.not_learned", nil, g.stats.TotalNotLearned),
+	)
+	g.mu.RUnlock()
+	if g.watcher != nil {
+		dps = append(dps, g.watcher.Datapoints()...)
+	}
+	return dps
+}
+
+// Close stops watching the rules file
+func (g *Getter) Close() error {
+	if g.watcher != nil {
+		return g.watcher.Close()
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package metrictype
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/signalfx/com_signalfx_metrics_protobuf"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/timekeeper/timekeepertest"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	gauge             = com_signalfx_metrics_protobuf.MetricType_GAUGE
+	counter           = com_signalfx_metrics_protobuf.MetricType_COUNTER
+	cumulativeCounter = com_signalfx_metrics_protobuf.MetricType_CUMULATIVE_COUNTER
+	enum              = com_signalfx_metrics_protobuf.MetricType_ENUM
+)
+
+type lastSink struct {
+	dps []*datapoint.Datapoint
+}
+
+func (s *lastSink) AddDatapoints(_ context.Context, dps []*datapoint.Datapoint) error {
+	s.dps = dps
+	return nil
+}
+func (s *lastSink) AddEvents(context.Context, []*event.Event) error { return nil }
+func (s *lastSink) AddSpans(context.Context, []*trace.Span) error   { return nil }
+
+func testGetter(t *testing.T, values map[string]string) (*Getter, *timekeepertest.StubClock, distconf.ReaderWriter) {
+	mem := distconf.Mem()
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	clock := timekeepertest.NewStubClock(time.Now())
+	g, err := New(conf, clock, log.Discard)
+	require.NoError(t, err)
+	return g, clock, mem
+}
+
+func resolved(g *Getter, source string) int64 {
+	for _, dp := range g.Datapoints() {
+		if dp.Metric == "metrictype.resolved" && dp.Dimensions["source"] == source {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return 0
+}
+
+func TestDefaultsToGauge(t *testing.T) {
+	g, _, _ := testGetter(t, nil)
+	defer g.Close()
+	assert.Equal(t, gauge, g.GetMetricTypeFromMap("anything"))
+	assert.Equal(t, int64(1), resolved(g, "default"))
+}
+
+func TestRulesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrictype")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"default": "counter", "rules": [
+		{"regex": "^jvm\\..*_total$", "type": "cumulative_counter"},
+		{"glob": "*.state", "type": "enum"},
+		{"metric": "jvm.gc_total", "type": "gauge"},
+		{"metric": "jvm.gc_total", "type": "counter"}
+	]}`), 0600))
+
+	g, clock, _ := testGetter(t, map[string]string{"METRIC_TYPE_RULES_FILE": path})
+	defer g.Close()
+	assert.Equal(t, cumulativeCounter, g.GetMetricTypeFromMap("jvm.threads_total"))
+	assert.Equal(t, enum, g.GetMetricTypeFromMap("service.state"))
+	assert.Equal(t, gauge, g.GetMetricTypeFromMap("jvm.gc_total"), "exact names win and the first one is used")
+	assert.Equal(t, counter, g.GetMetricTypeFromMap("requests"))
+	// only * is special in globs
+	assert.Equal(t, counter, g.GetMetricTypeFromMap("a.state?"))
+	assert.Equal(t, int64(1), resolved(g, "exact"))
+	assert.Equal(t, int64(2), resolved(g, "pattern"))
+	assert.Equal(t, int64(2), resolved(g, "default"))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"rules": [{"glob": "request*", "type": "cumulative_counter"}]}`), 0600))
+	for start := time.Now(); g.GetMetricTypeFromMap("requests") != cumulativeCounter; time.Sleep(time.Millisecond) {
+		require.True(t, time.Since(start) < 5*time.Second, "rules never reloaded")
+		clock.Incr(10 * time.Second)
+	}
+	assert.Equal(t, gauge, g.GetMetricTypeFromMap("service.state"))
+}
+
+func TestLearn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrictype")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"rules": [{"metric": "pinned", "type": "gauge"}]}`), 0600))
+
+	g, _, mem := testGetter(t, map[string]string{"METRIC_TYPE_RULES_FILE": path, "METRIC_TYPE_MAX_LEARNED": "3"})
+	defer g.Close()
+	next := &lastSink{}
+	sink := signalfx.FromChain(next, signalfx.NextWrap(g))
+	ctx := context.Background()
+	dps := []*datapoint.Datapoint{
+		datapoint.New("errors", nil, datapoint.NewIntValue(1), datapoint.Count, time.Now()),
+		datapoint.New("requests", nil, datapoint.NewIntValue(1), datapoint.Counter, time.Now()),
+		datapoint.New("pinned", nil, datapoint.NewIntValue(1), datapoint.Count, time.Now()),
+	}
+
+	require.NoError(t, sink.AddDatapoints(ctx, dps))
+	assert.Equal(t, dps, next.dps)
+	assert.Equal(t, gauge, g.GetMetricTypeFromMap("requests"), "nothing is learned until METRIC_TYPE_LEARN is set")
+
+	mem.Write("METRIC_TYPE_LEARN", []byte("true"))
+	require.NoError(t, sink.AddDatapoints(ctx, dps))
+	assert.Equal(t, cumulativeCounter, g.GetMetricTypeFromMap("requests"))
+	assert.Equal(t, counter, g.GetMetricTypeFromMap("errors"))
+	assert.Equal(t, gauge, g.GetMetricTypeFromMap("pinned"), "rules win over what is learned")
+	assert.Equal(t, int64(2), resolved(g, "learned"))
+	assert.Empty(t, g.unknown(dps), "batches of known names don't need the write lock")
+
+	// the types of known names keep being updated once the limit is reached, but new names aren't learned
+	require.NoError(t, sink.AddDatapoints(ctx, []*datapoint.Datapoint{
+		datapoint.New("new", nil, datapoint.NewIntValue(1), datapoint.Counter, time.Now()),
+		datapoint.New("errors", nil, datapoint.NewIntValue(1), datapoint.Enum, time.Now()),
+		datapoint.New("rate", nil, datapoint.NewIntValue(1), datapoint.Rate, time.Now()),
+	}))
+	assert.Equal(t, gauge, g.GetMetricTypeFromMap("new"))
+	assert.Equal(t, enum, g.GetMetricTypeFromMap("errors"))
+	for _, dp := range g.Datapoints() {
+		switch dp.Metric {
+		case "metrictype.learned":
+			assert.Equal(t, datapoint.NewIntValue(3), dp.Value)
+		case "metrictype.not_learned":
+			assert.Equal(t, datapoint.NewIntValue(1), dp.Value)
+		}
+	}
+
+	assert.NoError(t, sink.AddEvents(ctx, nil))
+	assert.NoError(t, sink.AddSpans(ctx, nil))
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, bad := range []string{
+		`{`,
+		`{"default": "histogram"}`,
+		`{"rules": [{"metric": "a", "type": "histogram"}]}`,
+		`{"rules": [{"type": "gauge"}]}`,
+		`{"rules": [{"metric": "a", "glob": "a*", "type": "gauge"}]}`,
+		`{"rules": [{"regex": "(", "type": "gauge"}]}`,
+	} {
+		_, err := parseRules([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+
+	mem := distconf.Mem()
+	mem.Write("METRIC_TYPE_RULES_FILE", []byte("/does/not/exist"))
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	_, err := New(conf, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	assert.Error(t, err)
+}
@@ -0,0 +1,309 @@
+package obfuscate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/config/globbing"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx/spanobfuscation"
+	"github.com/signalfx/pops/filewatch"
+)
+
+// Config configures which span tags are obfuscated, removed and redacted
+type Config struct {
+	RulesFile      *distconf.Str
+	ReloadInterval *distconf.Duration
+}
+
+// Load the obfuscate config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.RulesFile = d.Str("OBFUSCATE_RULES_FILE", "")
+	c.ReloadInterval = d.Duration("OBFUSCATE_RELOAD_INTERVAL", 10*time.Second)
+}
+
+const (
+	// ActionObfuscate replaces the value of each of a rule's tags with spanobfuscation.OBFUSCATED
+	ActionObfuscate = "obfuscate"
+	// ActionRemove deletes each of a rule's tags
+	ActionRemove = "remove"
+	// ActionRedact replaces whatever a rule's regex matches in the values of its tags with spanobfuscation.OBFUSCATED
+	ActionRedact = "redact"
+)
+
+// Rule changes the tags of the spans whose service matches the Service glob and whose name matches the Operation
+// glob, either of which matches everything if it isn't set.  Obfuscate and remove rules are spanobfuscation rules and
+// need Tags.  Redact rules need a Regex and apply to every tag if they have no Tags.
+type Rule struct {
+	Name      string   `json:"name,omitempty"`
+	Action    string   `json:"action"`
+	Service   string   `json:"service,omitempty"`
+	Operation string   `json:"operation,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Regex     string   `json:"regex,omitempty"`
+
+	// tagSink applies obfuscate and remove rules, and pending picks out the tags it hasn't changed yet
+	tagSink trace.Sink
+	pending func(value string, ok bool) bool
+	// service, operation and re apply redact rules
+	service   func(string) bool
+	operation func(string) bool
+	re        *regexp.Regexp
+	changed   *int64
+}
+
+func (r *Rule) compile(index int) error {
+	if r.Name == "" {
+		r.Name = strconv.Itoa(index)
+	}
+	if r.Regex != "" && r.Action != ActionRedact {
+		return fmt.Errorf("rule %s can only have a regex if it redacts", r.Name)
+	}
+	var err error
+	switch r.Action {
+	case ActionObfuscate:
+		r.pending = func(value string, ok bool) bool { return ok && value != spanobfuscation.OBFUSCATED }
+		r.tagSink, err = spanobfuscation.NewObf(r.tagMatchRules(), discard{})
+	case ActionRemove:
+		r.pending = func(_ string, ok bool) bool { return ok }
+		r.tagSink, err = spanobfuscation.NewRm(r.tagMatchRules(), discard{})
+	case ActionRedact:
+		err = r.compileRedact()
+	default:
+		return fmt.Errorf("rule %s has unknown action %q", r.Name, r.Action)
+	}
+	if err != nil {
+		return fmt.Errorf("rule %s: %s", r.Name, err)
+	}
+	return nil
+}
+
+func (r *Rule) tagMatchRules() []*spanobfuscation.TagMatchRuleConfig {
+	conf := &spanobfuscation.TagMatchRuleConfig{Tags: r.Tags}
+	if r.Service != "" {
+		conf.Service = &r.Service
+	}
+	if r.Operation != "" {
+		conf.Operation = &r.Operation
+	}
+	return []*spanobfuscation.TagMatchRuleConfig{conf}
+}
+
+func (r *Rule) compileRedact() error {
+	if r.Regex == "" {
+		return fmt.Errorf("redact rules need a regex")
+	}
+	var err error
+	if r.re, err = regexp.Compile(r.Regex); err != nil {
+		return err
+	}
+	r.service = globbing.GetGlob(defaultGlob(r.Service)).Match
+	r.operation = globbing.GetGlob(defaultGlob(r.Operation)).Match
+	return nil
+}
+
+func defaultGlob(g string) string {
+	if g == "" {
+		return "*"
+	}
+	return g
+}
+
+// apply changes the tags of the spans and returns how many it changed
+func (r *Rule) apply(ctx context.Context, spans []*trace.Span) int64 {
+	if r.re != nil {
+		return r.redact(spans)
+	}
+	before := r.countPending(spans)
+	_ = r.tagSink.AddSpans(ctx, spans)
+	return before - r.countPending(spans)
+}
+
+func (r *Rule) countPending(spans []*trace.Span) int64 {
+	var count int64
+	for _, s := range spans {
+		for _, tag := range r.Tags {
+			if value, ok := s.Tags[tag]; r.pending(value, ok) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func (r *Rule) redact(spans []*trace.Span) int64 {
+	var count int64
+	for _, s := range spans {
+		if !r.service(serviceName(s)) || !r.operation(spanName(s)) {
+			continue
+		}
+		for tag, value := range s.Tags {
+			if !r.redacts(tag) {
+				continue
+			}
+			if redacted := r.re.ReplaceAllLiteralString(value, spanobfuscation.OBFUSCATED); redacted != value {
+				s.Tags[tag] = redacted
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func (r *Rule) redacts(tag string) bool {
+	if len(r.Tags) == 0 {
+		return true
+	}
+	for _, t := range r.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func serviceName(s *trace.Span) string {
+	if s.LocalEndpoint != nil && s.LocalEndpoint.ServiceName != nil {
+		return *s.LocalEndpoint.ServiceName
+	}
+	return ""
+}
+
+func spanName(s *trace.Span) string {
+	if s.Name != nil {
+		return *s.Name
+	}
+	return ""
+}
+
+// discard is the sink after a rule's spanobfuscation sink, which only changes the spans given to it
+type discard struct{}
+
+func (discard) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return nil }
+func (discard) AddEvents(context.Context, []*event.Event) error             { return nil }
+func (discard) AddSpans(context.Context, []*trace.Span) error               { return nil }
+
+// Rules are loaded from the rules file and applied in order
+type Rules struct {
+	Rules []*Rule `json:"rules,omitempty"`
+}
+
+func parseRules(b []byte) (*Rules, error) {
+	rules := &Rules{}
+	if err := json.Unmarshal(b, rules); err != nil {
+		return nil, err
+	}
+	for i, r := range rules.Rules {
+		if err := r.compile(i); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// ruleKey is what a rule's count is kept under, so it starts again if a reload changes what the rule does
+type ruleKey struct {
+	action string
+	name   string
+}
+
+// Obfuscator is a signalfx.NextSink that obfuscates, removes and redacts span tags according to a set of rules
+type Obfuscator struct {
+	watcher *filewatch.Watcher
+
+	mu      sync.RWMutex
+	rules   *Rules
+	changed map[ruleKey]*int64
+}
+
+var _ signalfx.NextSink = &Obfuscator{}
+
+// New returns an Obfuscator for conf, loading the rules file if there is one and watching it for changes
+func New(conf *Config, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Obfuscator, error) {
+	o := &Obfuscator{
+		rules:   &Rules{},
+		changed: make(map[ruleKey]*int64),
+	}
+	if path := conf.RulesFile.Get(); path != "" {
+		var err error
+		if o.watcher, err = filewatch.New(path, conf.ReloadInterval.Get(), o.load, timeKeeper, logger); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *Obfuscator) load(b []byte) error {
+	rules, err := parseRules(b)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	// rules keep counting where they left off across reloads
+	for _, rule := range rules.Rules {
+		key := ruleKey{action: rule.Action, name: rule.Name}
+		if rule.changed = o.changed[key]; rule.changed == nil {
+			rule.changed = new(int64)
+			o.changed[key] = rule.changed
+		}
+	}
+	o.rules = rules
+	return nil
+}
+
+// AddDatapoints forwards the datapoints, which aren't changed
+func (o *Obfuscator) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	return next.AddDatapoints(ctx, points)
+}
+
+// AddEvents forwards the events, which aren't changed
+func (o *Obfuscator) AddEvents(ctx context.Context, events []*event.Event, next signalfx.Sink) error {
+	return next.AddEvents(ctx, events)
+}
+
+// AddSpans obfuscates, removes and redacts the tags of the spans and forwards them
+func (o *Obfuscator) AddSpans(ctx context.Context, spans []*trace.Span, next signalfx.Sink) error {
+	o.mu.RLock()
+	rules := o.rules
+	o.mu.RUnlock()
+	for _, rule := range rules.Rules {
+		atomic.AddInt64(rule.changed, rule.apply(ctx, spans))
+	}
+	return next.AddSpans(ctx, spans)
+}
+
+// Datapoints returns how many tags each rule obfuscated, removed or redacted
+func (o *Obfuscator) Datapoints() []*datapoint.Datapoint {
+	o.mu.RLock()
+	dps := make([]*datapoint.Datapoint, 0, len(o.changed))
+	for key, changed := range o.changed {
+		dps = append(dps, sfxclient.CumulativeP("obfuscate.tags", map[string]string{"rule": key.name, "action": key.action}, changed))
+	}
+	o.mu.RUnlock()
+	if o.watcher != nil {
+		dps = append(dps, o.watcher.Datapoints()...)
+	}
+	return dps
+}
+
+// Close stops watching the rules file
+func (o *Obfuscator) Close() error {
+	if o.watcher != nil {
+		return o.watcher.Close()
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package obfuscate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `{
+  "rules": [
+    {"name": "sql", "action": "obfuscate", "service": "db-*", "tags": ["db.statement"]},
+    {"name": "auth", "action": "remove", "operation": "GET *", "tags": ["http.request.header.authorization"]},
+    {"name": "emails", "action": "redact", "regex": "[a-z.]+@[a-z.]+"},
+    {"name": "cards", "action": "redact", "service": "billing", "tags": ["card"], "regex": "[0-9]{12}"}
+  ]
+}`
+
+// recorder keeps the spans that reach it
+type recorder struct {
+	spans []*trace.Span
+}
+
+func (r *recorder) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return nil }
+func (r *recorder) AddEvents(context.Context, []*event.Event) error             { return nil }
+
+func (r *recorder) AddSpans(ctx context.Context, spans []*trace.Span) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func testObfuscator(t *testing.T, rules string) (*Obfuscator, string, func()) {
+	dir, err := ioutil.TempDir("", "obfuscate")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(rules), 0600))
+	mem := distconf.Mem()
+	mem.Write("OBFUSCATE_RULES_FILE", []byte(path))
+	mem.Write("OBFUSCATE_RELOAD_INTERVAL", []byte("1ms"))
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	o, err := New(conf, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	return o, path, func() {
+		_ = o.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func span(service string, name string, tags map[string]string) *trace.Span {
+	return &trace.Span{Name: pointer.String(name), LocalEndpoint: &trace.Endpoint{ServiceName: pointer.String(service)}, Tags: tags}
+}
+
+func send(o *Obfuscator, spans ...*trace.Span) []*trace.Span {
+	r := &recorder{}
+	_ = signalfx.FromChain(r, signalfx.NextWrap(o)).AddSpans(context.Background(), spans)
+	return r.spans
+}
+
+func changed(o *Obfuscator, rule string, action string) int64 {
+	for _, dp := range o.Datapoints() {
+		if dp.Metric == "obfuscate.tags" && dp.Dimensions["rule"] == rule && dp.Dimensions["action"] == action {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return -1
+}
+
+func TestObfuscator(t *testing.T) {
+	o, _, cleanup := testObfuscator(t, testRules)
+	defer cleanup()
+
+	spans := send(o,
+		span("db-users", "select", map[string]string{"db.statement": "SELECT * FROM users WHERE email = 'bob@example.com'"}),
+		span("api", "select", map[string]string{"db.statement": "SELECT 1"}),
+		span("api", "GET /users", map[string]string{"http.request.header.authorization": "Bearer abc", "user": "contact bob@example.com or amy@example.com"}),
+		span("api", "POST /users", map[string]string{"http.request.header.authorization": "Bearer abc"}),
+		span("billing", "charge", map[string]string{"card": "card 123456789012", "order": "123456789012"}),
+		&trace.Span{},
+	)
+	assert.Equal(t, map[string]string{"db.statement": "<obfuscated>"}, spans[0].Tags, "obfuscated before it is redacted")
+	assert.Equal(t, "SELECT 1", spans[1].Tags["db.statement"])
+	assert.Equal(t, map[string]string{"user": "contact <obfuscated> or <obfuscated>"}, spans[2].Tags)
+	assert.Equal(t, "Bearer abc", spans[3].Tags["http.request.header.authorization"])
+	assert.Equal(t, map[string]string{"card": "card <obfuscated>", "order": "123456789012"}, spans[4].Tags)
+
+	assert.Equal(t, int64(1), changed(o, "sql", ActionObfuscate))
+	assert.Equal(t, int64(1), changed(o, "auth", ActionRemove))
+	assert.Equal(t, int64(1), changed(o, "emails", ActionRedact))
+	assert.Equal(t, int64(1), changed(o, "cards", ActionRedact))
+
+	send(o, span("db-users", "select", map[string]string{"db.statement": "<obfuscated>"}))
+	assert.Equal(t, int64(1), changed(o, "sql", ActionObfuscate), "tags that are already obfuscated aren't counted")
+}
+
+func TestNoRules(t *testing.T) {
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{distconf.Mem()}))
+	o, err := New(conf, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	tags := map[string]string{"db.statement": "SELECT 1"}
+	assert.Equal(t, tags, send(o, span("db", "select", tags))[0].Tags)
+	sink := signalfx.FromChain(&recorder{}, signalfx.NextWrap(o))
+	assert.NoError(t, sink.AddDatapoints(context.Background(), nil))
+	assert.NoError(t, sink.AddEvents(context.Background(), nil))
+	assert.NoError(t, o.Close())
+}
+
+func TestReload(t *testing.T) {
+	o, path, cleanup := testObfuscator(t, testRules)
+	defer cleanup()
+	send(o, span("db-users", "select", map[string]string{"db.statement": "SELECT 1"}))
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"rules": [{"name": "sql", "action": "remove", "tags": ["db.statement"]}]}`), 0600))
+	for {
+		if _, ok := send(o, span("db-users", "select", map[string]string{"db.statement": "SELECT 1"}))[0].Tags["db.statement"]; !ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, changed(o, "sql", ActionObfuscate) > 0)
+	assert.Equal(t, int64(1), changed(o, "sql", ActionRemove), "a rule that does something else counts from zero")
+}
+
+func TestBadRules(t *testing.T) {
+	for _, rules := range []string{
+		`{`,
+		`{"rules": [{"tags": ["a"]}]}`,
+		`{"rules": [{"action": "hash", "tags": ["a"]}]}`,
+		`{"rules": [{"action": "obfuscate"}]}`,
+		`{"rules": [{"action": "remove", "tags": [""]}]}`,
+		`{"rules": [{"action": "remove", "tags": ["a"], "regex": "a"}]}`,
+		`{"rules": [{"action": "redact"}]}`,
+		`{"rules": [{"action": "redact", "regex": "("}]}`,
+	} {
+		_, err := parseRules([]byte(rules))
+		assert.Error(t, err, rules)
+	}
+}
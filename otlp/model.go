@@ -0,0 +1,262 @@
+package otlp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// The types below are the parts of the OTLP metrics and trace protocols that POPS converts.  Each decodes from both
+// the OTLP/JSON encoding through its json tags and from protobuf through unmarshalProto in wire.go, using the field
+// numbers from opentelemetry-proto.  Anything else in a request is skipped.
+
+type exportMetricsRequest struct {
+	ResourceMetrics []*resourceMetrics `json:"resourceMetrics"`
+}
+
+type resourceMetrics struct {
+	Resource     *resource       `json:"resource"`
+	ScopeMetrics []*scopeMetrics `json:"scopeMetrics"`
+}
+
+type scopeMetrics struct {
+	Metrics []*metric `json:"metrics"`
+}
+
+type metric struct {
+	Name      string     `json:"name"`
+	Gauge     *gauge     `json:"gauge"`
+	Sum       *sum       `json:"sum"`
+	Histogram *histogram `json:"histogram"`
+	Summary   *summary   `json:"summary"`
+}
+
+type gauge struct {
+	DataPoints []*numberDataPoint `json:"dataPoints"`
+}
+
+const (
+	temporalityDelta      = 1
+	temporalityCumulative = 2
+)
+
+type sum struct {
+	DataPoints             []*numberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                `json:"aggregationTemporality"`
+	IsMonotonic            bool               `json:"isMonotonic"`
+}
+
+type numberDataPoint struct {
+	Attributes   []*keyValue  `json:"attributes"`
+	TimeUnixNano uint64Value  `json:"timeUnixNano"`
+	AsDouble     *doubleValue `json:"asDouble"`
+	AsInt        *int64Value  `json:"asInt"`
+}
+
+type histogram struct {
+	DataPoints             []*histogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+}
+
+type histogramDataPoint struct {
+	Attributes     []*keyValue   `json:"attributes"`
+	TimeUnixNano   uint64Value   `json:"timeUnixNano"`
+	Count          uint64Value   `json:"count"`
+	Sum            *doubleValue  `json:"sum"`
+	BucketCounts   []uint64Value `json:"bucketCounts"`
+	ExplicitBounds []doubleValue `json:"explicitBounds"`
+}
+
+type summary struct {
+	DataPoints []*summaryDataPoint `json:"dataPoints"`
+}
+
+type summaryDataPoint struct {
+	Attributes     []*keyValue        `json:"attributes"`
+	TimeUnixNano   uint64Value        `json:"timeUnixNano"`
+	Count          uint64Value        `json:"count"`
+	Sum            doubleValue        `json:"sum"`
+	QuantileValues []*valueAtQuantile `json:"quantileValues"`
+}
+
+type valueAtQuantile struct {
+	Quantile doubleValue `json:"quantile"`
+	Value    doubleValue `json:"value"`
+}
+
+type exportTraceRequest struct {
+	ResourceSpans []*resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   *resource     `json:"resource"`
+	ScopeSpans []*scopeSpans `json:"scopeSpans"`
+}
+
+type scopeSpans struct {
+	Spans []*span `json:"spans"`
+}
+
+const (
+	kindServer   = 2
+	kindClient   = 3
+	kindProducer = 4
+	kindConsumer = 5
+)
+
+type span struct {
+	TraceID           hexID       `json:"traceId"`
+	SpanID            hexID       `json:"spanId"`
+	ParentSpanID      hexID       `json:"parentSpanId"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano uint64Value `json:"startTimeUnixNano"`
+	EndTimeUnixNano   uint64Value `json:"endTimeUnixNano"`
+	Attributes        []*keyValue `json:"attributes"`
+	Events            []*event    `json:"events"`
+	Status            *status     `json:"status"`
+}
+
+type event struct {
+	TimeUnixNano uint64Value `json:"timeUnixNano"`
+	Name         string      `json:"name"`
+	Attributes   []*keyValue `json:"attributes"`
+}
+
+const statusCodeError = 2
+
+type status struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+type resource struct {
+	Attributes []*keyValue `json:"attributes"`
+}
+
+type keyValue struct {
+	Key   string    `json:"key"`
+	Value *anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string       `json:"stringValue"`
+	BoolValue   *bool         `json:"boolValue"`
+	IntValue    *int64Value   `json:"intValue"`
+	DoubleValue *doubleValue  `json:"doubleValue"`
+	ArrayValue  *arrayValue   `json:"arrayValue"`
+	KvlistValue *keyValueList `json:"kvlistValue"`
+	BytesValue  []byte        `json:"bytesValue"`
+}
+
+type arrayValue struct {
+	Values []*anyValue `json:"values"`
+}
+
+type keyValueList struct {
+	Values []*keyValue `json:"values"`
+}
+
+// String returns the value as a dimension or tag value.  Arrays and maps are written as JSON.
+func (v *anyValue) String() string {
+	switch {
+	case v == nil:
+		return ""
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*v.DoubleValue), 'f', -1, 64)
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	}
+	b, _ := json.Marshal(v.plain())
+	return string(b)
+}
+
+// plain returns the value as the interface{} it would be in JSON
+func (v *anyValue) plain() interface{} {
+	switch {
+	case v == nil:
+		return nil
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, value := range v.ArrayValue.Values {
+			values = append(values, value.plain())
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.plain()
+		}
+		return values
+	}
+	return v.String()
+}
+
+// uint64Value is written as a decimal string in OTLP/JSON, though numbers are accepted too
+type uint64Value uint64
+
+// UnmarshalJSON reads a quoted or bare decimal
+func (u *uint64Value) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(string(unquote(b)), 10, 64)
+	*u = uint64Value(v)
+	return err
+}
+
+// int64Value is written as a decimal string in OTLP/JSON, though numbers are accepted too
+type int64Value int64
+
+// UnmarshalJSON reads a quoted or bare decimal
+func (i *int64Value) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(string(unquote(b)), 10, 64)
+	*i = int64Value(v)
+	return err
+}
+
+// doubleValue is a number in OTLP/JSON, or one of the strings "NaN", "Infinity" and "-Infinity"
+type doubleValue float64
+
+// UnmarshalJSON reads a number or one of the non finite strings
+func (d *doubleValue) UnmarshalJSON(b []byte) error {
+	switch s := string(unquote(b)); s {
+	case "NaN":
+		*d = doubleValue(math.NaN())
+	case "Infinity":
+		*d = doubleValue(math.Inf(1))
+	case "-Infinity":
+		*d = doubleValue(math.Inf(-1))
+	default:
+		v, err := strconv.ParseFloat(s, 64)
+		*d = doubleValue(v)
+		return err
+	}
+	return nil
+}
+
+// hexID is a trace or span id, which OTLP/JSON writes in hex rather than base64
+type hexID []byte
+
+// UnmarshalJSON reads a hex encoded id
+func (h *hexID) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	id, err := hex.DecodeString(s)
+	*h = id
+	return err
+}
+
+func unquote(b []byte) []byte {
+	if len(b) >= 2 && b[0] == '"' && b[len(b)-1] == '"' {
+		return b[1 : len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,316 @@
+package otlp
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+)
+
+const (
+	// MetricsPath is the OTLP/HTTP path for metrics
+	MetricsPath = "/v1/metrics"
+	// TracesPath is the OTLP/HTTP path for traces
+	TracesPath = "/v1/traces"
+
+	protobufContentType = "application/x-protobuf"
+	jsonContentType     = "application/json"
+
+	serviceNameAttribute = "service.name"
+)
+
+// SetupMetricsPaths registers handler for OTLP metrics on r
+func SetupMetricsPaths(r *mux.Router, handler http.Handler) {
+	setupPaths(r, handler, MetricsPath)
+}
+
+// SetupTracesPaths registers handler for OTLP traces on r
+func SetupTracesPaths(r *mux.Router, handler http.Handler) {
+	setupPaths(r, handler, TracesPath)
+}
+
+func setupPaths(r *mux.Router, handler http.Handler, path string) {
+	for _, contentType := range []string{protobufContentType, jsonContentType} {
+		r.Path(path).Methods(http.MethodPost).Headers("Content-Type", contentType).Handler(handler)
+	}
+}
+
+func isJSON(req *http.Request) bool {
+	return req.Header.Get("Content-Type") == jsonContentType
+}
+
+// decode reads the request body into m from either protobuf or JSON
+func decode(req *http.Request, m interface{ unmarshalProto([]byte) error }) error {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	if isJSON(req) {
+		return json.Unmarshal(b, m)
+	}
+	return m.unmarshalProto(b)
+}
+
+// writeOK writes an empty export response, which is a valid OTLP response in either encoding
+func writeOK(rw http.ResponseWriter, req *http.Request) {
+	if isJSON(req) {
+		rw.Header().Set("Content-Type", jsonContentType)
+		_, _ = rw.Write([]byte("{}"))
+		return
+	}
+	rw.Header().Set("Content-Type", protobufContentType)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// MetricsDecoder reads OTLP metrics and sends them to Sink as datapoints.  Resource and data point attributes become
+// dimensions.
+type MetricsDecoder struct {
+	Sink   dpsink.DSink
+	Logger log.Logger
+}
+
+// Read decodes the OTLP metrics in req and sends them to the sink
+func (d *MetricsDecoder) Read(ctx context.Context, req *http.Request) error {
+	var export exportMetricsRequest
+	if err := decode(req, &export); err != nil {
+		return err
+	}
+	var dps []*datapoint.Datapoint
+	for _, rm := range export.ResourceMetrics {
+		var resourceDims map[string]string
+		if rm.Resource != nil {
+			resourceDims = attributeMap(nil, rm.Resource.Attributes)
+		}
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				dps = m.appendDatapoints(dps, resourceDims)
+			}
+		}
+	}
+	if len(dps) == 0 {
+		return nil
+	}
+	return d.Sink.AddDatapoints(ctx, dps)
+}
+
+// WriteOK writes the OTLP success response
+func (d *MetricsDecoder) WriteOK(rw http.ResponseWriter, req *http.Request) {
+	writeOK(rw, req)
+}
+
+// appendDatapoints converts the metric the same way the SignalFx exporter for the OpenTelemetry collector does.
+// Monotonic sums become counters, histograms become _count, _sum and per bucket _bucket series, and summaries become
+// _count, _sum and per quantile _quantile series.  Exponential histograms have no SignalFx equivalent and are dropped.
+func (m *metric) appendDatapoints(dps []*datapoint.Datapoint, resourceDims map[string]string) []*datapoint.Datapoint {
+	switch {
+	case m.Gauge != nil:
+		for _, dp := range m.Gauge.DataPoints {
+			dps = appendNumber(dps, m.Name, datapoint.Gauge, resourceDims, dp)
+		}
+	case m.Sum != nil:
+		metricType := datapoint.Gauge
+		if m.Sum.IsMonotonic {
+			metricType = counterType(m.Sum.AggregationTemporality)
+		}
+		for _, dp := range m.Sum.DataPoints {
+			dps = appendNumber(dps, m.Name, metricType, resourceDims, dp)
+		}
+	case m.Histogram != nil:
+		metricType := counterType(m.Histogram.AggregationTemporality)
+		for _, dp := range m.Histogram.DataPoints {
+			dps = appendHistogram(dps, m.Name, metricType, resourceDims, dp)
+		}
+	case m.Summary != nil:
+		for _, dp := range m.Summary.DataPoints {
+			dps = appendSummary(dps, m.Name, resourceDims, dp)
+		}
+	}
+	return dps
+}
+
+func counterType(temporality int) datapoint.MetricType {
+	if temporality == temporalityDelta {
+		return datapoint.Count
+	}
+	return datapoint.Counter
+}
+
+func appendNumber(dps []*datapoint.Datapoint, name string, metricType datapoint.MetricType, resourceDims map[string]string, dp *numberDataPoint) []*datapoint.Datapoint {
+	var value datapoint.Value
+	switch {
+	case dp.AsInt != nil:
+		value = datapoint.NewIntValue(int64(*dp.AsInt))
+	case dp.AsDouble != nil && isFinite(*dp.AsDouble):
+		value = datapoint.NewFloatValue(float64(*dp.AsDouble))
+	default:
+		return dps
+	}
+	return append(dps, datapoint.New(name, attributeMap(resourceDims, dp.Attributes), value, metricType, fromNanos(dp.TimeUnixNano)))
+}
+
+func appendHistogram(dps []*datapoint.Datapoint, name string, metricType datapoint.MetricType, resourceDims map[string]string, dp *histogramDataPoint) []*datapoint.Datapoint {
+	dims := attributeMap(resourceDims, dp.Attributes)
+	ts := fromNanos(dp.TimeUnixNano)
+	dps = append(dps, datapoint.New(name+"_count", dims, datapoint.NewIntValue(int64(dp.Count)), metricType, ts))
+	if dp.Sum != nil && isFinite(*dp.Sum) {
+		dps = append(dps, datapoint.New(name+"_sum", datapoint.AddMaps(dims, nil), datapoint.NewFloatValue(float64(*dp.Sum)), metricType, ts))
+	}
+	// buckets are sent cumulatively, like prometheus, so each bucket counts everything at or below its upper bound
+	if len(dp.BucketCounts) != len(dp.ExplicitBounds)+1 {
+		return dps
+	}
+	var cumulative uint64
+	for i, count := range dp.BucketCounts {
+		cumulative += uint64(count)
+		bound := "+Inf"
+		if i < len(dp.ExplicitBounds) {
+			bound = strconv.FormatFloat(float64(dp.ExplicitBounds[i]), 'f', -1, 64)
+		}
+		bucketDims := datapoint.AddMaps(dims, map[string]string{"upper_bound": bound})
+		dps = append(dps, datapoint.New(name+"_bucket", bucketDims, datapoint.NewIntValue(int64(cumulative)), metricType, ts))
+	}
+	return dps
+}
+
+func appendSummary(dps []*datapoint.Datapoint, name string, resourceDims map[string]string, dp *summaryDataPoint) []*datapoint.Datapoint {
+	dims := attributeMap(resourceDims, dp.Attributes)
+	ts := fromNanos(dp.TimeUnixNano)
+	dps = append(dps, datapoint.New(name+"_count", dims, datapoint.NewIntValue(int64(dp.Count)), datapoint.Counter, ts))
+	if isFinite(dp.Sum) {
+		dps = append(dps, datapoint.New(name+"_sum", datapoint.AddMaps(dims, nil), datapoint.NewFloatValue(float64(dp.Sum)), datapoint.Counter, ts))
+	}
+	for _, q := range dp.QuantileValues {
+		if !isFinite(q.Value) {
+			continue
+		}
+		quantileDims := datapoint.AddMaps(dims, map[string]string{"quantile": strconv.FormatFloat(float64(q.Quantile), 'f', -1, 64)})
+		dps = append(dps, datapoint.New(name+"_quantile", quantileDims, datapoint.NewFloatValue(float64(q.Value)), datapoint.Gauge, ts))
+	}
+	return dps
+}
+
+// TracesDecoder reads OTLP traces and sends them to Sink as SignalFx spans.  Resource and span attributes become tags
+// and service.name becomes the local endpoint's service name.
+type TracesDecoder struct {
+	Sink   trace.Sink
+	Logger log.Logger
+}
+
+// Read decodes the OTLP traces in req and sends them to the sink
+func (d *TracesDecoder) Read(ctx context.Context, req *http.Request) error {
+	var export exportTraceRequest
+	if err := decode(req, &export); err != nil {
+		return err
+	}
+	var spans []*trace.Span
+	for _, rs := range export.ResourceSpans {
+		var resourceTags map[string]string
+		if rs.Resource != nil {
+			resourceTags = attributeMap(nil, rs.Resource.Attributes)
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				spans = append(spans, s.convert(resourceTags))
+			}
+		}
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	return d.Sink.AddSpans(ctx, spans)
+}
+
+// WriteOK writes the OTLP success response
+func (d *TracesDecoder) WriteOK(rw http.ResponseWriter, req *http.Request) {
+	writeOK(rw, req)
+}
+
+var kinds = map[int]string{
+	kindServer:   "SERVER",
+	kindClient:   "CLIENT",
+	kindProducer: "PRODUCER",
+	kindConsumer: "CONSUMER",
+}
+
+func (s *span) convert(resourceTags map[string]string) *trace.Span {
+	tags := attributeMap(resourceTags, s.Attributes)
+	out := &trace.Span{
+		TraceID:       hex.EncodeToString(s.TraceID),
+		ID:            hex.EncodeToString(s.SpanID),
+		Name:          pointer.String(s.Name),
+		Timestamp:     pointer.Int64(int64(s.StartTimeUnixNano) / 1e3),
+		Duration:      pointer.Int64((int64(s.EndTimeUnixNano) - int64(s.StartTimeUnixNano)) / 1e3),
+		LocalEndpoint: &trace.Endpoint{},
+		Annotations:   make([]*trace.Annotation, 0, len(s.Events)),
+	}
+	if len(s.ParentSpanID) > 0 {
+		out.ParentID = pointer.String(hex.EncodeToString(s.ParentSpanID))
+	}
+	if kind, ok := kinds[s.Kind]; ok {
+		out.Kind = pointer.String(kind)
+	}
+	if service, ok := tags[serviceNameAttribute]; ok {
+		out.LocalEndpoint.ServiceName = pointer.String(service)
+		delete(tags, serviceNameAttribute)
+	}
+	if s.Status != nil && s.Status.Code == statusCodeError {
+		tags["error"] = "true"
+		if s.Status.Message != "" {
+			tags["otel.status_description"] = s.Status.Message
+		}
+	}
+	out.Tags = tags
+	for _, e := range s.Events {
+		out.Annotations = append(out.Annotations, e.convert())
+	}
+	return out
+}
+
+// convert turns the event into an annotation holding its name and attributes as JSON, or just its name if it has no
+// attributes
+func (e *event) convert() *trace.Annotation {
+	a := &trace.Annotation{Timestamp: pointer.Int64(int64(e.TimeUnixNano) / 1e3)}
+	if len(e.Attributes) == 0 {
+		a.Value = pointer.String(e.Name)
+		return a
+	}
+	fields := attributeMap(map[string]string{"event": e.Name}, e.Attributes)
+	if b, err := json.Marshal(fields); err == nil {
+		a.Value = pointer.String(string(b))
+	}
+	return a
+}
+
+// attributeMap returns a copy of base with the attributes added, skipping empty keys and values
+func attributeMap(base map[string]string, attributes []*keyValue) map[string]string {
+	m := make(map[string]string, len(base)+len(attributes))
+	for k, v := range base {
+		m[k] = v
+	}
+	for _, kv := range attributes {
+		if v := kv.Value.String(); kv.Key != "" && strings.TrimSpace(v) != "" {
+			m[kv.Key] = v
+		}
+	}
+	return m
+}
+
+func isFinite(d doubleValue) bool {
+	return !math.IsNaN(float64(d)) && !math.IsInf(float64(d), 0)
+}
+
+func fromNanos(ns uint64Value) time.Time {
+	return time.Unix(0, int64(ns))
+}
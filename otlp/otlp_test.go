@@ -0,0 +1,269 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type dpSink struct {
+	dps []*datapoint.Datapoint
+}
+
+func (s *dpSink) AddDatapoints(_ context.Context, dps []*datapoint.Datapoint) error {
+	s.dps = append(s.dps, dps...)
+	return nil
+}
+
+type spanSink struct {
+	spans []*trace.Span
+}
+
+func (s *spanSink) AddSpans(_ context.Context, spans []*trace.Span) error {
+	s.spans = append(s.spans, spans...)
+	return nil
+}
+
+// pb builds protobuf messages for tests
+type pb []byte
+
+func (p pb) tag(number int, wireType int) pb {
+	return p.uvarint(uint64(number<<3 | wireType))
+}
+
+func (p pb) uvarint(v uint64) pb {
+	var b [binary.MaxVarintLen64]byte
+	return append(p, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (p pb) varint(number int, v uint64) pb {
+	return p.tag(number, wireVarint).uvarint(v)
+}
+
+func (p pb) fixed64(number int, v uint64) pb {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(p.tag(number, wireFixed64), b[:]...)
+}
+
+func (p pb) double(number int, v float64) pb {
+	return p.fixed64(number, math.Float64bits(v))
+}
+
+func (p pb) bytes(number int, b []byte) pb {
+	return append(p.tag(number, wireBytes).uvarint(uint64(len(b))), b...)
+}
+
+func (p pb) str(number int, s string) pb {
+	return p.bytes(number, []byte(s))
+}
+
+func attribute(key string, value pb) pb {
+	return pb{}.str(1, key).bytes(2, value)
+}
+
+func post(path string, contentType string, body []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+const metricsJSON = `{
+  "resourceMetrics": [{
+    "resource": {"attributes": [
+      {"key": "host.name", "value": {"stringValue": "web-1"}},
+      {"key": "empty", "value": {"stringValue": ""}}
+    ]},
+    "scopeMetrics": [{"metrics": [
+      {"name": "cpu.utilization", "gauge": {"dataPoints": [
+        {"timeUnixNano": "1500000000000000000", "asDouble": 0.25, "attributes": [{"key": "cpu", "value": {"intValue": "3"}}]},
+        {"timeUnixNano": "1500000000000000000", "asDouble": "NaN"}
+      ]}},
+      {"name": "requests", "sum": {"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": [
+        {"timeUnixNano": 1500000000000000000, "asInt": "42"}
+      ]}},
+      {"name": "queue.depth", "sum": {"aggregationTemporality": 1, "dataPoints": [{"asInt": "7"}]}},
+      {"name": "errors", "sum": {"aggregationTemporality": 1, "isMonotonic": true, "dataPoints": [{"asInt": "2"}]}},
+      {"name": "rpc.latency", "summary": {"dataPoints": [{"count": "10", "sum": 5.5, "quantileValues": [
+        {"quantile": 0.5, "value": 0.4},
+        {"quantile": 0.99, "value": 1.2}
+      ]}]}}
+    ]}]
+  }]
+}`
+
+func TestMetricsJSON(t *testing.T) {
+	sink := &dpSink{}
+	d := &MetricsDecoder{Sink: sink, Logger: log.Discard}
+	require.NoError(t, d.Read(context.Background(), post(MetricsPath, jsonContentType, []byte(metricsJSON))))
+
+	byName := map[string][]*datapoint.Datapoint{}
+	for _, dp := range sink.dps {
+		byName[dp.Metric] = append(byName[dp.Metric], dp)
+	}
+	require.Len(t, byName["cpu.utilization"], 1)
+	cpu := byName["cpu.utilization"][0]
+	assert.Equal(t, datapoint.Gauge, cpu.MetricType)
+	assert.Equal(t, datapoint.NewFloatValue(0.25), cpu.Value)
+	assert.Equal(t, map[string]string{"host.name": "web-1", "cpu": "3"}, cpu.Dimensions)
+	assert.Equal(t, time.Unix(1500000000, 0), cpu.Timestamp)
+
+	assert.Equal(t, datapoint.Counter, byName["requests"][0].MetricType)
+	assert.Equal(t, datapoint.NewIntValue(42), byName["requests"][0].Value)
+	assert.Equal(t, datapoint.Gauge, byName["queue.depth"][0].MetricType)
+	assert.Equal(t, datapoint.Count, byName["errors"][0].MetricType)
+
+	assert.Equal(t, datapoint.NewIntValue(10), byName["rpc.latency_count"][0].Value)
+	assert.Equal(t, datapoint.NewFloatValue(5.5), byName["rpc.latency_sum"][0].Value)
+	require.Len(t, byName["rpc.latency_quantile"], 2)
+	assert.Equal(t, "0.99", byName["rpc.latency_quantile"][1].Dimensions["quantile"])
+
+	rw := httptest.NewRecorder()
+	d.WriteOK(rw, post(MetricsPath, jsonContentType, nil))
+	assert.Equal(t, "{}", rw.Body.String())
+}
+
+func TestMetricsProtobuf(t *testing.T) {
+	bounds := make([]byte, 16)
+	binary.LittleEndian.PutUint64(bounds, math.Float64bits(0.1))
+	binary.LittleEndian.PutUint64(bounds[8:], math.Float64bits(1))
+	hist := pb{}.
+		fixed64(3, 1500000000000000000).
+		fixed64(4, 6).
+		double(5, 2.5).
+		fixed64(6, 1).fixed64(6, 2).fixed64(6, 3). // unpacked bucket counts
+		bytes(7, bounds).                          // packed bounds
+		bytes(9, attribute("route", pb{}.str(1, "/")))
+	m := pb{}.str(1, "http.duration").bytes(9, pb{}.bytes(1, hist).varint(2, temporalityCumulative))
+	body := pb{}.bytes(1, pb{}.
+		bytes(1, pb{}.bytes(1, attribute("host.name", pb{}.str(1, "web-1")))).
+		bytes(2, pb{}.bytes(1, pb{}.str(1, "scope")).bytes(2, m)))
+
+	sink := &dpSink{}
+	d := &MetricsDecoder{Sink: sink, Logger: log.Discard}
+	require.NoError(t, d.Read(context.Background(), post(MetricsPath, protobufContentType, body)))
+	require.Len(t, sink.dps, 5)
+	assert.Equal(t, "http.duration_count", sink.dps[0].Metric)
+	assert.Equal(t, datapoint.NewIntValue(6), sink.dps[0].Value)
+	assert.Equal(t, map[string]string{"host.name": "web-1", "route": "/"}, sink.dps[0].Dimensions)
+	assert.Equal(t, datapoint.NewFloatValue(2.5), sink.dps[1].Value)
+	for i, want := range []struct {
+		bound string
+		count int64
+	}{{"0.1", 1}, {"1", 3}, {"+Inf", 6}} {
+		bucket := sink.dps[2+i]
+		assert.Equal(t, "http.duration_bucket", bucket.Metric)
+		assert.Equal(t, want.bound, bucket.Dimensions["upper_bound"])
+		assert.Equal(t, datapoint.NewIntValue(want.count), bucket.Value)
+		assert.Equal(t, datapoint.Counter, bucket.MetricType)
+	}
+
+	for _, bad := range []pb{{0x0a, 0x05, 0x01}, {0x0b}, pb{}.bytes(1, pb{}.bytes(2, pb{}.bytes(2, pb{}.bytes(9, pb{}.bytes(1, pb{}.bytes(7, []byte{1, 2, 3}))))))} {
+		assert.Error(t, d.Read(context.Background(), post(MetricsPath, protobufContentType, bad)))
+	}
+}
+
+func TestTracesProtobuf(t *testing.T) {
+	traceID := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	s := pb{}.
+		bytes(1, traceID).
+		bytes(2, []byte{0, 0, 0, 0, 0, 0, 0, 0xaa}).
+		bytes(4, []byte{0, 0, 0, 0, 0, 0, 0, 0xbb}).
+		str(5, "GET /users").
+		varint(6, kindServer).
+		fixed64(7, 1500000000000000000).
+		fixed64(8, 1500000000002000000).
+		bytes(9, attribute("http.status_code", pb{}.varint(3, 500))).
+		bytes(9, attribute("retry", pb{}.varint(2, 1))).
+		bytes(11, pb{}.fixed64(1, 1500000000001000000).str(2, "exception").bytes(3, attribute("exception.type", pb{}.str(1, "IOError")))).
+		bytes(11, pb{}.fixed64(1, 1500000000001000000).str(2, "cache miss")).
+		bytes(15, pb{}.str(2, "boom").varint(3, statusCodeError))
+	resource := pb{}.bytes(1, attribute("service.name", pb{}.str(1, "users"))).bytes(1, attribute("region", pb{}.str(1, "us-east-1")))
+	body := pb{}.bytes(1, pb{}.bytes(1, resource).bytes(2, pb{}.bytes(2, s)))
+
+	sink := &spanSink{}
+	d := &TracesDecoder{Sink: sink, Logger: log.Discard}
+	require.NoError(t, d.Read(context.Background(), post(TracesPath, protobufContentType, body)))
+	require.Len(t, sink.spans, 1)
+	span := sink.spans[0]
+	assert.Equal(t, "0102030405060708090a0b0c0d0e0f10", span.TraceID)
+	assert.Equal(t, "00000000000000aa", span.ID)
+	assert.Equal(t, "00000000000000bb", *span.ParentID)
+	assert.Equal(t, "GET /users", *span.Name)
+	assert.Equal(t, "SERVER", *span.Kind)
+	assert.Equal(t, int64(1500000000000000), *span.Timestamp)
+	assert.Equal(t, int64(2000), *span.Duration)
+	assert.Equal(t, "users", *span.LocalEndpoint.ServiceName)
+	assert.Equal(t, map[string]string{
+		"region":                  "us-east-1",
+		"http.status_code":        "500",
+		"retry":                   "true",
+		"error":                   "true",
+		"otel.status_description": "boom",
+	}, span.Tags)
+	require.Len(t, span.Annotations, 2)
+	assert.Equal(t, `{"event":"exception","exception.type":"IOError"}`, *span.Annotations[0].Value)
+	assert.Equal(t, "cache miss", *span.Annotations[1].Value)
+
+	rw := httptest.NewRecorder()
+	d.WriteOK(rw, post(TracesPath, protobufContentType, nil))
+	assert.Equal(t, protobufContentType, rw.Header().Get("Content-Type"))
+	assert.Equal(t, 0, rw.Body.Len())
+}
+
+func TestTracesJSON(t *testing.T) {
+	body := `{"resourceSpans": [{"scopeSpans": [{"spans": [{
+		"traceId": "0102030405060708090a0b0c0d0e0f10",
+		"spanId": "00000000000000aa",
+		"name": "produce",
+		"kind": 4,
+		"startTimeUnixNano": "1500000000000000000",
+		"endTimeUnixNano": "1500000000000001000",
+		"attributes": [
+			{"key": "tags", "value": {"arrayValue": {"values": [{"stringValue": "a"}, {"intValue": "1"}]}}},
+			{"key": "meta", "value": {"kvlistValue": {"values": [{"key": "k", "value": {"boolValue": false}}]}}}
+		]
+	}]}]}]}`
+	sink := &spanSink{}
+	d := &TracesDecoder{Sink: sink, Logger: log.Discard}
+	require.NoError(t, d.Read(context.Background(), post(TracesPath, jsonContentType, []byte(body))))
+	require.Len(t, sink.spans, 1)
+	span := sink.spans[0]
+	assert.Nil(t, span.ParentID)
+	assert.Equal(t, "PRODUCER", *span.Kind)
+	assert.Nil(t, span.LocalEndpoint.ServiceName)
+	assert.Equal(t, map[string]string{"tags": `["a","1"]`, "meta": `{"k":"false"}`}, span.Tags)
+
+	assert.Error(t, d.Read(context.Background(), post(TracesPath, jsonContentType, []byte(`{"resourceSpans": [{"scopeSpans": [{"spans": [{"traceId": "xyz"}]}]}]}`))))
+}
+
+func TestNestedAttributesTooDeep(t *testing.T) {
+	nested := func(depth int, kvlist bool) pb {
+		value := pb{}.str(1, "leaf")
+		for i := 0; i < depth; i++ {
+			if kvlist {
+				value = pb{}.bytes(6, pb{}.bytes(1, attribute("k", value)))
+			} else {
+				value = pb{}.bytes(5, pb{}.bytes(1, value))
+			}
+		}
+		s := pb{}.bytes(1, make([]byte, 16)).bytes(2, make([]byte, 8)).bytes(9, attribute("nested", value))
+		return pb{}.bytes(1, pb{}.bytes(2, pb{}.bytes(2, s)))
+	}
+	d := &TracesDecoder{Sink: &spanSink{}, Logger: log.Discard}
+	for _, kvlist := range []bool{false, true} {
+		assert.NoError(t, d.Read(context.Background(), post(TracesPath, protobufContentType, nested(maxValueDepth, kvlist))))
+		assert.Equal(t, errTooDeep, d.Read(context.Background(), post(TracesPath, protobufContentType, nested(maxValueDepth+1, kvlist))))
+	}
+}
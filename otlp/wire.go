@@ -0,0 +1,476 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// maxValueDepth is how deeply array and key value list attribute values can be nested, so a small request can't
+// recurse deep enough to overflow the stack
+const maxValueDepth = 64
+
+var errTruncated = errors.New("truncated protobuf message")
+
+var errTooDeep = fmt.Errorf("attribute values nested more than %d deep", maxValueDepth)
+
+// field is one protobuf field.  Varints and fixed width values are in num, and length delimited ones in bytes.
+type field struct {
+	number   int
+	wireType int
+	num      uint64
+	bytes    []byte
+}
+
+func (f *field) double() doubleValue {
+	return doubleValue(math.Float64frombits(f.num))
+}
+
+// eachField calls fn with every field in the message b
+func eachField(b []byte, fn func(f *field) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		f := field{number: int(tag >> 3), wireType: int(tag & 7)}
+		var err error
+		if b, err = f.read(b[n:]); err != nil {
+			return err
+		}
+		if err = fn(&f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read reads the field's value from the start of b and returns what follows it
+func (f *field) read(b []byte) ([]byte, error) {
+	switch f.wireType {
+	case wireVarint:
+		var n int
+		if f.num, n = binary.Uvarint(b); n <= 0 {
+			return nil, errTruncated
+		}
+		return b[n:], nil
+	case wireFixed64:
+		if len(b) < 8 {
+			return nil, errTruncated
+		}
+		f.num = binary.LittleEndian.Uint64(b)
+		return b[8:], nil
+	case wireFixed32:
+		if len(b) < 4 {
+			return nil, errTruncated
+		}
+		f.num = uint64(binary.LittleEndian.Uint32(b))
+		return b[4:], nil
+	case wireBytes:
+		size, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < size {
+			return nil, errTruncated
+		}
+		f.bytes = b[n : n+int(size)]
+		return b[n+int(size):], nil
+	}
+	return nil, fmt.Errorf("unsupported protobuf wire type %d", f.wireType)
+}
+
+// fixed64s returns a repeated fixed64 or double field's values, whether or not they were packed
+func (f *field) fixed64s() ([]uint64, error) {
+	if f.wireType != wireBytes {
+		return []uint64{f.num}, nil
+	}
+	if len(f.bytes)%8 != 0 {
+		return nil, errTruncated
+	}
+	values := make([]uint64, 0, len(f.bytes)/8)
+	for b := f.bytes; len(b) > 0; b = b[8:] {
+		values = append(values, binary.LittleEndian.Uint64(b))
+	}
+	return values, nil
+}
+
+func (m *exportMetricsRequest) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		if f.number == 1 {
+			rm := &resourceMetrics{}
+			m.ResourceMetrics = append(m.ResourceMetrics, rm)
+			return rm.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *resourceMetrics) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 1:
+			m.Resource = &resource{}
+			return m.Resource.unmarshalProto(f.bytes)
+		case 2:
+			sm := &scopeMetrics{}
+			m.ScopeMetrics = append(m.ScopeMetrics, sm)
+			return sm.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *scopeMetrics) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		if f.number == 2 {
+			mt := &metric{}
+			m.Metrics = append(m.Metrics, mt)
+			return mt.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *metric) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 1:
+			m.Name = string(f.bytes)
+		case 5:
+			m.Gauge = &gauge{}
+			return m.Gauge.unmarshalProto(f.bytes)
+		case 7:
+			m.Sum = &sum{}
+			return m.Sum.unmarshalProto(f.bytes)
+		case 9:
+			m.Histogram = &histogram{}
+			return m.Histogram.unmarshalProto(f.bytes)
+		case 11:
+			m.Summary = &summary{}
+			return m.Summary.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *gauge) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		if f.number == 1 {
+			dp := &numberDataPoint{}
+			m.DataPoints = append(m.DataPoints, dp)
+			return dp.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *sum) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 1:
+			dp := &numberDataPoint{}
+			m.DataPoints = append(m.DataPoints, dp)
+			return dp.unmarshalProto(f.bytes)
+		case 2:
+			m.AggregationTemporality = int(f.num)
+		case 3:
+			m.IsMonotonic = f.num != 0
+		}
+		return nil
+	})
+}
+
+func (m *numberDataPoint) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 3:
+			m.TimeUnixNano = uint64Value(f.num)
+		case 4:
+			v := f.double()
+			m.AsDouble = &v
+		case 6:
+			v := int64Value(f.num)
+			m.AsInt = &v
+		case 7:
+			return appendKeyValue(&m.Attributes, f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *histogram) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 1:
+			dp := &histogramDataPoint{}
+			m.DataPoints = append(m.DataPoints, dp)
+			return dp.unmarshalProto(f.bytes)
+		case 2:
+			m.AggregationTemporality = int(f.num)
+		}
+		return nil
+	})
+}
+
+func (m *histogramDataPoint) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 3:
+			m.TimeUnixNano = uint64Value(f.num)
+		case 4:
+			m.Count = uint64Value(f.num)
+		case 5:
+			v := f.double()
+			m.Sum = &v
+		case 6, 7:
+			values, err := f.fixed64s()
+			if err != nil {
+				return err
+			}
+			for _, v := range values {
+				if f.number == 6 {
+					m.BucketCounts = append(m.BucketCounts, uint64Value(v))
+				} else {
+					m.ExplicitBounds = append(m.ExplicitBounds, doubleValue(math.Float64frombits(v)))
+				}
+			}
+		case 9:
+			return appendKeyValue(&m.Attributes, f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *summary) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		if f.number == 1 {
+			dp := &summaryDataPoint{}
+			m.DataPoints = append(m.DataPoints, dp)
+			return dp.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *summaryDataPoint) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 3:
+			m.TimeUnixNano = uint64Value(f.num)
+		case 4:
+			m.Count = uint64Value(f.num)
+		case 5:
+			m.Sum = f.double()
+		case 6:
+			q := &valueAtQuantile{}
+			m.QuantileValues = append(m.QuantileValues, q)
+			return q.unmarshalProto(f.bytes)
+		case 7:
+			return appendKeyValue(&m.Attributes, f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *valueAtQuantile) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 1:
+			m.Quantile = f.double()
+		case 2:
+			m.Value = f.double()
+		}
+		return nil
+	})
+}
+
+func (m *exportTraceRequest) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		if f.number == 1 {
+			rs := &resourceSpans{}
+			m.ResourceSpans = append(m.ResourceSpans, rs)
+			return rs.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *resourceSpans) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 1:
+			m.Resource = &resource{}
+			return m.Resource.unmarshalProto(f.bytes)
+		case 2:
+			ss := &scopeSpans{}
+			m.ScopeSpans = append(m.ScopeSpans, ss)
+			return ss.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *scopeSpans) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		if f.number == 2 {
+			s := &span{}
+			m.Spans = append(m.Spans, s)
+			return s.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *span) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 9:
+			return appendKeyValue(&m.Attributes, f.bytes)
+		case 11:
+			e := &event{}
+			m.Events = append(m.Events, e)
+			return e.unmarshalProto(f.bytes)
+		case 15:
+			m.Status = &status{}
+			return m.Status.unmarshalProto(f.bytes)
+		}
+		m.setField(f)
+		return nil
+	})
+}
+
+// setField sets the span's scalar fields
+func (m *span) setField(f *field) {
+	switch f.number {
+	case 1:
+		m.TraceID = f.bytes
+	case 2:
+		m.SpanID = f.bytes
+	case 4:
+		m.ParentSpanID = f.bytes
+	case 5:
+		m.Name = string(f.bytes)
+	case 6:
+		m.Kind = int(f.num)
+	case 7:
+		m.StartTimeUnixNano = uint64Value(f.num)
+	case 8:
+		m.EndTimeUnixNano = uint64Value(f.num)
+	}
+}
+
+func (m *event) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 1:
+			m.TimeUnixNano = uint64Value(f.num)
+		case 2:
+			m.Name = string(f.bytes)
+		case 3:
+			return appendKeyValue(&m.Attributes, f.bytes)
+		}
+		return nil
+	})
+}
+
+func (m *status) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 2:
+			m.Message = string(f.bytes)
+		case 3:
+			m.Code = int(f.num)
+		}
+		return nil
+	})
+}
+
+func (m *resource) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *field) error {
+		if f.number == 1 {
+			return appendKeyValue(&m.Attributes, f.bytes)
+		}
+		return nil
+	})
+}
+
+func appendKeyValue(kvs *[]*keyValue, b []byte) error {
+	return appendNestedKeyValue(kvs, b, 0)
+}
+
+// appendNestedKeyValue appends a key value that is nested inside depth array or key value list values
+func appendNestedKeyValue(kvs *[]*keyValue, b []byte, depth int) error {
+	kv := &keyValue{}
+	*kvs = append(*kvs, kv)
+	return kv.unmarshalProto(b, depth)
+}
+
+func (m *keyValue) unmarshalProto(b []byte, depth int) error {
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 1:
+			m.Key = string(f.bytes)
+		case 2:
+			m.Value = &anyValue{}
+			return m.Value.unmarshalProto(f.bytes, depth)
+		}
+		return nil
+	})
+}
+
+func (m *anyValue) unmarshalProto(b []byte, depth int) error {
+	if depth > maxValueDepth {
+		return errTooDeep
+	}
+	return eachField(b, func(f *field) error {
+		switch f.number {
+		case 1:
+			s := string(f.bytes)
+			m.StringValue = &s
+		case 2:
+			v := f.num != 0
+			m.BoolValue = &v
+		case 3:
+			v := int64Value(f.num)
+			m.IntValue = &v
+		case 4:
+			v := f.double()
+			m.DoubleValue = &v
+		case 5:
+			m.ArrayValue = &arrayValue{}
+			return m.ArrayValue.unmarshalProto(f.bytes, depth+1)
+		case 6:
+			m.KvlistValue = &keyValueList{}
+			return m.KvlistValue.unmarshalProto(f.bytes, depth+1)
+		case 7:
+			m.BytesValue = append([]byte{}, f.bytes...)
+		}
+		return nil
+	})
+}
+
+func (m *arrayValue) unmarshalProto(b []byte, depth int) error {
+	return eachField(b, func(f *field) error {
+		if f.number == 1 {
+			v := &anyValue{}
+			m.Values = append(m.Values, v)
+			return v.unmarshalProto(f.bytes, depth)
+		}
+		return nil
+	})
+}
+
+func (m *keyValueList) unmarshalProto(b []byte, depth int) error {
+	return eachField(b, func(f *field) error {
+		if f.number == 1 {
+			return appendNestedKeyValue(&m.Values, f.bytes, depth)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,435 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/golib/v3/web"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/pops/filewatch"
+	"github.com/signalfx/pops/internal/tokenhash"
+)
+
+type kind int
+
+const (
+	datapoints kind = iota
+	events
+	spans
+	bytes
+	numKinds
+)
+
+var kindNames = [numKinds]string{"datapoints", "events", "spans", "bytes"}
+
+// ErrLimited is returned for data that would take a token over one of its limits
+type ErrLimited struct {
+	Kind       string
+	RetryAfter time.Duration
+}
+
+func (e *ErrLimited) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s, retry after %s", e.Kind, e.RetryAfter)
+}
+
+// WriteLimited responds to a request with a 429 and a Retry-After header in whole seconds
+func WriteLimited(rw http.ResponseWriter, err *ErrLimited) {
+	seconds := int64(math.Ceil(err.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	rw.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	rw.WriteHeader(http.StatusTooManyRequests)
+	_, _ = rw.Write([]byte(err.Error()))
+}
+
+type limitsConfig [numKinds]*distconf.Float
+
+func (l *limitsConfig) load(d *distconf.Distconf, prefix string) {
+	for k, name := range kindNames {
+		l[k] = d.Float(prefix+strings.ToUpper(name)+"_PER_SECOND", 0)
+	}
+}
+
+// Config configures the default per token and global limits.  Every limit is a rate per second and zero means
+// unlimited.  A token's buckets are forgotten once they have refilled, which is looked for every IdleTimeout.  Its
+// throttle counts are cumulative so they are kept, for up to MaxThrottledTokens tokens, and the throttles of any tokens
+// after that are counted together.
+type Config struct {
+	TokenLimits        limitsConfig
+	GlobalLimits       limitsConfig
+	BurstSeconds       *distconf.Float
+	Overrides          *distconf.Str
+	OverridesFile      *distconf.Str
+	ReloadInterval     *distconf.Duration
+	IdleTimeout        *distconf.Duration
+	MaxThrottledTokens *distconf.Int
+}
+
+// Load the rate limit config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.TokenLimits.load(d, "RATE_LIMIT_")
+	c.GlobalLimits.load(d, "RATE_LIMIT_GLOBAL_")
+	c.BurstSeconds = d.Float("RATE_LIMIT_BURST_SECONDS", 1)
+	c.Overrides = d.Str("RATE_LIMIT_OVERRIDES", "")
+	c.OverridesFile = d.Str("RATE_LIMIT_OVERRIDES_FILE", "")
+	c.ReloadInterval = d.Duration("RATE_LIMIT_OVERRIDES_RELOAD_INTERVAL", 10*time.Second)
+	c.IdleTimeout = d.Duration("RATE_LIMIT_IDLE_TIMEOUT", 5*time.Minute)
+	c.MaxThrottledTokens = d.Int("RATE_LIMIT_MAX_THROTTLED_TOKENS", 1000)
+}
+
+// Limits are rates per second that override the configured defaults.  Unset limits fall back to the default and zero
+// means unlimited.
+type Limits struct {
+	Datapoints *float64 `json:"datapoints_per_second,omitempty"`
+	Events     *float64 `json:"events_per_second,omitempty"`
+	Spans      *float64 `json:"spans_per_second,omitempty"`
+	Bytes      *float64 `json:"bytes_per_second,omitempty"`
+}
+
+func (l *Limits) get(k kind) *float64 {
+	if l == nil {
+		return nil
+	}
+	return [numKinds]*float64{l.Datapoints, l.Events, l.Spans, l.Bytes}[k]
+}
+
+// Overrides are the global limits and the limits for individual tokens
+type Overrides struct {
+	Global *Limits            `json:"global,omitempty"`
+	Tokens map[string]*Limits `json:"tokens,omitempty"`
+}
+
+func parseOverrides(b []byte) (*Overrides, error) {
+	o := &Overrides{}
+	if len(b) == 0 {
+		return o, nil
+	}
+	if err := json.Unmarshal(b, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// bucket is a token bucket that refills at rate per second up to rate * burst seconds
+type bucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func (b *bucket) refill(now time.Time, rate float64, burst float64) {
+	capacity := rate * burst
+	if b.last.IsZero() || b.rate <= 0 {
+		b.tokens = capacity
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	b.tokens = math.Min(b.tokens, capacity)
+	b.rate = rate
+	b.capacity = capacity
+	b.last = now
+}
+
+// wait returns how long until n can be taken from the bucket.  A batch bigger than the bucket only has to wait for a
+// full bucket, so it isn't rejected forever; it takes the bucket into debt instead.
+func (b *bucket) wait(n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	need := math.Min(n, b.capacity)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *bucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
+
+// full returns true if the bucket will have refilled by now, so forgetting it changes nothing
+func (b *bucket) full(now time.Time) bool {
+	return b.rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.capacity
+}
+
+type buckets [numKinds]bucket
+
+func (b *buckets) full(now time.Time) bool {
+	for k := range b {
+		if !b[k].full(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// throttleCounts counts the throttles by each limit of each kind
+type throttleCounts [2][numKinds]int64
+
+const (
+	limitToken = iota
+	limitGlobal
+)
+
+// Limiter enforces per token and global rate limits at the ingest edge.  Request bytes are limited by the
+// LimitRequests middleware before the body is decoded and datapoints, events and spans are limited by the Limiter's
+// signalfx.NextSink methods once they are.
+type Limiter struct {
+	conf       *Config
+	timeKeeper timekeeper.TimeKeeper
+	logger     log.Logger
+	watcher    *filewatch.Watcher
+
+	mu            sync.Mutex
+	fileOverrides *Overrides
+	confOverrides *Overrides
+	global        buckets
+	tokens        map[string]*buckets
+	throttled     map[string]*throttleCounts
+	other         throttleCounts
+	lastExpired   time.Time
+}
+
+var _ signalfx.NextSink = &Limiter{}
+
+// New returns a Limiter for conf, loading any overrides and watching them for changes
+func New(conf *Config, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Limiter, error) {
+	l := &Limiter{
+		conf:          conf,
+		timeKeeper:    timeKeeper,
+		logger:        logger,
+		fileOverrides: &Overrides{},
+		tokens:        make(map[string]*buckets),
+		throttled:     make(map[string]*throttleCounts),
+	}
+	var err error
+	if l.confOverrides, err = parseOverrides([]byte(conf.Overrides.Get())); err != nil {
+		return nil, fmt.Errorf("unable to parse rate limit overrides: %s", err)
+	}
+	conf.Overrides.Watch(l.loadConf)
+	if path := conf.OverridesFile.Get(); path != "" {
+		if l.watcher, err = filewatch.New(path, conf.ReloadInterval.Get(), l.loadFile, timeKeeper, logger); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *Limiter) loadConf(str *distconf.Str, oldValue string) {
+	o, err := parseOverrides([]byte(str.Get()))
+	if err != nil {
+		l.logger.Log(log.Err, err, "unable to parse rate limit overrides")
+		return
+	}
+	l.mu.Lock()
+	l.confOverrides = o
+	l.mu.Unlock()
+}
+
+func (l *Limiter) loadFile(b []byte) error {
+	o, err := parseOverrides(b)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.fileOverrides = o
+	l.mu.Unlock()
+	return nil
+}
+
+// rates returns the per token and global rate for k.  Overrides from distconf win over ones from the file.
+func (l *Limiter) rates(token string, k kind) (float64, float64) {
+	tokenRate, globalRate := l.conf.TokenLimits[k].Get(), l.conf.GlobalLimits[k].Get()
+	for _, o := range []*Overrides{l.fileOverrides, l.confOverrides} {
+		if r := o.Tokens[token].get(k); r != nil {
+			tokenRate = *r
+		}
+		if r := o.Global.get(k); r != nil {
+			globalRate = *r
+		}
+	}
+	return tokenRate, globalRate
+}
+
+// take takes n of k for token from both the token's and the global buckets, or neither.  If force is set n is taken
+// even if the buckets don't have room for it.
+func (l *Limiter) take(token string, k kind, n float64, force bool) error {
+	now := l.timeKeeper.Now()
+	burst := l.conf.BurstSeconds.Get()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(now)
+	tokenRate, globalRate := l.rates(token, k)
+	// a token only gets buckets once one of its limits isn't unlimited
+	tb, ok := l.tokens[token]
+	if !ok && tokenRate > 0 {
+		tb = &buckets{}
+		l.tokens[token] = tb
+	}
+	var tokenBucket *bucket
+	if tb != nil {
+		tokenBucket = &tb[k]
+		tokenBucket.refill(now, tokenRate, burst)
+	}
+	l.global[k].refill(now, globalRate, burst)
+	if !force {
+		limit, wait := limitToken, time.Duration(0)
+		if tokenBucket != nil {
+			wait = tokenBucket.wait(n)
+		}
+		if w := l.global[k].wait(n); w > wait {
+			limit, wait = limitGlobal, w
+		}
+		if wait > 0 {
+			l.throttleCounts(token)[limit][k]++
+			return &ErrLimited{Kind: kindNames[k], RetryAfter: wait}
+		}
+	}
+	if tokenBucket != nil {
+		tokenBucket.take(n)
+	}
+	l.global[k].take(n)
+	return nil
+}
+
+// throttleCounts returns the throttle counts for token, which are the ones shared by every token past the most that are
+// counted on their own if it doesn't have any yet and there's no room for it
+func (l *Limiter) throttleCounts(token string) *throttleCounts {
+	counts, ok := l.throttled[token]
+	if !ok {
+		if int64(len(l.throttled)) >= l.conf.MaxThrottledTokens.Get() {
+			return &l.other
+		}
+		counts = &throttleCounts{}
+		l.throttled[token] = counts
+	}
+	return counts
+}
+
+// expire forgets the buckets of tokens that have refilled, so tokens that are only seen once don't stay in memory.  It
+// looks for them once every idle timeout.
+func (l *Limiter) expire(now time.Time) {
+	if now.Sub(l.lastExpired) < l.conf.IdleTimeout.Get() {
+		return
+	}
+	l.lastExpired = now
+	for token, tb := range l.tokens {
+		if tb.full(now) {
+			delete(l.tokens, token)
+		}
+	}
+}
+
+// countingReader counts the bytes read from a request body whose length wasn't known up front
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// LimitRequests rejects requests whose body would take their token over its bytes per second limit.  It must run
+// after the token is put on the context.  Bodies of unknown length are always let through and charged once they have
+// been read.
+func (l *Limiter) LimitRequests(ctx context.Context, rw http.ResponseWriter, r *http.Request, next web.ContextHandler) {
+	token := tokenFromContext(ctx)
+	if r.ContentLength >= 0 {
+		if err := l.take(token, bytes, float64(r.ContentLength), false); err != nil {
+			WriteLimited(rw, err.(*ErrLimited))
+			return
+		}
+		next.ServeHTTPC(ctx, rw, r)
+		return
+	}
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	next.ServeHTTPC(ctx, rw, r)
+	_ = l.take(token, bytes, float64(body.n), true)
+}
+
+func tokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(sfxclient.TokenCtxKey).(string)
+	return token
+}
+
+// AddDatapoints forwards the datapoints if the token is within its datapoints per second limit
+func (l *Limiter) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	if err := l.take(tokenFromContext(ctx), datapoints, float64(len(points)), false); err != nil {
+		return err
+	}
+	return next.AddDatapoints(ctx, points)
+}
+
+// AddEvents forwards the events if the token is within its events per second limit
+func (l *Limiter) AddEvents(ctx context.Context, evts []*event.Event, next signalfx.Sink) error {
+	if err := l.take(tokenFromContext(ctx), events, float64(len(evts)), false); err != nil {
+		return err
+	}
+	return next.AddEvents(ctx, evts)
+}
+
+// AddSpans forwards the spans if the token is within its spans per second limit
+func (l *Limiter) AddSpans(ctx context.Context, spns []*trace.Span, next signalfx.Sink) error {
+	if err := l.take(tokenFromContext(ctx), spans, float64(len(spns)), false); err != nil {
+		return err
+	}
+	return next.AddSpans(ctx, spns)
+}
+
+// Datapoints returns how many times each token has been throttled by each of its limits.  Tokens are reported by their
+// hash, since anything a client sends as a token gets counted here.
+func (l *Limiter) Datapoints() []*datapoint.Datapoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var dps []*datapoint.Datapoint
+	add := func(tokenHash string, counts *throttleCounts) {
+		for limit, limitName := range []string{"token", "global"} {
+			for k, count := range counts[limit] {
+				if count == 0 {
+					continue
+				}
+				dims := map[string]string{"token_hash": tokenHash, "limit": limitName, "type": kindNames[k]}
+				dps = append(dps, sfxclient.Cumulative("ratelimit.throttled", dims, count))
+			}
+		}
+	}
+	for token, counts := range l.throttled {
+		add(tokenhash.Dimension(token), counts)
+	}
+	add(tokenhash.Other, &l.other)
+	if l.watcher != nil {
+		dps = append(dps, l.watcher.Datapoints()...)
+	}
+	return dps
+}
+
+// Close stops watching the overrides file
+func (l *Limiter) Close() error {
+	if l.watcher != nil {
+		return l.watcher.Close()
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper/timekeepertest"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/golib/v3/web"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/pops/internal/tokenhash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopSink struct{}
+
+func (nopSink) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return nil }
+func (nopSink) AddEvents(context.Context, []*event.Event) error             { return nil }
+func (nopSink) AddSpans(context.Context, []*trace.Span) error               { return nil }
+
+func testLimiter(t *testing.T, values map[string]string) (*Limiter, *timekeepertest.StubClock, distconf.ReaderWriter) {
+	mem := distconf.Mem()
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	clock := timekeepertest.NewStubClock(time.Now())
+	l, err := New(conf, clock, log.Discard)
+	require.NoError(t, err)
+	return l, clock, mem
+}
+
+func ctxFor(token string) context.Context {
+	return context.WithValue(context.Background(), sfxclient.TokenCtxKey, token)
+}
+
+func dps(n int) []*datapoint.Datapoint {
+	points := make([]*datapoint.Datapoint, n)
+	for i := range points {
+		points[i] = datapoint.New("m", nil, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())
+	}
+	return points
+}
+
+func throttled(l *Limiter, token string, limit string, typ string) int64 {
+	return throttledHash(l, tokenhash.Dimension(token), limit, typ)
+}
+
+func throttledHash(l *Limiter, tokenHash string, limit string, typ string) int64 {
+	for _, dp := range l.Datapoints() {
+		if dp.Metric == "ratelimit.throttled" && dp.Dimensions["token_hash"] == tokenHash && dp.Dimensions["limit"] == limit && dp.Dimensions["type"] == typ {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return 0
+}
+
+func TestUnlimitedByDefault(t *testing.T) {
+	l, _, _ := testLimiter(t, nil)
+	defer l.Close()
+	sink := signalfx.FromChain(nopSink{}, signalfx.NextWrap(l))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, sink.AddDatapoints(ctxFor("tok"), dps(1000)))
+	}
+	assert.Empty(t, l.Datapoints())
+}
+
+func TestTokenLimit(t *testing.T) {
+	l, clock, _ := testLimiter(t, map[string]string{"RATE_LIMIT_DATAPOINTS_PER_SECOND": "10"})
+	defer l.Close()
+	sink := signalfx.FromChain(nopSink{}, signalfx.NextWrap(l))
+
+	assert.NoError(t, sink.AddDatapoints(ctxFor("tok"), dps(10)))
+	err := sink.AddDatapoints(ctxFor("tok"), dps(1))
+	require.IsType(t, &ErrLimited{}, err)
+	assert.Equal(t, "datapoints", err.(*ErrLimited).Kind)
+	assert.Equal(t, 100*time.Millisecond, err.(*ErrLimited).RetryAfter)
+	// other tokens and other types have their own buckets
+	assert.NoError(t, sink.AddDatapoints(ctxFor("other"), dps(10)))
+	assert.NoError(t, sink.AddSpans(ctxFor("tok"), []*trace.Span{{}}))
+	assert.NoError(t, sink.AddEvents(ctxFor("tok"), []*event.Event{{}}))
+
+	clock.Incr(time.Second)
+	assert.NoError(t, sink.AddDatapoints(ctxFor("tok"), dps(10)))
+	assert.Equal(t, int64(1), throttled(l, "tok", "token", "datapoints"))
+}
+
+func TestBatchBiggerThanBucket(t *testing.T) {
+	l, clock, _ := testLimiter(t, map[string]string{"RATE_LIMIT_SPANS_PER_SECOND": "10"})
+	defer l.Close()
+	sink := signalfx.FromChain(nopSink{}, signalfx.NextWrap(l))
+	spans := make([]*trace.Span, 30)
+	assert.NoError(t, sink.AddSpans(ctxFor("tok"), spans))
+	// the bucket is now 20 in debt so needs 3 seconds to be full again
+	err := sink.AddSpans(ctxFor("tok"), spans)
+	require.IsType(t, &ErrLimited{}, err)
+	assert.Equal(t, 3*time.Second, err.(*ErrLimited).RetryAfter)
+	clock.Incr(3 * time.Second)
+	assert.NoError(t, sink.AddSpans(ctxFor("tok"), spans))
+}
+
+func TestIdleTokensExpire(t *testing.T) {
+	l, clock, _ := testLimiter(t, map[string]string{"RATE_LIMIT_GLOBAL_EVENTS_PER_SECOND": "2", "RATE_LIMIT_SPANS_PER_SECOND": "10"})
+	defer l.Close()
+	sink := signalfx.FromChain(nopSink{}, signalfx.NextWrap(l))
+
+	// tokens without a limit of their own don't get buckets
+	assert.NoError(t, sink.AddEvents(ctxFor("a"), []*event.Event{{}}))
+	assert.NoError(t, sink.AddEvents(ctxFor("b"), []*event.Event{{}}))
+	assert.Error(t, sink.AddEvents(ctxFor("c"), []*event.Event{{}}))
+	assert.NoError(t, sink.AddSpans(ctxFor("d"), make([]*trace.Span, 10)))
+	l.mu.Lock()
+	assert.Len(t, l.tokens, 1)
+	assert.Len(t, l.throttled, 1)
+	l.mu.Unlock()
+
+	// tokens whose buckets haven't refilled are kept
+	clock.Incr(l.conf.IdleTimeout.Get() - 100*time.Millisecond)
+	assert.NoError(t, sink.AddSpans(ctxFor("d"), make([]*trace.Span, 10)))
+	assert.NoError(t, sink.AddEvents(ctxFor("a"), make([]*event.Event, 2)))
+	assert.Error(t, sink.AddEvents(ctxFor("c"), []*event.Event{{}}))
+	clock.Incr(100 * time.Millisecond)
+	assert.NoError(t, sink.AddDatapoints(ctxFor("e"), dps(1)))
+	assert.Equal(t, int64(2), throttled(l, "c", "global", "events"))
+	l.mu.Lock()
+	assert.Len(t, l.tokens, 1)
+	assert.Len(t, l.throttled, 1)
+	l.mu.Unlock()
+
+	clock.Incr(l.conf.IdleTimeout.Get())
+	assert.NoError(t, sink.AddDatapoints(ctxFor("e"), dps(1)))
+	l.mu.Lock()
+	assert.Empty(t, l.tokens)
+	l.mu.Unlock()
+
+	// throttle counts are cumulative, so they carry on from where they were rather than starting again
+	assert.NoError(t, sink.AddEvents(ctxFor("a"), make([]*event.Event, 2)))
+	assert.Error(t, sink.AddEvents(ctxFor("c"), []*event.Event{{}}))
+	assert.Equal(t, int64(3), throttled(l, "c", "global", "events"))
+}
+
+func TestMaxThrottledTokens(t *testing.T) {
+	l, _, _ := testLimiter(t, map[string]string{"RATE_LIMIT_GLOBAL_EVENTS_PER_SECOND": "1", "RATE_LIMIT_MAX_THROTTLED_TOKENS": "1"})
+	defer l.Close()
+	sink := signalfx.FromChain(nopSink{}, signalfx.NextWrap(l))
+
+	assert.NoError(t, sink.AddEvents(ctxFor("a"), []*event.Event{{}}))
+	for _, token := range []string{"b", "c", "d", "b"} {
+		assert.Error(t, sink.AddEvents(ctxFor(token), []*event.Event{{}}))
+	}
+	assert.Equal(t, int64(2), throttled(l, "b", "global", "events"))
+	assert.Equal(t, int64(0), throttled(l, "c", "global", "events"))
+	assert.Equal(t, int64(2), throttledHash(l, tokenhash.Other, "global", "events"), "tokens past the most counted share a count")
+	l.mu.Lock()
+	assert.Len(t, l.throttled, 1)
+	l.mu.Unlock()
+}
+
+func TestGlobalLimit(t *testing.T) {
+	l, _, _ := testLimiter(t, map[string]string{"RATE_LIMIT_GLOBAL_EVENTS_PER_SECOND": "2"})
+	defer l.Close()
+	sink := signalfx.FromChain(nopSink{}, signalfx.NextWrap(l))
+	assert.NoError(t, sink.AddEvents(ctxFor("a"), []*event.Event{{}}))
+	assert.NoError(t, sink.AddEvents(ctxFor("b"), []*event.Event{{}}))
+	assert.Error(t, sink.AddEvents(ctxFor("c"), []*event.Event{{}}))
+	assert.Equal(t, int64(1), throttled(l, "c", "global", "events"))
+}
+
+func TestOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "overrides.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"tokens": {"small": {"datapoints_per_second": 1}, "vip": {"datapoints_per_second": 5}}}`), 0600))
+
+	l, _, mem := testLimiter(t, map[string]string{
+		"RATE_LIMIT_DATAPOINTS_PER_SECOND": "100",
+		"RATE_LIMIT_OVERRIDES_FILE":        path,
+		"RATE_LIMIT_OVERRIDES":             `{"tokens": {"vip": {"datapoints_per_second": 0}}}`,
+	})
+	defer l.Close()
+	sink := signalfx.FromChain(nopSink{}, signalfx.NextWrap(l))
+	assert.NoError(t, sink.AddDatapoints(ctxFor("default"), dps(100)))
+	assert.NoError(t, sink.AddDatapoints(ctxFor("small"), dps(1)))
+	assert.Error(t, sink.AddDatapoints(ctxFor("small"), dps(1)))
+	// distconf overrides win over the file, and zero is unlimited
+	assert.NoError(t, sink.AddDatapoints(ctxFor("vip"), dps(1000)))
+
+	mem.Write("RATE_LIMIT_OVERRIDES", []byte(`{"tokens": {"default": {"datapoints_per_second": 1}}}`))
+	assert.Error(t, sink.AddDatapoints(ctxFor("default"), dps(2)))
+	// vip falls back to the file
+	assert.NoError(t, sink.AddDatapoints(ctxFor("vip"), dps(5)))
+	assert.Error(t, sink.AddDatapoints(ctxFor("vip"), dps(5)))
+	// bad overrides are ignored
+	mem.Write("RATE_LIMIT_OVERRIDES", []byte(`{`))
+	assert.Error(t, sink.AddDatapoints(ctxFor("default"), dps(2)))
+}
+
+func TestBadOverrides(t *testing.T) {
+	for _, values := range []map[string]string{{"RATE_LIMIT_OVERRIDES": "{"}, {"RATE_LIMIT_OVERRIDES_FILE": "/does/not/exist"}} {
+		mem := distconf.Mem()
+		for k, v := range values {
+			mem.Write(k, []byte(v))
+		}
+		conf := &Config{}
+		conf.Load(distconf.New([]distconf.Reader{mem}))
+		_, err := New(conf, timekeepertest.NewStubClock(time.Now()), log.Discard)
+		assert.Error(t, err)
+	}
+}
+
+func TestLimitRequests(t *testing.T) {
+	l, clock, _ := testLimiter(t, map[string]string{"RATE_LIMIT_BYTES_PER_SECOND": "10"})
+	defer l.Close()
+	handler := web.NewHandler(ctxFor("tok"), web.HandlerFunc(func(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+	})).Add(web.NextConstructor(l.LimitRequests))
+
+	send := func(body string, length int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v2/datapoint", strings.NewReader(body))
+		req.ContentLength = length
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+	assert.Equal(t, http.StatusOK, send("12345678", 8).Code)
+	rw := send("12345678", 8)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+	assert.Equal(t, int64(1), throttled(l, "tok", "token", "bytes"))
+
+	// bodies of unknown length are let through and charged afterwards
+	clock.Incr(time.Second)
+	assert.Equal(t, http.StatusOK, send("123456789012345", -1).Code)
+	assert.Equal(t, http.StatusTooManyRequests, send("1", 1).Code)
+}
@@ -0,0 +1,65 @@
+package remotewrite
+
+import "github.com/golang/protobuf/proto"
+
+// The messages below are the subset of prometheus' prompb remote write protocol that POPS reads.  Fields that aren't
+// declared, like metadata, are skipped when decoding.
+
+// WriteRequest is a remote write batch
+type WriteRequest struct {
+	Timeseries []*TimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *WriteRequest) Reset() { *m = WriteRequest{} }
+
+// String implements proto.Message
+func (m *WriteRequest) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*WriteRequest) ProtoMessage() {}
+
+// TimeSeries is a set of samples for one series
+type TimeSeries struct {
+	Labels  []*Label  `protobuf:"bytes,1,rep,name=labels,proto3" json:"labels,omitempty"`
+	Samples []*Sample `protobuf:"bytes,2,rep,name=samples,proto3" json:"samples,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *TimeSeries) Reset() { *m = TimeSeries{} }
+
+// String implements proto.Message
+func (m *TimeSeries) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*TimeSeries) ProtoMessage() {}
+
+// Label is a series label
+type Label struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *Label) Reset() { *m = Label{} }
+
+// String implements proto.Message
+func (m *Label) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*Label) ProtoMessage() {}
+
+// Sample is a value at a timestamp in milliseconds since the epoch
+type Sample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+// Reset implements proto.Message
+func (m *Sample) Reset() { *m = Sample{} }
+
+// String implements proto.Message
+func (m *Sample) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message
+func (*Sample) ProtoMessage() {}
@@ -0,0 +1,104 @@
+package remotewrite
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/mux"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/log"
+)
+
+const (
+	// WritePath is the path prometheus remote write batches are posted to
+	WritePath = "/api/v1/write"
+	// ContentType is the content type of a remote write batch
+	ContentType = "application/x-protobuf"
+
+	metricNameLabel = "__name__"
+	counterSuffix   = "_total"
+)
+
+// SetupPaths registers handler for remote write batches on r
+func SetupPaths(r *mux.Router, handler http.Handler) {
+	r.Path(WritePath).Methods(http.MethodPost).Headers("Content-Type", ContentType).Handler(handler)
+}
+
+// Decoder reads prometheus remote write batches and sends their samples to Sink as datapoints.  Batches are snappy
+// compressed with a Content-Encoding of snappy, which is decompressed, within the request size limits, before the
+// Decoder sees it.
+type Decoder struct {
+	Sink   dpsink.DSink
+	Logger log.Logger
+}
+
+// Read decodes the remote write batch in req and sends it to the sink
+func (d *Decoder) Read(ctx context.Context, req *http.Request) error {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	var wr WriteRequest
+	if err := proto.Unmarshal(b, &wr); err != nil {
+		return err
+	}
+	var dps []*datapoint.Datapoint
+	for _, ts := range wr.Timeseries {
+		dps = appendDatapoints(dps, ts)
+	}
+	if len(dps) == 0 {
+		return nil
+	}
+	return d.Sink.AddDatapoints(ctx, dps)
+}
+
+// appendDatapoints turns each sample into a datapoint.  __name__ becomes the metric and the other labels become
+// dimensions.  Series named like counters are sent as cumulative counters and everything else as gauges.  NaN and
+// infinite samples, which include prometheus' staleness markers, can't be sent to SignalFx and are dropped.
+func appendDatapoints(dps []*datapoint.Datapoint, ts *TimeSeries) []*datapoint.Datapoint {
+	var metric string
+	dims := make(map[string]string, len(ts.Labels))
+	for _, l := range ts.Labels {
+		if l.Name == metricNameLabel {
+			metric = l.Value
+		} else if l.Value != "" {
+			dims[l.Name] = l.Value
+		}
+	}
+	if metric == "" {
+		return dps
+	}
+	metricType := datapoint.Gauge
+	if strings.HasSuffix(metric, counterSuffix) {
+		metricType = datapoint.Counter
+	}
+	for _, s := range ts.Samples {
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		sampleDims := dims
+		if len(ts.Samples) > 1 {
+			sampleDims = datapoint.AddMaps(dims, nil)
+		}
+		dps = append(dps, datapoint.New(metric, sampleDims, value(s.Value), metricType, fromMillis(s.Timestamp)))
+	}
+	return dps
+}
+
+// value keeps whole numbers as ints so counters aren't sent as floats
+func value(v float64) datapoint.Value {
+	if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+		return datapoint.NewIntValue(int64(v))
+	}
+	return datapoint.NewFloatValue(v)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,85 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type dpSink struct {
+	calls [][]*datapoint.Datapoint
+}
+
+func (s *dpSink) AddDatapoints(_ context.Context, dps []*datapoint.Datapoint) error {
+	s.calls = append(s.calls, dps)
+	return nil
+}
+
+func series(name string, values ...float64) *TimeSeries {
+	ts := &TimeSeries{Labels: []*Label{
+		{Name: "__name__", Value: name},
+		{Name: "job", Value: "node"},
+		{Name: "empty", Value: ""},
+	}}
+	for i, v := range values {
+		ts.Samples = append(ts.Samples, &Sample{Value: v, Timestamp: 1500000000000 + int64(i)*1000})
+	}
+	return ts
+}
+
+func post(t *testing.T, wr *WriteRequest) *http.Request {
+	b, err := proto.Marshal(wr)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, WritePath, bytes.NewReader(b))
+	req.Header.Set("Content-Type", ContentType)
+	return req
+}
+
+func TestRead(t *testing.T) {
+	sink := &dpSink{}
+	d := &Decoder{Sink: sink, Logger: log.Discard}
+	require.NoError(t, d.Read(context.Background(), post(t, &WriteRequest{Timeseries: []*TimeSeries{
+		series("http_requests_total", 10, 12),
+		series("load1", 0.5, math.NaN(), math.Inf(1)),
+		{Labels: []*Label{{Name: "job", Value: "unnamed"}}, Samples: []*Sample{{Value: 1}}},
+	}})))
+	require.Len(t, sink.calls, 1)
+	dps := sink.calls[0]
+	require.Len(t, dps, 3)
+
+	assert.Equal(t, "http_requests_total", dps[0].Metric)
+	assert.Equal(t, datapoint.Counter, dps[0].MetricType)
+	assert.Equal(t, datapoint.NewIntValue(10), dps[0].Value)
+	assert.Equal(t, map[string]string{"job": "node"}, dps[0].Dimensions)
+	assert.Equal(t, time.Unix(1500000000, 0), dps[0].Timestamp)
+	assert.Equal(t, datapoint.NewIntValue(12), dps[1].Value)
+	assert.Equal(t, time.Unix(1500000001, 0), dps[1].Timestamp)
+
+	assert.Equal(t, "load1", dps[2].Metric)
+	assert.Equal(t, datapoint.Gauge, dps[2].MetricType)
+	assert.Equal(t, datapoint.NewFloatValue(0.5), dps[2].Value)
+
+	// nothing worth sending doesn't reach the sink
+	require.NoError(t, d.Read(context.Background(), post(t, &WriteRequest{})))
+	assert.Len(t, sink.calls, 1)
+}
+
+func TestBadBodies(t *testing.T) {
+	d := &Decoder{Sink: &dpSink{}, Logger: log.Discard}
+	for _, body := range [][]byte{
+		[]byte("not protobuf"),
+	} {
+		req := httptest.NewRequest(http.MethodPost, WritePath, bytes.NewReader(body))
+		assert.Error(t, d.Read(context.Background(), req))
+	}
+}
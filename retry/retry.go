@@ -0,0 +1,453 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/pops/internal/httpbody"
+	"github.com/signalfx/pops/internal/tokenhash"
+)
+
+const (
+	// statusError is the status code recorded for requests that failed without a response
+	statusError = -1
+	// statusTooManyPending is the status code recorded for requests given up on before being sent, because their token
+	// already had too many waiting
+	statusTooManyPending = -2
+)
+
+// ErrTooManyPending is returned, when there is no GiveUp, for requests whose token already has as many requests waiting
+// to be retried as it is allowed
+var ErrTooManyPending = errors.New("too many requests pending retry for token")
+
+// ErrGaveUp is returned for requests that couldn't be retried and had nowhere else to go
+var ErrGaveUp = errors.New("gave up retrying request")
+
+// Config configures how failed upstream requests are retried
+type Config struct {
+	BaseDelay          *distconf.Duration
+	MaxDelay           *distconf.Duration
+	Jitter             *distconf.Float
+	MaxAttempts        *distconf.Int
+	MaxPendingPerToken *distconf.Int
+	RetryableStatuses  *distconf.Str
+	HonorRetryAfter    *distconf.Bool
+	MaxCountedTokens   *distconf.Int
+}
+
+// Load the retry config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.BaseDelay = d.Duration("RETRY_BASE_DELAY", 100*time.Millisecond)
+	c.MaxDelay = d.Duration("RETRY_MAX_DELAY", 30*time.Second)
+	c.Jitter = d.Float("RETRY_JITTER", 0.2)
+	c.MaxAttempts = d.Int("RETRY_MAX_ATTEMPTS", 5)
+	c.MaxPendingPerToken = d.Int("RETRY_MAX_PENDING_PER_TOKEN", 100)
+	c.RetryableStatuses = d.Str("RETRY_STATUS_CODES", "408,429,500,502,503,504,598")
+	c.HonorRetryAfter = d.Bool("RETRY_HONOR_RETRY_AFTER", true)
+	c.MaxCountedTokens = d.Int("RETRY_MAX_COUNTED_TOKENS", 1000)
+}
+
+// retryable returns true if the status code is in the configured set of retryable statuses
+func (c *Config) retryable(status int) bool {
+	if status == statusError {
+		return true
+	}
+	code := strconv.Itoa(status)
+	for _, s := range strings.Split(c.RetryableStatuses.Get(), ",") {
+		if strings.TrimSpace(s) == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait before the given attempt, with jitter applied
+func (c *Config) backoff(attempt int64) time.Duration {
+	base := float64(c.BaseDelay.Get())
+	delay := math.Min(base*math.Pow(2, float64(attempt-1)), float64(c.MaxDelay.Get()))
+	if jitter := c.Jitter.Get(); jitter > 0 {
+		delay -= delay * math.Min(jitter, 1) * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// pending is a request waiting to be retried
+type pending struct {
+	req       *http.Request
+	body      []byte
+	attempt   int64
+	notBefore time.Time
+}
+
+// tokenRetrier retries the requests for a single token, in order, on its own goroutine
+type tokenRetrier struct {
+	token   string
+	pending []*pending
+}
+
+type statusCounts map[int]int64
+
+// tokenCounts counts requests by token and status code.  The counts are cumulative, so a token's are kept once it has
+// some rather than expired and started again from zero.  Instead only so many tokens are counted on their own and the
+// rest are counted together, so tokens that are only seen once can't keep adding counts.
+type tokenCounts struct {
+	tokens map[string]statusCounts
+	other  statusCounts
+}
+
+func newTokenCounts() *tokenCounts {
+	return &tokenCounts{
+		tokens: make(map[string]statusCounts),
+		other:  make(statusCounts),
+	}
+}
+
+func (c *tokenCounts) add(token string, status int, maxTokens int64) {
+	s, ok := c.tokens[token]
+	if !ok {
+		if int64(len(c.tokens)) >= maxTokens {
+			c.other[status]++
+			return
+		}
+		s = make(statusCounts)
+		c.tokens[token] = s
+	}
+	s[status]++
+}
+
+func (c *tokenCounts) datapoints(name string) []*datapoint.Datapoint {
+	var dps []*datapoint.Datapoint
+	add := func(tokenHash string, s statusCounts) {
+		for status, count := range s {
+			dps = append(dps, sfxclient.Cumulative(name, map[string]string{"token_hash": tokenHash, "status_code": statusName(status)}, count))
+		}
+	}
+	for token, s := range c.tokens {
+		add(tokenhash.Dimension(token), s)
+	}
+	add(tokenhash.Other, c.other)
+	return dps
+}
+
+// Transport is an http.RoundTripper that retries failed upstream requests with exponential backoff.  Retries happen
+// asynchronously per token, so a token that is being throttled or failing doesn't hold up the sink's other tokens.
+type Transport struct {
+	conf       *Config
+	next       http.RoundTripper
+	timeKeeper timekeeper.TimeKeeper
+	logger     log.Logger
+	// GiveUp is called, without any locks held, with requests that ran out of retries or couldn't be queued.  If it is
+	// nil the request is dropped.
+	GiveUp func(req *http.Request, body []byte) error
+
+	mu       sync.Mutex
+	tokens   map[string]*tokenRetrier
+	retries  *tokenCounts
+	giveUps  *tokenCounts
+	wg       sync.WaitGroup
+	closing  chan struct{}
+	inFlight int64
+}
+
+// New returns a Transport that sends requests through next
+func New(conf *Config, next http.RoundTripper, timeKeeper timekeeper.TimeKeeper, logger log.Logger) *Transport {
+	return &Transport{
+		conf:       conf,
+		next:       next,
+		timeKeeper: timeKeeper,
+		logger:     logger,
+		tokens:     make(map[string]*tokenRetrier),
+		retries:    newTokenCounts(),
+		giveUps:    newTokenCounts(),
+		closing:    make(chan struct{}),
+	}
+}
+
+// RoundTrip sends the request and, if it fails with a retryable status, queues it to be retried and reports success
+// to the caller.  Requests for a token with retries already queued wait behind them so ordering is kept.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := httpbody.Read(req)
+	if err != nil {
+		return nil, err
+	}
+	token := req.Header.Get(sfxclient.TokenHeaderName)
+	if queued, qerr := t.enqueueIfWaiting(token, req, body); queued || qerr != nil {
+		if qerr != nil {
+			return nil, qerr
+		}
+		return httpbody.Accepted(req), nil
+	}
+	resp, err := t.next.RoundTrip(req)
+	status := statusOf(resp, err)
+	if !t.conf.retryable(status) || t.conf.MaxAttempts.Get() <= 1 {
+		return resp, err
+	}
+	delay := t.delay(1, resp)
+	if resp != nil {
+		httpbody.Drain(resp)
+	}
+	if qerr := t.enqueue(token, &pending{req: req, body: body, attempt: 1, notBefore: t.timeKeeper.Now().Add(delay)}, status); qerr != nil {
+		return nil, qerr
+	}
+	return httpbody.Accepted(req), nil
+}
+
+// delay returns how long to wait after the given attempt, honouring any Retry-After from the upstream
+func (t *Transport) delay(attempt int64, resp *http.Response) time.Duration {
+	delay := t.conf.backoff(attempt)
+	if resp != nil && t.conf.HonorRetryAfter.Get() {
+		if after, ok := retryAfter(resp.Header.Get("Retry-After"), t.timeKeeper.Now()); ok && after > delay {
+			delay = after
+		}
+	}
+	return delay
+}
+
+// enqueueIfWaiting queues the request behind the ones already waiting for its token, if there are any, giving up on it
+// if the token already has too many waiting
+func (t *Transport) enqueueIfWaiting(token string, req *http.Request, body []byte) (bool, error) {
+	p := &pending{req: req, body: body, notBefore: t.timeKeeper.Now()}
+	t.mu.Lock()
+	r, ok := t.tokens[token]
+	if !ok {
+		t.mu.Unlock()
+		return false, nil
+	}
+	full := int64(len(r.pending)) >= t.conf.MaxPendingPerToken.Get()
+	if full {
+		t.count(t.giveUps, token, statusTooManyPending)
+	} else {
+		r.pending = append(r.pending, p)
+	}
+	t.mu.Unlock()
+	if full {
+		return true, t.handOff(p, ErrTooManyPending)
+	}
+	return true, nil
+}
+
+func (t *Transport) enqueue(token string, p *pending, status int) error {
+	if !t.add(token, p, status) {
+		return t.handOff(p, ErrGaveUp)
+	}
+	return nil
+}
+
+// add queues the request to be retried, starting a retrier for its token if there isn't one, or counts it as given up
+// on and returns false if the transport is closing or the token has too many waiting
+func (t *Transport) add(token string, p *pending, status int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.closing:
+		t.count(t.giveUps, token, status)
+		return false
+	default:
+	}
+	r, ok := t.tokens[token]
+	if !ok {
+		r = &tokenRetrier{token: token}
+		t.tokens[token] = r
+		t.wg.Add(1)
+		go t.retry(r)
+	}
+	if int64(len(r.pending)) >= t.conf.MaxPendingPerToken.Get() {
+		t.count(t.giveUps, token, status)
+		return false
+	}
+	t.count(t.retries, token, status)
+	r.pending = append(r.pending, p)
+	return true
+}
+
+// count adds a request for token to counts.  It must be called with t.mu held.
+func (t *Transport) count(counts *tokenCounts, token string, status int) {
+	counts.add(token, status, t.conf.MaxCountedTokens.Get())
+}
+
+// handOff passes a request that was given up on to GiveUp, returning dropped if there is no GiveUp.  It must not be
+// called with t.mu held, since GiveUp can be slow and would hold up every token.
+func (t *Transport) handOff(p *pending, dropped error) error {
+	if t.GiveUp == nil {
+		return dropped
+	}
+	return t.GiveUp(p.req, p.body)
+}
+
+// head returns the request at the head of the token's queue, or removes the token and returns nil if there are none
+func (t *Transport) head(r *tokenRetrier) *pending {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(r.pending) == 0 {
+		delete(t.tokens, r.token)
+		return nil
+	}
+	return r.pending[0]
+}
+
+func (t *Transport) pop(r *tokenRetrier) {
+	t.mu.Lock()
+	r.pending = r.pending[1:]
+	t.mu.Unlock()
+}
+
+func (t *Transport) retry(r *tokenRetrier) {
+	defer t.wg.Done()
+	for {
+		p := t.head(r)
+		if p == nil {
+			return
+		}
+		if !t.waitFor(p.notBefore) {
+			t.abandon(r)
+			return
+		}
+		p.attempt++
+		atomic.AddInt64(&t.inFlight, 1)
+		resp, err := t.send(p)
+		atomic.AddInt64(&t.inFlight, -1)
+		status := statusOf(resp, err)
+		if !t.conf.retryable(status) {
+			if status >= http.StatusMultipleChoices {
+				t.logger.Log("status", status, "retried request was rejected")
+			}
+			t.pop(r)
+			continue
+		}
+		t.reschedule(r, p, status, resp)
+	}
+}
+
+// waitFor waits until notBefore, returning false if the transport is closed first
+func (t *Transport) waitFor(notBefore time.Time) bool {
+	select {
+	case <-t.closing:
+		return false
+	default:
+	}
+	if wait := notBefore.Sub(t.timeKeeper.Now()); wait > 0 {
+		select {
+		case <-t.closing:
+			return false
+		case <-t.timeKeeper.After(wait):
+		}
+	}
+	return true
+}
+
+// reschedule backs off before the next attempt at the head of the queue, or gives up on it after too many attempts
+func (t *Transport) reschedule(r *tokenRetrier, p *pending, status int, resp *http.Response) {
+	t.mu.Lock()
+	gaveUp := p.attempt >= t.conf.MaxAttempts.Get()
+	if gaveUp {
+		r.pending = r.pending[1:]
+		t.count(t.giveUps, r.token, status)
+	} else {
+		t.count(t.retries, r.token, status)
+		p.notBefore = t.timeKeeper.Now().Add(t.delay(p.attempt, resp))
+	}
+	t.mu.Unlock()
+	if gaveUp {
+		t.logGiveUp(t.handOff(p, ErrGaveUp))
+	}
+}
+
+// abandon gives up on everything still queued for a token when the transport is closed
+func (t *Transport) abandon(r *tokenRetrier) {
+	t.mu.Lock()
+	abandoned := r.pending
+	for range abandoned {
+		t.count(t.giveUps, r.token, statusError)
+	}
+	r.pending = nil
+	delete(t.tokens, r.token)
+	t.mu.Unlock()
+	for _, p := range abandoned {
+		t.logGiveUp(t.handOff(p, ErrGaveUp))
+	}
+}
+
+func (t *Transport) logGiveUp(err error) {
+	if err != nil {
+		t.logger.Log(log.Err, err, "giving up on request")
+	}
+}
+
+// send makes one attempt at a queued request, returning the response with its body already drained
+func (t *Transport) send(p *pending) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sfxclient.DefaultTimeout)
+	defer cancel()
+	req := p.req.Clone(ctx)
+	httpbody.Set(req, p.body)
+	resp, err := t.next.RoundTrip(req)
+	if resp != nil {
+		httpbody.Drain(resp)
+	}
+	return resp, err
+}
+
+// Datapoints returns retries and give ups by token and status code, along with how many requests are waiting.  Tokens
+// are reported by their hash, since whatever a client sends as a token ends up here.
+func (t *Transport) Datapoints() []*datapoint.Datapoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dps := append(t.retries.datapoints("retry.retries"), t.giveUps.datapoints("retry.give_ups")...)
+	for token, r := range t.tokens {
+		dps = append(dps, sfxclient.Gauge("retry.pending", map[string]string{"token_hash": tokenhash.Dimension(token)}, int64(len(r.pending))))
+	}
+	dps = append(dps, sfxclient.Gauge("retry.in_flight", nil, atomic.LoadInt64(&t.inFlight)))
+	return dps
+}
+
+// Close stops retrying and gives up on anything still waiting to be retried
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	close(t.closing)
+	t.mu.Unlock()
+	t.wg.Wait()
+	return nil
+}
+
+func statusOf(resp *http.Response, err error) int {
+	if err != nil || resp == nil {
+		return statusError
+	}
+	return resp.StatusCode
+}
+
+func statusName(status int) string {
+	switch status {
+	case statusError:
+		return "error"
+	case statusTooManyPending:
+		return "too_many_pending"
+	}
+	return strconv.Itoa(status)
+}
+
+// retryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(strings.TrimSpace(header), 10, 64); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return at.Sub(now), true
+	}
+	return 0, false
+}
@@ -0,0 +1,266 @@
+package retry
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/pops/internal/httpbody"
+	"github.com/signalfx/pops/internal/tokenhash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upstream fails each token's first few requests with a status before accepting them
+type upstream struct {
+	*httptest.Server
+	mu         sync.Mutex
+	failures   map[string]int
+	status     int
+	retryAfter string
+	received   []string
+}
+
+func newUpstream(status int, failures map[string]int) *upstream {
+	u := &upstream{status: status, failures: failures}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		token := req.Header.Get(sfxclient.TokenHeaderName)
+		body, _ := ioutil.ReadAll(req.Body)
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if u.failures[token] > 0 {
+			u.failures[token]--
+			if u.retryAfter != "" {
+				rw.Header().Set("Retry-After", u.retryAfter)
+			}
+			rw.WriteHeader(u.status)
+			return
+		}
+		u.received = append(u.received, token+":"+string(body))
+		_, _ = rw.Write([]byte(`"OK"`))
+	}))
+	return u
+}
+
+func (u *upstream) got() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.received...)
+}
+
+func testConfig(overrides map[string]string) *Config {
+	mem := distconf.Mem()
+	mem.Write("RETRY_BASE_DELAY", []byte("1ms"))
+	mem.Write("RETRY_MAX_DELAY", []byte("5ms"))
+	for k, v := range overrides {
+		mem.Write(k, []byte(v))
+	}
+	c := &Config{}
+	c.Load(distconf.New([]distconf.Reader{mem}))
+	return c
+}
+
+func post(t *testing.T, rt http.RoundTripper, url string, token string, body string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Set(sfxclient.TokenHeaderName, token)
+	resp, err := rt.RoundTrip(req)
+	if resp != nil {
+		httpbody.Drain(resp)
+	}
+	return resp, err
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 500; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("condition never became true")
+}
+
+func count(t *Transport, name string, status string) int64 {
+	return tokenCount(t, name, tokenhash.Dimension("tok"), status)
+}
+
+func tokenCount(t *Transport, name string, tokenHash string, status string) int64 {
+	for _, dp := range t.Datapoints() {
+		if dp.Metric == name && dp.Dimensions["token_hash"] == tokenHash && dp.Dimensions["status_code"] == status {
+			return dp.Value.(interface{ Int() int64 }).Int()
+		}
+	}
+	return 0
+}
+
+func TestRetriesUntilSuccess(t *testing.T) {
+	up := newUpstream(http.StatusServiceUnavailable, map[string]int{"tok": 2})
+	defer up.Close()
+	tr := New(testConfig(nil), http.DefaultTransport, timekeeper.RealTime{}, log.Discard)
+	defer tr.Close()
+
+	resp, err := post(t, tr, up.URL, "tok", "one")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "the sink is told the request was accepted")
+	// queued behind the request being retried
+	_, err = post(t, tr, up.URL, "tok", "two")
+	require.NoError(t, err)
+
+	waitFor(t, func() bool { return len(up.got()) == 2 })
+	assert.Equal(t, []string{"tok:one", "tok:two"}, up.got())
+	assert.Equal(t, int64(2), count(tr, "retry.retries", "503"))
+	assert.Equal(t, int64(0), count(tr, "retry.give_ups", "503"))
+}
+
+func TestCountedTokens(t *testing.T) {
+	up := newUpstream(http.StatusServiceUnavailable, map[string]int{"a": 1, "b": 1, "c": 1})
+	defer up.Close()
+	tr := New(testConfig(map[string]string{"RETRY_MAX_COUNTED_TOKENS": "2"}), http.DefaultTransport, timekeeper.RealTime{}, log.Discard)
+	defer tr.Close()
+
+	// each token's retry is counted as it is queued, in order
+	for _, token := range []string{"a", "b", "c"} {
+		_, err := post(t, tr, up.URL, token, "one")
+		require.NoError(t, err)
+	}
+	waitFor(t, func() bool { return len(up.got()) == 3 })
+	assert.Equal(t, int64(1), tokenCount(tr, "retry.retries", tokenhash.Dimension("a"), "503"))
+	assert.Equal(t, int64(1), tokenCount(tr, "retry.retries", tokenhash.Dimension("b"), "503"))
+	// tokens past the limit are counted together
+	assert.Equal(t, int64(0), tokenCount(tr, "retry.retries", tokenhash.Dimension("c"), "503"))
+	assert.Equal(t, int64(1), tokenCount(tr, "retry.retries", tokenhash.Other, "503"))
+}
+
+func TestNonRetryableStatus(t *testing.T) {
+	up := newUpstream(http.StatusBadRequest, map[string]int{"tok": 1})
+	defer up.Close()
+	tr := New(testConfig(nil), http.DefaultTransport, timekeeper.RealTime{}, log.Discard)
+	defer tr.Close()
+
+	resp, err := post(t, tr, up.URL, "tok", "one")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, int64(0), count(tr, "retry.retries", "400"))
+}
+
+func TestRetryableStatusesAreConfigurable(t *testing.T) {
+	up := newUpstream(http.StatusServiceUnavailable, map[string]int{"tok": 1})
+	defer up.Close()
+	tr := New(testConfig(map[string]string{"RETRY_STATUS_CODES": "429"}), http.DefaultTransport, timekeeper.RealTime{}, log.Discard)
+	defer tr.Close()
+
+	resp, err := post(t, tr, up.URL, "tok", "one")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestGiveUp(t *testing.T) {
+	up := newUpstream(http.StatusTooManyRequests, map[string]int{"tok": 100})
+	defer up.Close()
+	tr := New(testConfig(map[string]string{"RETRY_MAX_ATTEMPTS": "3"}), http.DefaultTransport, timekeeper.RealTime{}, log.Discard)
+	defer tr.Close()
+	var mu sync.Mutex
+	var gaveUp []string
+	tr.GiveUp = func(req *http.Request, body []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		gaveUp = append(gaveUp, string(body))
+		return nil
+	}
+
+	_, err := post(t, tr, up.URL, "tok", "one")
+	require.NoError(t, err)
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(gaveUp) == 1
+	})
+	assert.Equal(t, []string{"one"}, gaveUp)
+	assert.Equal(t, int64(2), count(tr, "retry.retries", "429"))
+	assert.Equal(t, int64(1), count(tr, "retry.give_ups", "429"))
+}
+
+func TestTooManyPending(t *testing.T) {
+	up := newUpstream(http.StatusServiceUnavailable, map[string]int{"tok": 100})
+	defer up.Close()
+	up.retryAfter = "3600"
+	tr := New(testConfig(map[string]string{"RETRY_MAX_PENDING_PER_TOKEN": "1"}), http.DefaultTransport, timekeeper.RealTime{}, log.Discard)
+
+	_, err := post(t, tr, up.URL, "tok", "one")
+	require.NoError(t, err)
+	_, err = post(t, tr, up.URL, "tok", "two")
+	assert.Equal(t, ErrTooManyPending, err)
+
+	assert.Equal(t, int64(1), count(tr, "retry.give_ups", "too_many_pending"))
+
+	var gaveUp []string
+	tr.mu.Lock()
+	tr.GiveUp = func(req *http.Request, body []byte) error {
+		// handed off without the transport locked, so the transport can still be used
+		_ = tr.Datapoints()
+		gaveUp = append(gaveUp, string(body))
+		return nil
+	}
+	tr.mu.Unlock()
+	resp, err := post(t, tr, up.URL, "tok", "three")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "the request that didn't fit was handed off")
+	assert.Equal(t, []string{"three"}, gaveUp)
+	// anything still waiting is given up on when the transport closes
+	assert.NoError(t, tr.Close())
+	assert.Equal(t, []string{"three", "one"}, gaveUp)
+}
+
+func TestThrottledTokenDoesNotBlockOthers(t *testing.T) {
+	up := newUpstream(http.StatusTooManyRequests, map[string]int{"slow": 1})
+	defer up.Close()
+	up.retryAfter = "3600"
+	tr := New(testConfig(nil), http.DefaultTransport, timekeeper.RealTime{}, log.Discard)
+	defer tr.Close()
+
+	_, err := post(t, tr, up.URL, "slow", "one")
+	require.NoError(t, err)
+	resp, err := post(t, tr, up.URL, "fast", "two")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"fast:two"}, up.got())
+	tr.mu.Lock()
+	notBefore := tr.tokens["slow"].pending[0].notBefore
+	tr.mu.Unlock()
+	assert.True(t, notBefore.After(time.Now().Add(time.Minute*59)), "Retry-After should be honoured")
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, ok := retryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, d)
+	d, ok = retryAfter(now.Add(time.Minute).Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, d)
+	_, ok = retryAfter("soon", now)
+	assert.False(t, ok)
+	_, ok = retryAfter("", now)
+	assert.False(t, ok)
+}
+
+func TestBackoff(t *testing.T) {
+	c := testConfig(map[string]string{"RETRY_BASE_DELAY": "100ms", "RETRY_MAX_DELAY": "1s", "RETRY_JITTER": "0"})
+	assert.Equal(t, 100*time.Millisecond, c.backoff(1))
+	assert.Equal(t, 400*time.Millisecond, c.backoff(3))
+	assert.Equal(t, time.Second, c.backoff(10))
+	c = testConfig(map[string]string{"RETRY_BASE_DELAY": "100ms", "RETRY_MAX_DELAY": "1s", "RETRY_JITTER": "0.5"})
+	for i := 0; i < 100; i++ {
+		d := c.backoff(1)
+		assert.True(t, d >= 50*time.Millisecond && d <= 100*time.Millisecond)
+	}
+}
@@ -0,0 +1,373 @@
+package rewrite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx/tagreplace"
+	"github.com/signalfx/pops/filewatch"
+)
+
+// Config configures how dimensions are rewritten
+type Config struct {
+	RulesFile      *distconf.Str
+	ReloadInterval *distconf.Duration
+}
+
+// Load the rewrite config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.RulesFile = d.Str("REWRITE_RULES_FILE", "")
+	c.ReloadInterval = d.Duration("REWRITE_RELOAD_INTERVAL", 10*time.Second)
+}
+
+type signalType int
+
+const (
+	signalDatapoints signalType = iota
+	signalEvents
+	signalSpans
+	numSignalTypes
+)
+
+var signalTypeNames = [numSignalTypes]string{"datapoints", "events", "spans"}
+
+// Extract adds a dimension for every named group of Regex, set to what it captured from the dimension called
+// Dimension, or from the metric name, event type or span name if Dimension isn't set
+type Extract struct {
+	Dimension string `json:"dimension,omitempty"`
+	Regex     string `json:"regex"`
+
+	re *regexp.Regexp
+}
+
+func (e *Extract) compile() error {
+	var err error
+	if e.re, err = regexp.Compile(e.Regex); err != nil {
+		return err
+	}
+	for _, name := range e.re.SubexpNames()[1:] {
+		if name == "" {
+			return fmt.Errorf("regex %q has a group without a name", e.Regex)
+		}
+	}
+	return nil
+}
+
+func (e *Extract) apply(name string, dims map[string]string) {
+	from := name
+	if e.Dimension != "" {
+		var ok bool
+		if from, ok = dims[e.Dimension]; !ok {
+			return
+		}
+	}
+	match := e.re.FindStringSubmatch(from)
+	for i, group := range e.re.SubexpNames() {
+		if i > 0 && match != nil && match[i] != "" {
+			dims[group] = match[i]
+		}
+	}
+}
+
+// Rule rewrites the dimensions of datapoints and events and the tags of spans.  The dimensions in Extract are added
+// first, then the dimensions in Rename are renamed in order of their names, so {"a": "b", "b": "c"} renames a to c, the ones in Drop dropped and the ones in Add added, replacing any
+// that are already there.  SpanNames are tagreplace rules: each named group they capture from a span's name becomes a
+// tag and is replaced with {name} in the span's name, stopping at the first that matches if SpanNamesExitEarly is
+// set.  A rule with Tokens only applies to data sent with one of them and a rule with Signals only to the signal types
+// named, which are datapoints, events and spans.
+type Rule struct {
+	Name               string            `json:"name,omitempty"`
+	Tokens             []string          `json:"tokens,omitempty"`
+	Signals            []string          `json:"signals,omitempty"`
+	Extract            []*Extract        `json:"extract,omitempty"`
+	Rename             map[string]string `json:"rename,omitempty"`
+	Drop               []string          `json:"drop,omitempty"`
+	Add                map[string]string `json:"add,omitempty"`
+	SpanNames          []string          `json:"span_names,omitempty"`
+	SpanNamesExitEarly bool              `json:"span_names_exit_early,omitempty"`
+
+	tokens     map[string]bool
+	renames    []string
+	signals    [numSignalTypes]bool
+	tagReplace *tagreplace.TagReplace
+	applied    *int64
+}
+
+func (r *Rule) compile(index int) error {
+	if r.Name == "" {
+		r.Name = strconv.Itoa(index)
+	}
+	if len(r.Extract) == 0 && len(r.Rename) == 0 && len(r.Drop) == 0 && len(r.Add) == 0 && len(r.SpanNames) == 0 {
+		return fmt.Errorf("rule %s does nothing", r.Name)
+	}
+	if err := r.compilePatterns(); err != nil {
+		return fmt.Errorf("rule %s: %s", r.Name, err)
+	}
+	if err := r.compileSignals(); err != nil {
+		return err
+	}
+	r.tokens = make(map[string]bool, len(r.Tokens))
+	for _, token := range r.Tokens {
+		r.tokens[token] = true
+	}
+	r.renames = make([]string, 0, len(r.Rename))
+	for from := range r.Rename {
+		r.renames = append(r.renames, from)
+	}
+	sort.Strings(r.renames)
+	return nil
+}
+
+func (r *Rule) compilePatterns() error {
+	for _, e := range r.Extract {
+		if err := e.compile(); err != nil {
+			return err
+		}
+	}
+	if len(r.SpanNames) > 0 {
+		var err error
+		r.tagReplace, err = tagreplace.New(r.SpanNames, r.SpanNamesExitEarly, discard{})
+		return err
+	}
+	return nil
+}
+
+func (r *Rule) compileSignals() error {
+	if len(r.Signals) == 0 {
+		r.signals = [numSignalTypes]bool{true, true, true}
+	}
+	for _, name := range r.Signals {
+		found := false
+		for s, signalName := range signalTypeNames {
+			if name == signalName {
+				r.signals[s] = true
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("rule %s has unknown signal type %q", r.Name, name)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) appliesTo(s signalType, token string) bool {
+	return r.signals[s] && (len(r.tokens) == 0 || r.tokens[token])
+}
+
+// apply rewrites dims in place
+func (r *Rule) apply(name string, dims map[string]string) {
+	for _, e := range r.Extract {
+		e.apply(name, dims)
+	}
+	for _, from := range r.renames {
+		if v, ok := dims[from]; ok {
+			delete(dims, from)
+			dims[r.Rename[from]] = v
+		}
+	}
+	for _, k := range r.Drop {
+		delete(dims, k)
+	}
+	for k, v := range r.Add {
+		dims[k] = v
+	}
+}
+
+// copyDims returns a copy of dims for the rules to rewrite, since decoders may share dims between datapoints
+func copyDims(dims map[string]string) map[string]string {
+	out := make(map[string]string, len(dims))
+	for k, v := range dims {
+		out[k] = v
+	}
+	return out
+}
+
+// discard is the sink after a rule's tagreplace, which only rewrites the spans given to it
+type discard struct{}
+
+func (discard) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return nil }
+func (discard) AddEvents(context.Context, []*event.Event) error             { return nil }
+func (discard) AddSpans(context.Context, []*trace.Span) error               { return nil }
+
+// Rules are loaded from the rules file and applied in order
+type Rules struct {
+	Rules []*Rule `json:"rules,omitempty"`
+}
+
+func parseRules(b []byte) (*Rules, error) {
+	rules := &Rules{}
+	if err := json.Unmarshal(b, rules); err != nil {
+		return nil, err
+	}
+	for i, r := range rules.Rules {
+		if err := r.compile(i); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// matching returns the rules that apply to s sent with the token on ctx
+func (r *Rules) matching(ctx context.Context, s signalType) []*Rule {
+	if len(r.Rules) == 0 {
+		return nil
+	}
+	token, _ := ctx.Value(sfxclient.TokenCtxKey).(string)
+	var matching []*Rule
+	for _, rule := range r.Rules {
+		if rule.appliesTo(s, token) {
+			matching = append(matching, rule)
+		}
+	}
+	return matching
+}
+
+// Rewriter is a signalfx.NextSink that rewrites dimensions and span tags according to a set of rules
+type Rewriter struct {
+	watcher *filewatch.Watcher
+
+	mu      sync.RWMutex
+	rules   *Rules
+	applied map[string]*int64
+}
+
+var _ signalfx.NextSink = &Rewriter{}
+
+// New returns a Rewriter for conf, loading the rules file if there is one and watching it for changes
+func New(conf *Config, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Rewriter, error) {
+	r := &Rewriter{
+		rules:   &Rules{},
+		applied: make(map[string]*int64),
+	}
+	if path := conf.RulesFile.Get(); path != "" {
+		var err error
+		if r.watcher, err = filewatch.New(path, conf.ReloadInterval.Get(), r.load, timeKeeper, logger); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Rewriter) load(b []byte) error {
+	rules, err := parseRules(b)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// rules keep counting where they left off across reloads
+	for _, rule := range rules.Rules {
+		if rule.applied = r.applied[rule.Name]; rule.applied == nil {
+			rule.applied = new(int64)
+			r.applied[rule.Name] = rule.applied
+		}
+	}
+	r.rules = rules
+	return nil
+}
+
+func (r *Rewriter) matching(ctx context.Context, s signalType) []*Rule {
+	r.mu.RLock()
+	rules := r.rules
+	r.mu.RUnlock()
+	return rules.matching(ctx, s)
+}
+
+// AddDatapoints rewrites the dimensions of the datapoints and forwards them
+func (r *Rewriter) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	rules := r.matching(ctx, signalDatapoints)
+	if len(rules) > 0 {
+		for _, dp := range points {
+			dims := copyDims(dp.Dimensions)
+			for _, rule := range rules {
+				rule.apply(dp.Metric, dims)
+			}
+			dp.Dimensions = dims
+		}
+	}
+	for _, rule := range rules {
+		atomic.AddInt64(rule.applied, int64(len(points)))
+	}
+	return next.AddDatapoints(ctx, points)
+}
+
+// AddEvents rewrites the dimensions of the events and forwards them
+func (r *Rewriter) AddEvents(ctx context.Context, events []*event.Event, next signalfx.Sink) error {
+	rules := r.matching(ctx, signalEvents)
+	if len(rules) > 0 {
+		for _, e := range events {
+			dims := copyDims(e.Dimensions)
+			for _, rule := range rules {
+				rule.apply(e.EventType, dims)
+			}
+			e.Dimensions = dims
+		}
+	}
+	for _, rule := range rules {
+		atomic.AddInt64(rule.applied, int64(len(events)))
+	}
+	return next.AddEvents(ctx, events)
+}
+
+// AddSpans rewrites the tags, and names, of the spans and forwards them
+func (r *Rewriter) AddSpans(ctx context.Context, spans []*trace.Span, next signalfx.Sink) error {
+	rules := r.matching(ctx, signalSpans)
+	if len(rules) > 0 {
+		for _, s := range spans {
+			s.Tags = copyDims(s.Tags)
+		}
+	}
+	// a rule's span_names can rename the spans the rules after it see, so each rule goes over all the spans in turn
+	for _, rule := range rules {
+		for _, s := range spans {
+			name := ""
+			if s.Name != nil {
+				name = *s.Name
+			}
+			rule.apply(name, s.Tags)
+		}
+		if rule.tagReplace != nil {
+			_ = rule.tagReplace.AddSpans(ctx, spans)
+		}
+		atomic.AddInt64(rule.applied, int64(len(spans)))
+	}
+	return next.AddSpans(ctx, spans)
+}
+
+// Datapoints returns how many datapoints, events and spans each rule was applied to
+func (r *Rewriter) Datapoints() []*datapoint.Datapoint {
+	r.mu.RLock()
+	dps := make([]*datapoint.Datapoint, 0, len(r.applied))
+	for name, applied := range r.applied {
+		dps = append(dps, sfxclient.CumulativeP("rewrite.applied", map[string]string{"rule": name}, applied))
+	}
+	r.mu.RUnlock()
+	if r.watcher != nil {
+		dps = append(dps, r.watcher.Datapoints()...)
+	}
+	return dps
+}
+
+// Close stops watching the rules file
+func (r *Rewriter) Close() error {
+	if r.watcher != nil {
+		return r.watcher.Close()
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package rewrite
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `{
+  "rules": [
+    {
+      "name": "k8s",
+      "signals": ["datapoints", "events"],
+      "extract": [
+        {"regex": "^(?P<service>[a-z]+)\\.requests$"},
+        {"dimension": "pod", "regex": "^(?P<deployment>[a-z-]+)-[0-9a-f]+$"}
+      ],
+      "rename": {"kubernetes_namespace": "namespace"},
+      "drop": ["pod", "request_id"],
+      "add": {"cluster": "east"}
+    },
+    {"name": "partner", "tokens": ["partner"], "add": {"partner": "true"}},
+    {"name": "spans", "signals": ["spans"], "drop": ["http.user_agent"], "span_names": ["^GET /users/(?P<userId>[0-9]+)$"]}
+  ]
+}`
+
+// recorder keeps what reaches it
+type recorder struct {
+	datapoints []*datapoint.Datapoint
+	events     []*event.Event
+	spans      []*trace.Span
+}
+
+func (r *recorder) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint) error {
+	r.datapoints = append(r.datapoints, points...)
+	return nil
+}
+
+func (r *recorder) AddEvents(ctx context.Context, events []*event.Event) error {
+	r.events = append(r.events, events...)
+	return nil
+}
+
+func (r *recorder) AddSpans(ctx context.Context, spans []*trace.Span) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func testRewriter(t *testing.T, rules string) (*Rewriter, string, func()) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(rules), 0600))
+	mem := distconf.Mem()
+	mem.Write("REWRITE_RULES_FILE", []byte(path))
+	mem.Write("REWRITE_RELOAD_INTERVAL", []byte("1ms"))
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	r, err := New(conf, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	return r, path, func() {
+		_ = r.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func tokenContext(token string) context.Context {
+	return context.WithValue(context.Background(), sfxclient.TokenCtxKey, token)
+}
+
+func applied(r *Rewriter, rule string) int64 {
+	for _, dp := range r.Datapoints() {
+		if dp.Metric == "rewrite.applied" && dp.Dimensions["rule"] == rule {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return -1
+}
+
+func TestDatapointsAndEvents(t *testing.T) {
+	r, _, cleanup := testRewriter(t, testRules)
+	defer cleanup()
+	rec := &recorder{}
+	sink := signalfx.FromChain(rec, signalfx.NextWrap(r))
+
+	shared := map[string]string{"pod": "checkout-7f9c", "kubernetes_namespace": "shop", "request_id": "abc", "cluster": "west"}
+	require.NoError(t, sink.AddDatapoints(tokenContext("mine"), []*datapoint.Datapoint{
+		datapoint.New("checkout.requests", shared, datapoint.NewIntValue(1), datapoint.Counter, time.Now()),
+		datapoint.New("latency", shared, datapoint.NewIntValue(1), datapoint.Gauge, time.Now()),
+	}))
+	assert.Equal(t, map[string]string{"service": "checkout", "deployment": "checkout", "namespace": "shop", "cluster": "east"}, rec.datapoints[0].Dimensions)
+	assert.Equal(t, map[string]string{"deployment": "checkout", "namespace": "shop", "cluster": "east"}, rec.datapoints[1].Dimensions)
+	assert.Equal(t, "checkout-7f9c", shared["pod"], "dimensions shared between datapoints are left alone")
+
+	require.NoError(t, sink.AddEvents(tokenContext("partner"), []*event.Event{event.New("deploy", event.USERDEFINED, map[string]string{"request_id": "abc"}, time.Now())}))
+	assert.Equal(t, map[string]string{"cluster": "east", "partner": "true"}, rec.events[0].Dimensions)
+
+	assert.Equal(t, int64(3), applied(r, "k8s"))
+	assert.Equal(t, int64(1), applied(r, "partner"))
+}
+
+func TestSpans(t *testing.T) {
+	r, _, cleanup := testRewriter(t, testRules)
+	defer cleanup()
+	rec := &recorder{}
+	sink := signalfx.FromChain(rec, signalfx.NextWrap(r))
+
+	require.NoError(t, sink.AddSpans(tokenContext("mine"), []*trace.Span{
+		{Name: pointer.String("GET /users/42"), Tags: map[string]string{"http.user_agent": "curl", "pod": "web-1"}},
+		{Name: pointer.String("GET /health")},
+		{},
+	}))
+	assert.Equal(t, "GET /users/{userId}", *rec.spans[0].Name)
+	assert.Equal(t, map[string]string{"userId": "42", "pod": "web-1"}, rec.spans[0].Tags, "datapoint only rules don't apply")
+	assert.Equal(t, "GET /health", *rec.spans[1].Name)
+	assert.Equal(t, int64(3), applied(r, "spans"))
+	assert.Equal(t, int64(0), applied(r, "k8s"))
+}
+
+func TestChainedRenames(t *testing.T) {
+	rules, err := parseRules([]byte(`{"rules": [{"rename": {"b": "c", "a": "b", "x": "a"}}, {"rename": {"c": "d"}}]}`))
+	require.NoError(t, err)
+	r := &Rewriter{rules: rules}
+	for _, rule := range rules.Rules {
+		rule.applied = new(int64)
+	}
+	// renames go in order of the names they rename, whatever order they come out of the map in
+	for i := 0; i < 20; i++ {
+		rec := &recorder{}
+		require.NoError(t, signalfx.FromChain(rec, signalfx.NextWrap(r)).AddDatapoints(tokenContext("mine"), []*datapoint.Datapoint{
+			datapoint.New("m", map[string]string{"a": "1", "x": "2"}, datapoint.NewIntValue(1), datapoint.Gauge, time.Now()),
+		}))
+		assert.Equal(t, map[string]string{"d": "1", "a": "2"}, rec.datapoints[0].Dimensions)
+	}
+}
+
+func TestNoRules(t *testing.T) {
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{distconf.Mem()}))
+	r, err := New(conf, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	rec := &recorder{}
+	dims := map[string]string{"a": "b"}
+	require.NoError(t, signalfx.FromChain(rec, signalfx.NextWrap(r)).AddDatapoints(tokenContext("mine"), []*datapoint.Datapoint{datapoint.New("m", dims, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())}))
+	assert.Equal(t, dims, rec.datapoints[0].Dimensions)
+	assert.NoError(t, r.Close())
+}
+
+func TestReload(t *testing.T) {
+	r, path, cleanup := testRewriter(t, testRules)
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"rules": [{"name": "partner", "add": {"partner": "false"}}]}`), 0600))
+	for {
+		rec := &recorder{}
+		require.NoError(t, signalfx.FromChain(rec, signalfx.NextWrap(r)).AddEvents(tokenContext("mine"), []*event.Event{event.New("deploy", event.USERDEFINED, nil, time.Now())}))
+		if rec.events[0].Dimensions["partner"] == "false" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBadRules(t *testing.T) {
+	for _, rules := range []string{
+		`{`,
+		`{"rules": [{"name": "nothing"}]}`,
+		`{"rules": [{"add": {"a": "b"}, "signals": ["logs"]}]}`,
+		`{"rules": [{"extract": [{"regex": "("}]}]}`,
+		`{"rules": [{"extract": [{"regex": "(a)"}]}]}`,
+		`{"rules": [{"span_names": ["no groups"]}]}`,
+	} {
+		_, err := parseRules([]byte(rules))
+		assert.Error(t, err, rules)
+	}
+}
@@ -0,0 +1,181 @@
+package sapm
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	jaegerpb "github.com/jaegertracing/jaeger/model"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+)
+
+const (
+	// TracePathV2 is the path SAPM batches are posted to
+	TracePathV2 = "/v2/trace"
+	// ContentType is the content type of a SAPM batch
+	ContentType = "application/x-protobuf"
+)
+
+// SetupPaths registers handler for SAPM batches on r
+func SetupPaths(r *mux.Router, handler http.Handler) {
+	r.Path(TracePathV2).Methods(http.MethodPost).Headers("Content-Type", ContentType).Handler(handler)
+}
+
+// Decoder reads SAPM batches and sends their spans to Sink
+type Decoder struct {
+	Sink   trace.Sink
+	Logger log.Logger
+}
+
+// Read decodes the SAPM batch in req and sends it to the sink
+func (d *Decoder) Read(ctx context.Context, req *http.Request) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	var sapm splunksapm.PostSpansRequest
+	if err := sapm.Unmarshal(body); err != nil {
+		return err
+	}
+	var spans []*trace.Span
+	for _, batch := range sapm.Batches {
+		for _, span := range batch.Spans {
+			process := span.Process
+			if process == nil {
+				process = batch.Process
+			}
+			spans = append(spans, convertSpan(span, process))
+		}
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	return d.Sink.AddSpans(ctx, spans)
+}
+
+// convertSpan turns a jaeger span into a SignalFx span the same way the jaeger thrift decoder does, so spans look the
+// same whichever way they arrive
+func convertSpan(span *jaegerpb.Span, process *jaegerpb.Process) *trace.Span {
+	s := &trace.Span{
+		TraceID:     span.TraceID.String(),
+		ID:          span.SpanID.String(),
+		Name:        pointer.String(span.OperationName),
+		Timestamp:   pointer.Int64(span.StartTime.UnixNano() / 1e3),
+		Duration:    pointer.Int64(span.Duration.Nanoseconds() / 1e3),
+		Annotations: convertLogs(span.Logs),
+	}
+	if span.Flags.IsDebug() {
+		s.Debug = pointer.Bool(true)
+	}
+	if parent, ok := parentID(span.References); ok {
+		s.ParentID = pointer.String(parent.String())
+	}
+	s.Kind, s.RemoteEndpoint, s.Tags = convertTags(span.Tags)
+	s.LocalEndpoint = &trace.Endpoint{}
+	if process != nil {
+		s.LocalEndpoint.ServiceName = pointer.String(process.ServiceName)
+		for i := range process.Tags {
+			t := &process.Tags[i]
+			if t.Key == "ip" && t.VType == jaegerpb.StringType {
+				s.LocalEndpoint.Ipv4 = pointer.String(t.VStr)
+			} else {
+				s.Tags[t.Key] = t.AsString()
+			}
+		}
+	}
+	return s
+}
+
+// parentID prefers a CHILD_OF reference, falling back to the first reference of any kind
+func parentID(refs []jaegerpb.SpanRef) (jaegerpb.SpanID, bool) {
+	if len(refs) == 0 {
+		return 0, false
+	}
+	for _, ref := range refs {
+		if ref.RefType == jaegerpb.SpanRefType_CHILD_OF {
+			return ref.SpanID, true
+		}
+	}
+	return refs[0].SpanID, true
+}
+
+var kinds = map[string]string{
+	"client":   "CLIENT",
+	"server":   "SERVER",
+	"producer": "PRODUCER",
+	"consumer": "CONSUMER",
+}
+
+// convertTags pulls the span kind and remote endpoint out of the tags and returns the rest as a map
+func convertTags(tags []jaegerpb.KeyValue) (*string, *trace.Endpoint, map[string]string) {
+	var kind *string
+	var remote *trace.Endpoint
+	m := make(map[string]string, len(tags))
+	for i := range tags {
+		t := &tags[i]
+		if t.Key == "span.kind" {
+			if k, ok := kinds[t.AsString()]; ok {
+				kind = pointer.String(k)
+			}
+			continue
+		}
+		if setPeer(&remote, t) {
+			continue
+		}
+		if v := t.AsString(); v != "" {
+			m[t.Key] = v
+		}
+	}
+	return kind, remote, m
+}
+
+// setPeer sets the remote endpoint field for a peer.* tag, creating the endpoint if needed.  It returns false for any
+// other tag.
+func setPeer(remote **trace.Endpoint, t *jaegerpb.KeyValue) bool {
+	endpoint := func() *trace.Endpoint {
+		if *remote == nil {
+			*remote = &trace.Endpoint{}
+		}
+		return *remote
+	}
+	switch t.Key {
+	case "peer.ipv4":
+		endpoint().Ipv4 = pointer.String(t.AsString())
+	case "peer.ipv6":
+		endpoint().Ipv6 = pointer.String(t.AsString())
+	case "peer.port":
+		if port, err := strconv.ParseInt(t.AsString(), 10, 32); err == nil {
+			endpoint().Port = pointer.Int32(int32(port))
+		}
+	case "peer.service":
+		endpoint().ServiceName = pointer.String(t.AsString())
+	default:
+		return false
+	}
+	return true
+}
+
+// convertLogs turns logs into annotations holding their fields as JSON, or just the event when that's the only field
+func convertLogs(logs []jaegerpb.Log) []*trace.Annotation {
+	annotations := make([]*trace.Annotation, 0, len(logs))
+	for _, l := range logs {
+		fields := make(map[string]string, len(l.Fields))
+		for i := range l.Fields {
+			fields[l.Fields[i].Key] = l.Fields[i].AsString()
+		}
+		a := &trace.Annotation{Timestamp: pointer.Int64(l.Timestamp.UnixNano() / 1e3)}
+		if event, ok := fields["event"]; ok && len(fields) == 1 {
+			a.Value = pointer.String(event)
+		} else if b, err := json.Marshal(fields); err == nil {
+			a.Value = pointer.String(string(b))
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations
+}
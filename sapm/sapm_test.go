@@ -0,0 +1,128 @@
+package sapm
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	jaegerpb "github.com/jaegertracing/jaeger/model"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/pointer"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/golib/v3/trace/translator"
+	splunksapm "github.com/signalfx/sapm-proto/gen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type spanSink struct {
+	spans []*trace.Span
+}
+
+func (s *spanSink) AddSpans(_ context.Context, spans []*trace.Span) error {
+	s.spans = append(s.spans, spans...)
+	return nil
+}
+
+func testSpan() *trace.Span {
+	return &trace.Span{
+		TraceID:   "0123456789abcdef0123456789abcdef",
+		ID:        "00000000000000aa",
+		ParentID:  pointer.String("00000000000000bb"),
+		Name:      pointer.String("get"),
+		Kind:      pointer.String("SERVER"),
+		Timestamp: pointer.Int64(1530215261156007),
+		Duration:  pointer.Int64(19242),
+		LocalEndpoint: &trace.Endpoint{
+			ServiceName: pointer.String("api"),
+			Ipv4:        pointer.String("10.2.6.231"),
+		},
+		RemoteEndpoint: &trace.Endpoint{
+			Ipv4: pointer.String("10.2.6.232"),
+			Port: pointer.Int32(8080),
+		},
+		Annotations: []*trace.Annotation{{Timestamp: pointer.Int64(1530215261156008), Value: pointer.String(`{"attempt":"2","event":"retry"}`)}},
+		Tags:        map[string]string{"component": "jetty", "hostname": "web-1"},
+	}
+}
+
+func encode(t *testing.T, spans ...*trace.Span) []byte {
+	b, err := translator.SFXToSAPMPostRequest(spans).Marshal()
+	require.NoError(t, err)
+	return b
+}
+
+func post(body []byte) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, TracePathV2, bytes.NewReader(body))
+	req.Header.Set("Content-Type", ContentType)
+	return req
+}
+
+func TestRead(t *testing.T) {
+	sink := &spanSink{}
+	d := &Decoder{Sink: sink, Logger: log.Discard}
+	require.NoError(t, d.Read(context.Background(), post(encode(t, testSpan()))))
+	require.Len(t, sink.spans, 1)
+	assert.Equal(t, testSpan(), sink.spans[0])
+}
+
+func TestBatchProcessAndReferences(t *testing.T) {
+	sapm := &splunksapm.PostSpansRequest{Batches: []*jaegerpb.Batch{{
+		Process: &jaegerpb.Process{ServiceName: "batch", Tags: []jaegerpb.KeyValue{jaegerpb.Int64("pid", 12)}},
+		Spans: []*jaegerpb.Span{{
+			TraceID:   jaegerpb.NewTraceID(0, 0xabc),
+			SpanID:    jaegerpb.NewSpanID(0x1),
+			StartTime: time.Unix(1, 0),
+			Flags:     jaegerpb.Flags(2),
+			Tags:      []jaegerpb.KeyValue{jaegerpb.String("span.kind", "client"), jaegerpb.Bool("error", true)},
+			References: []jaegerpb.SpanRef{
+				{SpanID: jaegerpb.NewSpanID(0x2), RefType: jaegerpb.SpanRefType_FOLLOWS_FROM},
+				{SpanID: jaegerpb.NewSpanID(0x3), RefType: jaegerpb.SpanRefType_CHILD_OF},
+			},
+			Logs: []jaegerpb.Log{{Timestamp: time.Unix(2, 0), Fields: []jaegerpb.KeyValue{jaegerpb.String("event", "retry")}}},
+		}},
+	}}}
+	b, err := sapm.Marshal()
+	require.NoError(t, err)
+	sink := &spanSink{}
+	d := &Decoder{Sink: sink, Logger: log.Discard}
+	require.NoError(t, d.Read(context.Background(), post(b)))
+	require.Len(t, sink.spans, 1)
+	s := sink.spans[0]
+	assert.Equal(t, "0000000000000abc", s.TraceID)
+	assert.Equal(t, "0000000000000003", *s.ParentID)
+	assert.Equal(t, "CLIENT", *s.Kind)
+	assert.True(t, *s.Debug)
+	assert.Equal(t, int64(1000000), *s.Timestamp)
+	assert.Equal(t, "batch", *s.LocalEndpoint.ServiceName)
+	assert.Equal(t, map[string]string{"pid": "12", "error": "true"}, s.Tags)
+	assert.Equal(t, "retry", *s.Annotations[0].Value)
+}
+
+func TestSetupPaths(t *testing.T) {
+	sink := &spanSink{}
+	d := &Decoder{Sink: sink, Logger: log.Discard}
+	r := mux.NewRouter()
+	SetupPaths(r, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if err := d.Read(req.Context(), req); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	for _, tc := range []struct {
+		req  *http.Request
+		code int
+	}{
+		{post(encode(t, testSpan())), http.StatusOK},
+		{post([]byte("not protobuf")), http.StatusBadRequest},
+		{httptest.NewRequest(http.MethodPost, TracePathV2, nil), http.StatusNotFound},
+	} {
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, tc.req)
+		assert.Equal(t, tc.code, rw.Code)
+	}
+	assert.Len(t, sink.spans, 1)
+}
@@ -0,0 +1,124 @@
+package sinkerr
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+)
+
+// Kind is why the sink path refused data
+type Kind int
+
+const (
+	// Full is the sink having no room for the data right now
+	Full Kind = iota
+	// Stopped is the sink shutting down
+	Stopped
+	// TooLarge is a request carrying more than will ever be accepted at once
+	TooLarge
+	// Invalid is data that is well formed but will never be accepted as it is
+	Invalid
+	// NumKinds is how many kinds there are, for counting each of them
+	NumKinds
+)
+
+var kindNames = [NumKinds]string{"full", "stopped", "too_large", "invalid"}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// Error is returned from the sink path for data that was refused for a reason other than the payload being unreadable
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error that was classified
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary returns true if the same data could be accepted if it were sent again later
+func (e *Error) Temporary() bool {
+	return e.Kind == Full || e.Kind == Stopped
+}
+
+// As returns err as an *Error if it is one or wraps one
+func As(err error) (*Error, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e, true
+	}
+	return nil, false
+}
+
+// Classify returns err as an *Error if it is the data sink refusing data because its buffer is full or because it
+// has been stopped, and err as it is otherwise.  The data sink only tells these apart in its messages.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := As(err); ok {
+		return err
+	}
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "the input buffer is full"):
+		return &Error{Kind: Full, Err: err}
+	case strings.Contains(msg, "the worker has been stopped"):
+		return &Error{Kind: Stopped, Err: err}
+	}
+	return err
+}
+
+// Classifier is a signalfx.NextSink that classifies the errors of the sinks after it
+type Classifier struct{}
+
+var _ signalfx.NextSink = Classifier{}
+
+// AddDatapoints forwards the datapoints, classifying the error
+func (Classifier) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	return Classify(next.AddDatapoints(ctx, points))
+}
+
+// AddEvents forwards the events, classifying the error
+func (Classifier) AddEvents(ctx context.Context, events []*event.Event, next signalfx.Sink) error {
+	return Classify(next.AddEvents(ctx, events))
+}
+
+// AddSpans forwards the spans, classifying the error
+func (Classifier) AddSpans(ctx context.Context, spans []*trace.Span, next signalfx.Sink) error {
+	return Classify(next.AddSpans(ctx, spans))
+}
+
+// Write responds to a request that failed with err, with a 413 if it was too large, a 400 if it was invalid and a 503
+// with a Retry-After header in whole seconds otherwise
+func Write(rw http.ResponseWriter, err *Error, retryAfter time.Duration) {
+	code := http.StatusRequestEntityTooLarge
+	if err.Kind == Invalid {
+		code = http.StatusBadRequest
+	}
+	if err.Temporary() {
+		seconds := int64(math.Ceil(retryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		rw.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+		code = http.StatusServiceUnavailable
+	}
+	rw.WriteHeader(code)
+	_, _ = rw.Write([]byte(err.Error()))
+}
@@ -0,0 +1,88 @@
+package sinkerr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/stretchr/testify/assert"
+)
+
+type errSink struct {
+	err error
+}
+
+func (s errSink) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return s.err }
+func (s errSink) AddEvents(context.Context, []*event.Event) error             { return s.err }
+func (s errSink) AddSpans(context.Context, []*trace.Span) error               { return s.err }
+
+func TestClassify(t *testing.T) {
+	assert.NoError(t, Classify(nil))
+	other := errors.New("something else")
+	assert.Equal(t, other, Classify(other))
+	_, classified := As(other)
+	assert.False(t, classified)
+
+	for msg, kind := range map[string]Kind{
+		"unable to add datapoints: the input buffer is full": Full,
+		"unable to add spans: the worker has been stopped":   Stopped,
+		"unable to add events: the input buffer is full":     Full,
+	} {
+		err := Classify(errors.New(msg))
+		e, ok := As(err)
+		if assert.True(t, ok, msg) {
+			assert.Equal(t, kind, e.Kind, msg)
+			assert.True(t, e.Temporary())
+			assert.EqualError(t, err, msg)
+			assert.EqualError(t, errors.Unwrap(err), msg)
+		}
+	}
+
+	tooLarge := &Error{Kind: TooLarge, Err: errors.New("too large")}
+	assert.Equal(t, tooLarge, Classify(tooLarge), "classified errors are left alone")
+	e, ok := As(fmt.Errorf("wrapped: %w", tooLarge))
+	assert.True(t, ok)
+	assert.False(t, e.Temporary())
+	assert.Equal(t, "too_large", e.Kind.String())
+}
+
+func TestClassifier(t *testing.T) {
+	ctx := context.Background()
+	sink := signalfx.FromChain(errSink{errors.New("the worker has been stopped")}, signalfx.NextWrap(Classifier{}))
+	for _, err := range []error{sink.AddDatapoints(ctx, nil), sink.AddEvents(ctx, nil), sink.AddSpans(ctx, nil)} {
+		e, ok := As(err)
+		if assert.True(t, ok) {
+			assert.Equal(t, Stopped, e.Kind)
+		}
+	}
+	sink = signalfx.FromChain(errSink{}, signalfx.NextWrap(Classifier{}))
+	assert.NoError(t, sink.AddDatapoints(ctx, nil))
+}
+
+func TestWrite(t *testing.T) {
+	for _, tc := range []struct {
+		err        *Error
+		retryAfter time.Duration
+		code       int
+		header     string
+	}{
+		{&Error{Kind: Full, Err: errors.New("full")}, 2500 * time.Millisecond, http.StatusServiceUnavailable, "3"},
+		{&Error{Kind: Stopped, Err: errors.New("stopped")}, 0, http.StatusServiceUnavailable, "1"},
+		{&Error{Kind: TooLarge, Err: errors.New("too large")}, time.Second, http.StatusRequestEntityTooLarge, ""},
+		{&Error{Kind: Invalid, Err: errors.New("invalid")}, time.Second, http.StatusBadRequest, ""},
+	} {
+		rw := httptest.NewRecorder()
+		Write(rw, tc.err, tc.retryAfter)
+		assert.Equal(t, tc.code, rw.Code)
+		assert.Equal(t, tc.header, rw.Header().Get("Retry-After"))
+		assert.Equal(t, tc.err.Error(), rw.Body.String())
+	}
+}
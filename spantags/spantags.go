@@ -0,0 +1,239 @@
+package spantags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx/additionalspantags"
+	"github.com/signalfx/pops/filewatch"
+)
+
+// Config configures which tags are added to spans
+type Config struct {
+	Tags           *distconf.Str
+	TagsFile       *distconf.Str
+	ReloadInterval *distconf.Duration
+	Overwrite      *distconf.Bool
+	Deployment     *distconf.Bool
+}
+
+// Load the span tags config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.Tags = d.Str("SPAN_TAGS", "")
+	c.TagsFile = d.Str("SPAN_TAGS_FILE", "")
+	c.ReloadInterval = d.Duration("SPAN_TAGS_RELOAD_INTERVAL", 10*time.Second)
+	c.Overwrite = d.Bool("SPAN_TAGS_OVERWRITE", true)
+	c.Deployment = d.Bool("SPAN_TAGS_DEPLOYMENT", false)
+}
+
+// Tags are added to every span, and the tags for a token to the spans sent with it, replacing any of the same name
+type Tags struct {
+	Tags   map[string]string            `json:"tags,omitempty"`
+	Tokens map[string]map[string]string `json:"tokens,omitempty"`
+}
+
+func parseTags(b []byte) (*Tags, error) {
+	t := &Tags{}
+	if len(b) == 0 {
+		return t, nil
+	}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// tagSet is the tags added to the spans of one token, and the additionalspantags sink that adds them
+type tagSet struct {
+	tags map[string]string
+	sink *additionalspantags.AdditionalSpanTags
+}
+
+func newTagSet(layers ...map[string]string) *tagSet {
+	tags := make(map[string]string)
+	for _, layer := range layers {
+		for k, v := range layer {
+			tags[k] = v
+		}
+	}
+	return &tagSet{tags: tags, sink: additionalspantags.New(tags, discard{})}
+}
+
+// add adds the tags to the spans, leaving the ones they already have alone unless overwrite is set
+func (t *tagSet) add(ctx context.Context, spans []*trace.Span, overwrite bool) {
+	if overwrite {
+		_ = t.sink.AddSpans(ctx, spans)
+		return
+	}
+	for _, s := range spans {
+		if s.Tags == nil {
+			s.Tags = make(map[string]string, len(t.tags))
+		}
+		for k, v := range t.tags {
+			if _, ok := s.Tags[k]; !ok {
+				s.Tags[k] = v
+			}
+		}
+	}
+}
+
+// discard is the sink after a tagSet's additionalspantags, which only tags the spans given to it
+type discard struct{}
+
+func (discard) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return nil }
+func (discard) AddEvents(context.Context, []*event.Event) error             { return nil }
+func (discard) AddSpans(context.Context, []*trace.Span) error               { return nil }
+
+// Tagger is a signalfx.NextSink that adds tags to spans, so they can be told apart by the POPS they came through
+type Tagger struct {
+	conf       *Config
+	deployment map[string]string
+	logger     log.Logger
+	watcher    *filewatch.Watcher
+
+	mu        sync.RWMutex
+	fileTags  *Tags
+	confTags  *Tags
+	defaults  *tagSet
+	overrides map[string]*tagSet
+
+	stats struct {
+		TotalSpans    int64
+		TotalOverride int64
+	}
+}
+
+var _ signalfx.NextSink = &Tagger{}
+
+// New returns a Tagger for conf, loading any tags and watching them for changes.  The deployment tags describe where
+// POPS is running and are added, under all the others, if conf.Deployment is set.
+func New(conf *Config, deployment map[string]string, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Tagger, error) {
+	t := &Tagger{
+		conf:       conf,
+		deployment: deployment,
+		logger:     logger,
+		fileTags:   &Tags{},
+	}
+	var err error
+	if t.confTags, err = parseTags([]byte(conf.Tags.Get())); err != nil {
+		return nil, fmt.Errorf("unable to parse span tags: %s", err)
+	}
+	t.resolve()
+	conf.Tags.Watch(t.loadConf)
+	conf.Deployment.Watch(func(*distconf.Bool, bool) {
+		t.resolve()
+	})
+	if path := conf.TagsFile.Get(); path != "" {
+		if t.watcher, err = filewatch.New(path, conf.ReloadInterval.Get(), t.loadFile, timeKeeper, logger); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *Tagger) loadConf(str *distconf.Str, oldValue string) {
+	tags, err := parseTags([]byte(str.Get()))
+	if err != nil {
+		t.logger.Log(log.Err, err, "unable to parse span tags")
+		return
+	}
+	t.mu.Lock()
+	t.confTags = tags
+	t.mu.Unlock()
+	t.resolve()
+}
+
+func (t *Tagger) loadFile(b []byte) error {
+	tags, err := parseTags(b)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.fileTags = tags
+	t.mu.Unlock()
+	t.resolve()
+	return nil
+}
+
+// resolve works out the tags for every token.  Tags from distconf win over ones from the file and tags for a token
+// win over ones for every token.
+func (t *Tagger) resolve() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var deployment map[string]string
+	if t.conf.Deployment.Get() {
+		deployment = t.deployment
+	}
+	t.defaults = newTagSet(deployment, t.fileTags.Tags, t.confTags.Tags)
+	t.overrides = make(map[string]*tagSet, len(t.fileTags.Tokens)+len(t.confTags.Tokens))
+	for _, tokens := range []map[string]map[string]string{t.fileTags.Tokens, t.confTags.Tokens} {
+		for token := range tokens {
+			t.overrides[token] = newTagSet(deployment, t.fileTags.Tags, t.confTags.Tags, t.fileTags.Tokens[token], t.confTags.Tokens[token])
+		}
+	}
+}
+
+func (t *Tagger) tagSet(ctx context.Context) (*tagSet, bool) {
+	token, _ := ctx.Value(sfxclient.TokenCtxKey).(string)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if set, ok := t.overrides[token]; ok {
+		return set, true
+	}
+	return t.defaults, false
+}
+
+// AddDatapoints forwards the datapoints, which aren't tagged
+func (t *Tagger) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	return next.AddDatapoints(ctx, points)
+}
+
+// AddEvents forwards the events, which aren't tagged
+func (t *Tagger) AddEvents(ctx context.Context, events []*event.Event, next signalfx.Sink) error {
+	return next.AddEvents(ctx, events)
+}
+
+// AddSpans adds the tags for the token the spans were sent with and forwards them
+func (t *Tagger) AddSpans(ctx context.Context, spans []*trace.Span, next signalfx.Sink) error {
+	set, override := t.tagSet(ctx)
+	if len(set.tags) > 0 {
+		set.add(ctx, spans, t.conf.Overwrite.Get())
+		atomic.AddInt64(&t.stats.TotalSpans, int64(len(spans)))
+		if override {
+			atomic.AddInt64(&t.stats.TotalOverride, int64(len(spans)))
+		}
+	}
+	return next.AddSpans(ctx, spans)
+}
+
+// Datapoints returns how many spans were tagged, and how many of them with the tags for their token
+func (t *Tagger) Datapoints() []*datapoint.Datapoint {
+	dps := []*datapoint.Datapoint{
+		sfxclient.CumulativeP("spantags.spans", nil, &t.stats.TotalSpans),
+		sfxclient.CumulativeP("spantags.token_spans", nil, &t.stats.TotalOverride),
+	}
+	if t.watcher != nil {
+		dps = append(dps, t.watcher.Datapoints()...)
+	}
+	return dps
+}
+
+// Close stops watching the tags file
+func (t *Tagger) Close() error {
+	if t.watcher != nil {
+		return t.watcher.Close()
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package spantags
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testFile = `{
+  "tags": {"environment": "prod", "region": "us-east-1"},
+  "tokens": {"partner": {"environment": "partner", "team": "partners"}}
+}`
+
+// recorder keeps the spans that reach it
+type recorder struct {
+	spans []*trace.Span
+}
+
+func (r *recorder) AddDatapoints(context.Context, []*datapoint.Datapoint) error { return nil }
+func (r *recorder) AddEvents(context.Context, []*event.Event) error             { return nil }
+
+func (r *recorder) AddSpans(ctx context.Context, spans []*trace.Span) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func testTagger(t *testing.T, file string, values map[string]string) (*Tagger, distconf.ReaderWriter, string, func()) {
+	dir, err := ioutil.TempDir("", "spantags")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "tags.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(file), 0600))
+	mem := distconf.Mem()
+	mem.Write("SPAN_TAGS_FILE", []byte(path))
+	mem.Write("SPAN_TAGS_RELOAD_INTERVAL", []byte("1ms"))
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	tagger, err := New(conf, map[string]string{"cluster": "pops-east", "region": "unknown"}, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	return tagger, mem, path, func() {
+		_ = tagger.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func send(tagger *Tagger, token string, tags map[string]string) map[string]string {
+	r := &recorder{}
+	ctx := context.WithValue(context.Background(), sfxclient.TokenCtxKey, token)
+	_ = signalfx.FromChain(r, signalfx.NextWrap(tagger)).AddSpans(ctx, []*trace.Span{{Tags: tags}})
+	return r.spans[0].Tags
+}
+
+func counter(tagger *Tagger, metric string) int64 {
+	for _, dp := range tagger.Datapoints() {
+		if dp.Metric == metric {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return -1
+}
+
+func TestTags(t *testing.T) {
+	tagger, _, _, cleanup := testTagger(t, testFile, map[string]string{"SPAN_TAGS": `{"tokens": {"partner": {"team": "external"}, "other": {"owner": "me"}}}`})
+	defer cleanup()
+
+	assert.Equal(t, map[string]string{"environment": "prod", "region": "us-east-1"}, send(tagger, "mine", nil))
+	assert.Equal(t, map[string]string{"environment": "prod", "region": "us-east-1", "kind": "client"}, send(tagger, "mine", map[string]string{"environment": "dev", "kind": "client"}))
+	assert.Equal(t, map[string]string{"environment": "partner", "region": "us-east-1", "team": "external"}, send(tagger, "partner", nil), "distconf wins over the file")
+	assert.Equal(t, map[string]string{"environment": "prod", "region": "us-east-1", "owner": "me"}, send(tagger, "other", nil))
+	assert.Equal(t, int64(4), counter(tagger, "spantags.spans"))
+	assert.Equal(t, int64(2), counter(tagger, "spantags.token_spans"))
+}
+
+func TestKeepExisting(t *testing.T) {
+	tagger, _, _, cleanup := testTagger(t, testFile, map[string]string{"SPAN_TAGS_OVERWRITE": "false"})
+	defer cleanup()
+	assert.Equal(t, map[string]string{"environment": "dev", "region": "us-east-1"}, send(tagger, "mine", map[string]string{"environment": "dev"}))
+}
+
+func TestDeployment(t *testing.T) {
+	tagger, mem, _, cleanup := testTagger(t, testFile, nil)
+	defer cleanup()
+	assert.Equal(t, "", send(tagger, "mine", nil)["cluster"])
+	mem.Write("SPAN_TAGS_DEPLOYMENT", []byte("true"))
+	assert.Equal(t, map[string]string{"cluster": "pops-east", "environment": "prod", "region": "us-east-1"}, send(tagger, "mine", nil), "configured tags win over the deployment's")
+	assert.Equal(t, "pops-east", send(tagger, "partner", nil)["cluster"])
+}
+
+func TestReload(t *testing.T) {
+	tagger, mem, path, cleanup := testTagger(t, testFile, nil)
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"tags": {"environment": "staging"}}`), 0600))
+	for send(tagger, "mine", nil)["environment"] != "staging" {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, map[string]string{"environment": "staging"}, send(tagger, "partner", nil))
+
+	mem.Write("SPAN_TAGS", []byte(`{"tags": {"environment": "test"}}`))
+	assert.Equal(t, "test", send(tagger, "mine", nil)["environment"])
+	mem.Write("SPAN_TAGS", []byte(`{`))
+	assert.Equal(t, "test", send(tagger, "mine", nil)["environment"], "bad tags are ignored")
+}
+
+func TestNoTags(t *testing.T) {
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{distconf.Mem()}))
+	tagger, err := New(conf, nil, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	assert.Nil(t, send(tagger, "mine", nil))
+	assert.Equal(t, int64(0), counter(tagger, "spantags.spans"))
+	sink := signalfx.FromChain(&recorder{}, signalfx.NextWrap(tagger))
+	assert.NoError(t, sink.AddDatapoints(context.Background(), nil))
+	assert.NoError(t, sink.AddEvents(context.Background(), nil))
+	assert.NoError(t, tagger.Close())
+}
+
+func TestBadTags(t *testing.T) {
+	mem := distconf.Mem()
+	mem.Write("SPAN_TAGS", []byte(`{"tags": ["environment"]}`))
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	_, err := New(conf, nil, timekeeper.RealTime{}, log.Discard)
+	assert.Error(t, err)
+
+	mem.Write("SPAN_TAGS", nil)
+	mem.Write("SPAN_TAGS_FILE", []byte("/does/not/exist/tags.json"))
+	_, err = New(conf, nil, timekeeper.RealTime{}, log.Discard)
+	assert.Error(t, err)
+}
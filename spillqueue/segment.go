@@ -0,0 +1,505 @@
+package spillqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/pops/internal/httpbody"
+	"github.com/signalfx/pops/internal/tokenhash"
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+	tokenFile     = "token"
+	frameHeader   = 8
+)
+
+// ErrQueueFull is returned when a token, or the spill queue as a whole, has reached its maximum amount of spilled data
+var ErrQueueFull = errors.New("spill queue for token is full")
+
+// errRemoved is returned when pushing to a token queue that was removed after it drained
+var errRemoved = errors.New("spill queue for token was removed")
+
+// errCorrupt is returned when a frame on disk fails its checksum
+var errCorrupt = errors.New("corrupt spill record")
+
+// record is a single spilled request
+type record struct {
+	Enqueued time.Time   `json:"enqueued"`
+	URL      string      `json:"url"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+}
+
+func (r *record) request() (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, r.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	httpbody.Set(req, r.Body)
+	return req, nil
+}
+
+// tokenDirName hashes the token so it is always a safe directory name.  The token itself is still on disk, in the
+// token file and in every record's headers, since replaying needs it: the spill directory must be kept as private as
+// the tokens are.
+func tokenDirName(token string) string {
+	return tokenhash.Sum(token)
+}
+
+func segmentName(id int64) string {
+	return fmt.Sprintf("%016d%s", id, segmentSuffix)
+}
+
+// tokenQueue is the on-disk FIFO of spilled requests for a single token.  Segments are append only
+// and are removed once every record in them has been replayed.
+type tokenQueue struct {
+	mu    sync.Mutex
+	dir   string
+	token string
+	conf  *Config
+
+	segments   []int64 // segment ids on disk, oldest first
+	writer     *os.File
+	writerSize int64
+
+	reader     *os.File
+	readSeg    int64
+	readOffset int64
+	head       *record
+	headSize   int64
+
+	records int64
+	bytes   int64
+	total   *int64 // bytes queued for every token, shared by all of them
+
+	unsynced    int64 // records written since the writer was last synced
+	cursorDirty bool  // whether the cursor has moved since it was last synced
+	removed     bool
+}
+
+func newTokenQueue(root string, token string, conf *Config, total *int64) (*tokenQueue, error) {
+	t := &tokenQueue{
+		dir:   filepath.Join(root, tokenDirName(token)),
+		token: token,
+		conf:  conf,
+		total: total,
+	}
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(t.dir, tokenFile), []byte(token), 0600); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// loadTokenQueue restores a tokenQueue from a directory written by a previous process
+func loadTokenQueue(dir string, conf *Config, total *int64) (*tokenQueue, error) {
+	token, err := ioutil.ReadFile(filepath.Join(dir, tokenFile))
+	if err != nil {
+		return nil, err
+	}
+	t := &tokenQueue{
+		dir:   dir,
+		token: string(token),
+		conf:  conf,
+		total: total,
+	}
+	if t.segments, err = listSegments(dir); err != nil {
+		return nil, err
+	}
+	if len(t.segments) == 0 {
+		return t, nil
+	}
+	t.readSeg = t.segments[0]
+	t.readOffset = readCursor(dir, t.readSeg)
+	if err := t.count(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// listSegments returns the ids of the segments in dir, oldest first
+func listSegments(dir string) ([]int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+		if id, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), segmentSuffix), 10, 64); err == nil {
+			segments = append(segments, id)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// readCursor returns the saved read offset into segment seg, or 0 if the cursor is missing or for another segment
+func readCursor(dir string, seg int64) int64 {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, cursorFile))
+	if err != nil {
+		return 0
+	}
+	var cursorSeg, offset int64
+	if _, err := fmt.Sscanf(string(raw), "%d %d", &cursorSeg, &offset); err != nil || cursorSeg != seg {
+		return 0
+	}
+	return offset
+}
+
+// count walks every frame after the cursor to restore the depth of the queue
+func (t *tokenQueue) count() error {
+	for i, id := range t.segments {
+		f, err := os.Open(filepath.Join(t.dir, segmentName(id)))
+		if err != nil {
+			return err
+		}
+		offset := int64(0)
+		if i == 0 {
+			offset = t.readOffset
+		}
+		r := bufio.NewReader(io.NewSectionReader(f, offset, 1<<62))
+		var header [frameHeader]byte
+		for {
+			if _, err = io.ReadFull(r, header[:]); err != nil {
+				break
+			}
+			size := int64(binary.BigEndian.Uint32(header[:4]))
+			if _, err = r.Discard(int(size)); err != nil {
+				break
+			}
+			t.records++
+			t.addBytes(frameHeader + size)
+		}
+		_ = f.Close()
+	}
+	return nil
+}
+
+func (t *tokenQueue) openWriter() error {
+	id := int64(1)
+	if len(t.segments) > 0 {
+		id = t.segments[len(t.segments)-1] + 1
+	}
+	f, err := os.OpenFile(filepath.Join(t.dir, segmentName(id)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	t.writer = f
+	t.writerSize = 0
+	t.segments = append(t.segments, id)
+	if len(t.segments) == 1 {
+		t.readSeg = id
+		t.readOffset = 0
+	}
+	return nil
+}
+
+// addBytes changes the bytes queued for the token and for every token
+func (t *tokenQueue) addBytes(n int64) {
+	t.bytes += n
+	atomic.AddInt64(t.total, n)
+}
+
+// push appends a record to the tail of the queue
+func (t *tokenQueue) push(r *record) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.removed {
+		return errRemoved
+	}
+	size := int64(frameHeader + len(payload))
+	if maxBytes := t.conf.MaxBytesPerToken.Get(); maxBytes > 0 && t.bytes+size > maxBytes {
+		return ErrQueueFull
+	}
+	// the space is reserved in the total first, so tokens spilling at the same time can't take it past the maximum
+	if maxBytes := t.conf.MaxBytes.Get(); atomic.AddInt64(t.total, size) > maxBytes && maxBytes > 0 {
+		atomic.AddInt64(t.total, -size)
+		return ErrQueueFull
+	}
+	if err := t.write(payload); err != nil {
+		atomic.AddInt64(t.total, -size)
+		return err
+	}
+	t.records++
+	t.bytes += size
+	t.unsynced++
+	if syncRecords := t.conf.SyncRecords.Get(); syncRecords > 0 && t.unsynced >= syncRecords {
+		return t.syncLocked()
+	}
+	return nil
+}
+
+// write writes a framed payload to the segment being written, starting a new segment if that one is full
+func (t *tokenQueue) write(payload []byte) error {
+	size := int64(frameHeader + len(payload))
+	if t.writer == nil || t.writerSize >= t.conf.SegmentSize.Get() {
+		if err := t.closeWriter(); err != nil {
+			return err
+		}
+		if err := t.openWriter(); err != nil {
+			return err
+		}
+	}
+	frame := make([]byte, size)
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[frameHeader:], payload)
+	if _, err := t.writer.Write(frame); err != nil {
+		return err
+	}
+	t.writerSize += size
+	return nil
+}
+
+// closeWriter syncs and closes the segment being written, if there is one
+func (t *tokenQueue) closeWriter() error {
+	if t.writer == nil {
+		return nil
+	}
+	err := t.writer.Sync()
+	if cerr := t.writer.Close(); err == nil {
+		err = cerr
+	}
+	t.writer = nil
+	t.unsynced = 0
+	return err
+}
+
+// sync flushes the records written and the cursor moved since the last sync to disk
+func (t *tokenQueue) sync() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.syncLocked()
+}
+
+func (t *tokenQueue) syncLocked() error {
+	if t.removed {
+		return nil
+	}
+	if t.writer != nil && t.unsynced > 0 {
+		if err := t.writer.Sync(); err != nil {
+			return err
+		}
+		t.unsynced = 0
+	}
+	if t.cursorDirty {
+		if err := t.writeCursor(); err != nil {
+			return err
+		}
+		t.cursorDirty = false
+	}
+	return nil
+}
+
+// writeCursor saves the read position, replacing the cursor file whole so a crash can't leave half of one behind
+func (t *tokenQueue) writeCursor() error {
+	tmp := filepath.Join(t.dir, cursorFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d", t.readSeg, t.readOffset)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.dir, cursorFile))
+}
+
+// peek returns the record at the head of the queue without removing it
+func (t *tokenQueue) peek() (*record, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.head == nil {
+		if t.records == 0 {
+			return nil, nil
+		}
+		if err := t.openReader(); err != nil {
+			return nil, err
+		}
+		r, size, err := readFrame(t.reader)
+		switch err {
+		case nil:
+			t.head = r
+			t.headSize = size
+		case io.EOF, io.ErrUnexpectedEOF:
+			if t.readSeg == t.lastSegment() {
+				return nil, nil
+			}
+			t.dropSegment()
+		case errCorrupt:
+			if cerr := t.dropCorrupt(); cerr != nil {
+				return nil, cerr
+			}
+			return nil, err
+		default:
+			return nil, err
+		}
+	}
+	return t.head, nil
+}
+
+// openReader opens the segment being read at the cursor, if it isn't open already
+func (t *tokenQueue) openReader() error {
+	if t.reader != nil {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(t.dir, segmentName(t.readSeg)))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(t.readOffset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+	t.reader = f
+	return nil
+}
+
+// dropCorrupt drops the segment being read, since nothing after a corrupt frame in it can be trusted, and recounts
+// what is left
+func (t *tokenQueue) dropCorrupt() error {
+	if t.readSeg == t.lastSegment() {
+		_ = t.closeWriter()
+	}
+	t.dropSegment()
+	t.records = 0
+	t.addBytes(-t.bytes)
+	return t.count()
+}
+
+// pop removes the record returned by peek.  The cursor is saved the next time the queue is synced, so a crash can
+// replay the records popped since then again.
+func (t *tokenQueue) pop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.head == nil {
+		return
+	}
+	t.readOffset += t.headSize
+	t.records--
+	t.addBytes(-t.headSize)
+	t.head = nil
+	t.headSize = 0
+	if t.records == 0 && t.readSeg != t.lastSegment() {
+		t.dropSegment()
+	}
+	t.cursorDirty = true
+}
+
+func (t *tokenQueue) lastSegment() int64 {
+	if len(t.segments) == 0 {
+		return 0
+	}
+	return t.segments[len(t.segments)-1]
+}
+
+// dropSegment removes the segment currently being read and moves the cursor to the next one
+func (t *tokenQueue) dropSegment() {
+	if t.reader != nil {
+		_ = t.reader.Close()
+		t.reader = nil
+	}
+	_ = os.Remove(filepath.Join(t.dir, segmentName(t.readSeg)))
+	if len(t.segments) > 0 {
+		t.segments = t.segments[1:]
+	}
+	t.readOffset = 0
+	if len(t.segments) > 0 {
+		t.readSeg = t.segments[0]
+	}
+}
+
+// depth returns the number of records and bytes queued and when the oldest record was queued
+func (t *tokenQueue) depth() (records int64, bytes int64, oldest time.Time) {
+	t.mu.Lock()
+	records, bytes = t.records, t.bytes
+	if t.head != nil {
+		oldest = t.head.Enqueued
+	}
+	t.mu.Unlock()
+	return
+}
+
+// remove deletes the queue's directory if nothing is left in the queue, and returns true if it did.  Anything pushed
+// to the queue afterwards fails with errRemoved.
+func (t *tokenQueue) remove() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.records > 0 || t.removed {
+		return false
+	}
+	_ = t.closeWriter()
+	if t.reader != nil {
+		_ = t.reader.Close()
+		t.reader = nil
+	}
+	t.removed = true
+	_ = os.RemoveAll(t.dir)
+	return true
+}
+
+func (t *tokenQueue) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.syncLocked()
+	if cerr := t.closeWriter(); err == nil {
+		err = cerr
+	}
+	if t.reader != nil {
+		_ = t.reader.Close()
+		t.reader = nil
+	}
+	return err
+}
+
+func readFrame(r io.Reader) (*record, int64, error) {
+	var header [frameHeader]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorrupt
+	}
+	rec := &record{}
+	if err := json.Unmarshal(payload, rec); err != nil {
+		return nil, 0, errCorrupt
+	}
+	return rec, int64(frameHeader + len(payload)), nil
+}
@@ -0,0 +1,446 @@
+package spillqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/pops/internal/httpbody"
+	"github.com/signalfx/pops/internal/tokenhash"
+	"github.com/signalfx/pops/sinkerr"
+)
+
+// Config configures where spilled data is written, how much of it is kept and how often it is synced to disk.  Spilled
+// data is synced at least every SyncInterval and every SyncRecords records, zero turning either off.  MaxBytes caps what
+// every token spills together and MaxBytesPerToken what each one does.  The directory holds the tokens of everything
+// spilled, so it is created readable by POPS only.
+type Config struct {
+	Directory        *distconf.Str
+	SegmentSize      *distconf.Int
+	MaxBytes         *distconf.Int
+	MaxBytesPerToken *distconf.Int
+	ReplayInterval   *distconf.Duration
+	SyncInterval     *distconf.Duration
+	SyncRecords      *distconf.Int
+}
+
+// Load the spill queue config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.Directory = d.Str("SPILL_DIR", "")
+	c.SegmentSize = d.Int("SPILL_SEGMENT_SIZE", 16*1024*1024)
+	c.MaxBytes = d.Int("SPILL_MAX_BYTES", 10*1024*1024*1024)
+	c.MaxBytesPerToken = d.Int("SPILL_MAX_BYTES_PER_TOKEN", 1024*1024*1024)
+	c.ReplayInterval = d.Duration("SPILL_REPLAY_INTERVAL", 5*time.Second)
+	c.SyncInterval = d.Duration("SPILL_SYNC_INTERVAL", time.Second)
+	c.SyncRecords = d.Int("SPILL_SYNC_RECORDS", 100)
+}
+
+// Enabled returns true if a spill directory has been configured
+func (c *Config) Enabled() bool {
+	return c.Directory.Get() != ""
+}
+
+// stats are internal tracking stats about the spill queue
+type stats struct {
+	TotalSpilled      int64
+	TotalReplayed     int64
+	TotalDropped      int64
+	TotalReplayErrors int64
+	TotalSpillErrors  int64
+}
+
+// Queue is a write-ahead spill queue of upstream requests, kept in segment files per token.
+// Requests that can't be delivered are written to disk and replayed in order once the upstream recovers.
+type Queue struct {
+	conf       *Config
+	dir        string
+	next       http.RoundTripper
+	replayTo   http.RoundTripper
+	timeKeeper timekeeper.TimeKeeper
+	logger     log.Logger
+	stats      stats
+	bytes      int64 // bytes queued for every token
+
+	mu      sync.RWMutex
+	tokens  map[string]*tokenQueue
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New opens the spill queue in conf.Directory, restoring anything spilled by a previous process,
+// and starts replaying it through replayTo.  Live requests are sent through next.  The directory can't be changed
+// once the queue is open.
+func New(conf *Config, next http.RoundTripper, replayTo http.RoundTripper, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Queue, error) {
+	dir := conf.Directory.Get()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		conf:       conf,
+		dir:        dir,
+		next:       next,
+		replayTo:   replayTo,
+		timeKeeper: timeKeeper,
+		logger:     logger,
+		tokens:     make(map[string]*tokenQueue),
+		closing:    make(chan struct{}),
+	}
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		t, err := loadTokenQueue(filepath.Join(dir, d.Name()), conf, &q.bytes)
+		if err != nil {
+			q.logger.Log(log.Err, err, "dir", d.Name(), "unable to restore spill queue")
+			continue
+		}
+		q.tokens[t.token] = t
+	}
+	q.wg.Add(2)
+	go q.replay()
+	go q.syncToDisk()
+	return q, nil
+}
+
+func (q *Queue) tokenQueue(token string, create bool) (*tokenQueue, error) {
+	q.mu.RLock()
+	t := q.tokens[token]
+	q.mu.RUnlock()
+	if t != nil || !create {
+		return t, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t = q.tokens[token]; t != nil {
+		return t, nil
+	}
+	t, err := newTokenQueue(q.dir, token, q.conf, &q.bytes)
+	if err != nil {
+		return nil, err
+	}
+	q.tokens[token] = t
+	return t, nil
+}
+
+// backlogged returns true if the token already has spilled requests waiting to be replayed
+func (q *Queue) backlogged(token string) bool {
+	t, _ := q.tokenQueue(token, false)
+	if t == nil {
+		return false
+	}
+	records, _, _ := t.depth()
+	return records > 0
+}
+
+// Append writes the request to the tail of its token's queue
+func (q *Queue) Append(req *http.Request, body []byte) error {
+	token := req.Header.Get(sfxclient.TokenHeaderName)
+	rec := &record{
+		Enqueued: q.timeKeeper.Now(),
+		URL:      req.URL.String(),
+		Header:   req.Header,
+		Body:     body,
+	}
+	err := errRemoved
+	for err == errRemoved {
+		// the token's queue may be reaped between finding it and pushing to it, in which case a new one is made
+		var t *tokenQueue
+		if t, err = q.tokenQueue(token, true); err == nil {
+			err = t.push(rec)
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&q.stats.TotalSpillErrors, 1)
+		return err
+	}
+	atomic.AddInt64(&q.stats.TotalSpilled, 1)
+	return nil
+}
+
+// RoundTrip sends the request upstream, spilling it to disk instead if the upstream is unavailable
+// or if earlier requests for the same token are still waiting to be replayed
+func (q *Queue) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := httpbody.Read(req)
+	if err != nil {
+		return nil, err
+	}
+	token := req.Header.Get(sfxclient.TokenHeaderName)
+	if q.backlogged(token) {
+		if err = q.Append(req, body); err == nil {
+			return httpbody.Accepted(req), nil
+		}
+	}
+	resp, err := q.next.RoundTrip(req)
+	if !unavailable(resp, err) {
+		return resp, err
+	}
+	if spillErr := q.Append(req, body); spillErr != nil {
+		q.logger.Log(log.Err, spillErr, "unable to spill request")
+		return resp, err
+	}
+	if resp != nil {
+		httpbody.Drain(resp)
+	}
+	return httpbody.Accepted(req), nil
+}
+
+// Appender returns a RoundTripper that writes every request straight to the queue
+func (q *Queue) Appender() http.RoundTripper {
+	return appender{q}
+}
+
+type appender struct {
+	q *Queue
+}
+
+func (a appender) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := httpbody.Read(req)
+	if err != nil {
+		return nil, err
+	}
+	if err = a.q.Append(req, body); err != nil {
+		return nil, err
+	}
+	return httpbody.Accepted(req), nil
+}
+
+func (q *Queue) snapshot() []*tokenQueue {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	ret := make([]*tokenQueue, 0, len(q.tokens))
+	for _, t := range q.tokens {
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+func (q *Queue) replay() {
+	defer q.wg.Done()
+	for {
+		for _, t := range q.snapshot() {
+			q.drainToken(t)
+			q.reap(t)
+		}
+		select {
+		case <-q.closing:
+			return
+		case <-q.timeKeeper.After(q.conf.ReplayInterval.Get()):
+		}
+	}
+}
+
+// syncToDisk syncs every token's queue each SyncInterval, so nothing spilled sits in the page cache for longer
+func (q *Queue) syncToDisk() {
+	defer q.wg.Done()
+	for {
+		var tick <-chan time.Time
+		if interval := q.conf.SyncInterval.Get(); interval > 0 {
+			tick = q.timeKeeper.After(interval)
+		}
+		select {
+		case <-q.closing:
+			return
+		case <-tick:
+		}
+		for _, t := range q.snapshot() {
+			if err := t.sync(); err != nil {
+				q.logger.Log(log.Err, err, "unable to sync spill queue")
+			}
+		}
+	}
+}
+
+// drainToken replays a token's queue in order until it is empty or the upstream stops accepting requests
+func (q *Queue) drainToken(t *tokenQueue) {
+	for {
+		select {
+		case <-q.closing:
+			return
+		default:
+		}
+		rec, err := t.peek()
+		if err == errCorrupt {
+			atomic.AddInt64(&q.stats.TotalDropped, 1)
+			q.logger.Log(log.Err, err, "dropping corrupt spill segment")
+			continue
+		}
+		if err != nil {
+			q.logger.Log(log.Err, err, "unable to read spill queue")
+			return
+		}
+		if rec == nil {
+			return
+		}
+		req, err := rec.request()
+		if err != nil {
+			atomic.AddInt64(&q.stats.TotalDropped, 1)
+			t.pop()
+			continue
+		}
+		resp, err := q.replayRequest(req)
+		if unavailable(resp, err) {
+			atomic.AddInt64(&q.stats.TotalReplayErrors, 1)
+			return
+		}
+		if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+			atomic.AddInt64(&q.stats.TotalReplayed, 1)
+		} else {
+			// the upstream rejected the request outright, replaying it again won't help
+			atomic.AddInt64(&q.stats.TotalDropped, 1)
+		}
+		t.pop()
+	}
+}
+
+// reap removes a token's queue and its directory once everything in it has been replayed, so every token that ever
+// spilled doesn't keep one
+func (q *Queue) reap(t *tokenQueue) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t.remove() && q.tokens[t.token] == t {
+		delete(q.tokens, t.token)
+	}
+}
+
+// replayRequest sends a spilled request upstream, returning the response with its body already drained
+func (q *Queue) replayRequest(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sfxclient.DefaultTimeout)
+	defer cancel()
+	resp, err := q.replayTo.RoundTrip(req.WithContext(ctx))
+	if resp != nil {
+		httpbody.Drain(resp)
+	}
+	return resp, err
+}
+
+// Datapoints returns the depth and age of every token's queue along with totals for the queue as a whole
+func (q *Queue) Datapoints() []*datapoint.Datapoint {
+	now := q.timeKeeper.Now()
+	dps := []*datapoint.Datapoint{
+		sfxclient.CumulativeP("spill_queue.spilled", nil, &q.stats.TotalSpilled),
+		sfxclient.CumulativeP("spill_queue.replayed", nil, &q.stats.TotalReplayed),
+		sfxclient.CumulativeP("spill_queue.dropped", nil, &q.stats.TotalDropped),
+		sfxclient.CumulativeP("spill_queue.replay_errors", nil, &q.stats.TotalReplayErrors),
+		sfxclient.CumulativeP("spill_queue.spill_errors", nil, &q.stats.TotalSpillErrors),
+		sfxclient.Gauge("spill_queue.total_bytes", nil, atomic.LoadInt64(&q.bytes)),
+	}
+	for _, t := range q.snapshot() {
+		records, size, oldest := t.depth()
+		age := time.Duration(0)
+		if records > 0 && !oldest.IsZero() {
+			age = now.Sub(oldest)
+		}
+		// anything can be sent as a token, and a token is a credential, so only a hash of it is reported
+		dims := map[string]string{"token_hash": tokenhash.Dimension(t.token)}
+		dps = append(dps,
+			sfxclient.Gauge("spill_queue.depth", dims, records),
+			sfxclient.Gauge("spill_queue.bytes", dims, size),
+			sfxclient.GaugeF("spill_queue.oldest_age_seconds", dims, age.Seconds()),
+		)
+	}
+	return dps
+}
+
+// Close stops replaying and syncs and closes every segment file.  Anything still queued is replayed on the next start.
+func (q *Queue) Close() error {
+	close(q.closing)
+	q.wg.Wait()
+	var err error
+	for _, t := range q.snapshot() {
+		if e := t.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Overflow is a signalfx.NextSink that spills data to the Queue when the next sink can't buffer it
+type Overflow struct {
+	mu   sync.Mutex
+	sink *sfxclient.HTTPSink
+}
+
+// NewOverflow returns an Overflow that encodes spilled data for the given upstream endpoints
+func NewOverflow(q *Queue, datapointEndpoint string, eventEndpoint string, traceEndpoint string) *Overflow {
+	sink := sfxclient.NewHTTPSink()
+	sink.DatapointEndpoint = datapointEndpoint
+	sink.EventEndpoint = eventEndpoint
+	sink.TraceEndpoint = traceEndpoint
+	sink.Client = &http.Client{Transport: q.Appender()}
+	return &Overflow{sink: sink}
+}
+
+// isBufferFull returns true if err is the data sink refusing data because its buffer is full
+func isBufferFull(err error) bool {
+	e, ok := sinkerr.As(sinkerr.Classify(err))
+	return ok && e.Kind == sinkerr.Full
+}
+
+func (o *Overflow) spill(ctx context.Context, f func(*sfxclient.HTTPSink) error) error {
+	token, ok := ctx.Value(sfxclient.TokenCtxKey).(string)
+	if !ok {
+		return fmt.Errorf("no value was found on the context with key '%s'", sfxclient.TokenCtxKey)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sink.AuthToken = token
+	return f(o.sink)
+}
+
+// AddDatapoints sends datapoints to next, spilling them if next is full
+func (o *Overflow) AddDatapoints(ctx context.Context, points []*datapoint.Datapoint, next signalfx.Sink) error {
+	err := next.AddDatapoints(ctx, points)
+	if isBufferFull(err) {
+		return o.spill(ctx, func(s *sfxclient.HTTPSink) error { return s.AddDatapoints(context.Background(), points) })
+	}
+	return err
+}
+
+// AddEvents sends events to next, spilling them if next is full
+func (o *Overflow) AddEvents(ctx context.Context, events []*event.Event, next signalfx.Sink) error {
+	err := next.AddEvents(ctx, events)
+	if isBufferFull(err) {
+		return o.spill(ctx, func(s *sfxclient.HTTPSink) error { return s.AddEvents(context.Background(), events) })
+	}
+	return err
+}
+
+// AddSpans sends spans to next, spilling them if next is full
+func (o *Overflow) AddSpans(ctx context.Context, spans []*trace.Span, next signalfx.Sink) error {
+	err := next.AddSpans(ctx, spans)
+	if isBufferFull(err) {
+		return o.spill(ctx, func(s *sfxclient.HTTPSink) error { return s.AddSpans(context.Background(), spans) })
+	}
+	return err
+}
+
+// unavailable returns true when a request failed because the upstream couldn't take it right now,
+// as opposed to the upstream rejecting the request itself
+func unavailable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
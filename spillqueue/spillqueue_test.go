@@ -0,0 +1,406 @@
+package spillqueue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/event"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper/timekeepertest"
+	"github.com/signalfx/golib/v3/trace"
+	"github.com/signalfx/ingest-protocols/protocol/signalfx"
+	"github.com/signalfx/pops/internal/httpbody"
+	"github.com/signalfx/pops/internal/tokenhash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upstream is a fake ingest endpoint that can be switched between up and down
+type upstream struct {
+	*httptest.Server
+	status int64
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newUpstream() *upstream {
+	u := &upstream{status: http.StatusOK}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		status := int(atomic.LoadInt64(&u.status))
+		if status == http.StatusOK {
+			b, _ := ioutil.ReadAll(req.Body)
+			u.mu.Lock()
+			u.bodies = append(u.bodies, req.Header.Get(sfxclient.TokenHeaderName)+":"+string(b))
+			u.mu.Unlock()
+		}
+		rw.WriteHeader(status)
+		_, _ = rw.Write([]byte(`"OK"`))
+	}))
+	return u
+}
+
+func (u *upstream) setStatus(status int) {
+	atomic.StoreInt64(&u.status, int64(status))
+}
+
+func (u *upstream) received() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.bodies...)
+}
+
+func post(t *testing.T, rt http.RoundTripper, url string, token string, body string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Set(sfxclient.TokenHeaderName, token)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	httpbody.Drain(resp)
+	return resp
+}
+
+func testConfig(t *testing.T, values map[string]string) (*Config, func()) {
+	dir, err := ioutil.TempDir("", "spillqueue")
+	require.NoError(t, err)
+	mem := distconf.Mem()
+	mem.Write("SPILL_DIR", []byte(dir))
+	mem.Write("SPILL_SEGMENT_SIZE", []byte("64"))
+	mem.Write("SPILL_MAX_BYTES_PER_TOKEN", []byte("1048576"))
+	mem.Write("SPILL_REPLAY_INTERVAL", []byte("1s"))
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	return conf, func() { _ = os.RemoveAll(dir) }
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 500; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("condition never became true")
+}
+
+func TestConfigLoad(t *testing.T) {
+	mem := distconf.Mem()
+	mem.Write("SPILL_DIR", []byte("/tmp/spill"))
+	mem.Write("SPILL_SEGMENT_SIZE", []byte("100"))
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	assert.True(t, conf.Enabled())
+	assert.Equal(t, "/tmp/spill", conf.Directory.Get())
+	assert.Equal(t, int64(100), conf.SegmentSize.Get())
+	assert.Equal(t, int64(10*1024*1024*1024), conf.MaxBytes.Get())
+	assert.Equal(t, 5*time.Second, conf.ReplayInterval.Get())
+	assert.Equal(t, time.Second, conf.SyncInterval.Get())
+	assert.Equal(t, int64(100), conf.SyncRecords.Get())
+}
+
+func TestSync(t *testing.T) {
+	conf, cleanup := testConfig(t, map[string]string{"SPILL_SEGMENT_SIZE": "1048576", "SPILL_SYNC_RECORDS": "3"})
+	defer cleanup()
+	up := newUpstream()
+	defer up.Close()
+	clock := timekeepertest.NewStubClock(time.Now())
+	q, err := New(conf, errTransport{}, errTransport{}, clock, log.Discard)
+	require.NoError(t, err)
+	unsynced := func() int64 {
+		tq := q.tokens["tok"]
+		tq.mu.Lock()
+		defer tq.mu.Unlock()
+		return tq.unsynced
+	}
+
+	for _, body := range []string{"a", "b"} {
+		post(t, q, up.URL, "tok", body)
+	}
+	assert.Equal(t, int64(2), unsynced())
+	post(t, q, up.URL, "tok", "c")
+	assert.Equal(t, int64(0), unsynced(), "every SPILL_SYNC_RECORDS records are synced")
+	post(t, q, up.URL, "tok", "d")
+	assert.Equal(t, int64(1), unsynced())
+	waitFor(t, func() bool {
+		clock.Incr(conf.SyncInterval.Get())
+		return unsynced() == 0
+	})
+	require.NoError(t, q.Close())
+	assert.Nil(t, q.tokens["tok"].writer)
+}
+
+func TestSpillAndReplay(t *testing.T) {
+	conf, cleanup := testConfig(t, nil)
+	defer cleanup()
+	up := newUpstream()
+	defer up.Close()
+	clock := timekeepertest.NewStubClock(time.Now())
+	q, err := New(conf, http.DefaultTransport, http.DefaultTransport, clock, log.Discard)
+	require.NoError(t, err)
+
+	up.setStatus(http.StatusServiceUnavailable)
+	for _, body := range []string{"one", "two", "three"} {
+		resp := post(t, q, up.URL, "tok", body)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "spilled requests look accepted to the sink")
+	}
+	assert.Empty(t, up.received())
+
+	up.setStatus(http.StatusOK)
+	// anything for a backlogged token must wait its turn
+	post(t, q, up.URL, "tok", "four")
+	assert.Empty(t, up.received())
+	// other tokens are unaffected
+	post(t, q, up.URL, "other", "five")
+	assert.Equal(t, []string{"other:five"}, up.received())
+
+	var depth float64
+	for _, dp := range q.Datapoints() {
+		assert.NotContains(t, dp.Dimensions, "token")
+		if dp.Metric == "spill_queue.depth" && dp.Dimensions["token_hash"] == tokenhash.Dimension("tok") {
+			depth = float64(dp.Value.(datapoint.IntValue).Int())
+		}
+	}
+	assert.Equal(t, float64(4), depth)
+
+	clock.Incr(conf.ReplayInterval.Get())
+	waitFor(t, func() bool { return len(up.received()) == 5 })
+	assert.Equal(t, []string{"other:five", "tok:one", "tok:two", "tok:three", "tok:four"}, up.received())
+	assert.Equal(t, int64(4), atomic.LoadInt64(&q.stats.TotalReplayed))
+	assert.False(t, q.backlogged("tok"))
+	assert.NoError(t, q.Close())
+}
+
+func TestSurvivesRestart(t *testing.T) {
+	conf, cleanup := testConfig(t, nil)
+	defer cleanup()
+	up := newUpstream()
+	defer up.Close()
+	up.setStatus(http.StatusBadGateway)
+	clock := timekeepertest.NewStubClock(time.Now())
+	q, err := New(conf, http.DefaultTransport, http.DefaultTransport, clock, log.Discard)
+	require.NoError(t, err)
+	for _, body := range []string{"a", "b", "c", "d"} {
+		post(t, q, up.URL, "tok", body)
+	}
+	assert.NoError(t, q.Close())
+
+	up.setStatus(http.StatusOK)
+	q, err = New(conf, http.DefaultTransport, http.DefaultTransport, clock, log.Discard)
+	require.NoError(t, err)
+	defer q.Close()
+	waitFor(t, func() bool { return len(up.received()) == 4 })
+	assert.Equal(t, []string{"tok:a", "tok:b", "tok:c", "tok:d"}, up.received())
+	assert.False(t, q.backlogged("tok"))
+}
+
+func TestCursorSavedOnSync(t *testing.T) {
+	conf, cleanup := testConfig(t, map[string]string{"SPILL_SYNC_INTERVAL": "0s"})
+	defer cleanup()
+	up := newUpstream()
+	defer up.Close()
+	up.setStatus(http.StatusServiceUnavailable)
+	clock := timekeepertest.NewStubClock(time.Now())
+	q, err := New(conf, http.DefaultTransport, http.DefaultTransport, clock, log.Discard)
+	require.NoError(t, err)
+	for _, body := range []string{"a", "b"} {
+		post(t, q, up.URL, "tok", body)
+	}
+	tq := q.tokens["tok"]
+	rec, err := tq.peek()
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	tq.pop()
+
+	// popping only marks the cursor as moved, syncing saves it
+	cursor := filepath.Join(conf.Directory.Get(), tokenDirName("tok"), cursorFile)
+	_, err = os.Stat(cursor)
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, tq.sync())
+	raw, err := ioutil.ReadFile(cursor)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d %d", tq.readSeg, tq.readOffset), string(raw))
+	require.NoError(t, q.Close())
+}
+
+func TestReapDrainedTokens(t *testing.T) {
+	conf, cleanup := testConfig(t, nil)
+	defer cleanup()
+	up := newUpstream()
+	defer up.Close()
+	up.setStatus(http.StatusServiceUnavailable)
+	clock := timekeepertest.NewStubClock(time.Now())
+	q, err := New(conf, http.DefaultTransport, http.DefaultTransport, clock, log.Discard)
+	require.NoError(t, err)
+	defer q.Close()
+	post(t, q, up.URL, "tok", "a")
+	dir := filepath.Join(conf.Directory.Get(), tokenDirName("tok"))
+	_, err = os.Stat(dir)
+	require.NoError(t, err)
+
+	up.setStatus(http.StatusOK)
+	waitFor(t, func() bool {
+		clock.Incr(conf.ReplayInterval.Get())
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+		return len(q.tokens) == 0
+	})
+	assert.Equal(t, []string{"tok:a"}, up.received())
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&q.bytes))
+
+	// a reaped queue that is still held fails to push, and spilling again makes a new one
+	up.setStatus(http.StatusServiceUnavailable)
+	reaped := &tokenQueue{token: "tok", removed: true}
+	assert.Equal(t, errRemoved, reaped.push(&record{}))
+	post(t, q, up.URL, "tok", "b")
+	assert.True(t, q.backlogged("tok"))
+	_, err = os.Stat(dir)
+	assert.NoError(t, err)
+}
+
+func TestRejectedRequestsAreNotSpilled(t *testing.T) {
+	conf, cleanup := testConfig(t, nil)
+	defer cleanup()
+	up := newUpstream()
+	defer up.Close()
+	up.setStatus(http.StatusBadRequest)
+	q, err := New(conf, http.DefaultTransport, http.DefaultTransport, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	require.NoError(t, err)
+	defer q.Close()
+	resp := post(t, q, up.URL, "tok", "bad")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.False(t, q.backlogged("tok"))
+}
+
+type errTransport struct{}
+
+func (errTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestQueueFull(t *testing.T) {
+	conf, cleanup := testConfig(t, map[string]string{"SPILL_MAX_BYTES_PER_TOKEN": "10"})
+	defer cleanup()
+	q, err := New(conf, errTransport{}, errTransport{}, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	require.NoError(t, err)
+	defer q.Close()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost", bytes.NewBufferString("too big to fit"))
+	_, err = q.RoundTrip(req)
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&q.stats.TotalSpillErrors))
+}
+
+func TestTotalFull(t *testing.T) {
+	conf, cleanup := testConfig(t, map[string]string{"SPILL_MAX_BYTES": "300"})
+	defer cleanup()
+	q, err := New(conf, errTransport{}, errTransport{}, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	require.NoError(t, err)
+	defer q.Close()
+	spill := func(token string) error {
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost", bytes.NewBufferString("body"))
+		req.Header.Set(sfxclient.TokenHeaderName, token)
+		return q.Append(req, []byte("body"))
+	}
+	// every token is within its own limit, but together they fill the queue
+	var spilled int
+	for _, token := range []string{"a", "b", "c", "d", "e"} {
+		if err := spill(token); err != nil {
+			assert.Equal(t, ErrQueueFull, err)
+			break
+		}
+		spilled++
+	}
+	assert.True(t, spilled > 0 && spilled < 5, "spilled %d", spilled)
+	assert.True(t, atomic.LoadInt64(&q.bytes) <= 300)
+	var total int64
+	for _, dp := range q.Datapoints() {
+		if dp.Metric == "spill_queue.total_bytes" {
+			total = dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	assert.Equal(t, atomic.LoadInt64(&q.bytes), total)
+}
+
+func TestCorruptSegment(t *testing.T) {
+	conf, cleanup := testConfig(t, nil)
+	defer cleanup()
+	up := newUpstream()
+	defer up.Close()
+	q, err := New(conf, errTransport{}, errTransport{}, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	require.NoError(t, err)
+	for _, body := range []string{"a", "b"} {
+		req, _ := http.NewRequest(http.MethodPost, up.URL, bytes.NewBufferString(body))
+		req.Header.Set(sfxclient.TokenHeaderName, "tok")
+		_, err = q.RoundTrip(req)
+		require.NoError(t, err)
+	}
+	require.NoError(t, q.Close())
+
+	// flip a byte in the first record of the first segment
+	dir := filepath.Join(conf.Directory.Get(), tokenDirName("tok"))
+	seg := filepath.Join(dir, segmentName(1))
+	raw, err := ioutil.ReadFile(seg)
+	require.NoError(t, err)
+	raw[frameHeader+1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(seg, raw, 0600))
+
+	q, err = New(conf, http.DefaultTransport, http.DefaultTransport, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	require.NoError(t, err)
+	defer q.Close()
+	waitFor(t, func() bool { return len(up.received()) == 1 })
+	assert.Equal(t, []string{"tok:b"}, up.received())
+	assert.Equal(t, int64(1), atomic.LoadInt64(&q.stats.TotalDropped))
+}
+
+type fullSink struct{}
+
+func (fullSink) AddDatapoints(context.Context, []*datapoint.Datapoint) error {
+	return errors.New("unable to add datapoints: the input buffer is full")
+}
+
+func (fullSink) AddEvents(context.Context, []*event.Event) error {
+	return errors.New("unable to add events: the input buffer is full")
+}
+
+func (fullSink) AddSpans(context.Context, []*trace.Span) error {
+	return errors.New("unable to add spans: the input buffer is full")
+}
+
+func TestOverflow(t *testing.T) {
+	conf, cleanup := testConfig(t, nil)
+	defer cleanup()
+	up := newUpstream()
+	defer up.Close()
+	clock := timekeepertest.NewStubClock(time.Now())
+	q, err := New(conf, http.DefaultTransport, http.DefaultTransport, clock, log.Discard)
+	require.NoError(t, err)
+	defer q.Close()
+
+	sink := signalfx.FromChain(fullSink{}, signalfx.NextWrap(NewOverflow(q, up.URL+"/v2/datapoint", up.URL+"/v2/event", up.URL+"/v1/trace")))
+	ctx := context.WithValue(context.Background(), sfxclient.TokenCtxKey, "tok")
+	assert.NoError(t, sink.AddDatapoints(ctx, []*datapoint.Datapoint{datapoint.New("m", nil, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())}))
+	assert.NoError(t, sink.AddEvents(ctx, []*event.Event{event.New("e", event.USERDEFINED, nil, time.Now())}))
+	assert.NoError(t, sink.AddSpans(ctx, []*trace.Span{{TraceID: "1", ID: "2"}}))
+	assert.Error(t, sink.AddDatapoints(context.Background(), []*datapoint.Datapoint{datapoint.New("m", nil, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())}))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&q.stats.TotalSpilled))
+
+	clock.Incr(conf.ReplayInterval.Get())
+	waitFor(t, func() bool { return len(up.received()) == 3 })
+}
@@ -0,0 +1,275 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+)
+
+type kind int
+
+const (
+	counter kind = iota
+	gauge
+	timer
+	set
+)
+
+var kinds = map[string]kind{
+	"c":  counter,
+	"g":  gauge,
+	"ms": timer,
+	"h":  timer,
+	"d":  timer,
+	"s":  set,
+}
+
+// sample is one parsed statsd line
+type sample struct {
+	name     string
+	kind     kind
+	value    float64
+	relative bool
+	member   string
+	rate     float64
+	dims     map[string]string
+}
+
+// parseLine parses a line like "name:value|type|@rate|#tag:value,tag:value".  DogStatsD events and service checks have
+// no datapoint equivalent, so they and blank lines return a nil sample.
+func parseLine(line string) (*sample, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return nil, nil
+	}
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return nil, fmt.Errorf("invalid statsd line %q: missing metric name", line)
+	}
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid statsd line %q: missing type", line)
+	}
+	s := &sample{name: line[:colon], rate: 1}
+	var ok bool
+	if s.kind, ok = kinds[parts[1]]; !ok {
+		return nil, fmt.Errorf("invalid statsd line %q: unknown type %q", line, parts[1])
+	}
+	if err := s.parseValue(parts[0]); err != nil {
+		return nil, fmt.Errorf("invalid statsd line %q: %s", line, err)
+	}
+	if err := s.parseOptions(parts[2:]); err != nil {
+		return nil, fmt.Errorf("invalid statsd line %q: %s", line, err)
+	}
+	return s, nil
+}
+
+// parseOptions reads the sample rate and tags.  Other DogStatsD fields, like container ids, are ignored.
+func (s *sample) parseOptions(options []string) error {
+	for _, option := range options {
+		switch {
+		case strings.HasPrefix(option, "@"):
+			rate, err := strconv.ParseFloat(option[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return errors.New("bad sample rate")
+			}
+			s.rate = rate
+		case strings.HasPrefix(option, "#"):
+			s.dims = parseTags(option[1:])
+		}
+	}
+	return nil
+}
+
+func (s *sample) parseValue(v string) error {
+	if s.kind == set {
+		if v == "" {
+			return errors.New("empty set member")
+		}
+		s.member = v
+		return nil
+	}
+	// gauges with a sign are relative to the last value
+	s.relative = s.kind == gauge && (strings.HasPrefix(v, "+") || strings.HasPrefix(v, "-"))
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return errors.New("value is not finite")
+	}
+	s.value = f
+	return nil
+}
+
+// parseTags turns DogStatsD tags into dimensions.  Tags without a value can't be dimensions and are dropped.
+func parseTags(tags string) map[string]string {
+	dims := make(map[string]string)
+	for _, tag := range strings.Split(tags, ",") {
+		if i := strings.IndexByte(tag, ':'); i > 0 && i < len(tag)-1 {
+			dims[tag[:i]] = tag[i+1:]
+		}
+	}
+	return dims
+}
+
+// series is everything received for one name, type and set of dimensions since the last flush
+type series struct {
+	name    string
+	kind    kind
+	dims    map[string]string
+	count   float64
+	value   float64
+	updated bool
+	idle    int64 // flushes since a gauge was last updated
+	values  []float64
+	members map[string]struct{}
+}
+
+func seriesKey(s *sample) string {
+	keys := make([]string, 0, len(s.dims))
+	for k := range s.dims {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(s.name)
+	b.WriteByte(0)
+	b.WriteByte(byte('0' + s.kind))
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(s.dims[k])
+	}
+	return b.String()
+}
+
+// aggregator combines samples between flushes the way statsd does.  Counters are summed, gauges keep their last
+// value, timers keep every value for their statistics and sets count their unique members.
+type aggregator struct {
+	percentiles []float64
+	gaugeExpiry int64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newAggregator(percentiles []float64, gaugeExpiry int64) *aggregator {
+	return &aggregator{
+		percentiles: percentiles,
+		gaugeExpiry: gaugeExpiry,
+		series:      make(map[string]*series),
+	}
+}
+
+func (a *aggregator) add(s *sample) {
+	key := seriesKey(s)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ser, ok := a.series[key]
+	if !ok {
+		ser = &series{name: s.name, kind: s.kind, dims: s.dims}
+		a.series[key] = ser
+	}
+	switch s.kind {
+	case counter:
+		ser.count += s.value / s.rate
+	case gauge:
+		if s.relative {
+			ser.value += s.value
+		} else {
+			ser.value = s.value
+		}
+		ser.updated = true
+		ser.idle = 0
+	case timer:
+		ser.count += 1 / s.rate
+		ser.values = append(ser.values, s.value)
+	case set:
+		if ser.members == nil {
+			ser.members = make(map[string]struct{})
+		}
+		ser.members[s.member] = struct{}{}
+	}
+}
+
+// flush returns datapoints for everything received since the last flush and starts a new interval.  Gauges are kept so
+// relative updates have something to apply to, but are only sent again once they are updated, and are forgotten once
+// they haven't been for gaugeExpiry flushes.
+func (a *aggregator) flush(now time.Time) []*datapoint.Datapoint {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var dps []*datapoint.Datapoint
+	for key, ser := range a.series {
+		switch ser.kind {
+		case counter:
+			dps = append(dps, datapoint.New(ser.name, ser.dims, value(ser.count), datapoint.Count, now))
+			delete(a.series, key)
+		case gauge:
+			if ser.updated {
+				dps = append(dps, datapoint.New(ser.name, datapoint.AddMaps(ser.dims, nil), value(ser.value), datapoint.Gauge, now))
+				ser.updated = false
+			} else if ser.idle++; ser.idle >= a.gaugeExpiry {
+				delete(a.series, key)
+			}
+		case timer:
+			dps = a.appendTimer(dps, ser, now)
+			delete(a.series, key)
+		case set:
+			dps = append(dps, datapoint.New(ser.name, ser.dims, datapoint.NewIntValue(int64(len(ser.members))), datapoint.Gauge, now))
+			delete(a.series, key)
+		}
+	}
+	return dps
+}
+
+// appendTimer sends name.count, name.min, name.max, name.mean and name.pNN for each percentile
+func (a *aggregator) appendTimer(dps []*datapoint.Datapoint, ser *series, now time.Time) []*datapoint.Datapoint {
+	values := ser.values
+	sort.Float64s(values)
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	gauge := func(suffix string, v float64) {
+		dps = append(dps, datapoint.New(ser.name+"."+suffix, datapoint.AddMaps(ser.dims, nil), value(v), datapoint.Gauge, now))
+	}
+	dps = append(dps, datapoint.New(ser.name+".count", datapoint.AddMaps(ser.dims, nil), value(ser.count), datapoint.Count, now))
+	gauge("min", values[0])
+	gauge("max", values[len(values)-1])
+	gauge("mean", total/float64(len(values)))
+	for _, p := range a.percentiles {
+		gauge(percentileName(p), percentile(values, p))
+	}
+	return dps
+}
+
+// percentile returns the nearest rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// percentileName is p90 for the 90th percentile and p99_9 for the 99.9th
+func percentileName(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", 1)
+}
+
+// value keeps whole numbers as ints so counts aren't sent as floats
+func value(v float64) datapoint.Value {
+	if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+		return datapoint.NewIntValue(int64(v))
+	}
+	return datapoint.NewFloatValue(v)
+}
@@ -0,0 +1,327 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/datapoint/dpsink"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/pops/listener"
+)
+
+// maxPacketSize is the largest UDP datagram
+const maxPacketSize = 65535
+
+// Config configures the statsd listeners and the defaults they share
+type Config struct {
+	Listeners     *distconf.Str
+	FlushInterval *distconf.Duration
+	Percentiles   *distconf.Str
+	GaugeExpiry   *distconf.Int
+}
+
+// Load the statsd config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.Listeners = d.Str("STATSD_LISTENERS", "")
+	c.FlushInterval = d.Duration("STATSD_FLUSH_INTERVAL", 10*time.Second)
+	c.Percentiles = d.Str("STATSD_PERCENTILES", "90,99")
+	c.GaugeExpiry = d.Int("STATSD_GAUGE_EXPIRY_FLUSHES", 6)
+}
+
+// Spec describes a statsd listener.  Network is "udp" or "tcp", and everything received on it is sent with Token.
+// Gauges that aren't updated for GaugeExpiry flushes are forgotten.  The flush interval, timer percentiles and gauge
+// expiry default to STATSD_FLUSH_INTERVAL, STATSD_PERCENTILES and STATSD_GAUGE_EXPIRY_FLUSHES.
+type Spec struct {
+	Name          string            `json:"name"`
+	Network       string            `json:"network,omitempty"`
+	Address       string            `json:"address"`
+	Token         string            `json:"token"`
+	FlushInterval listener.Duration `json:"flush_interval,omitempty"`
+	Percentiles   []float64         `json:"percentiles,omitempty"`
+	GaugeExpiry   int64             `json:"gauge_expiry_flushes,omitempty"`
+}
+
+// Specs returns the statsd listeners, checking they are valid and filling in the defaults
+func (c *Config) Specs() ([]*Spec, error) {
+	raw := c.Listeners.Get()
+	if raw == "" {
+		return nil, nil
+	}
+	percentiles, err := parsePercentiles(c.Percentiles.Get())
+	if err != nil {
+		return nil, err
+	}
+	var specs []*Spec
+	if err := json.Unmarshal([]byte(raw), &specs); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(specs))
+	for _, s := range specs {
+		if s.Name == "" || s.Address == "" || s.Token == "" {
+			return nil, errors.New("statsd listeners need a name, an address and a token")
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("statsd listener name %s is used more than once", s.Name)
+		}
+		names[s.Name] = true
+		if err := s.setDefaults(c.FlushInterval.Get(), percentiles, c.GaugeExpiry.Get()); err != nil {
+			return nil, err
+		}
+	}
+	return specs, nil
+}
+
+// setDefaults fills in anything the spec leaves unset and checks the result is valid
+func (s *Spec) setDefaults(flushInterval time.Duration, percentiles []float64, gaugeExpiry int64) error {
+	if s.Network == "" {
+		s.Network = "udp"
+	}
+	if s.Network != "udp" && s.Network != "tcp" {
+		return fmt.Errorf("statsd listener %s has unknown network %s", s.Name, s.Network)
+	}
+	if s.FlushInterval <= 0 {
+		s.FlushInterval = listener.Duration(flushInterval)
+	}
+	if s.Percentiles == nil {
+		s.Percentiles = percentiles
+	}
+	if s.GaugeExpiry <= 0 {
+		s.GaugeExpiry = gaugeExpiry
+	}
+	if s.GaugeExpiry <= 0 {
+		return fmt.Errorf("statsd listener %s needs a gauge expiry of at least one flush", s.Name)
+	}
+	for _, p := range s.Percentiles {
+		if p <= 0 || p > 100 {
+			return fmt.Errorf("statsd listener %s has percentile %v outside (0, 100]", s.Name, p)
+		}
+	}
+	return nil
+}
+
+func parsePercentiles(raw string) ([]float64, error) {
+	var percentiles []float64
+	for _, s := range strings.Split(raw, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid statsd percentile %q", s)
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
+
+// Listener receives statsd and DogStatsD lines, aggregates them and sends the result to the sink every flush interval
+// with the listener's token
+type Listener struct {
+	spec       *Spec
+	sink       dpsink.DSink
+	ctx        context.Context
+	timeKeeper timekeeper.TimeKeeper
+	logger     log.Logger
+	agg        *aggregator
+	packetConn net.PacketConn
+	listener   net.Listener
+	closing    chan struct{}
+	wg         sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+
+	stats struct {
+		TotalPackets      int64
+		TotalLines        int64
+		TotalInvalidLines int64
+		TotalDatapoints   int64
+		TotalSendErrors   int64
+	}
+}
+
+// New opens the listener described by spec and starts receiving and flushing
+func New(spec *Spec, sink dpsink.DSink, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Listener, error) {
+	l := &Listener{
+		spec:       spec,
+		sink:       sink,
+		ctx:        context.WithValue(context.Background(), sfxclient.TokenCtxKey, spec.Token),
+		timeKeeper: timeKeeper,
+		logger:     log.NewContext(logger).With("statsd_listener", spec.Name),
+		agg:        newAggregator(spec.Percentiles, spec.GaugeExpiry),
+		closing:    make(chan struct{}),
+		conns:      make(map[net.Conn]struct{}),
+	}
+	var err error
+	if spec.Network == "tcp" {
+		if l.listener, err = net.Listen("tcp", spec.Address); err != nil {
+			return nil, err
+		}
+		l.wg.Add(1)
+		go l.accept()
+	} else {
+		if l.packetConn, err = net.ListenPacket("udp", spec.Address); err != nil {
+			return nil, err
+		}
+		l.wg.Add(1)
+		go l.readPackets()
+	}
+	l.wg.Add(1)
+	go l.flushLoop()
+	return l, nil
+}
+
+// Addr returns the address the listener is bound to
+func (l *Listener) Addr() net.Addr {
+	if l.listener != nil {
+		return l.listener.Addr()
+	}
+	return l.packetConn.LocalAddr()
+}
+
+func (l *Listener) readPackets() {
+	defer l.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := l.packetConn.ReadFrom(buf)
+		if err != nil {
+			if !l.isClosing() {
+				l.logger.Log(log.Err, err, "unable to read statsd packet")
+			}
+			return
+		}
+		atomic.AddInt64(&l.stats.TotalPackets, 1)
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			l.handleLine(line)
+		}
+	}
+}
+
+func (l *Listener) accept() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if !l.isClosing() {
+				l.logger.Log(log.Err, err, "unable to accept statsd connection")
+			}
+			return
+		}
+		l.mu.Lock()
+		if l.isClosing() {
+			l.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
+		l.wg.Add(1)
+		go l.readConn(conn)
+	}
+}
+
+// readConn reads newline separated lines until the client disconnects or the listener is closed
+func (l *Listener) readConn(conn net.Conn) {
+	defer l.wg.Done()
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		_ = conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxPacketSize)
+	for scanner.Scan() {
+		l.handleLine(scanner.Text())
+	}
+}
+
+func (l *Listener) handleLine(line string) {
+	s, err := parseLine(line)
+	if err != nil {
+		atomic.AddInt64(&l.stats.TotalInvalidLines, 1)
+		l.logger.Log(log.Err, err, "dropping invalid statsd line")
+		return
+	}
+	if s != nil {
+		atomic.AddInt64(&l.stats.TotalLines, 1)
+		l.agg.add(s)
+	}
+}
+
+func (l *Listener) flushLoop() {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.closing:
+			return
+		case <-l.timeKeeper.After(time.Duration(l.spec.FlushInterval)):
+			l.flush()
+		}
+	}
+}
+
+func (l *Listener) flush() {
+	dps := l.agg.flush(l.timeKeeper.Now())
+	if len(dps) == 0 {
+		return
+	}
+	atomic.AddInt64(&l.stats.TotalDatapoints, int64(len(dps)))
+	if err := l.sink.AddDatapoints(l.ctx, dps); err != nil {
+		atomic.AddInt64(&l.stats.TotalSendErrors, 1)
+		l.logger.Log(log.Err, err, "unable to send statsd datapoints")
+	}
+}
+
+func (l *Listener) isClosing() bool {
+	select {
+	case <-l.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Datapoints returns how much the listener has received and sent
+func (l *Listener) Datapoints() []*datapoint.Datapoint {
+	dims := map[string]string{"listener": l.spec.Name}
+	return []*datapoint.Datapoint{
+		sfxclient.CumulativeP("statsd.packets", dims, &l.stats.TotalPackets),
+		sfxclient.CumulativeP("statsd.lines", dims, &l.stats.TotalLines),
+		sfxclient.CumulativeP("statsd.invalid_lines", dims, &l.stats.TotalInvalidLines),
+		sfxclient.CumulativeP("statsd.datapoints", dims, &l.stats.TotalDatapoints),
+		sfxclient.CumulativeP("statsd.send_errors", dims, &l.stats.TotalSendErrors),
+	}
+}
+
+// Close stops receiving and sends whatever has been aggregated since the last flush
+func (l *Listener) Close() error {
+	close(l.closing)
+	var err error
+	if l.listener != nil {
+		err = l.listener.Close()
+		l.mu.Lock()
+		for conn := range l.conns {
+			_ = conn.Close()
+		}
+		l.mu.Unlock()
+	} else {
+		err = l.packetConn.Close()
+	}
+	l.wg.Wait()
+	l.flush()
+	return err
+}
@@ -0,0 +1,225 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper/timekeepertest"
+	"github.com/signalfx/pops/listener"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type dpSink struct {
+	mu     sync.Mutex
+	tokens []string
+	dps    []*datapoint.Datapoint
+}
+
+func (s *dpSink) AddDatapoints(ctx context.Context, dps []*datapoint.Datapoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, _ := ctx.Value(sfxclient.TokenCtxKey).(string)
+	s.tokens = append(s.tokens, token)
+	s.dps = append(s.dps, dps...)
+	return nil
+}
+
+func (s *dpSink) byName() map[string]*datapoint.Datapoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]*datapoint.Datapoint, len(s.dps))
+	for _, dp := range s.dps {
+		m[dp.Metric] = dp
+	}
+	return m
+}
+
+func testConfig(values map[string]string) *Config {
+	mem := distconf.Mem()
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	return conf
+}
+
+func TestParseLine(t *testing.T) {
+	s, err := parseLine("api.requests:2|c|@0.5|#env:prod,route:/users,canary")
+	require.NoError(t, err)
+	assert.Equal(t, &sample{name: "api.requests", kind: counter, value: 2, rate: 0.5, dims: map[string]string{"env": "prod", "route": "/users"}}, s)
+
+	s, err = parseLine("queue.depth:-3|g")
+	require.NoError(t, err)
+	assert.True(t, s.relative)
+	assert.Equal(t, float64(-3), s.value)
+
+	s, err = parseLine("users:alice|s")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", s.member)
+
+	for _, ignored := range []string{"", "  ", "_e{5,4}:title|text", "_sc|redis.can_connect|0"} {
+		s, err = parseLine(ignored)
+		assert.NoError(t, err, ignored)
+		assert.Nil(t, s, ignored)
+	}
+	for _, bad := range []string{"novalue", ":1|c", "x:1", "x:1|q", "x:abc|c", "x:1|c|@2", "x:NaN|g", "x:|s"} {
+		_, err = parseLine(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	a := newAggregator([]float64{50, 99.9}, 2)
+	for _, line := range []string{
+		"hits:1|c", "hits:1|c|@0.5", "hits:1|c|#env:prod",
+		"temp:20|g", "temp:+2.5|g",
+		"latency:30|ms", "latency:10|ms", "latency:20|ms|@0.5",
+		"users:alice|s", "users:bob|s", "users:alice|s",
+	} {
+		s, err := parseLine(line)
+		require.NoError(t, err)
+		a.add(s)
+	}
+	now := time.Unix(1500000000, 0)
+	got := map[string]*datapoint.Datapoint{}
+	for _, dp := range a.flush(now) {
+		if dp.Metric == "hits" && dp.Dimensions["env"] == "prod" {
+			continue
+		}
+		got[dp.Metric] = dp
+		assert.Equal(t, now, dp.Timestamp)
+	}
+	assert.Equal(t, datapoint.NewIntValue(3), got["hits"].Value)
+	assert.Equal(t, datapoint.Count, got["hits"].MetricType)
+	assert.Equal(t, datapoint.NewFloatValue(22.5), got["temp"].Value)
+	assert.Equal(t, datapoint.Gauge, got["temp"].MetricType)
+	assert.Equal(t, datapoint.NewIntValue(4), got["latency.count"].Value)
+	assert.Equal(t, datapoint.Count, got["latency.count"].MetricType)
+	assert.Equal(t, datapoint.NewIntValue(10), got["latency.min"].Value)
+	assert.Equal(t, datapoint.NewIntValue(30), got["latency.max"].Value)
+	assert.Equal(t, datapoint.NewIntValue(20), got["latency.mean"].Value)
+	assert.Equal(t, datapoint.NewIntValue(20), got["latency.p50"].Value)
+	assert.Equal(t, datapoint.NewIntValue(30), got["latency.p99_9"].Value)
+	assert.Equal(t, datapoint.NewIntValue(2), got["users"].Value)
+	assert.Len(t, got, 9)
+
+	// only the gauge is kept, and it isn't sent again until it's updated
+	assert.Empty(t, a.flush(now))
+	s, err := parseLine("temp:+1|g")
+	require.NoError(t, err)
+	a.add(s)
+	dps := a.flush(now)
+	require.Len(t, dps, 1)
+	assert.Equal(t, datapoint.NewFloatValue(23.5), dps[0].Value)
+
+	// a gauge that isn't updated for gaugeExpiry flushes is forgotten, so a relative update starts again from zero
+	assert.Empty(t, a.flush(now))
+	assert.Len(t, a.series, 1)
+	assert.Empty(t, a.flush(now))
+	assert.Empty(t, a.series)
+	a.add(s)
+	dps = a.flush(now)
+	require.Len(t, dps, 1)
+	assert.Equal(t, datapoint.NewIntValue(1), dps[0].Value)
+}
+
+func TestSpecs(t *testing.T) {
+	specs, err := testConfig(nil).Specs()
+	assert.NoError(t, err)
+	assert.Nil(t, specs)
+
+	specs, err = testConfig(map[string]string{
+		"STATSD_LISTENERS":      `[{"name":"a","address":":8125","token":"T"},{"name":"b","network":"tcp","address":":8126","token":"U","flush_interval":"1s","percentiles":[95],"gauge_expiry_flushes":3}]`,
+		"STATSD_FLUSH_INTERVAL": "30s",
+	}).Specs()
+	require.NoError(t, err)
+	require.Len(t, specs, 2)
+	assert.Equal(t, "udp", specs[0].Network)
+	assert.Equal(t, 30*time.Second, time.Duration(specs[0].FlushInterval))
+	assert.Equal(t, []float64{90, 99}, specs[0].Percentiles)
+	assert.Equal(t, time.Second, time.Duration(specs[1].FlushInterval))
+	assert.Equal(t, []float64{95}, specs[1].Percentiles)
+	assert.Equal(t, int64(6), specs[0].GaugeExpiry)
+	assert.Equal(t, int64(3), specs[1].GaugeExpiry)
+
+	for _, bad := range []map[string]string{
+		{"STATSD_LISTENERS": `{`},
+		{"STATSD_LISTENERS": `[{"name":"a","address":":8125"}]`},
+		{"STATSD_LISTENERS": `[{"name":"a","address":":8125","token":"T"},{"name":"a","address":":8126","token":"T"}]`},
+		{"STATSD_LISTENERS": `[{"name":"a","network":"unix","address":":8125","token":"T"}]`},
+		{"STATSD_LISTENERS": `[{"name":"a","address":":8125","token":"T","percentiles":[101]}]`},
+		{"STATSD_LISTENERS": `[{"name":"a","address":":8125","token":"T"}]`, "STATSD_PERCENTILES": "ninety"},
+		{"STATSD_LISTENERS": `[{"name":"a","address":":8125","token":"T"}]`, "STATSD_GAUGE_EXPIRY_FLUSHES": "0"},
+	} {
+		_, err = testConfig(bad).Specs()
+		assert.Error(t, err, bad["STATSD_LISTENERS"])
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		require.True(t, time.Now().Before(deadline), "timed out")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestListenerUDP(t *testing.T) {
+	sink := &dpSink{}
+	clock := timekeepertest.NewStubClock(time.Unix(1500000000, 0))
+	l, err := New(&Spec{Name: "udp", Network: "udp", Address: "127.0.0.1:0", Token: "TOKEN", FlushInterval: 10}, sink, clock, log.Discard)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hits:1|c\nhits:2|c\nbad line"))
+	require.NoError(t, err)
+	waitFor(t, func() bool {
+		return atomic.LoadInt64(&l.stats.TotalLines)+atomic.LoadInt64(&l.stats.TotalInvalidLines) == 3
+	})
+
+	// the flush loop may not be waiting on the clock yet, so keep advancing it until the flush happens
+	waitFor(t, func() bool {
+		clock.Incr(10)
+		return len(sink.byName()) == 1
+	})
+	assert.Equal(t, datapoint.NewIntValue(3), sink.byName()["hits"].Value)
+	sink.mu.Lock()
+	assert.Equal(t, []string{"TOKEN"}, sink.tokens)
+	sink.mu.Unlock()
+	assert.Len(t, l.Datapoints(), 5)
+	require.NoError(t, l.Close())
+}
+
+func TestListenerTCP(t *testing.T) {
+	sink := &dpSink{}
+	l, err := New(&Spec{Name: "tcp", Network: "tcp", Address: "127.0.0.1:0", Token: "TOKEN", FlushInterval: listener.Duration(10 * time.Second)}, sink, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("load:1.5|g|#host:a\n"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { l.agg.mu.Lock(); defer l.agg.mu.Unlock(); return len(l.agg.series) == 1 })
+
+	// closing sends what is left, even with a client still connected
+	require.NoError(t, l.Close())
+	dp := sink.byName()["load"]
+	require.NotNil(t, dp)
+	assert.Equal(t, map[string]string{"host": "a"}, dp.Dimensions)
+	_ = conn.Close()
+
+	_, err = New(&Spec{Name: "tcp", Network: "tcp", Address: "127.0.0.1:-1"}, sink, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	assert.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/pops/filewatch"
+)
+
+// Config configures TLS termination on the ingest listener
+type Config struct {
+	CertFile       *distconf.Str
+	KeyFile        *distconf.Str
+	ReloadInterval *distconf.Duration
+	MinVersion     *distconf.Str
+	CipherSuites   *distconf.Str
+	ClientCAFile   *distconf.Str
+	ClientAuth     *distconf.Str
+}
+
+// Load the TLS config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.CertFile = d.Str("TLS_CERT_FILE", "")
+	c.KeyFile = d.Str("TLS_KEY_FILE", "")
+	c.ReloadInterval = d.Duration("TLS_RELOAD_INTERVAL", 10*time.Second)
+	c.MinVersion = d.Str("TLS_MIN_VERSION", "1.2")
+	c.CipherSuites = d.Str("TLS_CIPHER_SUITES", "")
+	c.ClientCAFile = d.Str("TLS_CLIENT_CA_FILE", "")
+	c.ClientAuth = d.Str("TLS_CLIENT_AUTH", "require")
+}
+
+// Enabled returns true if a certificate is configured
+func (c *Config) Enabled() bool {
+	return c.CertFile.Get() != ""
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseVersion(s string) (uint16, error) {
+	if v, ok := versions[s]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", s)
+}
+
+// parseCipherSuites turns a comma separated list of cipher suite names into their ids.  An empty list leaves the
+// choice to crypto/tls.
+func parseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ids := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		ids[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(s, ",") {
+		id, ok := ids[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// Loader builds the tls.Config for the ingest listener and reloads the certificate whenever the cert or key file
+// changes, so certificates can be rotated without a restart
+type Loader struct {
+	conf     *Config
+	config   *tls.Config
+	watchers []*filewatch.Watcher
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// New loads the certificate, key and client CA bundle in conf
+func New(conf *Config, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Loader, error) {
+	if !conf.Enabled() || conf.KeyFile.Get() == "" {
+		return nil, errors.New("TLS needs both a certificate and a key")
+	}
+	minVersion, err := parseVersion(conf.MinVersion.Get())
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(conf.CipherSuites.Get())
+	if err != nil {
+		return nil, err
+	}
+	l := &Loader{conf: conf}
+	l.config = &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+		GetCertificate: l.getCertificate,
+	}
+	if caFile := conf.ClientCAFile.Get(); caFile != "" {
+		if l.config.ClientAuth, err = clientAuth(conf.ClientAuth.Get()); err != nil {
+			return nil, err
+		}
+		if l.config.ClientCAs, err = loadCAs(caFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range []string{conf.CertFile.Get(), conf.KeyFile.Get()} {
+		w, err := filewatch.New(path, conf.ReloadInterval.Get(), l.reload, timeKeeper, logger)
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		l.watchers = append(l.watchers, w)
+	}
+	return l, nil
+}
+
+func clientAuth(s string) (tls.ClientAuthType, error) {
+	if t, ok := clientAuthTypes[s]; ok {
+		return t, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client auth %q", s)
+}
+
+func loadCAs(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// reload loads the certificate and key as a pair whenever either changes.  While they are being rotated they may not
+// match, in which case the old certificate is kept until the next check.
+func (l *Loader) reload([]byte) error {
+	cert, err := tls.LoadX509KeyPair(l.conf.CertFile.Get(), l.conf.KeyFile.Get())
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.cert = &cert
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *Loader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cert, nil
+}
+
+// Config returns the tls.Config to serve with
+func (l *Loader) Config() *tls.Config {
+	return l.config
+}
+
+// Datapoints returns how often the certificate and key have been reloaded
+func (l *Loader) Datapoints() []*datapoint.Datapoint {
+	var dps []*datapoint.Datapoint
+	for _, w := range l.watchers {
+		dps = append(dps, w.Datapoints()...)
+	}
+	return dps
+}
+
+// Close stops watching the certificate and key
+func (l *Loader) Close() error {
+	for _, w := range l.watchers {
+		_ = w.Close()
+	}
+	return nil
+}
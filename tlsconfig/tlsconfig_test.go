@@ -0,0 +1,238 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newKeyPair makes a certificate for cn signed by parent, or self signed if parent is nil
+func newKeyPair(t *testing.T, cn string, parent *keyPair) *keyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &keyPair{cert: cert, key: key, der: der}
+}
+
+func (k *keyPair) write(t *testing.T, certPath string, keyPath string) {
+	require.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: k.der}), 0600))
+	if keyPath != "" {
+		b, err := x509.MarshalECPrivateKey(k.key)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600))
+	}
+}
+
+func (k *keyPair) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{k.der}, PrivateKey: k.key}
+}
+
+type fixture struct {
+	dir  string
+	ca   *keyPair
+	cert string
+	key  string
+	caf  string
+}
+
+func newFixture(t *testing.T) *fixture {
+	dir, err := ioutil.TempDir("", "tlsconfig")
+	require.NoError(t, err)
+	f := &fixture{
+		dir:  dir,
+		ca:   newKeyPair(t, "test-ca", nil),
+		cert: filepath.Join(dir, "cert.pem"),
+		key:  filepath.Join(dir, "key.pem"),
+		caf:  filepath.Join(dir, "ca.pem"),
+	}
+	f.ca.write(t, f.caf, "")
+	newKeyPair(t, "server-1", f.ca).write(t, f.cert, f.key)
+	return f
+}
+
+func (f *fixture) config(values map[string]string) *Config {
+	mem := distconf.Mem()
+	mem.Write("TLS_CERT_FILE", []byte(f.cert))
+	mem.Write("TLS_KEY_FILE", []byte(f.key))
+	mem.Write("TLS_RELOAD_INTERVAL", []byte("1ms"))
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	return conf
+}
+
+// serve starts an https server with l and returns its address
+func serve(t *testing.T, l *Loader) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+			_, _ = rw.Write([]byte(req.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	})}
+	go func() {
+		_ = server.Serve(tls.NewListener(listener, l.Config()))
+	}()
+	return "https://" + listener.Addr().String(), func() { _ = server.Close() }
+}
+
+func (f *fixture) client(certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(f.ca.cert)
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certs},
+		DisableKeepAlives: true,
+	}}
+}
+
+func get(client *http.Client, url string) (string, *tls.ConnectionState, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), resp.TLS, err
+}
+
+func TestServeAndReload(t *testing.T) {
+	f := newFixture(t)
+	defer os.RemoveAll(f.dir)
+	l, err := New(f.config(nil), timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	defer l.Close()
+	url, stop := serve(t, l)
+	defer stop()
+
+	client := f.client()
+	_, state, err := get(client, url)
+	require.NoError(t, err)
+	assert.Equal(t, "server-1", state.PeerCertificates[0].Subject.CommonName)
+
+	newKeyPair(t, "server-2", f.ca).write(t, f.cert, f.key)
+	for {
+		_, state, err = get(client, url)
+		require.NoError(t, err)
+		if state.PeerCertificates[0].Subject.CommonName == "server-2" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.NotEmpty(t, l.Datapoints())
+}
+
+func TestMutualTLS(t *testing.T) {
+	f := newFixture(t)
+	defer os.RemoveAll(f.dir)
+	l, err := New(f.config(map[string]string{"TLS_CLIENT_CA_FILE": f.caf}), timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	defer l.Close()
+	url, stop := serve(t, l)
+	defer stop()
+
+	_, _, err = get(f.client(), url)
+	assert.Error(t, err, "a client certificate is required")
+
+	stranger := newKeyPair(t, "stranger", newKeyPair(t, "other-ca", nil))
+	_, _, err = get(f.client(stranger.tlsCert()), url)
+	assert.Error(t, err, "the client certificate must be signed by the CA")
+
+	body, _, err := get(f.client(newKeyPair(t, "team-a", f.ca).tlsCert()), url)
+	require.NoError(t, err)
+	assert.Equal(t, "team-a", body)
+}
+
+func TestOptionalClientCert(t *testing.T) {
+	f := newFixture(t)
+	defer os.RemoveAll(f.dir)
+	l, err := New(f.config(map[string]string{"TLS_CLIENT_CA_FILE": f.caf, "TLS_CLIENT_AUTH": "request"}), timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	defer l.Close()
+	url, stop := serve(t, l)
+	defer stop()
+
+	body, _, err := get(f.client(), url)
+	require.NoError(t, err)
+	assert.Equal(t, "", body)
+	body, _, err = get(f.client(newKeyPair(t, "team-a", f.ca).tlsCert()), url)
+	require.NoError(t, err)
+	assert.Equal(t, "team-a", body)
+}
+
+func TestMinVersionAndCiphers(t *testing.T) {
+	f := newFixture(t)
+	defer os.RemoveAll(f.dir)
+	l, err := New(f.config(map[string]string{
+		"TLS_MIN_VERSION":   "1.3",
+		"TLS_CIPHER_SUITES": "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	}), timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, uint16(tls.VersionTLS13), l.Config().MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, l.Config().CipherSuites)
+}
+
+func TestBadConfig(t *testing.T) {
+	f := newFixture(t)
+	defer os.RemoveAll(f.dir)
+	for _, values := range []map[string]string{
+		{"TLS_KEY_FILE": ""},
+		{"TLS_KEY_FILE": filepath.Join(f.dir, "missing.pem")},
+		{"TLS_KEY_FILE": f.caf},
+		{"TLS_MIN_VERSION": "2.0"},
+		{"TLS_CIPHER_SUITES": "TLS_RSA_WITH_RC4_128_SHA"},
+		{"TLS_CLIENT_CA_FILE": filepath.Join(f.dir, "missing.pem")},
+		{"TLS_CLIENT_CA_FILE": f.key},
+		{"TLS_CLIENT_CA_FILE": f.caf, "TLS_CLIENT_AUTH": "sometimes"},
+	} {
+		_, err := New(f.config(values), timekeeper.RealTime{}, log.Discard)
+		assert.Error(t, err, "%v", values)
+	}
+}
@@ -0,0 +1,258 @@
+package tokenmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/web"
+	"github.com/signalfx/pops/filewatch"
+)
+
+// Config configures how incoming requests are mapped to outgoing tokens
+type Config struct {
+	RulesFile      *distconf.Str
+	ReloadInterval *distconf.Duration
+	DefaultToken   *distconf.Str
+}
+
+// Load the token map config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.RulesFile = d.Str("TOKEN_MAP_FILE", "")
+	c.ReloadInterval = d.Duration("TOKEN_MAP_RELOAD_INTERVAL", 10*time.Second)
+	c.DefaultToken = d.Str("TOKEN_MAP_DEFAULT_TOKEN", "")
+}
+
+// Rule maps requests to the token To.  Every condition that is set must match: the incoming token, the source IP
+// being inside CIDR, the Header having Value, which must be set together, and the verified TLS client certificate
+// having ClientSubject as either its common name or its whole subject.
+type Rule struct {
+	Name          string `json:"name,omitempty"`
+	Token         string `json:"token,omitempty"`
+	CIDR          string `json:"cidr,omitempty"`
+	Header        string `json:"header,omitempty"`
+	Value         string `json:"value,omitempty"`
+	ClientSubject string `json:"client_subject,omitempty"`
+	To            string `json:"to"`
+
+	network *net.IPNet
+	mapped  *int64
+}
+
+func (r *Rule) compile(index int) error {
+	if r.Name == "" {
+		r.Name = strconv.Itoa(index)
+	}
+	if r.To == "" {
+		return fmt.Errorf("rule %s has no token to map to", r.Name)
+	}
+	if r.Token == "" && r.CIDR == "" && r.Header == "" && r.ClientSubject == "" {
+		return fmt.Errorf("rule %s has nothing to match", r.Name)
+	}
+	// a header with no value would match every request without the header
+	if (r.Header == "") != (r.Value == "") {
+		return fmt.Errorf("rule %s needs both a header and a value to match headers", r.Name)
+	}
+	if r.CIDR != "" {
+		var err error
+		if _, r.network, err = net.ParseCIDR(r.CIDR); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matches(req *http.Request, token string, ip net.IP) bool {
+	if r.Token != "" && r.Token != token {
+		return false
+	}
+	if r.network != nil && (ip == nil || !r.network.Contains(ip)) {
+		return false
+	}
+	if r.Header != "" && req.Header.Get(r.Header) != r.Value {
+		return false
+	}
+	if r.ClientSubject != "" && !hasClientSubject(req, r.ClientSubject) {
+		return false
+	}
+	return true
+}
+
+func hasClientSubject(req *http.Request, subject string) bool {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	return cert.Subject.CommonName == subject || cert.Subject.String() == subject
+}
+
+// Rules are loaded from the rules file.  The first matching rule wins and DefaultToken is used for requests without a
+// token that no rule matched.
+type Rules struct {
+	DefaultToken string  `json:"default_token,omitempty"`
+	Rules        []*Rule `json:"rules,omitempty"`
+}
+
+func parseRules(b []byte) (*Rules, error) {
+	rules := &Rules{}
+	if err := json.Unmarshal(b, rules); err != nil {
+		return nil, err
+	}
+	for i, r := range rules.Rules {
+		if err := r.compile(i); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// Mapper rewrites the token of incoming requests according to a set of rules
+type Mapper struct {
+	conf    *Config
+	watcher *filewatch.Watcher
+
+	mu        sync.RWMutex
+	rules     *Rules
+	mapped    map[string]*int64
+	defaulted int64
+}
+
+// New returns a Mapper for conf, loading the rules file if there is one and watching it for changes
+func New(conf *Config, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Mapper, error) {
+	m := &Mapper{
+		conf:   conf,
+		rules:  &Rules{},
+		mapped: make(map[string]*int64),
+	}
+	if path := conf.RulesFile.Get(); path != "" {
+		var err error
+		if m.watcher, err = filewatch.New(path, conf.ReloadInterval.Get(), m.load, timeKeeper, logger); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Mapper) load(b []byte) error {
+	rules, err := parseRules(b)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// rules keep counting where they left off across reloads
+	for _, rule := range rules.Rules {
+		if rule.mapped = m.mapped[rule.Name]; rule.mapped == nil {
+			rule.mapped = new(int64)
+			m.mapped[rule.Name] = rule.mapped
+		}
+	}
+	m.rules = rules
+	return nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header, which is how prometheus remote write sends it
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	if auth := r.Header.Get("Authorization"); len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return auth[len(prefix):]
+	}
+	return ""
+}
+
+// RequestToken returns the token a request was sent with, from the token header, an "Authorization: Bearer" header or
+// the password of basic auth with a username of "auth" or none.  It returns false if the request has none of them.
+func RequestToken(r *http.Request) (string, bool) {
+	if token := r.Header.Get(sfxclient.TokenHeaderName); token != "" {
+		return token, true
+	}
+	if token := bearerToken(r); token != "" {
+		return token, true
+	}
+	if username, password, ok := r.BasicAuth(); ok && (username == "auth" || username == "") {
+		return password, true
+	}
+	return "", false
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// Map returns the token the request should be sent upstream with, which is the request's own token if nothing matched
+func (m *Mapper) Map(r *http.Request) string {
+	token, _ := RequestToken(r)
+	m.mu.RLock()
+	rules := m.rules
+	m.mu.RUnlock()
+	if len(rules.Rules) > 0 {
+		ip := remoteIP(r)
+		for _, rule := range rules.Rules {
+			if rule.matches(r, token, ip) {
+				atomic.AddInt64(rule.mapped, 1)
+				return rule.To
+			}
+		}
+	}
+	if token != "" {
+		return token
+	}
+	// distconf wins over the file
+	defaultToken := m.conf.DefaultToken.Get()
+	if defaultToken == "" {
+		defaultToken = rules.DefaultToken
+	}
+	if defaultToken != "" {
+		atomic.AddInt64(&m.defaulted, 1)
+	}
+	return defaultToken
+}
+
+// MapTokens sets the request's token header to the mapped token.  It must run before the token is read off the
+// request.
+func (m *Mapper) MapTokens(ctx context.Context, rw http.ResponseWriter, r *http.Request, next web.ContextHandler) {
+	if token := m.Map(r); token != "" {
+		r.Header.Set(sfxclient.TokenHeaderName, token)
+	}
+	next.ServeHTTPC(ctx, rw, r)
+}
+
+// Datapoints returns how many requests each rule mapped and how many were given the default token
+func (m *Mapper) Datapoints() []*datapoint.Datapoint {
+	dps := []*datapoint.Datapoint{
+		sfxclient.CumulativeP("tokenmap.defaulted", nil, &m.defaulted),
+	}
+	m.mu.RLock()
+	for name, mapped := range m.mapped {
+		dps = append(dps, sfxclient.CumulativeP("tokenmap.mapped", map[string]string{"rule": name}, mapped))
+	}
+	m.mu.RUnlock()
+	if m.watcher != nil {
+		dps = append(dps, m.watcher.Datapoints()...)
+	}
+	return dps
+}
+
+// Close stops watching the rules file
+func (m *Mapper) Close() error {
+	if m.watcher != nil {
+		return m.watcher.Close()
+	}
+	return nil
+}
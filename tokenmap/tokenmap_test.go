@@ -0,0 +1,173 @@
+package tokenmap
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `{
+  "default_token": "anonymous",
+  "rules": [
+    {"name": "legacy", "token": "old", "to": "new"},
+    {"name": "office", "cidr": "10.1.0.0/16", "to": "office"},
+    {"header": "X-Team", "value": "infra", "to": "infra"},
+    {"name": "both", "cidr": "192.168.0.0/16", "header": "X-Team", "value": "web", "to": "web-lan"}
+  ]
+}`
+
+func testMapper(t *testing.T, rules string, values map[string]string) (*Mapper, string, func()) {
+	dir, err := ioutil.TempDir("", "tokenmap")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "rules.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(rules), 0600))
+	mem := distconf.Mem()
+	mem.Write("TOKEN_MAP_FILE", []byte(path))
+	mem.Write("TOKEN_MAP_RELOAD_INTERVAL", []byte("1ms"))
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	m, err := New(conf, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	return m, path, func() {
+		_ = m.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func request(remoteAddr string, token string, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/v2/datapoint", nil)
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set(sfxclient.TokenHeaderName, token)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestMap(t *testing.T) {
+	m, _, cleanup := testMapper(t, testRules, nil)
+	defer cleanup()
+
+	assert.Equal(t, "new", m.Map(request("1.2.3.4:5", "old", nil)))
+	assert.Equal(t, "mine", m.Map(request("1.2.3.4:5", "mine", nil)))
+	assert.Equal(t, "office", m.Map(request("10.1.2.3:5", "mine", nil)))
+	assert.Equal(t, "office", m.Map(request("10.1.2.3:5", "", nil)))
+	assert.Equal(t, "infra", m.Map(request("1.2.3.4:5", "", map[string]string{"X-Team": "infra"})))
+	assert.Equal(t, "anonymous", m.Map(request("1.2.3.4:5", "", map[string]string{"X-Team": "web"})))
+	assert.Equal(t, "web-lan", m.Map(request("192.168.1.1:5", "", map[string]string{"X-Team": "web"})))
+	assert.Equal(t, "anonymous", m.Map(request("not an address", "", nil)))
+
+	basic := request("1.2.3.4:5", "", nil)
+	basic.SetBasicAuth("auth", "old")
+	assert.Equal(t, "new", m.Map(basic))
+	assert.Equal(t, "new", m.Map(request("1.2.3.4:5", "", map[string]string{"Authorization": "Bearer old"})))
+
+	counts := map[string]int64{}
+	for _, dp := range m.Datapoints() {
+		if dp.Metric == "tokenmap.mapped" {
+			counts[dp.Dimensions["rule"]] = dp.Value.(datapoint.IntValue).Int()
+		}
+		if dp.Metric == "tokenmap.defaulted" {
+			counts["default"] = dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	assert.Equal(t, map[string]int64{"legacy": 3, "office": 2, "2": 1, "both": 1, "default": 2}, counts)
+}
+
+func TestRequestToken(t *testing.T) {
+	_, ok := RequestToken(request("1.2.3.4:5", "", map[string]string{"Authorization": "Bearer "}))
+	assert.False(t, ok)
+	basic := request("1.2.3.4:5", "", nil)
+	basic.SetBasicAuth("auth", "")
+	token, ok := RequestToken(basic)
+	assert.True(t, ok, "basic auth counts even without a password")
+	assert.Equal(t, "", token)
+	basic.SetBasicAuth("someone", "secret")
+	_, ok = RequestToken(basic)
+	assert.False(t, ok)
+}
+
+func TestDefaultTokenFromDistconf(t *testing.T) {
+	m, _, cleanup := testMapper(t, `{"default_token": "fromfile"}`, map[string]string{"TOKEN_MAP_DEFAULT_TOKEN": "fromconf"})
+	defer cleanup()
+	assert.Equal(t, "fromconf", m.Map(request("1.2.3.4:5", "", nil)))
+
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{distconf.Mem()}))
+	m, err := New(conf, timekeeper.RealTime{}, log.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "", m.Map(request("1.2.3.4:5", "", nil)))
+	assert.NoError(t, m.Close())
+}
+
+func TestReload(t *testing.T) {
+	m, path, cleanup := testMapper(t, testRules, nil)
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"rules": [{"token": "old", "to": "newer"}]}`), 0600))
+	for m.Map(request("1.2.3.4:5", "old", nil)) != "newer" {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBadRules(t *testing.T) {
+	for _, rules := range []string{
+		`{`,
+		`{"rules": [{"token": "a"}]}`,
+		`{"rules": [{"to": "a"}]}`,
+		`{"rules": [{"cidr": "10.0.0.0/33", "to": "a"}]}`,
+		`{"rules": [{"header": "X-Team", "to": "a"}]}`,
+		`{"rules": [{"token": "b", "value": "infra", "to": "a"}]}`,
+	} {
+		_, err := parseRules([]byte(rules))
+		assert.Error(t, err, rules)
+	}
+}
+
+func TestClientSubject(t *testing.T) {
+	m, _, cleanup := testMapper(t, `{"rules": [{"client_subject": "team-a", "to": "a"}, {"client_subject": "CN=team-b,O=Example", "to": "b"}]}`, nil)
+	defer cleanup()
+	withCert := func(subject pkix.Name) *http.Request {
+		req := request("1.2.3.4:5", "mine", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: subject}}}}
+		return req
+	}
+	assert.Equal(t, "a", m.Map(withCert(pkix.Name{CommonName: "team-a", Organization: []string{"Example"}})))
+	assert.Equal(t, "b", m.Map(withCert(pkix.Name{CommonName: "team-b", Organization: []string{"Example"}})))
+	assert.Equal(t, "mine", m.Map(withCert(pkix.Name{CommonName: "team-c"})))
+	assert.Equal(t, "mine", m.Map(request("1.2.3.4:5", "mine", nil)))
+}
+
+func TestMapTokens(t *testing.T) {
+	m, _, cleanup := testMapper(t, testRules, nil)
+	defer cleanup()
+	var got string
+	handler := web.NewHandler(context.Background(), web.HandlerFunc(func(_ context.Context, _ http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(sfxclient.TokenHeaderName)
+	})).Add(web.NextConstructor(m.MapTokens))
+	handler.ServeHTTP(httptest.NewRecorder(), request("1.2.3.4:5", "old", nil))
+	assert.Equal(t, "new", got)
+	handler.ServeHTTP(httptest.NewRecorder(), request("1.2.3.4:5", "", nil))
+	assert.Equal(t, "anonymous", got)
+}
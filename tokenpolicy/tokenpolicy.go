@@ -0,0 +1,256 @@
+package tokenpolicy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper"
+	"github.com/signalfx/golib/v3/web"
+	"github.com/signalfx/pops/filewatch"
+)
+
+var (
+	// ErrDenied is returned for tokens on the deny list
+	ErrDenied = errors.New("token is denied")
+	// ErrNotAllowed is returned for tokens missing from a non empty allow list
+	ErrNotAllowed = errors.New("token is not allowed")
+	// ErrRejectedUpstream is returned for tokens upstream recently rejected
+	ErrRejectedUpstream = errors.New("token was rejected upstream")
+)
+
+// Config configures which tokens are accepted at the edge
+type Config struct {
+	AllowList        *distconf.Str
+	DenyList         *distconf.Str
+	PolicyFile       *distconf.Str
+	ReloadInterval   *distconf.Duration
+	NegativeCacheTTL *distconf.Duration
+	NegativeCacheMax *distconf.Int
+}
+
+// Load the token policy config values from distconf
+func (c *Config) Load(d *distconf.Distconf) {
+	c.AllowList = d.Str("TOKEN_ALLOW_LIST", "")
+	c.DenyList = d.Str("TOKEN_DENY_LIST", "")
+	c.PolicyFile = d.Str("TOKEN_POLICY_FILE", "")
+	c.ReloadInterval = d.Duration("TOKEN_POLICY_RELOAD_INTERVAL", 10*time.Second)
+	c.NegativeCacheTTL = d.Duration("TOKEN_NEGATIVE_CACHE_TTL", 5*time.Minute)
+	c.NegativeCacheMax = d.Int("TOKEN_NEGATIVE_CACHE_SIZE", 10000)
+}
+
+// Lists are the static allow and deny lists.  An empty allow list allows every token that isn't denied.
+type Lists struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+type tokenSet map[string]struct{}
+
+func (t tokenSet) add(tokens ...string) {
+	for _, token := range tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			t[token] = struct{}{}
+		}
+	}
+}
+
+// Policy decides whether a token is accepted.  Static lists come from distconf and an optional file, and tokens
+// that upstream rejects with a 401 or 403 are remembered for a while so they can be rejected without a round trip.
+type Policy struct {
+	conf       *Config
+	timeKeeper timekeeper.TimeKeeper
+	logger     log.Logger
+	watcher    *filewatch.Watcher
+
+	mu        sync.RWMutex
+	fileLists Lists
+	allow     tokenSet
+	deny      tokenSet
+	rejected  map[string]time.Time
+
+	stats struct {
+		TotalDenied           int64
+		TotalNotAllowed       int64
+		TotalRejectedUpstream int64
+		TotalLearned          int64
+	}
+}
+
+// New returns a Policy for conf, loading the policy file if there is one and watching it for changes
+func New(conf *Config, timeKeeper timekeeper.TimeKeeper, logger log.Logger) (*Policy, error) {
+	p := &Policy{
+		conf:       conf,
+		timeKeeper: timeKeeper,
+		logger:     logger,
+		rejected:   make(map[string]time.Time),
+	}
+	p.rebuild()
+	rebuild := func(*distconf.Str, string) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.rebuild()
+	}
+	conf.AllowList.Watch(rebuild)
+	conf.DenyList.Watch(rebuild)
+	if path := conf.PolicyFile.Get(); path != "" {
+		var err error
+		if p.watcher, err = filewatch.New(path, conf.ReloadInterval.Get(), p.loadFile, timeKeeper, logger); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// rebuild merges the lists from distconf and the file.  The caller must hold mu.
+func (p *Policy) rebuild() {
+	p.allow = make(tokenSet)
+	p.allow.add(strings.Split(p.conf.AllowList.Get(), ",")...)
+	p.allow.add(p.fileLists.Allow...)
+	p.deny = make(tokenSet)
+	p.deny.add(strings.Split(p.conf.DenyList.Get(), ",")...)
+	p.deny.add(p.fileLists.Deny...)
+}
+
+func (p *Policy) loadFile(b []byte) error {
+	var lists Lists
+	if err := json.Unmarshal(b, &lists); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fileLists = lists
+	p.rebuild()
+	return nil
+}
+
+// Check returns an error if token should be rejected
+func (p *Policy) Check(token string) error {
+	p.mu.RLock()
+	_, denied := p.deny[token]
+	_, allowed := p.allow[token]
+	restricted := len(p.allow) > 0
+	expires, rejected := p.rejected[token]
+	p.mu.RUnlock()
+	switch {
+	case denied:
+		atomic.AddInt64(&p.stats.TotalDenied, 1)
+		return ErrDenied
+	case restricted && !allowed:
+		atomic.AddInt64(&p.stats.TotalNotAllowed, 1)
+		return ErrNotAllowed
+	case rejected && p.timeKeeper.Now().Before(expires):
+		atomic.AddInt64(&p.stats.TotalRejectedUpstream, 1)
+		return ErrRejectedUpstream
+	}
+	return nil
+}
+
+// RejectTokens responds with a 401 to requests whose token fails Check.  It must run after the token is put on the
+// context.
+func (p *Policy) RejectTokens(ctx context.Context, rw http.ResponseWriter, r *http.Request, next web.ContextHandler) {
+	token, _ := ctx.Value(sfxclient.TokenCtxKey).(string)
+	if err := p.Check(token); err != nil {
+		rw.WriteHeader(http.StatusUnauthorized)
+		_, _ = rw.Write([]byte(err.Error()))
+		return
+	}
+	next.ServeHTTPC(ctx, rw, r)
+}
+
+// learn records how upstream responded to a token
+func (p *Policy) learn(token string, status int) {
+	ttl := p.conf.NegativeCacheTTL.Get()
+	if token == "" || ttl <= 0 {
+		return
+	}
+	if status != http.StatusUnauthorized && status != http.StatusForbidden {
+		// upstream may have been told about a token after we learned it was bad
+		p.mu.RLock()
+		_, known := p.rejected[token]
+		p.mu.RUnlock()
+		if known {
+			p.mu.Lock()
+			delete(p.rejected, token)
+			p.mu.Unlock()
+		}
+		return
+	}
+	now := p.timeKeeper.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.rejected[token]; !exists && int64(len(p.rejected)) >= p.conf.NegativeCacheMax.Get() {
+		p.evict(now)
+	}
+	p.rejected[token] = now.Add(ttl)
+	atomic.AddInt64(&p.stats.TotalLearned, 1)
+}
+
+// evict makes room in the negative cache, preferring expired entries.  The caller must hold mu.
+func (p *Policy) evict(now time.Time) {
+	for token, expires := range p.rejected {
+		if !now.Before(expires) {
+			delete(p.rejected, token)
+		}
+	}
+	for token := range p.rejected {
+		if int64(len(p.rejected)) < p.conf.NegativeCacheMax.Get() {
+			return
+		}
+		delete(p.rejected, token)
+	}
+}
+
+type observer struct {
+	policy *Policy
+	next   http.RoundTripper
+}
+
+func (o *observer) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := o.next.RoundTrip(req)
+	if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError {
+		o.policy.learn(req.Header.Get(sfxclient.TokenHeaderName), resp.StatusCode)
+	}
+	return resp, err
+}
+
+// Observe wraps next so the Policy learns which tokens upstream rejects
+func (p *Policy) Observe(next http.RoundTripper) http.RoundTripper {
+	return &observer{policy: p, next: next}
+}
+
+// Datapoints returns how many requests were rejected and why.  Rejected tokens aren't reported individually since
+// anything can be sent as a token.
+func (p *Policy) Datapoints() []*datapoint.Datapoint {
+	p.mu.RLock()
+	size := int64(len(p.rejected))
+	p.mu.RUnlock()
+	dps := []*datapoint.Datapoint{
+		sfxclient.CumulativeP("tokenpolicy.rejected", map[string]string{"reason": "deny_list"}, &p.stats.TotalDenied),
+		sfxclient.CumulativeP("tokenpolicy.rejected", map[string]string{"reason": "allow_list"}, &p.stats.TotalNotAllowed),
+		sfxclient.CumulativeP("tokenpolicy.rejected", map[string]string{"reason": "negative_cache"}, &p.stats.TotalRejectedUpstream),
+		sfxclient.CumulativeP("tokenpolicy.negative_cache.learned", nil, &p.stats.TotalLearned),
+		sfxclient.Gauge("tokenpolicy.negative_cache.size", nil, size),
+	}
+	if p.watcher != nil {
+		dps = append(dps, p.watcher.Datapoints()...)
+	}
+	return dps
+}
+
+// Close stops watching the policy file
+func (p *Policy) Close() error {
+	if p.watcher != nil {
+		return p.watcher.Close()
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package tokenpolicy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/distconf"
+	"github.com/signalfx/golib/v3/log"
+	"github.com/signalfx/golib/v3/sfxclient"
+	"github.com/signalfx/golib/v3/timekeeper/timekeepertest"
+	"github.com/signalfx/golib/v3/web"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPolicy(t *testing.T, values map[string]string) (*Policy, *timekeepertest.StubClock, distconf.ReaderWriter) {
+	mem := distconf.Mem()
+	for k, v := range values {
+		mem.Write(k, []byte(v))
+	}
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	clock := timekeepertest.NewStubClock(time.Now())
+	p, err := New(conf, clock, log.Discard)
+	require.NoError(t, err)
+	return p, clock, mem
+}
+
+func rejections(p *Policy, reason string) int64 {
+	for _, dp := range p.Datapoints() {
+		if dp.Metric == "tokenpolicy.rejected" && dp.Dimensions["reason"] == reason {
+			return dp.Value.(datapoint.IntValue).Int()
+		}
+	}
+	return 0
+}
+
+func TestAcceptsEverythingByDefault(t *testing.T) {
+	p, _, _ := testPolicy(t, nil)
+	defer p.Close()
+	assert.NoError(t, p.Check("anything"))
+	assert.NoError(t, p.Check(""))
+}
+
+func TestStaticLists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokenpolicy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"allow": ["fromfile"], "deny": ["revoked"]}`), 0600))
+
+	p, _, mem := testPolicy(t, map[string]string{
+		"TOKEN_ALLOW_LIST":  "a, b,revoked",
+		"TOKEN_DENY_LIST":   "bad",
+		"TOKEN_POLICY_FILE": path,
+	})
+	defer p.Close()
+	assert.NoError(t, p.Check("a"))
+	assert.NoError(t, p.Check("b"))
+	assert.NoError(t, p.Check("fromfile"))
+	assert.Equal(t, ErrNotAllowed, p.Check("c"))
+	assert.Equal(t, ErrDenied, p.Check("bad"))
+	// deny wins over allow
+	assert.Equal(t, ErrDenied, p.Check("revoked"))
+
+	mem.Write("TOKEN_ALLOW_LIST", []byte(""))
+	mem.Write("TOKEN_DENY_LIST", []byte("a"))
+	assert.Equal(t, ErrDenied, p.Check("a"))
+	assert.Equal(t, ErrNotAllowed, p.Check("c"), "the file's allow list still applies")
+	assert.Equal(t, int64(3), rejections(p, "deny_list"))
+	assert.Equal(t, int64(2), rejections(p, "allow_list"))
+}
+
+func TestMissingPolicyFile(t *testing.T) {
+	mem := distconf.Mem()
+	mem.Write("TOKEN_POLICY_FILE", []byte("/does/not/exist"))
+	conf := &Config{}
+	conf.Load(distconf.New([]distconf.Reader{mem}))
+	_, err := New(conf, timekeepertest.NewStubClock(time.Now()), log.Discard)
+	assert.Error(t, err)
+}
+
+func TestNegativeCache(t *testing.T) {
+	status := http.StatusUnauthorized
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(status)
+	}))
+	defer upstream.Close()
+	p, clock, _ := testPolicy(t, map[string]string{"TOKEN_NEGATIVE_CACHE_TTL": "1m"})
+	defer p.Close()
+	client := &http.Client{Transport: p.Observe(http.DefaultTransport)}
+	send := func(token string) {
+		req, _ := http.NewRequest(http.MethodPost, upstream.URL, nil)
+		req.Header.Set(sfxclient.TokenHeaderName, token)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	send("revoked")
+	assert.Equal(t, ErrRejectedUpstream, p.Check("revoked"))
+	assert.NoError(t, p.Check("other"))
+	clock.Incr(time.Minute)
+	assert.NoError(t, p.Check("revoked"), "entries expire")
+
+	send("revoked")
+	assert.Error(t, p.Check("revoked"))
+	status = http.StatusOK
+	send("revoked")
+	assert.NoError(t, p.Check("revoked"), "a successful send clears the entry")
+
+	// throttling and upstream errors say nothing about the token
+	for _, status = range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		send("unknown")
+		assert.NoError(t, p.Check("unknown"))
+	}
+	assert.Equal(t, int64(2), rejections(p, "negative_cache"))
+}
+
+func TestNegativeCacheSize(t *testing.T) {
+	p, clock, _ := testPolicy(t, map[string]string{"TOKEN_NEGATIVE_CACHE_SIZE": "2"})
+	defer p.Close()
+	p.learn("a", http.StatusForbidden)
+	clock.Incr(time.Hour)
+	p.learn("b", http.StatusForbidden)
+	p.learn("c", http.StatusForbidden)
+	assert.Len(t, p.rejected, 2)
+	assert.NoError(t, p.Check("a"), "expired entries are evicted first")
+	p.learn("d", http.StatusForbidden)
+	assert.Len(t, p.rejected, 2)
+	assert.Error(t, p.Check("d"))
+}
+
+func TestRejectTokens(t *testing.T) {
+	p, _, _ := testPolicy(t, map[string]string{"TOKEN_DENY_LIST": "bad"})
+	defer p.Close()
+	for token, code := range map[string]int{"bad": http.StatusUnauthorized, "good": http.StatusNoContent} {
+		ctx := context.WithValue(context.Background(), sfxclient.TokenCtxKey, token)
+		handler := web.NewHandler(ctx, web.HandlerFunc(func(_ context.Context, rw http.ResponseWriter, _ *http.Request) {
+			rw.WriteHeader(http.StatusNoContent)
+		})).Add(web.NextConstructor(p.RejectTokens))
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/v2/datapoint", nil))
+		assert.Equal(t, code, rw.Code, token)
+	}
+}